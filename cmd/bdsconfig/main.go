@@ -34,6 +34,10 @@ func main() {
 	fmt.Println()
 	fmt.Printf(`bindpop3 = 127.0.0.1:1110`)
 	fmt.Println()
+	fmt.Printf(`bindimap = 127.0.0.1:1143`)
+	fmt.Println()
+	fmt.Printf(`bindmanagesieve = 127.0.0.1:4190`)
+	fmt.Println()
 	fmt.Printf(`domain = %s`, domain)
 	fmt.Println()
 	fmt.Printf(`maildir = %s`, maildir)
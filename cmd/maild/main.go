@@ -9,7 +9,7 @@ import (
 )
 
 func main() {
-	sigchnl := make(chan os.Signal)
+	sigchnl := make(chan os.Signal, 1)
 	log.SetLevel(log.InfoLevel)
 	log.Info(server.Version())
 	var cfg_fname string
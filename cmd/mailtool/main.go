@@ -1,19 +1,195 @@
 package main
 
 import (
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/bayes"
 	"github.com/majestrate/bdsmail/lib/config"
 	"github.com/majestrate/bdsmail/lib/db"
 	"github.com/majestrate/bdsmail/lib/maildir"
 	"github.com/majestrate/bdsmail/lib/model"
+	"github.com/majestrate/bdsmail/lib/server"
+	"github.com/majestrate/bdsmail/lib/starttls"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
+// load the config and open the database it uses
+func openDB(cfg_fname string) (conf *config.Config, d db.DB, err error) {
+	conf = new(config.Config)
+	if _, err = os.Stat(cfg_fname); err != nil {
+		log.Errorf("failed to load config: %s", err.Error())
+		return
+	}
+	err = conf.Load(cfg_fname)
+	if err != nil {
+		log.Errorf("Failed to parse %s, %s", cfg_fname, err.Error())
+	}
+
+	s, _ := conf.Get("database")
+	if s == "" {
+		log.Error("no database provided")
+		err = os.ErrNotExist
+		return
+	}
+	d, err = db.NewDB(s)
+	if err != nil {
+		log.Errorf("failed to open db: %s", err.Error())
+		return
+	}
+	log.Infof("opened %s", s)
+	go d.Run()
+	return
+}
+
+// get the default user quota from config
+func defaultQuota(conf *config.Config) (q model.Quota) {
+	q = model.Quota{Bytes: server.DEFAULT_QUOTA_BYTES, Messages: server.DEFAULT_QUOTA_MESSAGES}
+	if s, _ := conf.Get("quota_bytes"); s != "" {
+		q.Bytes, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s, _ := conf.Get("quota_messages"); s != "" {
+		q.Messages, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return
+}
+
+// show a user's quota usage and set their quota if given
+func quota(cfg_fname, user string, args []string) {
+	conf, d, err := openDB(cfg_fname)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if len(args) == 2 {
+		var qbytes, qmsgs int64
+		qbytes, err = strconv.ParseInt(args[0], 10, 64)
+		if err == nil {
+			qmsgs, err = strconv.ParseInt(args[1], 10, 64)
+		}
+		if err != nil {
+			log.Errorf("bad quota: %s", err.Error())
+			return
+		}
+		err = d.UpdateUser(user, func(u *model.User) *model.User {
+			u.QuotaBytes = qbytes
+			u.QuotaMessages = qmsgs
+			log.Infof("setting %s quota to %d bytes %d messages", user, qbytes, qmsgs)
+			return u
+		})
+		if err != nil {
+			log.Errorf("failed to set quota: %s", err.Error())
+			return
+		}
+	}
+	found := false
+	err = d.VisitUser(user, func(u *model.User) error {
+		found = true
+		q := u.Quota(defaultQuota(conf))
+		us, err := u.Usage()
+		if err == nil {
+			log.Infof("%s uses %d of %d bytes and %d of %d messages (<= 0 is unlimited)", user, us.Bytes, q.Bytes, us.Messages, q.Messages)
+		}
+		return err
+	})
+	if err == nil && !found {
+		log.Errorf("no such user %s", user)
+	} else if err != nil {
+		log.Errorf("error: %s", err.Error())
+	}
+}
+
+// learn message files of a user as spam or ham
+func train(cfg_fname, user, kind string, files []string) {
+	if kind != "spam" && kind != "ham" {
+		log.Errorf("can only train spam or ham, not %s", kind)
+		return
+	}
+	conf, d, err := openDB(cfg_fname)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	root, _ := conf.Get("maildir")
+	if root == "" {
+		root = "mail"
+	}
+	root, _ = filepath.Abs(root)
+	var cs []*bayes.Corpus
+	err = d.VisitUser(user, func(u *model.User) (e error) {
+		for _, dir := range []string{root, u.MailDirPath} {
+			var c *bayes.Corpus
+			c, e = bayes.Open(filepath.Join(dir, bayes.FileName))
+			if e != nil {
+				return
+			}
+			cs = append(cs, c)
+		}
+		return
+	})
+	if err == nil && len(cs) == 0 {
+		log.Errorf("no such user %s", user)
+		return
+	}
+	for _, fname := range files {
+		if err == nil {
+			err = bayes.TrainFile(fname, kind == "spam", cs...)
+		}
+	}
+	if err == nil {
+		spam, ham := cs[1].Count()
+		log.Infof("learned %d messages as %s, %s has trained %d spam and %d ham", len(files), kind, user, spam, ham)
+	} else {
+		log.Errorf("error: %s", err.Error())
+	}
+}
+
+// print the fingerprints of our tls certificates for clients to pin
+func fingerprint(cfg_fname string) {
+	conf := new(config.Config)
+	err := conf.Load(cfg_fname)
+	if err != nil {
+		log.Errorf("failed to load config: %s", err.Error())
+		return
+	}
+	for _, fname := range server.CertFiles(conf) {
+		certs, err := starttls.ReadCertFile(fname)
+		if err != nil {
+			log.Errorf("failed to read certificate: %s", err.Error())
+			continue
+		}
+		cert := certs[0]
+		fmt.Printf("%s\n", fname)
+		fmt.Printf("  subject:     %s\n", cert.Subject)
+		fmt.Printf("  expires:     %s\n", cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("  sha256:      %s\n", starttls.Fingerprint(cert))
+		fmt.Printf("  pin-sha256:  %s\n", starttls.PublicKeyPin(cert))
+	}
+}
+
 func main() {
 
+	if len(os.Args) == 3 && os.Args[2] == "-fingerprint" {
+		fingerprint(os.Args[1])
+		return
+	}
+
+	if len(os.Args) > 3 && os.Args[2] == "-quota" && (len(os.Args) == 4 || len(os.Args) == 6) {
+		quota(os.Args[1], os.Args[3], os.Args[4:])
+		return
+	}
+
+	if len(os.Args) > 5 && os.Args[2] == "-train" {
+		train(os.Args[1], os.Args[3], os.Args[4], os.Args[5:])
+		return
+	}
+
 	if len(os.Args) < 4 {
 		log.Errorf("Usage: %s config.ini username maildirpath [password]", os.Args[0])
+		log.Errorf("       %s config.ini -quota username [bytes messages]", os.Args[0])
+		log.Errorf("       %s config.ini -train username spam|ham message files...", os.Args[0])
+		log.Errorf("       %s config.ini -fingerprint", os.Args[0])
 		return
 	}
 
@@ -30,28 +206,10 @@ func main() {
 		log.Errorf("failed to create maildir: %s", err.Error())
 		return
 	}
-	conf := new(config.Config)
-	if _, err = os.Stat(cfg_fname); err != nil {
-		log.Errorf("failed to load config: %s", err.Error())
-		return
-	}
-	err = conf.Load(cfg_fname)
+	_, db, err := openDB(cfg_fname)
 	if err != nil {
-		log.Errorf("Failed to parse %s, %s", cfg_fname, err.Error())
-	}
-
-	s, _ := conf.Get("database")
-	if s == "" {
-		log.Error("no database provided")
 		return
 	}
-	db, err := db.NewDB(s)
-	if err != nil {
-		log.Errorf("failed to open db: %s", err.Error())
-		return
-	}
-	log.Infof("opened %s", s)
-	go db.Run()
 	err = db.EnsureUser(user, func(u *model.User) error {
 		log.Infof("creating user: %s", u.Name)
 		return nil
@@ -72,7 +230,7 @@ func main() {
 
 	if len(passwd) > 0 {
 		err = db.UpdateUser(user, func(u *model.User) *model.User {
-			u.Login = string(model.NewLoginCred(passwd))
+			u.SetPassword(passwd)
 			log.Infof("upading %s password", user)
 			return u
 		})
@@ -0,0 +1,38 @@
+--
+-- example bdsmail filter script
+--
+-- set filter_script = contrib/filters/filters.lua in the [maild] section
+-- of your config, reload with SIGHUP after editing
+--
+-- each function is called with an event table:
+--   ev.addr     remote i2p destination of sender
+--   ev.sender   envelope sender
+--   ev.recip    envelope recipiant
+--   ev.file     path to the message file
+--   ev.signer   domain with a good signature on the message, empty if unsigned
+--   ev.headers  table of header values keyed by lower case header name
+--   ev.header(name) returns all values of a header
+--
+-- return true to hit the filter, or one of ACCEPT, DROP, SPAM or PASS
+--
+
+local friends = {
+   ["jeff@ivpxmoh2qzcmxbij3sxfnlsua6panhxke2b3bbhn4xxw7oacujdq.b32.i2p"] = true,
+}
+
+function whitelist(ev)
+   return friends[ev.sender] == true
+end
+
+function blacklist(ev)
+   return false
+end
+
+function checkspam(ev)
+   local subject = ev.headers["subject"] or ""
+   if subject:lower():find("viagra") then
+      log("spam from", ev.sender)
+      return SPAM
+   end
+   return PASS
+end
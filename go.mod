@@ -6,4 +6,6 @@ require (
 	github.com/go-xorm/xorm v0.7.9
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/sirupsen/logrus v1.8.1
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
 )
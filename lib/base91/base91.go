@@ -75,7 +75,7 @@ func Decode(data []byte) (out []byte, err error) {
 	for idx, c := range []byte(data) {
 		d := uint32(dectab[c])
 		if d >= 91 {
-			err = errors.New(fmt.Sprintf("invalid char at position %d, '%s'", idx, c))
+			err = errors.New(fmt.Sprintf("invalid char at position %d, '%c'", idx, c))
 			return
 		}
 		if val == -1 {
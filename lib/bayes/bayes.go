@@ -0,0 +1,291 @@
+package bayes
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// name of the file a corpus is saved in inside a maildir or the mail root
+const FileName = "bdsmail.bayes"
+
+// score of a message we know nothing about
+const Unsure = 0.5
+
+// most tokens used to score a message
+const maxScoreTokens = 150
+
+// tokens with a probability closer to 0.5 than this are ignored
+const minDeviation = 0.1
+
+// training data of spam and ham messages saved in a file
+type Corpus struct {
+	mtx  sync.Mutex
+	path string
+	// the file as we last loaded or saved it
+	info os.FileInfo
+	data corpusData
+}
+
+type corpusData struct {
+	// number of messages trained
+	Spam int64 `json:"spam"`
+	Ham  int64 `json:"ham"`
+	// spam and ham message counts per token
+	Tokens map[string]*[2]int64 `json:"tokens"`
+}
+
+// corpora used by this process by path
+var corpora = struct {
+	sync.Mutex
+	m map[string]*Corpus
+}{m: make(map[string]*Corpus)}
+
+// open the corpus saved at a path, it is empty if the file does not exist yet
+// all users of a path in this process share 1 corpus
+func Open(path string) (c *Corpus, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	corpora.Lock()
+	c, ok := corpora.m[path]
+	if !ok {
+		c = &Corpus{path: path}
+		c.data.Tokens = make(map[string]*[2]int64)
+		corpora.m[path] = c
+	}
+	corpora.Unlock()
+	c.mtx.Lock()
+	err = c.reload(false)
+	c.mtx.Unlock()
+	return
+}
+
+// lock the corpus against other processes training it, returns a function that unlocks it
+func (c *Corpus) lock() (unlock func(), err error) {
+	var f *os.File
+	f, err = os.OpenFile(c.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return
+	}
+	unlock = func() {
+		unlockFile(f)
+		f.Close()
+	}
+	return
+}
+
+// return true if the file is still the one we last loaded or saved
+// every save replaces the file so a different inode, size or mtime means it changed
+func (c *Corpus) unchanged(info os.FileInfo) bool {
+	return c.info != nil && os.SameFile(info, c.info) && info.Size() == c.info.Size() && info.ModTime().Equal(c.info.ModTime())
+}
+
+// load the file again if another process changed it or always if force is set, must hold the mutex
+func (c *Corpus) reload(force bool) (err error) {
+	info, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || (!force && c.unchanged(info)) {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(c.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var data corpusData
+	err = json.NewDecoder(bufio.NewReader(f)).Decode(&data)
+	if err == nil {
+		if data.Tokens == nil {
+			data.Tokens = make(map[string]*[2]int64)
+		}
+		c.data = data
+		c.info = info
+	}
+	return
+}
+
+// write the corpus to its file, must hold the lock
+func (c *Corpus) save() (err error) {
+	tmp := c.path + ".tmp"
+	var f *os.File
+	f, err = os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(&c.data)
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if info, serr := os.Stat(c.path); serr == nil {
+		c.info = info
+	}
+	return
+}
+
+// learn the tokens of a spam or ham message and save the corpus
+// the file is locked from loading to saving so training in other processes isn't lost
+func (c *Corpus) Train(tokens []string, spam bool) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var unlock func()
+	unlock, err = c.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	err = c.reload(true)
+	if err != nil {
+		return
+	}
+	idx := 1
+	if spam {
+		idx = 0
+		c.data.Spam++
+	} else {
+		c.data.Ham++
+	}
+	for _, tok := range tokens {
+		counts, ok := c.data.Tokens[tok]
+		if !ok {
+			counts = new([2]int64)
+			c.data.Tokens[tok] = counts
+		}
+		counts[idx]++
+	}
+	return c.save()
+}
+
+// get the number of spam and ham messages trained
+func (c *Corpus) Count() (spam, ham int64) {
+	c.mtx.Lock()
+	c.reload(false)
+	spam, ham = c.data.Spam, c.data.Ham
+	c.mtx.Unlock()
+	return
+}
+
+// chi squared survival function for even degrees of freedom
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	sum := math.Exp(-m)
+	term := sum
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
+
+// score the tokens of a message against the combined corpora
+// returns the probability the message is spam from 0 to 1, Unsure if the corpora lack spam or ham
+func Score(tokens []string, cs ...*Corpus) float64 {
+	var nspam, nham int64
+	counts := make([][2]int64, len(tokens))
+	for _, c := range cs {
+		c.mtx.Lock()
+		if err := c.reload(false); err == nil {
+			nspam += c.data.Spam
+			nham += c.data.Ham
+			for i, tok := range tokens {
+				if tc, ok := c.data.Tokens[tok]; ok {
+					counts[i][0] += tc[0]
+					counts[i][1] += tc[1]
+				}
+			}
+		}
+		c.mtx.Unlock()
+	}
+	if nspam == 0 || nham == 0 {
+		return Unsure
+	}
+	var probs []float64
+	for _, tc := range counts {
+		n := float64(tc[0] + tc[1])
+		if n == 0 {
+			continue
+		}
+		spamratio := float64(tc[0]) / float64(nspam)
+		hamratio := float64(tc[1]) / float64(nham)
+		p := spamratio / (spamratio + hamratio)
+		// robinson's adjustment towards unsure for rare tokens
+		f := (Unsure + n*p) / (1 + n)
+		if math.Abs(f-Unsure) >= minDeviation {
+			probs = append(probs, f)
+		}
+	}
+	if len(probs) == 0 {
+		return Unsure
+	}
+	// most telling tokens first
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-Unsure) > math.Abs(probs[j]-Unsure)
+	})
+	if len(probs) > maxScoreTokens {
+		probs = probs[:maxScoreTokens]
+	}
+	var lnspam, lnham float64
+	for _, f := range probs {
+		lnspam += math.Log(1 - f)
+		lnham += math.Log(f)
+	}
+	s := 1 - chi2Q(-2*lnspam, 2*len(probs))
+	h := 1 - chi2Q(-2*lnham, 2*len(probs))
+	return (s - h + 1) / 2
+}
+
+// learn a message file as spam or ham in all of the corpora
+func TrainFile(fpath string, spam bool, cs ...*Corpus) (err error) {
+	var f *os.File
+	f, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	var tokens []string
+	tokens, err = Tokenize(f)
+	f.Close()
+	for _, c := range cs {
+		if err == nil {
+			err = c.Train(tokens, spam)
+		}
+	}
+	return
+}
+
+// score a message file against the combined corpora
+func ScoreFile(fpath string, cs ...*Corpus) (score float64, err error) {
+	var f *os.File
+	f, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	var tokens []string
+	tokens, err = Tokenize(f)
+	f.Close()
+	if err == nil {
+		score = Score(tokens, cs...)
+	}
+	return
+}
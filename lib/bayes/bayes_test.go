@@ -0,0 +1,111 @@
+package bayes
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func tokens(t *testing.T, msg string) []string {
+	toks, err := Tokenize(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return toks
+}
+
+func TestTokenize(t *testing.T) {
+	toks := tokens(t, "Subject: Cheap Pills!\r\nFrom: a@b.i2p\r\n\r\nBuy cheap pills now, cheap!\r\n"+strings.Repeat("QUJD", 40)+"\r\n")
+	want := []string{"subject:cheap", "subject:pills", "from:i2p", "buy", "cheap", "pills", "now"}
+	if strings.Join(toks, " ") != strings.Join(want, " ") {
+		t.Errorf("got tokens %q", toks)
+	}
+}
+
+var spams = []string{
+	"Subject: cheap pills\r\n\r\nbuy cheap pills online now, best price guaranteed\r\n",
+	"Subject: you won\r\n\r\nclaim your prize now, send your wallet keys\r\n",
+	"Subject: best price\r\n\r\ncheap watches online, limited offer, buy now\r\n",
+}
+
+var hams = []string{
+	"Subject: meeting\r\n\r\nare we still on for the meeting tomorrow about the router\r\n",
+	"Subject: i2p router\r\n\r\nthe new router release fixes the tunnel build bug\r\n",
+	"Subject: lunch\r\n\r\nwant to grab lunch tomorrow and talk about the release\r\n",
+}
+
+func TestScore(t *testing.T) {
+	dir := t.TempDir()
+	user, err := Open(filepath.Join(dir, "user", FileName))
+	if err == nil {
+		_, err = Open(filepath.Join(dir, FileName))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := Score(tokens(t, spams[0]), user); s != Unsure {
+		t.Errorf("untrained score %f", s)
+	}
+	global, _ := Open(filepath.Join(dir, FileName))
+	for _, m := range spams {
+		if err = global.Train(tokens(t, m), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range hams {
+		global.Train(tokens(t, m), false)
+	}
+	spam := Score(tokens(t, "Subject: cheap offer\r\n\r\nbuy pills now at the best price\r\n"), user, global)
+	ham := Score(tokens(t, "Subject: router\r\n\r\nthe release meeting is tomorrow\r\n"), user, global)
+	if spam < 0.8 || ham > 0.2 {
+		t.Errorf("spam scored %f and ham scored %f", spam, ham)
+	}
+
+	// a new process loads the saved corpus
+	corpora.Lock()
+	delete(corpora.m, global.path)
+	corpora.Unlock()
+	reopened, err := Open(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, h := reopened.Count(); s != 3 || h != 3 {
+		t.Errorf("reopened corpus has %d spam %d ham", s, h)
+	}
+	// and picks up training from other processes
+	reopened.Train(tokens(t, spams[0]), true)
+	if s, _ := global.Count(); s != 4 {
+		t.Errorf("training from another process not seen, %d spam", s)
+	}
+}
+
+// open a corpus the way another process would, not shared with this one's
+func openOther(path string) *Corpus {
+	c := &Corpus{path: path}
+	c.data.Tokens = make(map[string]*[2]int64)
+	return c
+}
+
+func TestTrainProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	a, b := openOther(path), openOther(path)
+	var wg sync.WaitGroup
+	for _, c := range []*Corpus{a, b} {
+		wg.Add(1)
+		go func(c *Corpus) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := c.Train(tokens(t, spams[i%len(spams)]), i%2 == 0); err != nil {
+					t.Error(err)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	for _, c := range []*Corpus{a, b, openOther(path)} {
+		if s, h := c.Count(); s != 20 || h != 20 {
+			t.Errorf("lost training, %d spam %d ham", s, h)
+		}
+	}
+}
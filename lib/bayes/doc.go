@@ -0,0 +1,4 @@
+// token based bayesian spam classifier
+//
+// scores messages with robinson's token probabilities combined by fisher's method
+package bayes
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package bayes
+
+import (
+	"os"
+	"syscall"
+)
+
+// wait for an exclusive lock on a file shared with other processes
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
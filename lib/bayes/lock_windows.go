@@ -0,0 +1,14 @@
+package bayes
+
+import (
+	"os"
+)
+
+// windows has no flock, only training in this process is serialized
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package bayes
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+	"unicode"
+)
+
+// most bytes of a message body we read tokens from
+const maxBodyRead = 64 * 1024
+
+// header fields we take tokens from
+var tokenHeaders = []string{"Subject", "From", "Reply-To", "Content-Type", "X-Mailer", "User-Agent"}
+
+// shortest and longest words that become tokens
+const (
+	minTokenLen = 3
+	maxTokenLen = 24
+)
+
+// split text into lower case words that make good tokens
+func words(text string) (ws []string) {
+	for _, w := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '$' && r != '-'
+	}) {
+		w = strings.ToLower(strings.Trim(w, "'-"))
+		if n := len(w); n >= minTokenLen && n <= maxTokenLen {
+			ws = append(ws, w)
+		}
+	}
+	return
+}
+
+// get the distinct tokens of a message
+// header words are prefixed with the lower case header name
+func Tokenize(r io.Reader) (tokens []string, err error) {
+	br := bufio.NewReader(r)
+	seen := make(map[string]bool)
+	add := func(tok string) {
+		if !seen[tok] {
+			seen[tok] = true
+			tokens = append(tokens, tok)
+		}
+	}
+	hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return
+	}
+	err = nil
+	for _, k := range tokenHeaders {
+		prefix := strings.ToLower(k) + ":"
+		for _, v := range hdr[k] {
+			for _, w := range words(v) {
+				add(prefix + w)
+			}
+		}
+	}
+	sc := bufio.NewScanner(io.LimitReader(br, maxBodyRead))
+	sc.Buffer(make([]byte, 4096), maxBodyRead)
+	for sc.Scan() {
+		line := sc.Text()
+		// skip encoded data
+		if len(line) > 60 && !strings.ContainsRune(line, ' ') {
+			continue
+		}
+		for _, w := range words(line) {
+			add(w)
+		}
+	}
+	return
+}
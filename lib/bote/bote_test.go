@@ -0,0 +1,131 @@
+package bote
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/sendmail"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stand-in bote node that keeps sent mail and serves a fixed inbox
+type testNode struct {
+	mtx   sync.Mutex
+	sent  []sendRequest
+	inbox map[string][]Message
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	identity := r.URL.Query().Get("identity")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/identities":
+		json.NewEncoder(w).Encode([]Identity{{Name: "alice", Address: "alicedest"}})
+	case r.Method == http.MethodPost && r.URL.Path == "/send":
+		var req sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.sent = append(n.sent, req)
+	case r.Method == http.MethodGet && r.URL.Path == "/inbox":
+		json.NewEncoder(w).Encode(n.inbox[identity])
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/inbox/"):
+		id := strings.TrimPrefix(r.URL.Path, "/inbox/")
+		msgs := n.inbox[identity]
+		for idx := range msgs {
+			if msgs[idx].ID == id {
+				n.inbox[identity] = append(msgs[:idx], msgs[idx+1:]...)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testGateway(t *testing.T, n *testNode) *Gateway {
+	srv := httptest.NewServer(n)
+	t.Cleanup(srv.Close)
+	g := New(NewClient(srv.URL+"/"), map[string]string{"alice": "alice"})
+	g.LocalUser = func(addr string) (string, bool) {
+		if strings.HasSuffix(addr, "@ourdest.b32.i2p") {
+			return strings.Split(addr, "@")[0], true
+		}
+		return "", false
+	}
+	return g
+}
+
+func TestBoteSend(t *testing.T) {
+	n := new(testNode)
+	g := testGateway(t, n)
+	ids, err := g.Client.Identities()
+	if err != nil || len(ids) != 1 || ids[0].Address != "alicedest" {
+		t.Fatalf("bad identities: %v %v", ids, err)
+	}
+	fpath := filepath.Join(t.TempDir(), "msg")
+	body := "Subject: hi\r\n\r\nhello bote\r\n"
+	if err := ioutil.WriteFile(fpath, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Handles("bobdest@bote") || g.Handles("bob@bobdest.b32.i2p") {
+		t.Errorf("bad recipiant check")
+	}
+	err = g.Send("bobdest@bote", "alice@ourdest.b32.i2p", maildir.Message(fpath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.sent) != 1 || n.sent[0].Identity != "alice" || n.sent[0].To[0] != "bobdest" || string(n.sent[0].Data) != body {
+		t.Errorf("bad sent message: %+v", n.sent)
+	}
+	// users without an identity cannot send
+	err = g.Send("bobdest@bote", "carol@ourdest.b32.i2p", maildir.Message(fpath))
+	if !errors.Is(err, sendmail.ErrNoRoute) || !sendmail.IsPermanent(err) {
+		t.Errorf("expected permanent failure, got %v", err)
+	}
+}
+
+func TestBoteFetch(t *testing.T) {
+	n := &testNode{
+		inbox: map[string][]Message{
+			"alice": {
+				{ID: "1", From: "bobdest", Data: []byte("Subject: one\r\n\r\n")},
+				{ID: "2", Data: []byte("Subject: two\r\n\r\n")},
+			},
+		},
+	}
+	g := testGateway(t, n)
+	var got []string
+	g.Deliver = func(user, from string, body io.Reader) error {
+		data, _ := ioutil.ReadAll(body)
+		got = append(got, user+" "+from+" "+string(data))
+		return nil
+	}
+	if err := g.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "alice bobdest@bote Subject: one\r\n\r\n" || got[1] != "alice anonymous@bote Subject: two\r\n\r\n" {
+		t.Errorf("bad delivered mail: %q", got)
+	}
+	if len(n.inbox["alice"]) != 0 {
+		t.Errorf("delivered mail left on node")
+	}
+	// failed delivery keeps mail on the node
+	n.inbox["alice"] = []Message{{ID: "3", Data: []byte("x")}}
+	g.Deliver = func(user, from string, body io.Reader) error {
+		return errors.New("disk full")
+	}
+	if err := g.Fetch(); err == nil || len(n.inbox["alice"]) != 1 {
+		t.Errorf("failed delivery removed mail from node")
+	}
+}
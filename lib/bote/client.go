@@ -0,0 +1,127 @@
+package bote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// a bote identity held by the node
+type Identity struct {
+	// public name of identity
+	Name string `json:"name"`
+	// bote destination of identity
+	Address string `json:"address"`
+}
+
+// a message in a bote node's inbox
+type Message struct {
+	// id of message on the node
+	ID string `json:"id"`
+	// bote destination of sender, empty for anonymous mail
+	From string `json:"from"`
+	// raw rfc 5322 message
+	Data []byte `json:"data"`
+}
+
+// request to send a message
+type sendRequest struct {
+	Identity string   `json:"identity"`
+	To       []string `json:"to"`
+	Data     []byte   `json:"data"`
+}
+
+// client for a local bote node's http json api
+//
+//	GET    /identities                    list identities
+//	POST   /send                          send {identity, to, data}
+//	GET    /inbox?identity=name           list received messages
+//	DELETE /inbox/{id}?identity=name      remove a received message
+type Client struct {
+	// base url of api
+	URL string
+	// http client to use
+	HTTP *http.Client
+}
+
+// create a client for a node's api at a base url
+func NewClient(u string) *Client {
+	return &Client{
+		URL: strings.TrimRight(u, "/"),
+		HTTP: &http.Client{
+			Timeout: time.Minute,
+		},
+	}
+}
+
+// do an api request and decode the json response into v if it's not nil
+func (c *Client) do(method, path string, query url.Values, body interface{}, v interface{}) (err error) {
+	var r io.Reader
+	if body != nil {
+		var data []byte
+		data, err = json.Marshal(body)
+		if err != nil {
+			return
+		}
+		r = bytes.NewReader(data)
+	}
+	u := c.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var req *http.Request
+	req, err = http.NewRequest(method, u, r)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	var resp *http.Response
+	resp, err = c.HTTP.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("bote node: %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+		return
+	}
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+	}
+	return
+}
+
+// list the node's identities
+func (c *Client) Identities() (ids []Identity, err error) {
+	err = c.do(http.MethodGet, "/identities", nil, nil, &ids)
+	return
+}
+
+// send a message from an identity to bote destinations
+func (c *Client) Send(identity string, to []string, data []byte) error {
+	return c.do(http.MethodPost, "/send", nil, &sendRequest{
+		Identity: identity,
+		To:       to,
+		Data:     data,
+	}, nil)
+}
+
+// list messages received by an identity
+func (c *Client) Inbox(identity string) (msgs []Message, err error) {
+	err = c.do(http.MethodGet, "/inbox", url.Values{"identity": {identity}}, nil, &msgs)
+	return
+}
+
+// remove a received message from the node
+func (c *Client) Delete(identity, id string) error {
+	return c.do(http.MethodDelete, "/inbox/"+url.PathEscape(id), url.Values{"identity": {identity}}, nil, nil)
+}
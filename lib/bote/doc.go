@@ -1 +1,2 @@
+// i2p-bote gateway, talks to a local bote node's api
 package bote
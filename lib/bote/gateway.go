@@ -0,0 +1,138 @@
+package bote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/sendmail"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// mail domain of bote addresses, a bote destination d is written as d@bote
+const Domain = "bote"
+
+// largest message we send over bote
+const maxMessageSize = 8 * 1024 * 1024
+
+// return true if an address is a bote address
+func IsBote(addr string) bool {
+	idx := strings.LastIndex(addr, "@")
+	return idx > 0 && strings.ToLower(addr[idx+1:]) == Domain
+}
+
+// get the mail address of a bote destination
+func Address(dest string) string {
+	return dest + "@" + Domain
+}
+
+// get the bote destination of a mail address
+func Destination(addr string) string {
+	return addr[:strings.LastIndex(addr, "@")]
+}
+
+// delivers received bote mail to a user
+type Deliverer func(user, from string, body io.Reader) error
+
+// relays mail between bote identities and users
+// implements sendmail.Transport
+type Gateway struct {
+	// node api client
+	Client *Client
+	// bote identity name of each user
+	Identities map[string]string
+	// get the user name of a local mail address
+	LocalUser func(addr string) (string, bool)
+	// delivers received mail
+	Deliver Deliverer
+	// how often to fetch received mail
+	Poll time.Duration
+}
+
+// create a gateway using a node api and a user to identity mapping
+func New(c *Client, identities map[string]string) *Gateway {
+	return &Gateway{
+		Client:     c,
+		Identities: identities,
+		Poll:       time.Minute,
+	}
+}
+
+// return true if we deliver mail for this recipiant
+func (g *Gateway) Handles(recip string) bool {
+	return IsBote(recip)
+}
+
+// get the identity a local sender sends as
+func (g *Gateway) identityOf(from string) (identity string, err error) {
+	var user string
+	var ok bool
+	if g.LocalUser != nil {
+		user, ok = g.LocalUser(from)
+	}
+	if ok {
+		identity, ok = g.Identities[user]
+	}
+	if !ok {
+		err = fmt.Errorf("%s has no bote identity: %w", from, sendmail.ErrNoRoute)
+	}
+	return
+}
+
+// send a message to a bote recipiant
+func (g *Gateway) Send(recip, from string, msg mailstore.Message) (err error) {
+	var identity string
+	identity, err = g.identityOf(from)
+	if err != nil {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(msg.Filepath())
+	if err != nil {
+		return
+	}
+	if len(data) > maxMessageSize {
+		err = fmt.Errorf("message too big for bote: %w", sendmail.ErrNoRoute)
+		return
+	}
+	err = g.Client.Send(identity, []string{Destination(recip)}, data)
+	if err == nil {
+		log.Infof("sent %s over bote from %s to %s", msg.Filename(), identity, recip)
+	}
+	return
+}
+
+// fetch received mail for every mapped identity and deliver it
+// messages are removed from the node once delivered
+func (g *Gateway) Fetch() (err error) {
+	if g.Deliver == nil {
+		return errors.New("bote gateway has no deliverer")
+	}
+	for user, identity := range g.Identities {
+		var msgs []Message
+		msgs, err = g.Client.Inbox(identity)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			from := "anonymous@" + Domain
+			if msg.From != "" {
+				from = Address(msg.From)
+			}
+			err = g.Deliver(user, from, bytes.NewReader(msg.Data))
+			if err != nil {
+				return
+			}
+			err = g.Client.Delete(identity, msg.ID)
+			if err != nil {
+				return
+			}
+			log.Infof("got bote mail for %s from %s", user, from)
+		}
+	}
+	return
+}
@@ -8,6 +8,10 @@ import (
 type Config struct {
 	opts    map[string]string
 	Aliases AliasConfig
+	// gateway address rewriting rules from the [rewrite] section, clearnet address to i2p address
+	Rewrite map[string]string
+	// bote identity of each user from the [bote] section
+	Bote map[string]string
 }
 
 func (c *Config) Get(name string) (val string, ok bool) {
@@ -28,6 +32,16 @@ func (c *Config) Load(fname string) (err error) {
 				err = c.Aliases.Load(a)
 			}
 		}
+		c.Rewrite = make(map[string]string)
+		s, _ = conf.Section("rewrite")
+		if s != nil {
+			c.Rewrite = s.Options()
+		}
+		c.Bote = make(map[string]string)
+		s, _ = conf.Section("bote")
+		if s != nil {
+			c.Bote = s.Options()
+		}
 	}
 	return
 }
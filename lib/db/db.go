@@ -3,6 +3,7 @@ package db
 import (
 	"github.com/majestrate/bdsmail/lib/mailstore"
 	"github.com/majestrate/bdsmail/lib/model"
+	"time"
 )
 
 // a callback that visits a user model safely
@@ -32,6 +33,29 @@ type DB interface {
 	EnsureUser(name string, i UserInitializer) error
 	// update a user that already exists, does nothing if it doesn't exist
 	UpdateUser(name string, u UserUpdater) error
+	// delete a user, does nothing if it doesn't exist
+	DeleteUser(name string) error
+
+	// list a user's sieve scripts
+	ListSieveScripts(user string) ([]*model.SieveScript, error)
+	// get a user's sieve script by name
+	GetSieveScript(user, name string) (*model.SieveScript, error)
+	// store a user's sieve script, replacing the script with the same name
+	PutSieveScript(user, name, script string) error
+	// delete a user's sieve script, the active script can't be deleted
+	DeleteSieveScript(user, name string) error
+	// rename a user's sieve script
+	RenameSieveScript(user, oldname, newname string) error
+	// make a user's sieve script the active one, empty name deactivates all
+	ActivateSieveScript(user, name string) error
+	// get a user's active sieve script or nil if there is none
+	ActiveSieveScript(user string) (*model.SieveScript, error)
+
+	// check a (remote host, sender, recipiant) triple against the greylist and remember it
+	// returns true if the triple retried after delay or was let through within lifetime
+	Greylist(host, sender, recipient string, delay, lifetime time.Duration) (bool, error)
+	// forget greylist entries that expired, returns how many were removed
+	ExpireGreylist(lifetime time.Duration) (int64, error)
 
 	// run db mainloop
 	Run()
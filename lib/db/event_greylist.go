@@ -0,0 +1,63 @@
+package db
+
+import (
+	"github.com/majestrate/bdsmail/lib/model"
+	"strings"
+	"time"
+)
+
+// check a triple against the greylist
+type greylistEvent struct {
+	*dbEvent
+	host      string
+	sender    string
+	recipient string
+	delay     time.Duration
+	lifetime  time.Duration
+	// the mail is let through
+	pass bool
+	// any errors that occur
+	err error
+}
+
+func (ev *greylistEvent) Error() error {
+	return ev.err
+}
+
+func (ev *greylistEvent) Query() {
+	e := &model.GreylistEntry{
+		Host:      ev.host,
+		Sender:    strings.ToLower(ev.sender),
+		Recipient: strings.ToLower(ev.recipient),
+	}
+	var has bool
+	// the null sender is empty so the triple can't be matched by example
+	has, ev.err = ev.X.engine.Where("host = ? AND sender = ? AND recipient = ?", e.Host, e.Sender, e.Recipient).Get(e)
+	if ev.err != nil {
+		return
+	}
+	ev.pass = e.Check(time.Now(), ev.delay, ev.lifetime)
+	if has {
+		_, ev.err = ev.X.engine.Id(e.Id).AllCols().Update(e)
+	} else {
+		_, ev.err = ev.X.engine.InsertOne(e)
+	}
+}
+
+// forget greylist entries that expired
+type greylistExpireEvent struct {
+	*dbEvent
+	lifetime time.Duration
+	// number of entries removed
+	n   int64
+	err error
+}
+
+func (ev *greylistExpireEvent) Error() error {
+	return ev.err
+}
+
+func (ev *greylistExpireEvent) Query() {
+	now := time.Now()
+	ev.n, ev.err = ev.X.engine.Where("(passed = ? AND last_seen < ?) OR (passed = ? AND first_seen < ?)", true, now.Add(-ev.lifetime), false, now.Add(-model.GreylistPendingTime)).Delete(new(model.GreylistEntry))
+}
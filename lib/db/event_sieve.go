@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"github.com/majestrate/bdsmail/lib/model"
+)
+
+// error for sieve scripts that don't exist
+var ErrNoSuchScript = errors.New("no such script")
+
+// error for sieve script names that are taken
+var ErrScriptExists = errors.New("script already exists")
+
+// error for deleting the active sieve script
+var ErrScriptActive = errors.New("script is active")
+
+// a query on a user's sieve scripts
+type sieveEvent struct {
+	*dbEvent
+	// user who owns the scripts
+	owner string
+	// runs the query
+	q func(ev *sieveEvent) error
+	// scripts fetched
+	scripts []*model.SieveScript
+	// any errors that occur
+	err error
+}
+
+func (ev *sieveEvent) Error() error {
+	return ev.err
+}
+
+func (ev *sieveEvent) Query() {
+	ev.err = ev.q(ev)
+}
+
+// get one script
+func (ev *sieveEvent) get(name string) (s *model.SieveScript, err error) {
+	s = new(model.SieveScript)
+	var has bool
+	has, err = ev.X.engine.Where("owner = ? AND name = ?", ev.owner, name).Get(s)
+	if err == nil && !has {
+		s = nil
+		err = ErrNoSuchScript
+	}
+	return
+}
+
+func (ev *sieveEvent) list() error {
+	return ev.X.engine.Where("owner = ?", ev.owner).Asc("name").Find(&ev.scripts)
+}
+
+func (ev *sieveEvent) put(name, script string) (err error) {
+	var s *model.SieveScript
+	s, err = ev.get(name)
+	if err == ErrNoSuchScript {
+		_, err = ev.X.engine.InsertOne(&model.SieveScript{
+			Owner:  ev.owner,
+			Name:   name,
+			Script: script,
+		})
+	} else if err == nil {
+		s.Script = script
+		_, err = ev.X.engine.Id(s.Id).Cols("script").Update(s)
+	}
+	return
+}
+
+func (ev *sieveEvent) delete(name string) (err error) {
+	var s *model.SieveScript
+	s, err = ev.get(name)
+	if err == nil && s.Active {
+		err = ErrScriptActive
+	}
+	if err == nil {
+		_, err = ev.X.engine.Id(s.Id).Delete(new(model.SieveScript))
+	}
+	return
+}
+
+func (ev *sieveEvent) rename(oldname, newname string) (err error) {
+	var s *model.SieveScript
+	s, err = ev.get(oldname)
+	if err == nil {
+		_, err = ev.get(newname)
+		if err == nil {
+			err = ErrScriptExists
+		} else if err == ErrNoSuchScript {
+			s.Name = newname
+			_, err = ev.X.engine.Id(s.Id).Cols("name").Update(s)
+		}
+	}
+	return
+}
+
+func (ev *sieveEvent) activate(name string) (err error) {
+	if name != "" {
+		_, err = ev.get(name)
+		if err != nil {
+			return
+		}
+	}
+	_, err = ev.X.engine.Where("owner = ?", ev.owner).Cols("active").Update(&model.SieveScript{Active: false})
+	if err == nil && name != "" {
+		_, err = ev.X.engine.Where("owner = ? AND name = ?", ev.owner, name).Cols("active").Update(&model.SieveScript{Active: true})
+	}
+	return
+}
+
+func (ev *sieveEvent) active() (err error) {
+	return ev.X.engine.Where("owner = ? AND active = ?", ev.owner, true).Find(&ev.scripts)
+}
+
+func (ev *sieveEvent) deleteAll() (err error) {
+	_, err = ev.X.engine.Where("owner = ?", ev.owner).Delete(new(model.SieveScript))
+	return
+}
@@ -56,7 +56,23 @@ func (ev *userUpdateEvent) Error() error {
 }
 
 func (ev *userUpdateEvent) Query() {
-	_, ev.err = ev.X.engine.Id(ev.u.Name).Update(ev.u)
+	_, ev.err = ev.X.engine.Id(ev.u.Name).AllCols().Update(ev.u)
+}
+
+type userDeleteEvent struct {
+	*dbEvent
+	// name of user to delete
+	name string
+	// any errors that occur
+	err error
+}
+
+func (ev *userDeleteEvent) Error() error {
+	return ev.err
+}
+
+func (ev *userDeleteEvent) Query() {
+	_, ev.err = ev.X.engine.Id(ev.name).Delete(new(model.User))
 }
 
 // visit all users
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	defer d.Close()
+	check := func(host, sender string, delay time.Duration, want bool) {
+		t.Helper()
+		pass, err := d.Greylist(host, sender, "bob@test.i2p", delay, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pass != want {
+			t.Errorf("greylist of %s %q gave %v", host, sender, pass)
+		}
+	}
+	check("a.b32.i2p", "alice@test.i2p", 0, true)
+	check("a.b32.i2p", "", time.Hour, false)
+	check("a.b32.i2p", "", time.Hour, false)
+	// other triples are separate
+	check("b.b32.i2p", "", 0, true)
+	check("a.b32.i2p", "ALICE@test.i2p", time.Hour, true)
+	check("a.b32.i2p", "", 0, true)
+
+	n, err := d.ExpireGreylist(time.Hour)
+	if err != nil || n != 0 {
+		t.Errorf("expired %d entries %v", n, err)
+	}
+	n, err = d.ExpireGreylist(-time.Second)
+	if err != nil || n != 3 {
+		t.Errorf("expired %d entries %v", n, err)
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSieveScripts(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	defer d.Close()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(d.PutSieveScript("alice", "b", "keep;"))
+	must(d.PutSieveScript("alice", "a", "discard;"))
+	must(d.PutSieveScript("bob", "a", "stop;"))
+	must(d.PutSieveScript("alice", "a", "keep; stop;"))
+	scripts, err := d.ListSieveScripts("alice")
+	must(err)
+	if len(scripts) != 2 || scripts[0].Name != "a" || scripts[0].Script != "keep; stop;" {
+		t.Errorf("bad script list %+v", scripts)
+	}
+	s, err := d.ActiveSieveScript("alice")
+	if err != nil || s != nil {
+		t.Errorf("active script before activation: %v %v", s, err)
+	}
+	must(d.ActivateSieveScript("alice", "a"))
+	must(d.ActivateSieveScript("alice", "b"))
+	must(d.ActivateSieveScript("bob", "a"))
+	s, err = d.ActiveSieveScript("alice")
+	if err != nil || s == nil || s.Name != "b" {
+		t.Errorf("wrong active script: %v %v", s, err)
+	}
+	if err = d.DeleteSieveScript("alice", "b"); err != ErrScriptActive {
+		t.Errorf("deleted active script: %v", err)
+	}
+	if err = d.RenameSieveScript("alice", "b", "a"); err != ErrScriptExists {
+		t.Errorf("renamed over existing script: %v", err)
+	}
+	must(d.RenameSieveScript("alice", "b", "c"))
+	s, _ = d.ActiveSieveScript("alice")
+	if s == nil || s.Name != "c" {
+		t.Errorf("rename lost active script: %v", s)
+	}
+	must(d.ActivateSieveScript("alice", ""))
+	must(d.DeleteSieveScript("alice", "c"))
+	if _, err = d.GetSieveScript("alice", "c"); err != ErrNoSuchScript {
+		t.Errorf("deleted script still there: %v", err)
+	}
+	s, _ = d.ActiveSieveScript("bob")
+	if s == nil || s.Name != "a" {
+		t.Errorf("other user's script changed: %v", s)
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"github.com/majestrate/bdsmail/lib/model"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegacyLogin(t *testing.T) {
+	d, err := NewDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	defer d.Close()
+	// cred for hunter2 made by an older version
+	legacy := "b8}ATSN+Xt1:V}[i,<MaNx6V<w80!vV]qZ8CN]SB gw_,$k_i$Js@+a{iPPAJ2i~RR2W<mCLU#G(Ic,WC"
+	err = d.EnsureUser("alice", func(u *model.User) error {
+		u.Login = legacy
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func() string {
+		var cred string
+		d.VisitUser("alice", func(u *model.User) error {
+			cred = u.Login
+			return nil
+		})
+		return cred
+	}
+	// legacy creds never check, not even with a password of the same length
+	for _, passwd := range []string{"hunter2", "xxxxxxx", "1234567", "hunter3x"} {
+		if good, _ := d.CheckUserLogin("alice", passwd); good || login() != legacy {
+			t.Fatalf("legacy login with %q worked or changed the cred", passwd)
+		}
+	}
+	// until the admin resets the password
+	passwd := "hunter2"
+	err = d.UpdateUser("alice", func(u *model.User) *model.User {
+		if !u.NeedsPasswordReset() {
+			t.Error("legacy cred doesn't need a reset")
+		}
+		// without scram credentials, they are made at the next login
+		u.Login = string(model.NewLoginCred(passwd))
+		return u
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if good, err := d.CheckUserLogin("alice", passwd); !good || err != nil {
+		t.Fatalf("login after reset failed: %v", err)
+	}
+	if !strings.HasPrefix(login(), "$argon2id$") {
+		t.Fatalf("reset cred is not argon2id: %s", login())
+	}
+	if good, _ := d.CheckUserLogin("alice", "xxxxxxx"); good {
+		t.Fatal("bad password of the same length worked")
+	}
+	var scram string
+	d.VisitUser("alice", func(u *model.User) error {
+		scram = u.Scram
+		return nil
+	})
+	if !strings.HasPrefix(scram, "SCRAM-SHA-256$4096:") {
+		t.Errorf("no scram credentials made on login: %q", scram)
+	}
+	if good, _ := d.CheckUserLogin("alice", passwd); !good {
+		t.Errorf("upgraded cred does not check")
+	}
+}
@@ -7,13 +7,17 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
 type xormDB struct {
 	engine      *xorm.Engine
 	dbChnl      chan dbQuery
 	closewaiter chan error
-	runit       bool
+	// held to send on dbChnl, Close takes it to close dbChnl
+	mtx    sync.RWMutex
+	closed bool
 }
 
 // create database driver
@@ -32,19 +36,46 @@ func NewDB(dburl string) (db DB, err error) {
 
 func (x *xormDB) Ensure() (err error) {
 	// ensure underlying xorm engine
-	err = x.engine.Sync(new(model.User))
+	err = x.engine.Sync(new(model.User), new(model.SieveScript), new(model.GreylistEntry))
 	return
 }
 
 func (x *xormDB) CheckUserLogin(username, password string) (good bool, err error) {
 	var u *model.User
 	u, err = x.getUser(username)
-	if err == nil && u != nil && u.Login != "" {
-		good = model.LoginCred(u.Login).Check(password)
+	if err == nil && u != nil {
+		if u.NeedsPasswordReset() {
+			log.Warnf("%s has a login cred from an older version, reset their password with the admin panel or mailtool", username)
+			return
+		}
+		good = u.CheckLogin(password)
+	}
+	if good && (model.LoginCred(u.Login).NeedsRehash() || u.ScramCred() == nil) {
+		x.rehashLogin(username, u.Login, password)
 	}
 	return
 }
 
+// replace a login cred hashed with less work than new ones after its password was checked
+// this also makes scram credentials for users who had none
+func (x *xormDB) rehashLogin(username, old, password string) {
+	upgraded := false
+	err := x.UpdateUser(username, func(u *model.User) *model.User {
+		if u.Login != old {
+			// changed since we checked it
+			return nil
+		}
+		u.SetPassword(password)
+		upgraded = true
+		return u
+	})
+	if err == nil && upgraded {
+		log.Infof("upgraded login cred of %s", username)
+	} else if err != nil {
+		log.Errorf("failed to upgrade login cred of %s: %s", username, err.Error())
+	}
+}
+
 func (x *xormDB) EnsureUser(name string, i UserInitializer) (err error) {
 	if _, err = x.getUser(name); err != nil {
 		// already there
@@ -67,8 +98,9 @@ func (x *xormDB) EnsureUser(name string, i UserInitializer) (err error) {
 			},
 			u: u,
 		}
-		x.fireEvent(ev)
-		ev.Wait()
+		if x.fireEvent(ev) {
+			ev.Wait()
+		}
 	}
 	return
 }
@@ -97,6 +129,127 @@ func (x *xormDB) UpdateUser(email string, up UserUpdater) (err error) {
 	return
 }
 
+func (x *xormDB) DeleteUser(name string) (err error) {
+	ev := &userDeleteEvent{
+		dbEvent: &dbEvent{
+			X:    x,
+			chnl: make(chan bool),
+		},
+		name: name,
+	}
+	if x.fireEvent(ev) {
+		ev.Wait()
+		err = ev.Error()
+	}
+	if err == nil {
+		_, err = x.sieveQuery(name, (*sieveEvent).deleteAll)
+	}
+	return
+}
+
+// run a query on a user's sieve scripts
+func (x *xormDB) sieveQuery(owner string, q func(*sieveEvent) error) (scripts []*model.SieveScript, err error) {
+	ev := &sieveEvent{
+		dbEvent: &dbEvent{
+			X:    x,
+			chnl: make(chan bool),
+		},
+		owner: owner,
+		q:     q,
+	}
+	if x.fireEvent(ev) {
+		ev.Wait()
+		err = ev.Error()
+		scripts = ev.scripts
+	}
+	return
+}
+
+func (x *xormDB) ListSieveScripts(user string) (scripts []*model.SieveScript, err error) {
+	return x.sieveQuery(user, (*sieveEvent).list)
+}
+
+func (x *xormDB) GetSieveScript(user, name string) (s *model.SieveScript, err error) {
+	_, err = x.sieveQuery(user, func(ev *sieveEvent) (e error) {
+		s, e = ev.get(name)
+		return
+	})
+	return
+}
+
+func (x *xormDB) PutSieveScript(user, name, script string) (err error) {
+	_, err = x.sieveQuery(user, func(ev *sieveEvent) error {
+		return ev.put(name, script)
+	})
+	return
+}
+
+func (x *xormDB) DeleteSieveScript(user, name string) (err error) {
+	_, err = x.sieveQuery(user, func(ev *sieveEvent) error {
+		return ev.delete(name)
+	})
+	return
+}
+
+func (x *xormDB) RenameSieveScript(user, oldname, newname string) (err error) {
+	_, err = x.sieveQuery(user, func(ev *sieveEvent) error {
+		return ev.rename(oldname, newname)
+	})
+	return
+}
+
+func (x *xormDB) ActivateSieveScript(user, name string) (err error) {
+	_, err = x.sieveQuery(user, func(ev *sieveEvent) error {
+		return ev.activate(name)
+	})
+	return
+}
+
+func (x *xormDB) ActiveSieveScript(user string) (s *model.SieveScript, err error) {
+	var scripts []*model.SieveScript
+	scripts, err = x.sieveQuery(user, (*sieveEvent).active)
+	if err == nil && len(scripts) > 0 {
+		s = scripts[0]
+	}
+	return
+}
+
+func (x *xormDB) Greylist(host, sender, recipient string, delay, lifetime time.Duration) (pass bool, err error) {
+	ev := &greylistEvent{
+		dbEvent: &dbEvent{
+			X:    x,
+			chnl: make(chan bool),
+		},
+		host:      host,
+		sender:    sender,
+		recipient: recipient,
+		delay:     delay,
+		lifetime:  lifetime,
+	}
+	if x.fireEvent(ev) {
+		ev.Wait()
+		err = ev.Error()
+		pass = ev.pass
+	}
+	return
+}
+
+func (x *xormDB) ExpireGreylist(lifetime time.Duration) (n int64, err error) {
+	ev := &greylistExpireEvent{
+		dbEvent: &dbEvent{
+			X:    x,
+			chnl: make(chan bool),
+		},
+		lifetime: lifetime,
+	}
+	if x.fireEvent(ev) {
+		ev.Wait()
+		err = ev.Error()
+		n = ev.n
+	}
+	return
+}
+
 // get maildir for user given email
 func (x *xormDB) FindStoreFor(email string) (st mailstore.Store, has bool) {
 	u, _ := x.getUser(email)
@@ -124,17 +277,21 @@ func (x *xormDB) VisitAllUsers(v UserVisitor) (err error) {
 		},
 		v: v,
 	}
-	x.fireEvent(ev)
-	ev.Wait()
+	if x.fireEvent(ev) {
+		ev.Wait()
+	}
 	return
 }
 
 // fire a db event and return true if it was queued otherwise false
 func (x *xormDB) fireEvent(ev dbQuery) bool {
-	if x.dbChnl != nil {
-		x.dbChnl <- ev
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	if x.closed {
+		return false
 	}
-	return x.dbChnl != nil
+	x.dbChnl <- ev
+	return true
 }
 
 func (x *xormDB) CreateUser(i UserInitializer, v UserVisitor) (err error) {
@@ -151,8 +308,10 @@ func (x *xormDB) CreateUser(i UserInitializer, v UserVisitor) (err error) {
 			},
 			u: u,
 		}
-		x.fireEvent(ev)
-		ev.Wait()
+		if x.fireEvent(ev) {
+			ev.Wait()
+			err = ev.Error()
+		}
 	}
 
 	if err == nil && v != nil {
@@ -186,24 +345,26 @@ func (x *xormDB) getUser(email string) (u *model.User, err error) {
 }
 
 func (x *xormDB) Run() {
-	for x.dbChnl != nil {
-		ev, ok := <-x.dbChnl
-		if !ok {
-			break
-		}
+	for ev := range x.dbChnl {
 		ev.Query()
 		ev.Done()
 	}
 	// close
-	x.closewaiter <- x.engine.Close()
+	err := x.engine.Close()
 	x.engine = nil
+	x.closewaiter <- err
 }
 
+// stop queuing events and wait for Run to finish the queued ones and exit
 func (x *xormDB) Close() (err error) {
-	c := x.dbChnl
-	x.dbChnl = nil
-	close(c)
+	x.mtx.Lock()
+	if x.closed {
+		x.mtx.Unlock()
+		return
+	}
+	x.closed = true
+	close(x.dbChnl)
+	x.mtx.Unlock()
 	err = <-x.closewaiter
-	close(x.closewaiter)
 	return
 }
@@ -0,0 +1,307 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// header holding the signature
+const HeaderName = "X-I2P-Signature"
+
+// the only signing algorithm
+const algorithm = "ed25519-sha256"
+
+// headers signed when present, from is always signed
+var DefaultHeaders = []string{
+	"from", "sender", "reply-to", "to", "cc", "subject", "date", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding",
+}
+
+// message has no signature
+var ErrNoSignature = errors.New("message is not signed")
+
+// signature does not match message
+var ErrBadSignature = errors.New("bad signature")
+
+// finds the public key of a signing domain
+type KeyLookup func(domain string) (ed25519.PublicKey, error)
+
+// a raw header field
+type field struct {
+	// lower case name
+	name string
+	// raw value after the colon, unfolded lines included
+	value string
+}
+
+// split a message into its header fields and body
+func readMessage(r io.Reader) (fields []field, body []byte, err error) {
+	br := bufio.NewReader(r)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			err = nil
+			return
+		}
+		if err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// folded continuation
+			fields[len(fields)-1].value += "\r\n" + trimmed
+			continue
+		}
+		idx := strings.Index(trimmed, ":")
+		if idx <= 0 {
+			err = fmt.Errorf("bad header line: %q", trimmed)
+			return
+		}
+		fields = append(fields, field{
+			name:  strings.ToLower(strings.TrimSpace(trimmed[:idx])),
+			value: trimmed[idx+1:],
+		})
+	}
+	body, err = ioutil.ReadAll(br)
+	return
+}
+
+// collapse runs of whitespace into 1 space
+func compressSpace(str string) string {
+	return strings.Join(strings.FieldsFunc(str, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}), " ")
+}
+
+// relaxed header canonicalization from rfc 6376
+func canonHeader(name, value string) string {
+	return name + ":" + compressSpace(value)
+}
+
+// relaxed body canonicalization from rfc 6376
+func canonBody(body []byte) []byte {
+	var buf bytes.Buffer
+	var blank int
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			buf.WriteString("\r\n")
+		}
+		// only compress inner whitespace, keep leading whitespace as a single space
+		lead := ""
+		if line[0] == ' ' || line[0] == '\t' {
+			lead = " "
+		}
+		buf.WriteString(lead + compressSpace(line) + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// hash of canonical body
+func bodyHash(body []byte) string {
+	h := sha256.Sum256(canonBody(body))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// data covered by a signature, signed headers picked bottom up like dkim then the signature header with b= empty
+func signedData(fields []field, names []string, sigValue string) []byte {
+	var buf bytes.Buffer
+	used := make(map[int]bool)
+	for _, name := range names {
+		for idx := len(fields) - 1; idx >= 0; idx-- {
+			if fields[idx].name == name && !used[idx] {
+				used[idx] = true
+				buf.WriteString(canonHeader(name, fields[idx].value) + "\r\n")
+				break
+			}
+		}
+	}
+	buf.WriteString(canonHeader(strings.ToLower(HeaderName), sigValue))
+	return buf.Bytes()
+}
+
+// signs messages with a destination's key
+type Signer struct {
+	// signing key
+	Key ed25519.PrivateKey
+	// headers to sign
+	Headers []string
+	// current time, swapped out in tests
+	now func() time.Time
+}
+
+// create a signer for a key
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{
+		Key:     key,
+		Headers: DefaultHeaders,
+		now:     time.Now,
+	}
+}
+
+// reader that always fails
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
+
+// sign a message as a domain, returns the message with the signature header prepended
+// reading the result fails if the message can't be read
+func (s *Signer) Sign(domain string, r io.Reader) io.Reader {
+	var raw bytes.Buffer
+	fields, body, err := readMessage(io.TeeReader(r, &raw))
+	if err != nil {
+		return errReader{err}
+	}
+	present := make(map[string]bool)
+	for _, f := range fields {
+		present[f.name] = true
+	}
+	names := []string{"from"}
+	for _, name := range s.Headers {
+		name = strings.ToLower(name)
+		if name != "from" && present[name] {
+			names = append(names, name)
+		}
+	}
+	value := fmt.Sprintf(" v=1; a=%s; d=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, domain, s.now().Unix(), strings.Join(names, ":"), bodyHash(body))
+	sig := ed25519.Sign(s.Key, signedData(fields, names, value))
+	value += base64.StdEncoding.EncodeToString(sig)
+	return io.MultiReader(strings.NewReader(HeaderName+":"+value+"\r\n"), &raw)
+}
+
+// parse tag=value list
+func parseTags(value string) (tags map[string]string, err error) {
+	tags = make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.Index(part, "=")
+		if idx <= 0 {
+			err = fmt.Errorf("bad signature tag %q", part)
+			return
+		}
+		tags[strings.TrimSpace(part[:idx])] = strings.Join(strings.Fields(part[idx+1:]), "")
+	}
+	return
+}
+
+// remove the value of the b= tag keeping everything else as is
+func stripSignature(value string) string {
+	parts := strings.Split(value, ";")
+	for idx, part := range parts {
+		tag := strings.TrimLeft(part, " \t\r\n")
+		if strings.HasPrefix(tag, "b=") {
+			parts[idx] = part[:len(part)-len(tag)] + "b="
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// verify the topmost signature of a message
+// returns the signing domain if the signature is good
+func Verify(r io.Reader, lookup KeyLookup) (domain string, err error) {
+	var fields []field
+	var body []byte
+	fields, body, err = readMessage(r)
+	if err != nil {
+		return
+	}
+	var sigField *field
+	for idx := range fields {
+		if fields[idx].name == strings.ToLower(HeaderName) {
+			sigField = &fields[idx]
+			break
+		}
+	}
+	if sigField == nil {
+		err = ErrNoSignature
+		return
+	}
+	var tags map[string]string
+	tags, err = parseTags(sigField.value)
+	if err != nil {
+		return
+	}
+	if tags["v"] != "1" || tags["a"] != algorithm {
+		err = fmt.Errorf("unsupported signature v=%s a=%s", tags["v"], tags["a"])
+		return
+	}
+	names := strings.Split(strings.ToLower(tags["h"]), ":")
+	if names[0] != "from" || tags["d"] == "" {
+		err = fmt.Errorf("%w: from header not signed", ErrBadSignature)
+		return
+	}
+	if _, err = strconv.ParseInt(tags["t"], 10, 64); err != nil {
+		err = fmt.Errorf("%w: bad timestamp", ErrBadSignature)
+		return
+	}
+	if tags["bh"] != bodyHash(body) {
+		err = fmt.Errorf("%w: body hash mismatch", ErrBadSignature)
+		return
+	}
+	var sig []byte
+	sig, err = base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrBadSignature, err.Error())
+		return
+	}
+	var pk ed25519.PublicKey
+	pk, err = lookup(tags["d"])
+	if err != nil {
+		return
+	}
+	// the signature header itself is excluded from the signed headers
+	var signed []field
+	for idx := range fields {
+		if &fields[idx] != sigField {
+			signed = append(signed, fields[idx])
+		}
+	}
+	if !ed25519.Verify(pk, signedData(signed, names, stripSignature(sigField.value)), sig) {
+		err = ErrBadSignature
+		return
+	}
+	domain = strings.ToLower(tags["d"])
+	return
+}
+
+// get the domain of the address in a from header
+func FromDomain(from string) (domain string) {
+	a, err := mail.ParseAddress(from)
+	if err == nil {
+		from = a.Address
+	}
+	idx := strings.LastIndex(from, "@")
+	if idx >= 0 {
+		domain = strings.ToLower(strings.Trim(from[idx+1:], "> \t"))
+	}
+	return
+}
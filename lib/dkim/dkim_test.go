@@ -0,0 +1,105 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDomain = "ourdest.b32.i2p"
+
+const testMessage = "From: Alice <alice@ourdest.b32.i2p>\r\n" +
+	"To: bob@otherdest.b32.i2p\r\n" +
+	"Subject: hello\r\n" +
+	"\tthere\r\n" +
+	"X-Unsigned: whatever\r\n" +
+	"\r\n" +
+	"hi bob\r\n" +
+	"\r\n"
+
+func testSign(t *testing.T, msg string) (string, KeyLookup) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSigner(sk)
+	s.now = func() time.Time {
+		return time.Unix(1600000000, 0)
+	}
+	signed, err := ioutil.ReadAll(s.Sign(testDomain, strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed), func(domain string) (ed25519.PublicKey, error) {
+		if domain != testDomain {
+			return nil, errors.New("no such domain")
+		}
+		return pk, nil
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	signed, lookup := testSign(t, testMessage)
+	if !strings.HasPrefix(signed, HeaderName+": v=1; a=ed25519-sha256; d="+testDomain+"; t=1600000000; h=from:to:subject; bh=") {
+		t.Errorf("bad signature header: %s", strings.SplitN(signed, "\r\n", 2)[0])
+	}
+	if !strings.HasSuffix(signed, testMessage) {
+		t.Errorf("message changed by signing")
+	}
+	domain, err := Verify(strings.NewReader(signed), lookup)
+	if err != nil || domain != testDomain {
+		t.Fatalf("verify failed: %s %v", domain, err)
+	}
+	// relaxed canonicalization survives whitespace changes and unsigned headers
+	relayed := "Received: from somewhere\r\n" + strings.NewReplacer(
+		"Subject: hello\r\n\tthere", "Subject:  hello there",
+		"X-Unsigned: whatever", "X-Unsigned: changed",
+		"hi bob\r\n", "hi  bob \n",
+	).Replace(signed)
+	if _, err = Verify(strings.NewReader(relayed), lookup); err != nil {
+		t.Errorf("relayed message failed to verify: %v", err)
+	}
+	for _, c := range []struct{ old, new string }{
+		{"Subject: hello", "Subject: goodbye"},
+		{"hi bob", "hi eve"},
+		{"From: Alice <alice@", "From: Eve <alice@"},
+		{"To: bob@", "To: eve@"},
+	} {
+		tampered := strings.Replace(signed, c.old, c.new, 1)
+		if _, err = Verify(strings.NewReader(tampered), lookup); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("tampered %q verified: %v", c.new, err)
+		}
+	}
+	// added signed header
+	if _, err = Verify(strings.NewReader(strings.Replace(signed, "\r\n\r\n", "\r\nTo: eve@evil.b32.i2p\r\n\r\n", 1)), lookup); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("added recipiant verified: %v", err)
+	}
+	// wrong key
+	_, other := testSign(t, testMessage)
+	if _, err = Verify(strings.NewReader(signed), other); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("verified with wrong key: %v", err)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	_, err := Verify(strings.NewReader(testMessage), nil)
+	if err != ErrNoSignature {
+		t.Errorf("expected no signature, got %v", err)
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	for in, want := range map[string]string{
+		"Alice <alice@Ourdest.b32.i2p>": "ourdest.b32.i2p",
+		"alice@ourdest.b32.i2p":         "ourdest.b32.i2p",
+		"<alice@ourdest.b32.i2p>":       "ourdest.b32.i2p",
+		"nobody":                        "",
+	} {
+		if got := FromDomain(in); got != want {
+			t.Errorf("FromDomain(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// dkim style message signatures keyed to i2p destinations
+//
+// messages are signed with the ed25519 key of the sending destination,
+// receivers look up the destination of the signing domain to verify
+package dkim
@@ -0,0 +1,2 @@
+// scripted mail filters using an embedded lua interpreter
+package filter
@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// result of running a filter
+type Verdict int
+
+const (
+	// filter has no opinion, go on to the next filter
+	Pass = Verdict(iota)
+	// accept the message for delivery
+	Accept
+	// silently drop the message
+	Drop
+	// message is spam
+	Spam
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept:
+		return "accept"
+	case Drop:
+		return "drop"
+	case Spam:
+		return "spam"
+	}
+	return "pass"
+}
+
+// parse a verdict name
+func ParseVerdict(str string) (v Verdict, err error) {
+	switch strings.ToLower(str) {
+	case "pass":
+		v = Pass
+	case "accept":
+		v = Accept
+	case "drop":
+		v = Drop
+	case "spam":
+		v = Spam
+	default:
+		err = fmt.Errorf("invalid verdict: %s", str)
+	}
+	return
+}
+
+// how long a filter function may run by default
+const DefaultTimeout = time.Second * 5
+
+// mail event given to filters
+type Event struct {
+	// remote address of sender
+	Addr string
+	// recipiant of message
+	Recip string
+	// sender of message
+	Sender string
+	// file containg the message
+	File string
+	// parsed message header
+	Header textproto.MIMEHeader
+	// domain that signed the message, empty if not signed
+	Signer string
+}
+
+// a loaded filter script
+type Engine struct {
+	// how long a filter function may run
+	Timeout time.Duration
+	// script filename
+	fname string
+	// lua interpreter core
+	l *lua.LState
+	// lock to use to ensure 1 thread accessing lua
+	mtx sync.Mutex
+}
+
+// load a filter script
+func Load(fname string) (e *Engine, err error) {
+	e = &Engine{
+		Timeout: DefaultTimeout,
+		fname:   fname,
+		l:       lua.NewState(),
+	}
+	e.setGlobals()
+	err = e.l.DoFile(fname)
+	if err != nil {
+		e.l.Close()
+		e = nil
+	}
+	return
+}
+
+// set up globals scripts can use
+func (e *Engine) setGlobals() {
+	for _, v := range []Verdict{Pass, Accept, Drop, Spam} {
+		e.l.SetGlobal(strings.ToUpper(v.String()), lua.LString(v.String()))
+	}
+	e.l.SetGlobal("log", e.l.NewFunction(func(l *lua.LState) int {
+		var parts []string
+		for i := 1; i <= l.GetTop(); i++ {
+			parts = append(parts, l.ToStringMeta(l.Get(i)).String())
+		}
+		log.WithFields(log.Fields{
+			"script": e.fname,
+		}).Info(strings.Join(parts, " "))
+		return 0
+	}))
+}
+
+// script filename
+func (e *Engine) Filename() string {
+	return e.fname
+}
+
+// does the script define a filter function?
+func (e *Engine) Has(name string) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	_, ok := e.l.GetGlobal(name).(*lua.LFunction)
+	return ok
+}
+
+// convert an event to a lua table
+func (e *Engine) eventTable(ev *Event) *lua.LTable {
+	t := e.l.NewTable()
+	t.RawSetString("addr", lua.LString(ev.Addr))
+	t.RawSetString("recip", lua.LString(ev.Recip))
+	t.RawSetString("sender", lua.LString(ev.Sender))
+	t.RawSetString("file", lua.LString(ev.File))
+	t.RawSetString("signer", lua.LString(ev.Signer))
+	headers := e.l.NewTable()
+	for k, vs := range ev.Header {
+		if len(vs) > 0 {
+			headers.RawSetString(strings.ToLower(k), lua.LString(vs[0]))
+		}
+	}
+	t.RawSetString("headers", headers)
+	// header(name) returns all values of a header
+	t.RawSetString("header", e.l.NewFunction(func(l *lua.LState) int {
+		vs := ev.Header[textproto.CanonicalMIMEHeaderKey(l.CheckString(1))]
+		for _, v := range vs {
+			l.Push(lua.LString(v))
+		}
+		return len(vs)
+	}))
+	return t
+}
+
+// run a filter function on an event
+// functions that return true or 1 give the verdict hit
+// functions can return a verdict name like ACCEPT, DROP, SPAM or PASS
+// functions that don't exist or return nothing give Pass
+func (e *Engine) Run(name string, ev *Event, hit Verdict) (v Verdict, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	fn, ok := e.l.GetGlobal(name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+	e.l.SetContext(ctx)
+	defer e.l.RemoveContext()
+	err = e.l.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, e.eventTable(ev))
+	if err != nil {
+		return
+	}
+	ret := e.l.Get(-1)
+	e.l.Pop(1)
+	switch r := ret.(type) {
+	case lua.LBool:
+		if r {
+			v = hit
+		}
+	case lua.LNumber:
+		if r == 1 {
+			v = hit
+		} else if r != 0 {
+			err = fmt.Errorf("filter %s returned invalid code %s", name, r.String())
+		}
+	case lua.LString:
+		v, err = ParseVerdict(string(r))
+	case *lua.LNilType:
+	default:
+		err = errors.New("filter " + name + " returned " + ret.Type().String())
+	}
+	return
+}
+
+// close the lua interpreter
+func (e *Engine) Close() {
+	e.mtx.Lock()
+	e.l.Close()
+	e.mtx.Unlock()
+}
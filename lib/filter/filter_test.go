@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+const testScript = `
+function whitelist(ev)
+  return ev.sender == "friend@a.b32.i2p"
+end
+
+function blacklist(ev)
+  if ev.headers["subject"] == "buy now" then
+    return 1
+  end
+  return 0
+end
+
+function checkspam(ev)
+  local to = {ev.header("To")}
+  if #to > 1 then
+    return SPAM
+  end
+  return PASS
+end
+
+function loop(ev)
+  while true do end
+end
+`
+
+func loadTestScript(t *testing.T) (e *Engine, cleanup func()) {
+	f, err := ioutil.TempFile("", "filter*.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(testScript)
+	f.Close()
+	e, err = Load(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		e.Close()
+		os.Remove(f.Name())
+	}
+	return
+}
+
+func TestFilterVerdicts(t *testing.T) {
+	e, cleanup := loadTestScript(t)
+	defer cleanup()
+	ev := &Event{
+		Sender: "friend@a.b32.i2p",
+		Header: textproto.MIMEHeader{
+			"Subject": {"buy now"},
+			"To":      {"a@b.b32.i2p", "c@d.b32.i2p"},
+		},
+	}
+	for _, tc := range []struct {
+		name   string
+		hit    Verdict
+		expect Verdict
+	}{
+		{"whitelist", Accept, Accept},
+		{"blacklist", Drop, Drop},
+		{"checkspam", Spam, Spam},
+		{"nonexistant", Drop, Pass},
+	} {
+		v, err := e.Run(tc.name, ev, tc.hit)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+		}
+		if v != tc.expect {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.expect, v)
+		}
+	}
+	ev.Sender = "stranger@a.b32.i2p"
+	v, _ := e.Run("whitelist", ev, Accept)
+	if v != Pass {
+		t.Errorf("whitelist: expected pass got %s", v)
+	}
+}
+
+func TestFilterTimeout(t *testing.T) {
+	e, cleanup := loadTestScript(t)
+	defer cleanup()
+	e.Timeout = time.Millisecond * 100
+	_, err := e.Run("loop", &Event{}, Drop)
+	if err == nil {
+		t.Fatal("runaway filter did not time out")
+	}
+	// engine is still usable after a timeout
+	v, err := e.Run("whitelist", &Event{Sender: "friend@a.b32.i2p"}, Accept)
+	if err != nil || v != Accept {
+		t.Fatalf("engine broken after timeout: %s %v", v, err)
+	}
+}
@@ -0,0 +1,2 @@
+// inet <-> i2p mail gateway
+package gateway
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/smtp"
+	log "github.com/sirupsen/logrus"
+	"net"
+	netsmtp "net/smtp"
+	"sort"
+	"strings"
+)
+
+// a clearnet host to connect to, resolved by whoever dials it
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "tcp"
+}
+
+func (a hostAddr) String() string {
+	return string(a)
+}
+
+// relays mail between clearnet and i2p
+type Gateway struct {
+	// clearnet domains we accept mail for, the first one is where foreign i2p addresses are encoded
+	Domains []string
+	// relay all clearnet mail through this host:port instead of looking up mx records
+	Smarthost string
+	// username and password for the smarthost
+	SmarthostUser     string
+	SmarthostPassword string
+	// dial clearnet through this socks5 proxy, tor for example
+	Proxy string
+	// relay mail from other i2p servers to the clearnet, otherwise only our users can send to the clearnet
+	RelayI2P bool
+	// rewrites addresses between networks
+	Rewrite *Rewriter
+	// resolves mx records, swapped out in tests
+	lookupMX func(string) ([]*net.MX, error)
+}
+
+// create a gateway for clearnet domains, i2pDomain is our b32 address
+func New(domains []string, i2pDomain string, rules map[string]string) *Gateway {
+	var inetDomain string
+	for idx := range domains {
+		domains[idx] = strings.ToLower(strings.TrimSpace(domains[idx]))
+	}
+	if len(domains) > 0 {
+		inetDomain = domains[0]
+	}
+	return &Gateway{
+		Domains:  domains,
+		Rewrite:  NewRewriter(inetDomain, i2pDomain, rules),
+		lookupMX: net.LookupMX,
+	}
+}
+
+// return true if we accept clearnet mail for an address
+func (g *Gateway) AcceptsRecipient(addr string) bool {
+	_, domain := splitAddr(addr)
+	for _, d := range g.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// dial a clearnet host
+func (g *Gateway) Dial(network, addr string) (net.Conn, error) {
+	if g.Proxy == "" {
+		return net.Dial(network, addr)
+	}
+	return DialSocks(g.Proxy, addr)
+}
+
+// find the smtp server for a clearnet domain
+func (g *Gateway) Resolve(domain string) (a net.Addr, err error) {
+	if g.Smarthost != "" {
+		a = hostAddr(g.Smarthost)
+		return
+	}
+	var mx []*net.MX
+	mx, err = g.lookupMX(domain)
+	if err == nil && len(mx) == 0 {
+		err = errors.New("no mx records for " + domain)
+	}
+	if err != nil {
+		return
+	}
+	sort.Slice(mx, func(i, j int) bool {
+		return mx[i].Pref < mx[j].Pref
+	})
+	host := strings.TrimSuffix(mx[0].Host, ".")
+	log.Debugf("mx for %s is %s", domain, host)
+	a = hostAddr(net.JoinHostPort(host, "25"))
+	return
+}
+
+// set up a new connection to a clearnet smtp server
+// uses starttls when offered and logs into the smarthost if we have credentials
+func (g *Gateway) Setup(cl *smtp.Client, addr string) (err error) {
+	host, _, _ := net.SplitHostPort(addr)
+	if ok, _ := cl.Extension("STARTTLS"); ok {
+		err = cl.StartTLS(&tls.Config{
+			ServerName: host,
+		})
+		if err != nil {
+			return
+		}
+	}
+	if g.Smarthost != "" && addr == g.Smarthost && g.SmarthostUser != "" {
+		err = cl.Auth(netsmtp.PlainAuth("", g.SmarthostUser, g.SmarthostPassword, host))
+	}
+	return
+}
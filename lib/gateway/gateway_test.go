@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testB32 = "ourdest.b32.i2p"
+
+func testRewriter() *Rewriter {
+	return NewRewriter("example.com", testB32, map[string]string{
+		"boss@example.com": "ceo@otherdest.b32.i2p",
+		"@friends.org":     "@frienddest.b32.i2p",
+	})
+}
+
+func TestRewrite(t *testing.T) {
+	rw := testRewriter()
+	for _, c := range []struct {
+		in, i2p, inet string
+	}{
+		// our users
+		{"alice@example.com", "alice@" + testB32, "alice@example.com"},
+		// explicit address rule
+		{"boss@example.com", "ceo@otherdest.b32.i2p", "boss@example.com"},
+		// domain rule
+		{"bob@friends.org", "bob@frienddest.b32.i2p", "bob@friends.org"},
+		// foreign clearnet address
+		{"carol@mail.net", "carol=mail.net@" + testB32, "carol@mail.net"},
+		// foreign i2p address
+		{"dave@somewhere.b32.i2p", "dave@somewhere.b32.i2p", "dave=somewhere.b32.i2p@example.com"},
+	} {
+		if got := rw.ToI2P(c.in); got != c.i2p {
+			t.Errorf("ToI2P(%s) = %s, want %s", c.in, got, c.i2p)
+		}
+		if got := rw.ToInet(c.i2p); got != c.inet {
+			t.Errorf("ToInet(%s) = %s, want %s", c.i2p, got, c.inet)
+		}
+	}
+	// encoded addresses decode back
+	if got := rw.ToI2P("dave=somewhere.b32.i2p@example.com"); got != "dave@somewhere.b32.i2p" {
+		t.Errorf("bad decode of encoded i2p address: %s", got)
+	}
+	if _, ok := rw.DecodeI2P("eve=evil.b32.i2p@" + testB32); ok {
+		t.Errorf("decoded an i2p address as clearnet")
+	}
+}
+
+func TestRewriteHeader(t *testing.T) {
+	rw := testRewriter()
+	msg := "From: Alice <alice@" + testB32 + ">\r\n" +
+		"To: carol=mail.net@" + testB32 + ",\r\n dave@somewhere.b32.i2p\r\n" +
+		"Subject: hi alice@" + testB32 + "\r\n" +
+		"\r\n" +
+		"From: alice@" + testB32 + "\r\n"
+	b, err := ioutil.ReadAll(rw.Header(strings.NewReader(msg), true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(string(b))))
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Get("From") != `"Alice" <alice@example.com>` {
+		t.Errorf("bad from: %s", hdr.Get("From"))
+	}
+	if hdr.Get("To") != "<carol@mail.net>, <dave=somewhere.b32.i2p@example.com>" {
+		t.Errorf("bad to: %s", hdr.Get("To"))
+	}
+	if hdr.Get("Subject") != "hi alice@"+testB32 {
+		t.Errorf("subject was rewritten: %s", hdr.Get("Subject"))
+	}
+	body, _ := ioutil.ReadAll(r.R)
+	if string(body) != "From: alice@"+testB32+"\r\n" {
+		t.Errorf("body was rewritten: %q", body)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	g := New([]string{"Example.com"}, testB32, nil)
+	g.lookupMX = func(name string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "backup.mail.net.", Pref: 20}, {Host: "mx.mail.net.", Pref: 10}}, nil
+	}
+	a, err := g.Resolve("mail.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "mx.mail.net:25" {
+		t.Errorf("bad mx: %s", a)
+	}
+	g.Smarthost = "relay.example.com:587"
+	a, _ = g.Resolve("mail.net")
+	if a.String() != g.Smarthost {
+		t.Errorf("smarthost not used: %s", a)
+	}
+	if !g.AcceptsRecipient("bob@EXAMPLE.com") || g.AcceptsRecipient("bob@mail.net") {
+		t.Errorf("bad recipiant check")
+	}
+}
+
+func TestDialSocks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 3)
+		io.ReadFull(c, buf)
+		c.Write([]byte{5, 0})
+		buf = make([]byte, 5)
+		io.ReadFull(c, buf)
+		host := make([]byte, buf[4]+2)
+		io.ReadFull(c, host)
+		port := int(host[len(host)-2])<<8 | int(host[len(host)-1])
+		target <- net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(port))
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		c.Write([]byte("220 hello\r\n"))
+	}()
+	c, err := DialSocks(l.Addr().String(), "mx.mail.net:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := <-target; got != "mx.mail.net:25" {
+		t.Errorf("proxy asked for %s", got)
+	}
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	if line != "220 hello\r\n" {
+		t.Errorf("bad greeting through proxy: %q", line)
+	}
+}
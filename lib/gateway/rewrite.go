@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// separates the local part and domain of a foreign address encoded in a local part
+const encodeSep = "="
+
+// headers holding addresses we rewrite
+var addrHeaders = map[string]bool{
+	"from":     true,
+	"sender":   true,
+	"reply-to": true,
+	"to":       true,
+	"cc":       true,
+}
+
+// rewrites addresses between clearnet and i2p
+// explicit rules map addresses or whole domains, users of our own domains have the same name on both sides,
+// other foreign addresses are encoded as local=domain@gateway so replies find their way back through the gateway
+type Rewriter struct {
+	// clearnet domain foreign i2p addresses are encoded under
+	InetDomain string
+	// i2p domain foreign clearnet addresses are encoded under
+	I2PDomain string
+	// clearnet address to i2p address, keys starting with @ map whole domains
+	toI2P map[string]string
+	// i2p address to clearnet address, keys starting with @ map whole domains
+	toInet map[string]string
+}
+
+// create a rewriter given rules mapping clearnet addresses to i2p addresses
+// a rule like @example.com = @xxx.b32.i2p maps every user of a domain
+func NewRewriter(inetDomain, i2pDomain string, rules map[string]string) *Rewriter {
+	rw := &Rewriter{
+		InetDomain: strings.ToLower(inetDomain),
+		I2PDomain:  strings.ToLower(i2pDomain),
+		toI2P:      make(map[string]string),
+		toInet:     make(map[string]string),
+	}
+	for inet, i2p := range rules {
+		inet = strings.ToLower(strings.TrimSpace(inet))
+		i2p = strings.ToLower(strings.TrimSpace(i2p))
+		if inet == "" || i2p == "" {
+			continue
+		}
+		rw.toI2P[inet] = i2p
+		rw.toInet[i2p] = inet
+	}
+	return rw
+}
+
+// split an address into local part and lowercase domain
+func splitAddr(addr string) (local, domain string) {
+	idx := strings.LastIndex(addr, "@")
+	if idx == -1 {
+		return addr, ""
+	}
+	return addr[:idx], strings.ToLower(addr[idx+1:])
+}
+
+// return true if an address is on i2p
+func IsI2P(addr string) bool {
+	_, domain := splitAddr(addr)
+	return strings.HasSuffix(domain, ".i2p")
+}
+
+// apply an explicit rule to an address
+func applyRule(rules map[string]string, addr string) (string, bool) {
+	if to, ok := rules[strings.ToLower(addr)]; ok {
+		return to, true
+	}
+	local, domain := splitAddr(addr)
+	if to, ok := rules["@"+domain]; ok {
+		return local + to, true
+	}
+	return "", false
+}
+
+// decode a foreign address encoded under a domain
+func decode(addr, domain string) (string, bool) {
+	local, d := splitAddr(addr)
+	if d == "" || d != domain {
+		return "", false
+	}
+	idx := strings.LastIndex(local, encodeSep)
+	if idx <= 0 || idx == len(local)-1 {
+		return "", false
+	}
+	return local[:idx] + "@" + local[idx+1:], true
+}
+
+// encode a foreign address under a domain
+func encode(addr, domain string) string {
+	local, d := splitAddr(addr)
+	return local + encodeSep + d + "@" + domain
+}
+
+// get the clearnet address an address encoded under our i2p domain stands for
+func (rw *Rewriter) DecodeI2P(addr string) (inet string, ok bool) {
+	inet, ok = decode(addr, rw.I2PDomain)
+	if ok && IsI2P(inet) {
+		inet, ok = "", false
+	}
+	return
+}
+
+// get the i2p address an address encoded under our clearnet domain stands for
+func (rw *Rewriter) DecodeInet(addr string) (i2p string, ok bool) {
+	i2p, ok = decode(addr, rw.InetDomain)
+	if ok && !IsI2P(i2p) {
+		i2p, ok = "", false
+	}
+	return
+}
+
+// get the i2p address for an address, i2p addresses are returned as is
+func (rw *Rewriter) ToI2P(addr string) string {
+	if addr == "" || IsI2P(addr) {
+		return addr
+	}
+	if to, ok := applyRule(rw.toI2P, addr); ok {
+		return to
+	}
+	if to, ok := rw.DecodeInet(addr); ok {
+		return to
+	}
+	local, domain := splitAddr(addr)
+	if domain == rw.InetDomain {
+		// our users have the same name on both sides
+		return local + "@" + rw.I2PDomain
+	}
+	return encode(addr, rw.I2PDomain)
+}
+
+// get the clearnet address for an address, clearnet addresses are returned as is
+func (rw *Rewriter) ToInet(addr string) string {
+	if addr == "" {
+		return addr
+	}
+	if to, ok := rw.DecodeI2P(addr); ok {
+		return to
+	}
+	if !IsI2P(addr) {
+		return addr
+	}
+	if to, ok := applyRule(rw.toInet, addr); ok {
+		return to
+	}
+	local, domain := splitAddr(addr)
+	if domain == rw.I2PDomain {
+		return local + "@" + rw.InetDomain
+	}
+	return encode(addr, rw.InetDomain)
+}
+
+// rewrite the addresses in an address header value
+func rewriteAddrList(value string, conv func(string) string) string {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		// leave headers we cannot parse alone
+		return value
+	}
+	var parts []string
+	for _, a := range list {
+		a.Address = conv(a.Address)
+		parts = append(parts, a.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rewrite the addresses in the header of a message
+// toInet selects which way addresses are rewritten
+func (rw *Rewriter) Header(body io.Reader, toInet bool) io.Reader {
+	conv := rw.ToI2P
+	if toInet {
+		conv = rw.ToInet
+	}
+	r := bufio.NewReader(body)
+	var hdr bytes.Buffer
+	var field []string
+	flush := func() {
+		if len(field) == 0 {
+			return
+		}
+		line := strings.Join(field, "")
+		field = nil
+		idx := strings.Index(line, ":")
+		if idx > 0 && addrHeaders[strings.ToLower(line[:idx])] {
+			value := strings.TrimSpace(strings.Replace(strings.Replace(line[idx+1:], "\r\n", "", -1), "\n", "", -1))
+			line = line[:idx] + ": " + rewriteAddrList(value, conv) + "\r\n"
+		}
+		hdr.WriteString(line)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if line == "\r\n" || line == "\n" {
+			flush()
+			hdr.WriteString(line)
+			break
+		}
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line)
+		} else if len(line) > 0 {
+			flush()
+			field = append(field, line)
+		}
+		if err != nil {
+			flush()
+			break
+		}
+	}
+	return io.MultiReader(&hdr, r)
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// how long to wait for a socks proxy to connect us
+const socksTimeout = time.Minute
+
+// dial a tcp address through a socks5 proxy without authentication
+// host names are resolved by the proxy so nothing leaks when using tor
+func DialSocks(proxy, addr string) (c net.Conn, err error) {
+	var host, portstr string
+	host, portstr, err = net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	var port int
+	port, err = strconv.Atoi(portstr)
+	if err != nil || port <= 0 || port > 65535 {
+		err = fmt.Errorf("bad port in %s", addr)
+		return
+	}
+	if len(host) > 255 {
+		err = errors.New("host name too long")
+		return
+	}
+	c, err = net.DialTimeout("tcp", proxy, socksTimeout)
+	if err != nil {
+		return
+	}
+	c.SetDeadline(time.Now().Add(socksTimeout))
+	err = socksConnect(c, host, port)
+	if err == nil {
+		c.SetDeadline(time.Time{})
+	} else {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+// do the socks5 handshake and connect request
+func socksConnect(c net.Conn, host string, port int) (err error) {
+	// version 5, 1 method, no auth
+	_, err = c.Write([]byte{5, 1, 0})
+	if err != nil {
+		return
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(c, reply[:])
+	if err != nil {
+		return
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		err = errors.New("socks proxy wants authentication")
+		return
+	}
+	req := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else if ip != nil {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	} else {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = c.Write(req)
+	if err != nil {
+		return
+	}
+	var resp [4]byte
+	_, err = io.ReadFull(c, resp[:])
+	if err != nil {
+		return
+	}
+	if resp[1] != 0 {
+		err = fmt.Errorf("socks proxy failed to connect to %s: code %d", host, resp[1])
+		return
+	}
+	// skip bound address
+	var skip int
+	switch resp[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		var l [1]byte
+		_, err = io.ReadFull(c, l[:])
+		skip = int(l[0])
+	default:
+		err = errors.New("bad socks reply")
+	}
+	if err == nil {
+		_, err = io.ReadFull(c, make([]byte, skip+2))
+	}
+	return
+}
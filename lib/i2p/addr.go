@@ -15,10 +15,19 @@ func (a I2PAddr) String() string {
 	return string(a)
 }
 
+// get raw destination
+func (a I2PAddr) decode() (buf []byte, err error) {
+	buf = make([]byte, i2pB64enc.DecodedLen(len(a)))
+	var n int
+	n, err = i2pB64enc.Decode(buf, []byte(a))
+	buf = buf[:n]
+	return
+}
+
 // compute base32 address
 func (a I2PAddr) Base32Addr() (b32 Base32Addr) {
-	buf := make([]byte, i2pB64enc.DecodedLen(len(a)))
-	if _, err := i2pB64enc.Decode(buf, []byte(a)); err != nil {
+	buf, err := a.decode()
+	if err != nil {
 		return
 	}
 	h := sha256.New()
@@ -67,7 +67,7 @@ func (k *Keyfile) ensure(nc net.Conn) (err error) {
 	}
 	if os.IsNotExist(err) || len(k.fname) == 0 {
 		// no keyfile
-		_, err = fmt.Fprintf(nc, "DEST GENERATE\n")
+		_, err = fmt.Fprintf(nc, "DEST GENERATE SIGNATURE_TYPE=%d\n", sigTypeEd25519)
 		r := bufio.NewReader(nc)
 		var line string
 		line, err = r.ReadString(10)
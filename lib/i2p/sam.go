@@ -2,6 +2,7 @@ package i2p
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -42,6 +43,10 @@ func (s *samSession) Addr() net.Addr {
 	return s.keys.Addr()
 }
 
+func (s *samSession) SigningKey() (ed25519.PrivateKey, error) {
+	return s.keys.SigningKey()
+}
+
 func (s *samSession) OpenControlSocket() (n net.Conn, err error) {
 	n, err = net.Dial("tcp", s.addr)
 	if err == nil {
@@ -1,6 +1,7 @@
 package i2p
 
 import (
+	"crypto/ed25519"
 	"net"
 )
 
@@ -19,6 +20,9 @@ type Session interface {
 	// implements network.Network
 	Addr() net.Addr
 
+	// get the key our destination signs with
+	SigningKey() (ed25519.PrivateKey, error)
+
 	// implements network.Network
 	Accept() (net.Conn, error)
 
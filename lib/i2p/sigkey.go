@@ -0,0 +1,101 @@
+package i2p
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// destination signature type for ed25519
+const sigTypeEd25519 = 7
+
+// certificate type carrying key types
+const certTypeKey = 5
+
+// size of destination before its certificate
+const destKeysLen = 384
+
+// error returned for destinations that don't sign with ed25519
+var ErrNotEd25519 = errors.New("destination does not use ed25519 signatures")
+
+// parse the start of a raw destination
+// returns the signature type, encryption type and length of the destination
+func parseDest(buf []byte) (sigType, cryptoType, l int, err error) {
+	if len(buf) < destKeysLen+3 {
+		err = errors.New("destination too short")
+		return
+	}
+	cert := buf[destKeysLen:]
+	certLen := int(binary.BigEndian.Uint16(cert[1:3]))
+	l = destKeysLen + 3 + certLen
+	if len(buf) < l {
+		err = errors.New("destination certificate too short")
+		return
+	}
+	if cert[0] == certTypeKey && certLen >= 4 {
+		sigType = int(binary.BigEndian.Uint16(cert[3:5]))
+		cryptoType = int(binary.BigEndian.Uint16(cert[5:7]))
+	}
+	return
+}
+
+// get the ed25519 public key this destination signs with
+func (a I2PAddr) SigningPublicKey() (pk ed25519.PublicKey, err error) {
+	var buf []byte
+	buf, err = a.decode()
+	if err != nil {
+		return
+	}
+	var sigType int
+	sigType, _, _, err = parseDest(buf)
+	if err == nil && sigType != sigTypeEd25519 {
+		err = ErrNotEd25519
+	}
+	if err == nil {
+		// signing key is right aligned in its field
+		pk = ed25519.PublicKey(append([]byte(nil), buf[destKeysLen-ed25519.PublicKeySize:destKeysLen]...))
+	}
+	return
+}
+
+// get the ed25519 private key our destination signs with
+func (k *Keyfile) SigningKey() (sk ed25519.PrivateKey, err error) {
+	a := I2PAddr(k.privkey)
+	var buf []byte
+	buf, err = a.decode()
+	if err != nil {
+		return
+	}
+	var sigType, cryptoType, l int
+	sigType, cryptoType, l, err = parseDest(buf)
+	if err != nil {
+		return
+	}
+	if sigType != sigTypeEd25519 {
+		err = ErrNotEd25519
+		return
+	}
+	// skip encryption private key
+	switch cryptoType {
+	case 0:
+		l += 256
+	case 4:
+		l += 32
+	default:
+		err = fmt.Errorf("unknown destination encryption type %d", cryptoType)
+		return
+	}
+	if len(buf) < l+ed25519.SeedSize {
+		err = errors.New("private key too short")
+		return
+	}
+	sk = ed25519.NewKeyFromSeed(buf[l : l+ed25519.SeedSize])
+	// must match the public key in the destination
+	pk := buf[destKeysLen-ed25519.PublicKeySize : destKeysLen]
+	if !sk.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(pk)) {
+		sk = nil
+		err = errors.New("signing key does not match destination")
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package i2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+// make an ed25519 destination and its private keys the way the router does
+func testKeys(t *testing.T) (dest []byte, priv []byte, pk ed25519.PublicKey) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest = make([]byte, destKeysLen)
+	rand.Read(dest[:destKeysLen-ed25519.PublicKeySize])
+	copy(dest[destKeysLen-ed25519.PublicKeySize:], pk)
+	dest = append(dest, certTypeKey, 0, 4, 0, sigTypeEd25519, 0, 0)
+	elg := make([]byte, 256)
+	rand.Read(elg)
+	priv = append(append(append([]byte(nil), dest...), elg...), sk.Seed()...)
+	return
+}
+
+func TestSigningKey(t *testing.T) {
+	dest, priv, pk := testKeys(t)
+	k := &Keyfile{
+		pubkey:  i2pB64enc.EncodeToString(dest),
+		privkey: i2pB64enc.EncodeToString(priv),
+	}
+	sk, err := k.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := k.Addr().SigningPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(pk) || !bytes.Equal(sk.Public().(ed25519.PublicKey), pk) {
+		t.Errorf("keys do not match destination")
+	}
+	// b32 of a destination with a key certificate is the hash of the whole destination
+	h := sha256.Sum256(dest)
+	var b32 Base32Addr
+	copy(b32[:], h[:])
+	if k.Addr().Base32Addr() != b32 {
+		t.Errorf("bad b32 address %s", k.Addr().Base32Addr())
+	}
+	// dsa destinations can't sign
+	dest[destKeysLen] = 0
+	if _, err = I2PAddr(i2pB64enc.EncodeToString(dest)).SigningPublicKey(); err != ErrNotEd25519 {
+		t.Errorf("expected ErrNotEd25519, got %v", err)
+	}
+}
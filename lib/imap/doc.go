@@ -0,0 +1,2 @@
+// imap4rev1 server implementation
+package imap
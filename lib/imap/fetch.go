@@ -0,0 +1,346 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// date format used for internal dates
+const internalDateFormat = "02-Jan-2006 15:04:05 -0700"
+
+// date format clients use in APPEND, the day may be space padded
+const appendDateFormat = "_2-Jan-2006 15:04:05 -0700"
+
+// 1 requested fetch attribute
+type fetchItem struct {
+	// attribute name like FLAGS or BODY
+	name string
+	// for BODY[...]: the section spec
+	section string
+	// is there a section at all
+	hasSection bool
+	// don't set seen flag
+	peek bool
+	// partial fetch
+	partial       bool
+	start, length int
+}
+
+// expand fetch macros and parse fetch attributes
+func parseFetchItems(a arg) (items []fetchItem, err error) {
+	var args []arg
+	if a.kind == argList {
+		args = a.list
+	} else {
+		switch a.upper() {
+		case "ALL":
+			args = atoms("FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE")
+		case "FAST":
+			args = atoms("FLAGS", "INTERNALDATE", "RFC822.SIZE")
+		case "FULL":
+			args = atoms("FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY")
+		default:
+			args = []arg{a}
+		}
+	}
+	for _, a := range args {
+		if a.kind != argAtom {
+			err = errBadSyntax
+			return
+		}
+		var item fetchItem
+		item, err = parseFetchItem(a.str)
+		if err != nil {
+			return
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+func atoms(names ...string) (args []arg) {
+	for _, n := range names {
+		args = append(args, arg{kind: argAtom, str: n})
+	}
+	return
+}
+
+// parse 1 fetch attribute like BODY.PEEK[HEADER.FIELDS (From)]<0.100>
+func parseFetchItem(s string) (item fetchItem, err error) {
+	idx := strings.Index(s, "[")
+	if idx == -1 {
+		item.name = strings.ToUpper(s)
+		switch item.name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		default:
+			err = errBadSyntax
+		}
+		return
+	}
+	item.name = strings.ToUpper(s[:idx])
+	if item.name == "BODY.PEEK" {
+		item.name = "BODY"
+		item.peek = true
+	} else if item.name != "BODY" {
+		err = errBadSyntax
+		return
+	}
+	end := strings.LastIndex(s, "]")
+	if end < idx {
+		err = errBadSyntax
+		return
+	}
+	item.hasSection = true
+	item.section = s[idx+1 : end]
+	rest := s[end+1:]
+	if len(rest) > 0 {
+		if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+			err = errBadSyntax
+			return
+		}
+		nums := strings.SplitN(rest[1:len(rest)-1], ".", 2)
+		if len(nums) != 2 {
+			err = errBadSyntax
+			return
+		}
+		item.partial = true
+		item.start, err = strconv.Atoi(nums[0])
+		if err == nil {
+			item.length, err = strconv.Atoi(nums[1])
+		}
+		if err != nil || item.start < 0 || item.length < 0 {
+			err = errBadSyntax
+		}
+	}
+	return
+}
+
+// does fetching this item set the seen flag?
+func (item fetchItem) setsSeen() bool {
+	return (item.name == "BODY" && item.hasSection && !item.peek) || item.name == "RFC822" || item.name == "RFC822.TEXT"
+}
+
+// does fetching this item need the message content?
+// the rest comes from the maildir index
+func (item fetchItem) needsContent() bool {
+	switch item.name {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE":
+		return false
+	}
+	return true
+}
+
+// get the content of a body section of a message
+func sectionContent(p *part, section string) (data []byte, err error) {
+	spec := strings.ToUpper(section)
+	var path []int
+	// parse leading part numbers
+	for len(spec) > 0 && spec[0] >= '0' && spec[0] <= '9' {
+		idx := strings.Index(spec, ".")
+		num := spec
+		if idx != -1 {
+			num = spec[:idx]
+			spec = spec[idx+1:]
+		} else {
+			spec = ""
+		}
+		var n int
+		n, err = strconv.Atoi(num)
+		if err != nil {
+			return
+		}
+		path = append(path, n)
+		// keep the original case of the remaining section for field names
+		section = section[len(section)-len(spec):]
+	}
+	target := p.find(path)
+	if target == nil {
+		// no such part, send empty data
+		return
+	}
+	// the message that HEADER and TEXT refer to
+	msg := target
+	if len(path) > 0 {
+		msg = target.message
+	}
+	switch {
+	case spec == "":
+		if len(path) == 0 {
+			data = target.raw()
+		} else {
+			data = target.body
+		}
+	case spec == "MIME":
+		if len(path) == 0 {
+			err = errBadSyntax
+		} else {
+			data = target.rawHeader
+		}
+	case spec == "HEADER":
+		if msg != nil {
+			data = msg.rawHeader
+		}
+	case spec == "TEXT":
+		if msg != nil {
+			data = msg.body
+		}
+	case strings.HasPrefix(spec, "HEADER.FIELDS"):
+		not := strings.HasPrefix(spec, "HEADER.FIELDS.NOT")
+		open := strings.Index(section, "(")
+		close := strings.LastIndex(section, ")")
+		if open == -1 || close < open {
+			err = errBadSyntax
+			return
+		}
+		var fields []string
+		for _, f := range strings.Fields(section[open+1 : close]) {
+			fields = append(fields, strings.Trim(f, "\""))
+		}
+		if msg != nil {
+			data = msg.headerFields(fields, not)
+		}
+	default:
+		err = errBadSyntax
+	}
+	return
+}
+
+// format an address list for an envelope
+func envelopeAddrs(h string) string {
+	if h == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(h)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var parts []string
+	for _, a := range addrs {
+		mbox, host := a.Address, ""
+		if idx := strings.LastIndex(a.Address, "@"); idx != -1 {
+			mbox, host = a.Address[:idx], a.Address[idx+1:]
+		}
+		parts = append(parts, fmt.Sprintf("(%s NIL %s %s)", nstring(a.Name), nstring(mbox), nstring(host)))
+	}
+	return "(" + strings.Join(parts, "") + ")"
+}
+
+// build the envelope structure of a message
+func envelope(p *part) string {
+	h := p.header
+	return formatEnvelope(mailstore.Envelope{
+		Date:      h.Get("Date"),
+		Subject:   h.Get("Subject"),
+		From:      h.Get("From"),
+		Sender:    h.Get("Sender"),
+		ReplyTo:   h.Get("Reply-To"),
+		To:        h.Get("To"),
+		Cc:        h.Get("Cc"),
+		Bcc:       h.Get("Bcc"),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageID: h.Get("Message-Id"),
+	})
+}
+
+// format an envelope structure
+func formatEnvelope(e mailstore.Envelope) string {
+	sender := e.Sender
+	if sender == "" {
+		sender = e.From
+	}
+	replyTo := e.ReplyTo
+	if replyTo == "" {
+		replyTo = e.From
+	}
+	fields := []string{
+		nstring(e.Date),
+		nstring(e.Subject),
+		envelopeAddrs(e.From),
+		envelopeAddrs(sender),
+		envelopeAddrs(replyTo),
+		envelopeAddrs(e.To),
+		envelopeAddrs(e.Cc),
+		envelopeAddrs(e.Bcc),
+		nstring(e.InReplyTo),
+		nstring(e.MessageID),
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// format mime parameters as a list
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// format the content disposition of a part
+func disposition(p *part) string {
+	d, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+	if err != nil || d == "" {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)", quote(strings.ToUpper(d)), paramList(params))
+}
+
+// build the body structure of a part, ext includes extension data
+func bodyStructure(p *part, ext bool) string {
+	var buf bytes.Buffer
+	if len(p.children) > 0 {
+		buf.WriteString("(")
+		for _, c := range p.children {
+			buf.WriteString(bodyStructure(c, ext))
+		}
+		sub := strings.ToUpper(p.mediaType[strings.Index(p.mediaType, "/")+1:])
+		buf.WriteString(" " + quote(sub))
+		if ext {
+			fmt.Fprintf(&buf, " %s %s NIL", paramList(p.params), disposition(p))
+		}
+		buf.WriteString(")")
+		return buf.String()
+	}
+	typ, sub := p.mediaType, ""
+	if idx := strings.Index(p.mediaType, "/"); idx != -1 {
+		typ, sub = p.mediaType[:idx], p.mediaType[idx+1:]
+	}
+	encoding := p.header.Get("Content-Transfer-Encoding")
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fmt.Fprintf(&buf, "(%s %s %s %s %s %s %d",
+		quote(strings.ToUpper(typ)), quote(strings.ToUpper(sub)), paramList(p.params),
+		nstring(p.header.Get("Content-Id")), nstring(p.header.Get("Content-Description")),
+		quote(strings.ToUpper(encoding)), len(p.body))
+	if p.message != nil {
+		fmt.Fprintf(&buf, " %s %s %d", envelope(p.message), bodyStructure(p.message, ext), countLines(p.body))
+	} else if strings.ToLower(typ) == "text" {
+		fmt.Fprintf(&buf, " %d", countLines(p.body))
+	}
+	if ext {
+		fmt.Fprintf(&buf, " %s %s NIL", nstring(p.header.Get("Content-Md5")), disposition(p))
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// format the internal date of a message
+func internalDate(t time.Time) string {
+	return quote(t.Format(internalDateFormat))
+}
@@ -0,0 +1,103 @@
+package imap
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"sort"
+	"strings"
+)
+
+// separates nested mailbox names, the same as Maildir++ folders
+const hierarchyDelim = "."
+
+// a mailbox in a LIST response
+type listEntry struct {
+	name  string
+	attrs []string
+}
+
+// get the maildir of a mailbox, ok is false if it doesn't exist
+// every mailbox but INBOX is a Maildir++ folder of the user's maildir
+func (p *imapSession) mailDir(name string) (md maildir.MailDir, ok bool) {
+	if isInbox(name) {
+		return p.md, true
+	}
+	if !p.md.HasFolder(name) {
+		return
+	}
+	md, err := p.md.Folder(name)
+	return md, err == nil
+}
+
+// check if the selected mailbox is a folder or inside it
+func (p *imapSession) inUse(name string) bool {
+	if p.mb == nil {
+		return false
+	}
+	f, err := p.md.Folder(name)
+	if err != nil {
+		return false
+	}
+	sel := p.mb.md.Filepath()
+	return sel == f.Filepath() || strings.HasPrefix(sel, f.Filepath()+hierarchyDelim)
+}
+
+// list all mailboxes of the logged in user with their attributes, INBOX first
+// parents of nested folders that don't exist themselves are listed as \Noselect
+func (p *imapSession) mailboxes() (entries []listEntry, err error) {
+	var folders []string
+	folders, err = p.md.Folders()
+	if err != nil {
+		return
+	}
+	exists := make(map[string]bool)
+	for _, name := range folders {
+		if isInbox(name) {
+			continue
+		}
+		exists[name] = true
+	}
+	all := make(map[string]bool)
+	for name := range exists {
+		all[name] = true
+		for idx := range name {
+			if name[idx] == hierarchyDelim[0] {
+				all[name[:idx]] = true
+			}
+		}
+	}
+	parents := make(map[string]bool)
+	var names []string
+	for name := range all {
+		names = append(names, name)
+		if idx := strings.LastIndex(name, hierarchyDelim); idx > 0 {
+			parents[name[:idx]] = true
+		}
+	}
+	sort.Strings(names)
+	entries = append(entries, listEntry{name: inboxName, attrs: []string{`\HasNoChildren`}})
+	for _, name := range names {
+		var attrs []string
+		if !exists[name] {
+			attrs = append(attrs, `\Noselect`)
+		}
+		if parents[name] {
+			attrs = append(attrs, `\HasChildren`)
+		} else {
+			attrs = append(attrs, `\HasNoChildren`)
+		}
+		if name == mailstore.JunkFolder {
+			attrs = append(attrs, `\Junk`)
+		}
+		entries = append(entries, listEntry{name: name, attrs: attrs})
+	}
+	return
+}
+
+// format a mailbox name for a response
+func mailboxName(name string) string {
+	if isInbox(name) {
+		return inboxName
+	}
+	return quote(name)
+}
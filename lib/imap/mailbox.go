@@ -0,0 +1,360 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the file inside a maildir that holds uid assignments
+const uidListFile = "bdsmail-uidlist"
+
+// the user's maildir, other mailboxes are its folders
+const inboxName = "INBOX"
+
+// lock held while reading or writing any uid list
+var uidListMtx sync.Mutex
+
+// persistent mapping of maildir unique names to imap uids
+type uidList struct {
+	validity uint32
+	next     uint32
+	uids     map[string]uint32
+}
+
+func uidListPath(md maildir.MailDir) string {
+	return filepath.Join(md.Filepath(), uidListFile)
+}
+
+// load the uid list of a maildir, creates a fresh one if it does not exist
+func loadUIDList(md maildir.MailDir) (l *uidList, err error) {
+	l = &uidList{
+		uids: make(map[string]uint32),
+	}
+	var f *os.File
+	f, err = os.Open(uidListPath(md))
+	if os.IsNotExist(err) {
+		err = nil
+		l.validity = uint32(time.Now().Unix())
+		l.next = 1
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if sc.Scan() {
+		_, err = fmt.Sscanf(sc.Text(), "%d %d", &l.validity, &l.next)
+		if err != nil {
+			err = fmt.Errorf("bad uid list header: %s", err.Error())
+			return
+		}
+	}
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var uid uint64
+		uid, err = strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return
+		}
+		l.uids[parts[1]] = uint32(uid)
+	}
+	err = sc.Err()
+	return
+}
+
+// store the uid list of a maildir atomically
+func (l *uidList) store(md maildir.MailDir) (err error) {
+	fname := uidListPath(md)
+	tmp := fname + ".tmp"
+	var f *os.File
+	f, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%d %d\n", l.validity, l.next)
+	for name, uid := range l.uids {
+		fmt.Fprintf(w, "%d %s\n", uid, name)
+	}
+	err = w.Flush()
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	} else {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// 1 message in a selected mailbox
+type message struct {
+	uid    uint32
+	msg    maildir.Message
+	recent bool
+	// size, delivery time and envelope from the maildir index
+	info mailstore.MessageInfo
+}
+
+// imap flags on this message
+func (m *message) flags() (flags []string) {
+	for _, f := range m.msg.GetFlags() {
+		if name, ok := flagToIMAP[f]; ok {
+			flags = append(flags, name)
+		}
+	}
+	if m.recent {
+		flags = append(flags, `\Recent`)
+	}
+	return
+}
+
+// check if this message has a maildir flag set
+func (m *message) hasFlag(flag maildir.Flag) bool {
+	return m.msg.HasFlag(flag)
+}
+
+// mapping from maildir flags to imap system flags
+var flagToIMAP = map[maildir.Flag]string{
+	maildir.Seen:    `\Seen`,
+	maildir.Replied: `\Answered`,
+	maildir.Flagged: `\Flagged`,
+	maildir.Trashed: `\Deleted`,
+	maildir.Draft:   `\Draft`,
+}
+
+// mapping from upper case imap system flags to maildir flags
+var flagFromIMAP = map[string]maildir.Flag{
+	`\SEEN`:     maildir.Seen,
+	`\ANSWERED`: maildir.Replied,
+	`\FLAGGED`:  maildir.Flagged,
+	`\DELETED`:  maildir.Trashed,
+	`\DRAFT`:    maildir.Draft,
+}
+
+// imap flags we can store
+const permanentFlags = `\Seen \Answered \Flagged \Deleted \Draft`
+
+// a selected mailbox
+type mailbox struct {
+	md       maildir.MailDir
+	readOnly bool
+	validity uint32
+	next     uint32
+	msgs     []*message
+}
+
+// scan the maildir, moving new messages to cur and assigning uids to them
+// returns all messages sorted by uid
+func scanMailDir(md maildir.MailDir) (msgs []*message, validity, next uint32, err error) {
+	uidListMtx.Lock()
+	defer uidListMtx.Unlock()
+	var l *uidList
+	l, err = loadUIDList(md)
+	if err != nil {
+		return
+	}
+	recent := make(map[string]bool)
+	news, err := md.ListNew()
+	if err != nil {
+		return
+	}
+	for _, n := range news {
+		var m maildir.Message
+		m, err = md.ProcessNew(maildir.Message(n.Filepath()))
+		if err == nil {
+			recent[m.Name()] = true
+		}
+	}
+	var infos []mailstore.MessageInfo
+	infos, err = md.ListInfo()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		if info.New {
+			// arrived after we processed new
+			continue
+		}
+		name := info.Name
+		uid, ok := l.uids[name]
+		if !ok {
+			uid = l.next
+			l.next++
+			l.uids[name] = uid
+		}
+		seen[name] = true
+		msgs = append(msgs, &message{
+			uid:    uid,
+			msg:    maildir.Message(info.Message.Filepath()),
+			recent: recent[name],
+			info:   info,
+		})
+	}
+	// forget messages that are gone
+	for name := range l.uids {
+		if !seen[name] {
+			delete(l.uids, name)
+		}
+	}
+	err = l.store(md)
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].uid < msgs[j].uid
+	})
+	validity, next = l.validity, l.next
+	return
+}
+
+// open a mailbox from a maildir
+func openMailbox(md maildir.MailDir, readOnly bool) (mb *mailbox, err error) {
+	mb = &mailbox{
+		md:       md,
+		readOnly: readOnly,
+	}
+	mb.msgs, mb.validity, mb.next, err = scanMailDir(md)
+	return
+}
+
+// number of recent messages
+func (mb *mailbox) recent() (n int) {
+	for _, m := range mb.msgs {
+		if m.recent {
+			n++
+		}
+	}
+	return
+}
+
+// number of messages without the seen flag
+func (mb *mailbox) unseen() (n int) {
+	for _, m := range mb.msgs {
+		if !m.hasFlag(maildir.Seen) {
+			n++
+		}
+	}
+	return
+}
+
+// sequence number of the first message without the seen flag or 0
+func (mb *mailbox) firstUnseen() int {
+	for idx, m := range mb.msgs {
+		if !m.hasFlag(maildir.Seen) {
+			return idx + 1
+		}
+	}
+	return 0
+}
+
+// highest uid in this mailbox or 0 if empty
+func (mb *mailbox) maxUID() uint32 {
+	if len(mb.msgs) == 0 {
+		return 0
+	}
+	return mb.msgs[len(mb.msgs)-1].uid
+}
+
+// rescan the maildir, calls expunged with the sequence number of each message that vanished
+// returns the number of new messages found
+func (mb *mailbox) rescan(expunged func(seq int) error) (added int, err error) {
+	var msgs []*message
+	msgs, mb.validity, mb.next, err = scanMailDir(mb.md)
+	if err != nil {
+		return
+	}
+	byUID := make(map[uint32]*message)
+	for _, m := range msgs {
+		byUID[m.uid] = m
+	}
+	// report vanished messages
+	idx := 0
+	for idx < len(mb.msgs) {
+		m, ok := byUID[mb.msgs[idx].uid]
+		if ok {
+			// keep session recent flag and update path
+			mb.msgs[idx].msg = m.msg
+			mb.msgs[idx].info = m.info
+			delete(byUID, m.uid)
+			idx++
+		} else {
+			mb.msgs = append(mb.msgs[:idx], mb.msgs[idx+1:]...)
+			err = expunged(idx + 1)
+			if err != nil {
+				return
+			}
+		}
+	}
+	// append new messages
+	for _, m := range msgs {
+		if _, ok := byUID[m.uid]; ok {
+			mb.msgs = append(mb.msgs, m)
+			added++
+		}
+	}
+	return
+}
+
+// set the imap flags of a message, keeping maildir flags imap does not know about
+func (mb *mailbox) setFlags(m *message, flags []maildir.Flag) (err error) {
+	var keep []maildir.Flag
+	for _, f := range m.msg.GetFlags() {
+		if _, ok := flagToIMAP[f]; !ok {
+			keep = append(keep, f)
+		}
+	}
+	flags = append(keep, flags...)
+	uidListMtx.Lock()
+	m.msg, err = mb.md.SetFlags(m.msg, flags...)
+	uidListMtx.Unlock()
+	return
+}
+
+// add or remove flags of a message
+func (mb *mailbox) changeFlags(m *message, flags []maildir.Flag, add bool) (err error) {
+	uidListMtx.Lock()
+	if add {
+		m.msg, err = mb.md.AddFlags(m.msg, flags...)
+	} else {
+		m.msg, err = mb.md.RemoveFlags(m.msg, flags...)
+	}
+	uidListMtx.Unlock()
+	return
+}
+
+// remove all messages marked deleted, calls expunged with the sequence number of each
+func (mb *mailbox) expunge(expunged func(seq int) error) (err error) {
+	idx := 0
+	for idx < len(mb.msgs) {
+		m := mb.msgs[idx]
+		if m.hasFlag(maildir.Trashed) {
+			err = mb.md.Remove(m.msg)
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+			mb.msgs = append(mb.msgs[:idx], mb.msgs[idx+1:]...)
+			if expunged != nil {
+				err = expunged(idx + 1)
+				if err != nil {
+					return
+				}
+			} else {
+				err = nil
+			}
+		} else {
+			idx++
+		}
+	}
+	return
+}
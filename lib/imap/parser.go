@@ -0,0 +1,417 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// max size of a whole command including literals from a client that has not logged in
+const maxUnauthCommandSize = 64 * 1024
+
+// default max size of a whole command including literals from a client that logged in
+const DefaultMaxCommandSize = 64 * 1024 * 1024
+
+var errBadSyntax = errors.New("syntax error")
+
+// error reading a command bigger than the size limit
+type tooBigError struct {
+	// the command read so far
+	line []byte
+	// the client waits for a continuation request that we won't send
+	// so the session can go on, otherwise it's sending data we can't find the end of
+	recoverable bool
+}
+
+func (e *tooBigError) Error() string {
+	return "command too big"
+}
+
+// kind of parsed argument
+type argKind int
+
+const (
+	argAtom argKind = iota
+	argString
+	argList
+)
+
+// 1 parsed argument of an imap command
+type arg struct {
+	kind argKind
+	// value of atom or string
+	str string
+	// members of a parenthesized or bracketed list
+	list []arg
+}
+
+// is this argument the nil atom?
+func (a arg) isNil() bool {
+	return a.kind == argAtom && strings.ToUpper(a.str) == "NIL"
+}
+
+// get the upper case value of an atom or string
+func (a arg) upper() string {
+	return strings.ToUpper(a.str)
+}
+
+// a command sent by a client
+type command struct {
+	tag  string
+	name string
+	args []arg
+}
+
+// read 1 line without its line ending, fails with a *tooBigError if it's longer than limit
+func readLine(r *bufio.Reader, limit int) (l []byte, err error) {
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\n')
+		l = append(l, chunk...)
+		if len(bytes.TrimRight(l, "\r\n")) > limit {
+			return nil, &tooBigError{line: l}
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	l = bytes.TrimRight(l, "\r\n")
+	return
+}
+
+// read 1 full command line from a client including any literals
+// the command can be at most limit bytes, a *tooBigError is returned for bigger ones
+// before the continuation request for a literal going over the limit is sent
+// cont is called when the client waits for a continuation request
+func readCommand(r *bufio.Reader, limit int, cont func() error) (line []byte, err error) {
+	for {
+		var l []byte
+		l, err = readLine(r, limit-len(line))
+		if e, ok := err.(*tooBigError); ok {
+			e.line = append(line, e.line...)
+		}
+		if err != nil {
+			return
+		}
+		line = append(line, l...)
+		// check for trailing literal
+		n, sync, ok := trailingLiteral(string(l))
+		if !ok {
+			return
+		}
+		if n > int64(limit-len(line)) {
+			err = &tooBigError{line: line, recoverable: sync}
+			return
+		}
+		if sync {
+			err = cont()
+			if err != nil {
+				return
+			}
+		}
+		line = append(line, '\r', '\n')
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return
+		}
+		line = append(line, buf...)
+	}
+}
+
+// check if a line ends with a literal marker {n} or {n+}
+func trailingLiteral(l string) (n int64, sync, ok bool) {
+	if !strings.HasSuffix(l, "}") {
+		return
+	}
+	idx := strings.LastIndex(l, "{")
+	if idx == -1 {
+		return
+	}
+	s := l[idx+1 : len(l)-1]
+	sync = true
+	if strings.HasSuffix(s, "+") {
+		sync = false
+		s = s[:len(s)-1]
+	}
+	var err error
+	n, err = strconv.ParseInt(s, 10, 64)
+	ok = err == nil && n >= 0
+	return
+}
+
+// parse a full command line into a command
+func parseCommand(line []byte) (cmd *command, err error) {
+	p := &argParser{data: line}
+	cmd = new(command)
+	cmd.tag = p.atom()
+	if len(cmd.tag) == 0 || !p.space() {
+		err = errBadSyntax
+		return
+	}
+	cmd.name = strings.ToUpper(p.atom())
+	if len(cmd.name) == 0 {
+		err = errBadSyntax
+		return
+	}
+	if cmd.name == "UID" {
+		// the uid command prefixes another command
+		if !p.space() {
+			err = errBadSyntax
+			return
+		}
+		cmd.name = "UID " + strings.ToUpper(p.atom())
+	}
+	for err == nil && p.space() {
+		var a arg
+		a, err = p.arg()
+		if err == nil {
+			cmd.args = append(cmd.args, a)
+		}
+	}
+	if err == nil && !p.done() {
+		err = errBadSyntax
+	}
+	return
+}
+
+// parser of command arguments
+type argParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *argParser) done() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *argParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// consume 1 space, returns false if there was none
+func (p *argParser) space() bool {
+	if p.peek() == ' ' {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// read an atom, brackets are allowed inside atoms so BODY[HEADER] is 1 atom
+func (p *argParser) atom() string {
+	start := p.pos
+	depth := 0
+	for !p.done() {
+		c := p.peek()
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '{' || c == '"' || c < 0x20) {
+			break
+		} else if depth > 0 && (c == '\r' || c == '\n') {
+			break
+		}
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// read a quoted string
+func (p *argParser) quoted() (s string, err error) {
+	// skip opening quote
+	p.pos++
+	var b []byte
+	for {
+		if p.done() {
+			err = errBadSyntax
+			return
+		}
+		c := p.data[p.pos]
+		p.pos++
+		if c == '"' {
+			break
+		}
+		if c == '\\' {
+			if p.done() {
+				err = errBadSyntax
+				return
+			}
+			c = p.data[p.pos]
+			p.pos++
+		}
+		b = append(b, c)
+	}
+	s = string(b)
+	return
+}
+
+// read a literal string
+func (p *argParser) literal() (s string, err error) {
+	idx := strings.Index(string(p.data[p.pos:]), "}")
+	if idx == -1 {
+		err = errBadSyntax
+		return
+	}
+	n, _, ok := trailingLiteral(string(p.data[p.pos : p.pos+idx+1]))
+	if !ok {
+		err = errBadSyntax
+		return
+	}
+	p.pos += idx + 1
+	if !strings.HasPrefix(string(p.data[p.pos:]), "\r\n") {
+		err = errBadSyntax
+		return
+	}
+	p.pos += 2
+	if int64(len(p.data)-p.pos) < n {
+		err = errBadSyntax
+		return
+	}
+	s = string(p.data[p.pos : p.pos+int(n)])
+	p.pos += int(n)
+	return
+}
+
+// read a parenthesized list
+func (p *argParser) list() (l []arg, err error) {
+	// skip opening paren
+	p.pos++
+	for err == nil {
+		if p.peek() == ')' {
+			p.pos++
+			return
+		}
+		if p.done() {
+			err = errBadSyntax
+			return
+		}
+		if len(l) > 0 && !p.space() {
+			err = errBadSyntax
+			return
+		}
+		var a arg
+		a, err = p.arg()
+		if err == nil {
+			l = append(l, a)
+		}
+	}
+	return
+}
+
+// read 1 argument
+func (p *argParser) arg() (a arg, err error) {
+	switch p.peek() {
+	case '"':
+		a.kind = argString
+		a.str, err = p.quoted()
+	case '{':
+		a.kind = argString
+		a.str, err = p.literal()
+	case '(':
+		a.kind = argList
+		a.list, err = p.list()
+	case 0, ' ', ')':
+		err = errBadSyntax
+	default:
+		a.kind = argAtom
+		a.str = p.atom()
+		if len(a.str) == 0 {
+			err = errBadSyntax
+		}
+	}
+	return
+}
+
+// quote a string for sending to a client
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") || len(s) > 1024 {
+		return literal(s)
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// quote a string or send NIL if it's empty
+func nstring(s string) string {
+	if len(s) == 0 {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+// format a string as a literal
+func literal(s string) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+}
+
+// a range in a sequence set, 0 means '*'
+type seqRange struct {
+	start, stop uint32
+}
+
+// a set of sequence numbers or uids
+type seqSet []seqRange
+
+// parse a sequence set like 1:4,7,9:*
+func parseSeqSet(s string) (set seqSet, err error) {
+	for _, part := range strings.Split(s, ",") {
+		var r seqRange
+		bounds := strings.SplitN(part, ":", 2)
+		r.start, err = parseSeqNum(bounds[0])
+		if err != nil {
+			return
+		}
+		r.stop = r.start
+		if len(bounds) == 2 {
+			r.stop, err = parseSeqNum(bounds[1])
+			if err != nil {
+				return
+			}
+		}
+		set = append(set, r)
+	}
+	return
+}
+
+func parseSeqNum(s string) (n uint32, err error) {
+	if s == "*" {
+		return
+	}
+	var i uint64
+	i, err = strconv.ParseUint(s, 10, 32)
+	if err == nil && i == 0 {
+		err = errBadSyntax
+	}
+	n = uint32(i)
+	return
+}
+
+// check if a number is in this set, max is the value of '*'
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if n >= start && n <= stop {
+			return true
+		}
+	}
+	return false
+}
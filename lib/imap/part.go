@@ -0,0 +1,200 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// a parsed mime entity, either a whole message or a body part
+type part struct {
+	// raw header including the blank line ending it
+	rawHeader []byte
+	// parsed header
+	header textproto.MIMEHeader
+	// raw body
+	body []byte
+	// media type and parameters
+	mediaType string
+	params    map[string]string
+	// body parts of a multipart entity
+	children []*part
+	// encapsulated message of a message/rfc822 entity
+	message *part
+}
+
+// read a message file and parse it
+func loadPart(fname string) (p *part, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err == nil {
+		p = parsePart(toCRLF(data), "text/plain")
+	}
+	return
+}
+
+// convert bare line feeds to CRLF
+func toCRLF(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(data) + len(data)/32)
+	for idx, c := range data {
+		if c == '\n' && (idx == 0 || data[idx-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+// parse a mime entity, defType is the media type to use if it has no content type
+func parsePart(data []byte, defType string) (p *part) {
+	p = new(part)
+	idx := bytes.Index(data, []byte("\r\n\r\n"))
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		// no header at all
+		p.rawHeader = data[:2]
+		p.body = data[2:]
+	} else if idx == -1 {
+		p.rawHeader = data
+	} else {
+		p.rawHeader = data[:idx+4]
+		p.body = data[idx+4:]
+	}
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.rawHeader)))
+	p.header, _ = r.ReadMIMEHeader()
+	if p.header == nil {
+		p.header = make(textproto.MIMEHeader)
+	}
+	var err error
+	p.mediaType, p.params, err = mime.ParseMediaType(p.header.Get("Content-Type"))
+	if err != nil || p.mediaType == "" {
+		p.mediaType = defType
+		p.params = make(map[string]string)
+		if defType == "text/plain" {
+			p.params["charset"] = "us-ascii"
+		}
+	}
+	if strings.HasPrefix(p.mediaType, "multipart/") {
+		childType := "text/plain"
+		if p.mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for _, c := range splitMultipart(p.body, p.params["boundary"]) {
+			p.children = append(p.children, parsePart(c, childType))
+		}
+	} else if p.mediaType == "message/rfc822" {
+		p.message = parsePart(p.body, "text/plain")
+	}
+	return
+}
+
+// split the body of a multipart entity into its raw parts
+func splitMultipart(body []byte, boundary string) (parts [][]byte) {
+	if boundary == "" {
+		return
+	}
+	delim := []byte("--" + boundary)
+	var start = -1
+	pos := 0
+	for pos < len(body) {
+		end := bytes.Index(body[pos:], []byte("\r\n"))
+		var line []byte
+		next := len(body)
+		if end == -1 {
+			line = body[pos:]
+		} else {
+			line = body[pos : pos+end]
+			next = pos + end + 2
+		}
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			if start != -1 {
+				// the CRLF before the delimiter belongs to the delimiter
+				stop := pos - 2
+				if stop < start {
+					stop = start
+				}
+				parts = append(parts, body[start:stop])
+			}
+			if bytes.Equal(rest, []byte("--")) {
+				return
+			}
+			if len(rest) == 0 {
+				start = next
+			}
+		}
+		pos = next
+	}
+	return
+}
+
+// count lines in a body
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// find a nested part given a part number path like 1.2.3
+func (p *part) find(path []int) *part {
+	cur := p
+	for idx, n := range path {
+		if idx > 0 && cur.message != nil {
+			// part numbers below a message/rfc822 part refer to the encapsulated message
+			cur = cur.message
+		}
+		if len(cur.children) == 0 {
+			// non multipart entities only have part 1
+			if n != 1 {
+				return nil
+			}
+			continue
+		}
+		if n < 1 || n > len(cur.children) {
+			return nil
+		}
+		cur = cur.children[n-1]
+	}
+	return cur
+}
+
+// get the header lines for a list of fields
+func (p *part) headerFields(fields []string, not bool) []byte {
+	want := make(map[string]bool)
+	for _, f := range fields {
+		want[textproto.CanonicalMIMEHeaderKey(f)] = true
+	}
+	var buf bytes.Buffer
+	include := false
+	for _, line := range bytes.SplitAfter(p.rawHeader, []byte("\r\n")) {
+		if len(line) == 0 || bytes.Equal(line, []byte("\r\n")) {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			idx := bytes.IndexByte(line, ':')
+			if idx == -1 {
+				include = false
+				continue
+			}
+			name := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:idx])))
+			include = want[name] != not
+		}
+		if include {
+			buf.Write(line)
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// get the whole raw entity
+func (p *part) raw() []byte {
+	b := make([]byte, 0, len(p.rawHeader)+len(p.body))
+	b = append(b, p.rawHeader...)
+	return append(b, p.body...)
+}
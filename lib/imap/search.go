@@ -0,0 +1,282 @@
+package imap
+
+import (
+	"bytes"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// date format used in search criteria
+const searchDateFormat = "2-Jan-2006"
+
+// context for matching 1 message against search criteria
+type searchContext struct {
+	mb  *mailbox
+	seq uint32
+	m   *message
+	// lazily loaded content
+	p    *part
+	perr error
+}
+
+// get parsed message content
+func (ctx *searchContext) content() *part {
+	if ctx.p == nil && ctx.perr == nil {
+		ctx.p, ctx.perr = loadPart(ctx.m.msg.Filepath())
+	}
+	if ctx.p == nil {
+		return &part{}
+	}
+	return ctx.p
+}
+
+// a search criterion
+type searchKey func(ctx *searchContext) bool
+
+// parse all search keys in a SEARCH command, they are and-ed together
+func parseSearch(args []arg) (key searchKey, err error) {
+	if len(args) > 1 && args[0].upper() == "CHARSET" {
+		cs := args[1].upper()
+		if cs != "UTF-8" && cs != "US-ASCII" {
+			err = errBadCharset
+			return
+		}
+		args = args[2:]
+	}
+	var keys []searchKey
+	for len(args) > 0 && err == nil {
+		var k searchKey
+		k, args, err = parseSearchKey(args)
+		keys = append(keys, k)
+	}
+	if err == nil && len(keys) == 0 {
+		err = errBadSyntax
+	}
+	key = and(keys)
+	return
+}
+
+func and(keys []searchKey) searchKey {
+	return func(ctx *searchContext) bool {
+		for _, k := range keys {
+			if !k(ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// match a maildir flag
+func hasFlag(f maildir.Flag, want bool) searchKey {
+	return func(ctx *searchContext) bool {
+		return ctx.m.hasFlag(f) == want
+	}
+}
+
+// match a header substring
+func headerContains(name, s string) searchKey {
+	s = strings.ToLower(s)
+	return func(ctx *searchContext) bool {
+		for _, v := range ctx.content().header[textproto.CanonicalMIMEHeaderKey(name)] {
+			if strings.Contains(strings.ToLower(v), s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// match a substring of an envelope field from the maildir index
+func envelopeContains(field func(*mailstore.Envelope) string, s string) searchKey {
+	s = strings.ToLower(s)
+	return func(ctx *searchContext) bool {
+		return strings.Contains(strings.ToLower(field(&ctx.m.info.Envelope)), s)
+	}
+}
+
+// match the internal date with a comparison
+func internalDateCmp(d time.Time, cmp func(a, b time.Time) bool) searchKey {
+	return func(ctx *searchContext) bool {
+		return cmp(truncDay(ctx.m.info.Date), d)
+	}
+}
+
+// match the sent date with a comparison
+func sentDateCmp(d time.Time, cmp func(a, b time.Time) bool) searchKey {
+	return func(ctx *searchContext) bool {
+		t, err := mail.ParseDate(ctx.m.info.Envelope.Date)
+		if err != nil {
+			return false
+		}
+		return cmp(truncDay(t), d)
+	}
+}
+
+// truncate a time to the start of its day ignoring timezone
+func truncDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func before(a, b time.Time) bool { return a.Before(b) }
+func on(a, b time.Time) bool     { return a.Equal(b) }
+func since(a, b time.Time) bool  { return !a.Before(b) }
+
+// parse 1 search key, returns the remaining arguments
+func parseSearchKey(args []arg) (key searchKey, rest []arg, err error) {
+	a := args[0]
+	rest = args[1:]
+	if a.kind == argList {
+		var keys []searchKey
+		l := a.list
+		for len(l) > 0 && err == nil {
+			var k searchKey
+			k, l, err = parseSearchKey(l)
+			keys = append(keys, k)
+		}
+		key = and(keys)
+		return
+	}
+	// get the next argument as a string
+	next := func() (s string) {
+		if len(rest) == 0 || rest[0].kind == argList {
+			err = errBadSyntax
+			return
+		}
+		s = rest[0].str
+		rest = rest[1:]
+		return
+	}
+	// get the next argument as a date
+	date := func() (t time.Time) {
+		s := next()
+		if err == nil {
+			t, err = time.Parse(searchDateFormat, s)
+		}
+		return
+	}
+	// get the next argument as a number
+	number := func() (n int64) {
+		s := next()
+		if err == nil {
+			n, err = strconv.ParseInt(s, 10, 64)
+		}
+		return
+	}
+	switch a.upper() {
+	case "ALL":
+		key = func(*searchContext) bool { return true }
+	case "ANSWERED":
+		key = hasFlag(maildir.Replied, true)
+	case "UNANSWERED":
+		key = hasFlag(maildir.Replied, false)
+	case "DELETED":
+		key = hasFlag(maildir.Trashed, true)
+	case "UNDELETED":
+		key = hasFlag(maildir.Trashed, false)
+	case "DRAFT":
+		key = hasFlag(maildir.Draft, true)
+	case "UNDRAFT":
+		key = hasFlag(maildir.Draft, false)
+	case "FLAGGED":
+		key = hasFlag(maildir.Flagged, true)
+	case "UNFLAGGED":
+		key = hasFlag(maildir.Flagged, false)
+	case "SEEN":
+		key = hasFlag(maildir.Seen, true)
+	case "UNSEEN":
+		key = hasFlag(maildir.Seen, false)
+	case "RECENT":
+		key = func(ctx *searchContext) bool { return ctx.m.recent }
+	case "OLD":
+		key = func(ctx *searchContext) bool { return !ctx.m.recent }
+	case "NEW":
+		key = func(ctx *searchContext) bool { return ctx.m.recent && !ctx.m.hasFlag(maildir.Seen) }
+	case "KEYWORD":
+		// we don't store keywords
+		next()
+		key = func(*searchContext) bool { return false }
+	case "UNKEYWORD":
+		next()
+		key = func(*searchContext) bool { return true }
+	case "FROM":
+		key = envelopeContains(func(e *mailstore.Envelope) string { return e.From }, next())
+	case "TO":
+		key = envelopeContains(func(e *mailstore.Envelope) string { return e.To }, next())
+	case "CC":
+		key = envelopeContains(func(e *mailstore.Envelope) string { return e.Cc }, next())
+	case "BCC":
+		key = envelopeContains(func(e *mailstore.Envelope) string { return e.Bcc }, next())
+	case "SUBJECT":
+		key = envelopeContains(func(e *mailstore.Envelope) string { return e.Subject }, next())
+	case "HEADER":
+		name := next()
+		key = headerContains(name, next())
+	case "BODY":
+		s := strings.ToLower(next())
+		key = func(ctx *searchContext) bool {
+			return bytes.Contains(bytes.ToLower(ctx.content().body), []byte(s))
+		}
+	case "TEXT":
+		s := strings.ToLower(next())
+		key = func(ctx *searchContext) bool {
+			return bytes.Contains(bytes.ToLower(ctx.content().raw()), []byte(s))
+		}
+	case "BEFORE":
+		key = internalDateCmp(date(), before)
+	case "ON":
+		key = internalDateCmp(date(), on)
+	case "SINCE":
+		key = internalDateCmp(date(), since)
+	case "SENTBEFORE":
+		key = sentDateCmp(date(), before)
+	case "SENTON":
+		key = sentDateCmp(date(), on)
+	case "SENTSINCE":
+		key = sentDateCmp(date(), since)
+	case "LARGER":
+		n := number()
+		key = func(ctx *searchContext) bool { return ctx.m.info.WireSize > n }
+	case "SMALLER":
+		n := number()
+		key = func(ctx *searchContext) bool { return ctx.m.info.WireSize < n }
+	case "UID":
+		var set seqSet
+		set, err = parseSeqSet(next())
+		key = func(ctx *searchContext) bool { return set.contains(ctx.m.uid, ctx.mb.maxUID()) }
+	case "NOT":
+		var k searchKey
+		if len(rest) == 0 {
+			err = errBadSyntax
+			return
+		}
+		k, rest, err = parseSearchKey(rest)
+		key = func(ctx *searchContext) bool { return !k(ctx) }
+	case "OR":
+		var k1, k2 searchKey
+		if len(rest) == 0 {
+			err = errBadSyntax
+			return
+		}
+		k1, rest, err = parseSearchKey(rest)
+		if err == nil && len(rest) == 0 {
+			err = errBadSyntax
+		}
+		if err == nil {
+			k2, rest, err = parseSearchKey(rest)
+		}
+		key = func(ctx *searchContext) bool { return k1(ctx) || k2(ctx) }
+	default:
+		// sequence set
+		var set seqSet
+		set, err = parseSeqSet(a.str)
+		key = func(ctx *searchContext) bool { return set.contains(ctx.seq, uint32(len(ctx.mb.msgs))) }
+	}
+	return
+}
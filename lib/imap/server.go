@@ -0,0 +1,1040 @@
+package imap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/starttls"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadCharset = errors.New("unsupported charset")
+
+// function that authenticates a user
+type UserAuthenticator func(string, string) (bool, error)
+
+// imap server
+type Server struct {
+	// obtains a mail store given a user
+	Local mailstore.MailRouter
+	// login authenticator
+	Auth UserAuthenticator
+	// largest command with its literals a logged in client may send, 0 for DefaultMaxCommandSize
+	// clients that have not logged in can send at most 64KB
+	MaxCommandSize int
+	// server name
+	name string
+	// tls config
+	TLS *tls.Config
+}
+
+func New() *Server {
+	host, _ := os.Hostname()
+	return &Server{
+		name: host,
+	}
+}
+
+func (s *Server) checkUser(user, passwd string) (allowed bool) {
+	if s.Auth != nil {
+		allowed, _ = s.Auth(user, passwd)
+	}
+	return
+}
+
+// get a user's maildir
+func (s *Server) getMailDir(user string) (md maildir.MailDir, err error) {
+	if s.Local == nil {
+		err = errors.New("could't find mail store")
+		return
+	}
+	st, has := s.Local.FindStoreFor(user)
+	if !has {
+		err = errors.New("no such local user")
+		return
+	}
+	var ok bool
+	md, ok = st.(maildir.MailDir)
+	if !ok {
+		err = errors.New("mail store is not a maildir")
+	}
+	return
+}
+
+// serve sessions with connections accepted from a net.Listener
+func (s *Server) Serve(l net.Listener) (err error) {
+	for err == nil {
+		var c net.Conn
+		c, err = l.Accept()
+		if err == nil {
+			p := &imapSession{
+				nc: c,
+				c:  textproto.NewConn(c),
+				s:  s,
+			}
+			go p.Run()
+		}
+	}
+	return
+}
+
+// imap session handler
+type imapSession struct {
+	// network connection
+	nc net.Conn
+	c  *textproto.Conn
+	// parent server
+	s *Server
+	// did we do starttls?
+	tls bool
+	// logged in user
+	user string
+	// logged in user's maildir
+	md maildir.MailDir
+	// selected mailbox or nil
+	mb *mailbox
+}
+
+// command handler, returns a network error if one happens
+type cmdHandler func(p *imapSession, cmd *command) error
+
+const (
+	stateAny = iota
+	stateNotAuthenticated
+	stateAuthenticated
+	stateSelected
+)
+
+type cmdInfo struct {
+	state   int
+	handler cmdHandler
+}
+
+var commands map[string]cmdInfo
+
+func init() {
+	commands = map[string]cmdInfo{
+		"CAPABILITY":   {stateAny, (*imapSession).cmdCapability},
+		"NOOP":         {stateAny, (*imapSession).cmdNoop},
+		"LOGOUT":       {stateAny, (*imapSession).cmdLogout},
+		"STARTTLS":     {stateNotAuthenticated, (*imapSession).cmdStartTLS},
+		"LOGIN":        {stateNotAuthenticated, (*imapSession).cmdLogin},
+		"AUTHENTICATE": {stateNotAuthenticated, (*imapSession).cmdAuthenticate},
+		"SELECT":       {stateAuthenticated, (*imapSession).cmdSelect},
+		"EXAMINE":      {stateAuthenticated, (*imapSession).cmdSelect},
+		"CREATE":       {stateAuthenticated, (*imapSession).cmdCreate},
+		"DELETE":       {stateAuthenticated, (*imapSession).cmdDelete},
+		"RENAME":       {stateAuthenticated, (*imapSession).cmdRename},
+		"SUBSCRIBE":    {stateAuthenticated, (*imapSession).cmdSubscribe},
+		"UNSUBSCRIBE":  {stateAuthenticated, (*imapSession).cmdSubscribe},
+		"LIST":         {stateAuthenticated, (*imapSession).cmdList},
+		"LSUB":         {stateAuthenticated, (*imapSession).cmdList},
+		"STATUS":       {stateAuthenticated, (*imapSession).cmdStatus},
+		"APPEND":       {stateAuthenticated, (*imapSession).cmdAppend},
+		"CHECK":        {stateSelected, (*imapSession).cmdNoop},
+		"CLOSE":        {stateSelected, (*imapSession).cmdClose},
+		"EXPUNGE":      {stateSelected, (*imapSession).cmdExpunge},
+		"SEARCH":       {stateSelected, (*imapSession).cmdSearch},
+		"FETCH":        {stateSelected, (*imapSession).cmdFetch},
+		"STORE":        {stateSelected, (*imapSession).cmdStore},
+		"COPY":         {stateSelected, (*imapSession).cmdCopy},
+		"UID SEARCH":   {stateSelected, (*imapSession).cmdSearch},
+		"UID FETCH":    {stateSelected, (*imapSession).cmdFetch},
+		"UID STORE":    {stateSelected, (*imapSession).cmdStore},
+		"UID COPY":     {stateSelected, (*imapSession).cmdCopy},
+	}
+}
+
+// current session state
+func (p *imapSession) state() int {
+	if p.mb != nil {
+		return stateSelected
+	}
+	if len(p.user) > 0 {
+		return stateAuthenticated
+	}
+	return stateNotAuthenticated
+}
+
+// run imap session mainloop
+func (p *imapSession) Run() {
+	// send banner
+	err := p.untagged("OK [CAPABILITY %s] IMAP4rev1 Server Ready", p.capabilities())
+	if err == nil {
+		err = p.flush()
+	}
+	for err == nil {
+		var line []byte
+		line, err = readCommand(p.c.R, p.maxCommandSize(), p.continuation)
+		if e, ok := err.(*tooBigError); ok {
+			err = p.commandTooBig(e)
+			if err == nil {
+				err = p.flush()
+			}
+			continue
+		}
+		if err != nil {
+			break
+		}
+		var cmd *command
+		cmd, err = parseCommand(line)
+		if err != nil {
+			err = nil
+			if cmd != nil && len(cmd.tag) > 0 {
+				err = p.tagged(cmd.tag, "BAD", "syntax error")
+			} else {
+				err = p.untagged("BAD syntax error")
+			}
+		} else {
+			err = p.dispatch(cmd)
+		}
+		if err == nil {
+			err = p.flush()
+		}
+	}
+	if err != nil && err != io.EOF {
+		log.Errorf("error in imap session: %s", err.Error())
+	}
+	// close connection
+	p.c.Close()
+}
+
+// get the largest command we read in this session
+func (p *imapSession) maxCommandSize() int {
+	if p.state() == stateNotAuthenticated {
+		return maxUnauthCommandSize
+	}
+	if p.s.MaxCommandSize > 0 {
+		return p.s.MaxCommandSize
+	}
+	return DefaultMaxCommandSize
+}
+
+// refuse a command that is too big
+// hangs up if the client is sending data we can't skip
+func (p *imapSession) commandTooBig(e *tooBigError) (err error) {
+	tag := (&argParser{data: e.line}).atom()
+	if e.recoverable && len(tag) > 0 {
+		return p.tagged(tag, "BAD", "[TOOBIG] command too big")
+	}
+	err = p.untagged("BYE command too big")
+	if err == nil {
+		err = p.flush()
+	}
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// run a command
+func (p *imapSession) dispatch(cmd *command) (err error) {
+	info, ok := commands[cmd.name]
+	if !ok {
+		return p.tagged(cmd.tag, "BAD", "unknown command")
+	}
+	state := p.state()
+	switch info.state {
+	case stateNotAuthenticated:
+		if state != stateNotAuthenticated {
+			return p.tagged(cmd.tag, "BAD", "already authenticated")
+		}
+	case stateAuthenticated:
+		if state == stateNotAuthenticated {
+			return p.tagged(cmd.tag, "BAD", "not authenticated")
+		}
+	case stateSelected:
+		if state != stateSelected {
+			return p.tagged(cmd.tag, "BAD", "no mailbox selected")
+		}
+	}
+	return info.handler(p, cmd)
+}
+
+// send continuation request
+func (p *imapSession) continuation() (err error) {
+	_, err = p.c.W.WriteString("+ Ready for literal data\r\n")
+	if err == nil {
+		err = p.flush()
+	}
+	return
+}
+
+func (p *imapSession) flush() error {
+	return p.c.W.Flush()
+}
+
+// send untagged response
+func (p *imapSession) untagged(format string, args ...interface{}) (err error) {
+	_, err = fmt.Fprintf(p.c.W, "* "+format+"\r\n", args...)
+	return
+}
+
+// send tagged response
+func (p *imapSession) tagged(tag, status, msg string) (err error) {
+	_, err = fmt.Fprintf(p.c.W, "%s %s %s\r\n", tag, status, msg)
+	return
+}
+
+// get capability string
+func (p *imapSession) capabilities() string {
+	caps := []string{"IMAP4rev1", "LITERAL+", "CHILDREN", "SPECIAL-USE", "AUTH=PLAIN"}
+	if p.s.TLS != nil && !p.tls {
+		caps = append(caps, "STARTTLS")
+	}
+	return strings.Join(caps, " ")
+}
+
+// send untagged updates about the selected mailbox
+func (p *imapSession) update() (err error) {
+	if p.mb == nil {
+		return
+	}
+	var added int
+	added, err = p.mb.rescan(func(seq int) error {
+		return p.untagged("%d EXPUNGE", seq)
+	})
+	if err != nil {
+		log.Errorf("imap: failed to rescan mailbox: %s", err.Error())
+		return nil
+	}
+	if added > 0 {
+		err = p.untagged("%d EXISTS", len(p.mb.msgs))
+		if err == nil {
+			err = p.untagged("%d RECENT", p.mb.recent())
+		}
+	}
+	return
+}
+
+func (p *imapSession) cmdCapability(cmd *command) (err error) {
+	err = p.untagged("CAPABILITY %s", p.capabilities())
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", "CAPABILITY completed")
+	}
+	return
+}
+
+func (p *imapSession) cmdNoop(cmd *command) (err error) {
+	err = p.update()
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", cmd.name+" completed")
+	}
+	return
+}
+
+func (p *imapSession) cmdLogout(cmd *command) (err error) {
+	err = p.untagged("BYE logging out")
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", "LOGOUT completed")
+	}
+	if err == nil {
+		err = p.flush()
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return
+}
+
+func (p *imapSession) cmdStartTLS(cmd *command) (err error) {
+	if p.s.TLS == nil || p.tls {
+		return p.tagged(cmd.tag, "NO", "no TLS supported")
+	}
+	err = p.tagged(cmd.tag, "OK", "Begin TLS negotiation now")
+	if err == nil {
+		err = p.flush()
+	}
+	if err == nil {
+		p.c, _, err = starttls.HandleStartTLS(p.nc, p.s.TLS)
+		p.tls = err == nil
+	}
+	return
+}
+
+// log in as a user
+func (p *imapSession) login(tag, user, passwd string) (err error) {
+	if !p.s.checkUser(user, passwd) {
+		return p.tagged(tag, "NO", "[AUTHENTICATIONFAILED] bad login")
+	}
+	p.md, err = p.s.getMailDir(user)
+	if err != nil {
+		log.Errorf("imap: %s", err.Error())
+		return p.tagged(tag, "NO", "[UNAVAILABLE] "+err.Error())
+	}
+	p.user = user
+	return p.tagged(tag, "OK", "logged in")
+}
+
+func (p *imapSession) cmdLogin(cmd *command) (err error) {
+	if len(cmd.args) != 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	return p.login(cmd.tag, cmd.args[0].str, cmd.args[1].str)
+}
+
+func (p *imapSession) cmdAuthenticate(cmd *command) (err error) {
+	if len(cmd.args) == 0 || cmd.args[0].upper() != "PLAIN" {
+		return p.tagged(cmd.tag, "NO", "unsupported authentication mechanism")
+	}
+	var resp string
+	if len(cmd.args) > 1 {
+		resp = cmd.args[1].str
+	} else {
+		_, err = p.c.W.WriteString("+ \r\n")
+		if err == nil {
+			err = p.flush()
+		}
+		var l []byte
+		if err == nil {
+			l, err = readLine(p.c.R, maxUnauthCommandSize)
+		}
+		if e, ok := err.(*tooBigError); ok {
+			return p.commandTooBig(e)
+		}
+		if err != nil {
+			return
+		}
+		resp = string(l)
+	}
+	if resp == "*" {
+		return p.tagged(cmd.tag, "BAD", "authentication cancelled")
+	}
+	decoded, e := base64.StdEncoding.DecodeString(resp)
+	if e != nil {
+		return p.tagged(cmd.tag, "BAD", "invalid base64")
+	}
+	parts := bytes.Split(decoded, []byte{0})
+	if len(parts) != 3 {
+		return p.tagged(cmd.tag, "BAD", "invalid PLAIN response")
+	}
+	return p.login(cmd.tag, string(parts[1]), string(parts[2]))
+}
+
+// check if a mailbox name refers to the inbox
+func isInbox(name string) bool {
+	return strings.ToUpper(name) == inboxName
+}
+
+func (p *imapSession) cmdSelect(cmd *command) (err error) {
+	if len(cmd.args) != 1 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	// deselect any selected mailbox
+	p.mb = nil
+	md, ok := p.mailDir(cmd.args[0].str)
+	if !ok {
+		return p.tagged(cmd.tag, "NO", "[NONEXISTENT] no such mailbox")
+	}
+	readOnly := cmd.name == "EXAMINE"
+	var mb *mailbox
+	mb, err = openMailbox(md, readOnly)
+	if err != nil {
+		log.Errorf("imap: failed to open mailbox: %s", err.Error())
+		return p.tagged(cmd.tag, "NO", "failed to open mailbox")
+	}
+	p.mb = mb
+	lines := []string{
+		fmt.Sprintf("FLAGS (%s)", permanentFlags),
+		fmt.Sprintf("OK [PERMANENTFLAGS (%s)] limited", permanentFlags),
+		fmt.Sprintf("%d EXISTS", len(mb.msgs)),
+		fmt.Sprintf("%d RECENT", mb.recent()),
+	}
+	if seq := mb.firstUnseen(); seq > 0 {
+		lines = append(lines, fmt.Sprintf("OK [UNSEEN %d] first unseen", seq))
+	}
+	lines = append(lines,
+		fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", mb.validity),
+		fmt.Sprintf("OK [UIDNEXT %d] predicted next UID", mb.next))
+	for _, l := range lines {
+		err = p.untagged("%s", l)
+		if err != nil {
+			return
+		}
+	}
+	if readOnly {
+		err = p.tagged(cmd.tag, "OK", "[READ-ONLY] EXAMINE completed")
+	} else {
+		err = p.tagged(cmd.tag, "OK", "[READ-WRITE] SELECT completed")
+	}
+	return
+}
+
+// reply to a failed change of a folder
+func (p *imapSession) folderError(cmd *command, err error) error {
+	switch err {
+	case mailstore.ErrNoSuchFolder:
+		return p.tagged(cmd.tag, "NO", "[NONEXISTENT] no such mailbox")
+	case mailstore.ErrFolderExists:
+		return p.tagged(cmd.tag, "NO", "[ALREADYEXISTS] mailbox already exists")
+	case mailstore.ErrBadFolder:
+		return p.tagged(cmd.tag, "NO", "[CANNOT] bad mailbox name")
+	}
+	log.Errorf("imap: %s failed: %s", strings.ToLower(cmd.name), err.Error())
+	return p.tagged(cmd.tag, "NO", cmd.name+" failed")
+}
+
+func (p *imapSession) cmdCreate(cmd *command) (err error) {
+	if len(cmd.args) != 1 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	// a trailing delimiter says the client wants to make folders inside it
+	name := strings.TrimSuffix(cmd.args[0].str, hierarchyDelim)
+	if isInbox(name) {
+		return p.tagged(cmd.tag, "NO", "[ALREADYEXISTS] INBOX always exists")
+	}
+	err = p.md.CreateFolder(name)
+	if err != nil {
+		return p.folderError(cmd, err)
+	}
+	return p.tagged(cmd.tag, "OK", "CREATE completed")
+}
+
+func (p *imapSession) cmdDelete(cmd *command) (err error) {
+	if len(cmd.args) != 1 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	name := cmd.args[0].str
+	if isInbox(name) {
+		return p.tagged(cmd.tag, "NO", "[CANNOT] INBOX can't be deleted")
+	}
+	if p.inUse(name) {
+		return p.tagged(cmd.tag, "NO", "[INUSE] mailbox is selected")
+	}
+	err = p.md.DeleteFolder(name)
+	if err != nil {
+		return p.folderError(cmd, err)
+	}
+	return p.tagged(cmd.tag, "OK", "DELETE completed")
+}
+
+func (p *imapSession) cmdRename(cmd *command) (err error) {
+	if len(cmd.args) != 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	from, to := cmd.args[0].str, cmd.args[1].str
+	if isInbox(from) {
+		return p.tagged(cmd.tag, "NO", "[CANNOT] INBOX can't be renamed")
+	}
+	if isInbox(to) {
+		return p.tagged(cmd.tag, "NO", "[ALREADYEXISTS] INBOX always exists")
+	}
+	if p.inUse(from) {
+		return p.tagged(cmd.tag, "NO", "[INUSE] mailbox is selected")
+	}
+	err = p.md.RenameFolder(from, to)
+	if err != nil {
+		return p.folderError(cmd, err)
+	}
+	return p.tagged(cmd.tag, "OK", "RENAME completed")
+}
+
+// every mailbox is subscribed, we don't keep a subscription list
+func (p *imapSession) cmdSubscribe(cmd *command) (err error) {
+	if len(cmd.args) != 1 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	if _, ok := p.mailDir(cmd.args[0].str); !ok && cmd.name == "SUBSCRIBE" {
+		return p.tagged(cmd.tag, "NO", "[NONEXISTENT] no such mailbox")
+	}
+	return p.tagged(cmd.tag, "OK", cmd.name+" completed")
+}
+
+// match a mailbox name against a LIST pattern
+// '*' matches anything, '%' anything but the hierarchy delimiter
+func matchMailbox(pattern, name string) bool {
+	// match[j] is true if the pattern so far matches name[:j]
+	match := make([]bool, len(name)+1)
+	next := make([]bool, len(name)+1)
+	match[0] = true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		for j := 0; j <= len(name); j++ {
+			switch {
+			case c == '*' || c == '%':
+				next[j] = match[j] || (j > 0 && next[j-1] && (c == '*' || name[j-1] != hierarchyDelim[0]))
+			default:
+				next[j] = j > 0 && match[j-1] && name[j-1] == c
+			}
+		}
+		match, next = next, match
+	}
+	return match[len(name)]
+}
+
+func (p *imapSession) cmdList(cmd *command) (err error) {
+	if len(cmd.args) != 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	pattern := cmd.args[0].str + cmd.args[1].str
+	if cmd.name == "LIST" && cmd.args[1].str == "" {
+		// hierarchy delimiter request
+		err = p.untagged(`LIST (\Noselect) "." ""`)
+	} else {
+		var entries []listEntry
+		entries, err = p.mailboxes()
+		if err != nil {
+			log.Errorf("imap: failed to list folders: %s", err.Error())
+			return p.tagged(cmd.tag, "NO", cmd.name+" failed")
+		}
+		for _, e := range entries {
+			// INBOX is case insensitive
+			match := matchMailbox(pattern, e.name)
+			if e.name == inboxName {
+				match = matchMailbox(strings.ToUpper(pattern), e.name)
+			}
+			if match && err == nil {
+				err = p.untagged(`%s (%s) "." %s`, cmd.name, strings.Join(e.attrs, " "), mailboxName(e.name))
+			}
+		}
+	}
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", cmd.name+" completed")
+	}
+	return
+}
+
+func (p *imapSession) cmdStatus(cmd *command) (err error) {
+	if len(cmd.args) != 2 || cmd.args[1].kind != argList {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	md, ok := p.mailDir(cmd.args[0].str)
+	if !ok {
+		return p.tagged(cmd.tag, "NO", "[NONEXISTENT] no such mailbox")
+	}
+	mb := p.mb
+	if mb == nil || mb.md != md {
+		mb, err = openMailbox(md, true)
+		if err != nil {
+			log.Errorf("imap: failed to open mailbox: %s", err.Error())
+			return p.tagged(cmd.tag, "NO", "failed to open mailbox")
+		}
+	}
+	var items []string
+	for _, a := range cmd.args[1].list {
+		switch a.upper() {
+		case "MESSAGES":
+			items = append(items, fmt.Sprintf("MESSAGES %d", len(mb.msgs)))
+		case "RECENT":
+			items = append(items, fmt.Sprintf("RECENT %d", mb.recent()))
+		case "UIDNEXT":
+			items = append(items, fmt.Sprintf("UIDNEXT %d", mb.next))
+		case "UIDVALIDITY":
+			items = append(items, fmt.Sprintf("UIDVALIDITY %d", mb.validity))
+		case "UNSEEN":
+			items = append(items, fmt.Sprintf("UNSEEN %d", mb.unseen()))
+		default:
+			return p.tagged(cmd.tag, "BAD", "invalid status item")
+		}
+	}
+	err = p.untagged("STATUS %s (%s)", mailboxName(cmd.args[0].str), strings.Join(items, " "))
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", "STATUS completed")
+	}
+	return
+}
+
+// parse a flag list into maildir flags
+func parseFlags(a arg) (flags []maildir.Flag, err error) {
+	args := a.list
+	if a.kind != argList {
+		args = []arg{a}
+	}
+	for _, f := range args {
+		if f.kind != argAtom {
+			err = errBadSyntax
+			return
+		}
+		fl, ok := flagFromIMAP[f.upper()]
+		if ok {
+			flags = append(flags, fl)
+		} else if strings.HasPrefix(f.str, `\`) && f.upper() != `\RECENT` {
+			err = fmt.Errorf("unknown flag %s", f.str)
+			return
+		}
+		// keywords are accepted but not stored
+	}
+	return
+}
+
+func (p *imapSession) cmdAppend(cmd *command) (err error) {
+	args := cmd.args
+	if len(args) < 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	md, ok := p.mailDir(args[0].str)
+	if !ok {
+		return p.tagged(cmd.tag, "NO", "[TRYCREATE] no such mailbox")
+	}
+	args = args[1:]
+	var flags []maildir.Flag
+	if args[0].kind == argList {
+		flags, err = parseFlags(args[0])
+		if err != nil {
+			return p.tagged(cmd.tag, "BAD", err.Error())
+		}
+		args = args[1:]
+	}
+	var date time.Time
+	if len(args) == 2 {
+		date, err = time.Parse(appendDateFormat, args[0].str)
+		if err != nil {
+			return p.tagged(cmd.tag, "BAD", "invalid date")
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 || args[0].kind != argString {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	err = p.deliver(md, strings.NewReader(args[0].str), flags, date)
+	if err != nil {
+		log.Errorf("imap: append failed: %s", err.Error())
+		return p.tagged(cmd.tag, "NO", "append failed")
+	}
+	err = p.update()
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", "APPEND completed")
+	}
+	return
+}
+
+// deliver a message into a mailbox's maildir with flags and an optional internal date
+func (p *imapSession) deliver(md maildir.MailDir, r io.Reader, flags []maildir.Flag, date time.Time) (err error) {
+	var msg mailstore.Message
+	msg, err = md.Deliver(r)
+	if err != nil {
+		return
+	}
+	if !date.IsZero() {
+		md.SetDate(msg, date)
+	}
+	if len(flags) > 0 {
+		uidListMtx.Lock()
+		_, err = md.ProcessNew(maildir.Message(msg.Filepath()), flags...)
+		uidListMtx.Unlock()
+	}
+	return
+}
+
+func (p *imapSession) cmdClose(cmd *command) (err error) {
+	if !p.mb.readOnly {
+		err = p.mb.expunge(nil)
+		if err != nil {
+			log.Errorf("imap: expunge failed: %s", err.Error())
+		}
+	}
+	p.mb = nil
+	return p.tagged(cmd.tag, "OK", "CLOSE completed")
+}
+
+func (p *imapSession) cmdExpunge(cmd *command) (err error) {
+	if p.mb.readOnly {
+		return p.tagged(cmd.tag, "NO", "mailbox is read-only")
+	}
+	var netErr error
+	err = p.mb.expunge(func(seq int) error {
+		netErr = p.untagged("%d EXPUNGE", seq)
+		return netErr
+	})
+	if netErr != nil {
+		return netErr
+	}
+	if err != nil {
+		log.Errorf("imap: expunge failed: %s", err.Error())
+		return p.tagged(cmd.tag, "NO", "expunge failed")
+	}
+	return p.tagged(cmd.tag, "OK", "EXPUNGE completed")
+}
+
+// is this a UID command?
+func isUID(cmd *command) bool {
+	return strings.HasPrefix(cmd.name, "UID ")
+}
+
+// select messages given a sequence set, returns 0 based indexes
+func (p *imapSession) selectMessages(set string, uid bool) (idxs []int, err error) {
+	var s seqSet
+	s, err = parseSeqSet(set)
+	if err != nil {
+		return
+	}
+	for idx, m := range p.mb.msgs {
+		if uid {
+			if s.contains(m.uid, p.mb.maxUID()) {
+				idxs = append(idxs, idx)
+			}
+		} else if s.contains(uint32(idx+1), uint32(len(p.mb.msgs))) {
+			idxs = append(idxs, idx)
+		}
+	}
+	if !uid {
+		// sequence numbers out of range are an error
+		for _, r := range s {
+			if r.start > uint32(len(p.mb.msgs)) || r.stop > uint32(len(p.mb.msgs)) {
+				err = errors.New("invalid message sequence number")
+				return
+			}
+		}
+	}
+	return
+}
+
+func (p *imapSession) cmdSearch(cmd *command) (err error) {
+	var key searchKey
+	key, err = parseSearch(cmd.args)
+	if err == errBadCharset {
+		return p.tagged(cmd.tag, "NO", "[BADCHARSET (UTF-8 US-ASCII)] unsupported charset")
+	}
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", "invalid search criteria")
+	}
+	var results []string
+	for idx, m := range p.mb.msgs {
+		ctx := &searchContext{
+			mb:  p.mb,
+			seq: uint32(idx + 1),
+			m:   m,
+		}
+		if key(ctx) {
+			if isUID(cmd) {
+				results = append(results, strconv.FormatUint(uint64(m.uid), 10))
+			} else {
+				results = append(results, strconv.Itoa(idx+1))
+			}
+		}
+	}
+	if len(results) == 0 {
+		err = p.untagged("SEARCH")
+	} else {
+		err = p.untagged("SEARCH %s", strings.Join(results, " "))
+	}
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", cmd.name+" completed")
+	}
+	return
+}
+
+// format flags of a message
+func formatFlags(m *message) string {
+	return "FLAGS (" + strings.Join(m.flags(), " ") + ")"
+}
+
+// fetch items for 1 message
+func (p *imapSession) fetchMessage(seq int, m *message, items []fetchItem, uid bool) (err error) {
+	var content *part
+	var parts []string
+	setSeen := false
+	hasFlags := false
+	for _, item := range items {
+		if item.needsContent() && content == nil {
+			content, err = loadPart(m.msg.Filepath())
+			if err != nil {
+				return
+			}
+		}
+		if item.setsSeen() && !p.mb.readOnly {
+			setSeen = true
+		}
+	}
+	if setSeen && !m.hasFlag(maildir.Seen) {
+		err = p.mb.changeFlags(m, []maildir.Flag{maildir.Seen}, true)
+		if err != nil {
+			return
+		}
+	} else {
+		setSeen = false
+	}
+	if uid {
+		parts = append(parts, fmt.Sprintf("UID %d", m.uid))
+	}
+	for _, item := range items {
+		switch item.name {
+		case "FLAGS":
+			hasFlags = true
+			parts = append(parts, formatFlags(m))
+		case "UID":
+			if !uid {
+				parts = append(parts, fmt.Sprintf("UID %d", m.uid))
+			}
+		case "INTERNALDATE":
+			parts = append(parts, "INTERNALDATE "+internalDate(m.info.Date))
+		case "RFC822.SIZE":
+			parts = append(parts, fmt.Sprintf("RFC822.SIZE %d", m.info.WireSize))
+		case "ENVELOPE":
+			parts = append(parts, "ENVELOPE "+formatEnvelope(m.info.Envelope))
+		case "BODYSTRUCTURE":
+			parts = append(parts, "BODYSTRUCTURE "+bodyStructure(content, true))
+		case "RFC822":
+			parts = append(parts, "RFC822 "+literal(string(content.raw())))
+		case "RFC822.HEADER":
+			parts = append(parts, "RFC822.HEADER "+literal(string(content.rawHeader)))
+		case "RFC822.TEXT":
+			parts = append(parts, "RFC822.TEXT "+literal(string(content.body)))
+		case "BODY":
+			if !item.hasSection {
+				parts = append(parts, "BODY "+bodyStructure(content, false))
+				continue
+			}
+			var data []byte
+			data, err = sectionContent(content, item.section)
+			if err != nil {
+				return
+			}
+			name := "BODY[" + item.section + "]"
+			if item.partial {
+				if item.start > len(data) {
+					data = nil
+				} else {
+					data = data[item.start:]
+				}
+				if len(data) > item.length {
+					data = data[:item.length]
+				}
+				name += fmt.Sprintf("<%d>", item.start)
+			}
+			parts = append(parts, name+" "+literal(string(data)))
+		}
+	}
+	if setSeen && !hasFlags {
+		parts = append(parts, formatFlags(m))
+	}
+	err = p.untagged("%d FETCH (%s)", seq, strings.Join(parts, " "))
+	return
+}
+
+func (p *imapSession) cmdFetch(cmd *command) (err error) {
+	if len(cmd.args) != 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	var items []fetchItem
+	items, err = parseFetchItems(cmd.args[1])
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", "invalid fetch items")
+	}
+	var idxs []int
+	idxs, err = p.selectMessages(cmd.args[0].str, isUID(cmd))
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", err.Error())
+	}
+	failed := false
+	for _, idx := range idxs {
+		err = p.fetchMessage(idx+1, p.mb.msgs[idx], items, isUID(cmd))
+		if err == errBadSyntax {
+			return p.tagged(cmd.tag, "BAD", "invalid section")
+		}
+		if err != nil {
+			// message probably vanished
+			log.Warnf("imap: fetch failed: %s", err.Error())
+			failed = true
+			err = nil
+		}
+	}
+	if failed {
+		err = p.update()
+		if err == nil {
+			err = p.tagged(cmd.tag, "NO", "some messages could not be fetched")
+		}
+		return
+	}
+	return p.tagged(cmd.tag, "OK", cmd.name+" completed")
+}
+
+func (p *imapSession) cmdStore(cmd *command) (err error) {
+	if len(cmd.args) != 3 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	if p.mb.readOnly {
+		return p.tagged(cmd.tag, "NO", "mailbox is read-only")
+	}
+	op := cmd.args[1].upper()
+	silent := strings.HasSuffix(op, ".SILENT")
+	op = strings.TrimSuffix(op, ".SILENT")
+	if op != "FLAGS" && op != "+FLAGS" && op != "-FLAGS" {
+		return p.tagged(cmd.tag, "BAD", "invalid store item")
+	}
+	var flags []maildir.Flag
+	flags, err = parseFlags(cmd.args[2])
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", err.Error())
+	}
+	var idxs []int
+	idxs, err = p.selectMessages(cmd.args[0].str, isUID(cmd))
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", err.Error())
+	}
+	for _, idx := range idxs {
+		m := p.mb.msgs[idx]
+		if op == "FLAGS" {
+			err = p.mb.setFlags(m, flags)
+		} else {
+			err = p.mb.changeFlags(m, flags, op == "+FLAGS")
+		}
+		if err != nil {
+			log.Errorf("imap: failed to store flags: %s", err.Error())
+			err = p.update()
+			if err == nil {
+				err = p.tagged(cmd.tag, "NO", "failed to store flags")
+			}
+			return
+		}
+		if !silent {
+			if isUID(cmd) {
+				err = p.untagged("%d FETCH (UID %d %s)", idx+1, m.uid, formatFlags(m))
+			} else {
+				err = p.untagged("%d FETCH (%s)", idx+1, formatFlags(m))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return p.tagged(cmd.tag, "OK", cmd.name+" completed")
+}
+
+func (p *imapSession) cmdCopy(cmd *command) (err error) {
+	if len(cmd.args) != 2 {
+		return p.tagged(cmd.tag, "BAD", "invalid syntax")
+	}
+	md, ok := p.mailDir(cmd.args[1].str)
+	if !ok {
+		return p.tagged(cmd.tag, "NO", "[TRYCREATE] no such mailbox")
+	}
+	var idxs []int
+	idxs, err = p.selectMessages(cmd.args[0].str, isUID(cmd))
+	if err != nil {
+		return p.tagged(cmd.tag, "BAD", err.Error())
+	}
+	for _, idx := range idxs {
+		m := p.mb.msgs[idx]
+		var f *os.File
+		f, err = os.Open(m.msg.Filepath())
+		if err == nil {
+			var info os.FileInfo
+			info, err = f.Stat()
+			if err == nil {
+				err = p.deliver(md, f, m.msg.GetFlags(), info.ModTime())
+			}
+			f.Close()
+		}
+		if err != nil {
+			log.Errorf("imap: copy failed: %s", err.Error())
+			return p.tagged(cmd.tag, "NO", "copy failed")
+		}
+	}
+	err = p.update()
+	if err == nil {
+		err = p.tagged(cmd.tag, "OK", cmd.name+" completed")
+	}
+	return
+}
@@ -0,0 +1,388 @@
+package imap
+
+import (
+	"bytes"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testRouter struct {
+	md maildir.MailDir
+}
+
+func (r testRouter) FindStoreFor(user string) (mailstore.Store, bool) {
+	return r.md, user == "test"
+}
+
+const testMessage = "From: Alice <alice@a.b32.i2p>\nTo: test@b.b32.i2p\nSubject: hello\n\nhi there\n"
+
+// start a session against a fresh maildir, returns the client side
+func testSession(t *testing.T) (c *textproto.Conn, md maildir.MailDir, cleanup func()) {
+	dir, err := ioutil.TempDir("", "imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = maildir.MailDir(dir)
+	if err = md.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	s.Local = testRouter{md}
+	s.Auth = func(user, passwd string) (bool, error) {
+		return user == "test" && passwd == "secret", nil
+	}
+	client, server := net.Pipe()
+	p := &imapSession{
+		nc: server,
+		c:  textproto.NewConn(server),
+		s:  s,
+	}
+	go p.Run()
+	c = textproto.NewConn(client)
+	// read banner
+	line, err := c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("bad banner: %q %v", line, err)
+	}
+	cleanup = func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// send a command and collect responses up to the tagged one
+func roundTrip(t *testing.T, c *textproto.Conn, tag, cmd string) (lines []string, status string) {
+	if err := c.PrintfLine("%s %s", tag, cmd); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status = line[len(tag)+1:]
+			return
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	cmd, err := parseCommand([]byte(`a1 UID FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (From To)]<0.10>)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.tag != "a1" || cmd.name != "UID FETCH" || len(cmd.args) != 2 {
+		t.Fatalf("bad parse: %+v", cmd)
+	}
+	items, err := parseFetchItems(cmd.args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].section != "HEADER.FIELDS (From To)" || !items[1].peek || items[1].length != 10 {
+		t.Fatalf("bad fetch items: %+v", items)
+	}
+	cmd, err = parseCommand([]byte("a2 LOGIN {4}\r\ntest \"se\\\"cret\""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.args[0].str != "test" || cmd.args[1].str != `se"cret` {
+		t.Fatalf("bad login args: %+v", cmd.args)
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1:3,7,9:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint32{1, 2, 3, 7, 9, 10} {
+		if !set.contains(n, 10) {
+			t.Errorf("%d should be in set", n)
+		}
+	}
+	for _, n := range []uint32{4, 8} {
+		if set.contains(n, 10) {
+			t.Errorf("%d should not be in set", n)
+		}
+	}
+}
+
+func TestMatchMailbox(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "Work.Old", true},
+		{"%", "Work", true},
+		{"%", "Work.Old", false},
+		{"Work.%", "Work.Old", true},
+		{"Work%", "Work.Old", false},
+		{"*Old", "Work.Old", true},
+		{"W*k", "Work", true},
+		{"Work", "Work.Old", false},
+		{"", "", true},
+		{"%%%*", "", true},
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 100), false},
+	}
+	for _, test := range tests {
+		if matchMailbox(test.pattern, test.name) != test.match {
+			t.Errorf("matchMailbox(%q, %q) should be %v", test.pattern, test.name, test.match)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, md, cleanup := testSession(t)
+	defer cleanup()
+	for i := 0; i < 2; i++ {
+		if _, err := md.Deliver(strings.NewReader(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, status := roundTrip(t, c, "a1", "LOGIN test wrong")
+	if !strings.HasPrefix(status, "NO") {
+		t.Fatalf("bad login accepted: %s", status)
+	}
+	_, status = roundTrip(t, c, "a2", "LOGIN test secret")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("login failed: %s", status)
+	}
+	lines, status := roundTrip(t, c, "a3", "SELECT inbox")
+	if !strings.HasPrefix(status, "OK [READ-WRITE]") {
+		t.Fatalf("select failed: %s", status)
+	}
+	if !contains(lines, "* 2 EXISTS") || !contains(lines, "* 2 RECENT") {
+		t.Fatalf("bad select response: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a4", "FETCH 1 (UID RFC822.SIZE ENVELOPE)")
+	size := len(strings.Replace(testMessage, "\n", "\r\n", -1))
+	if len(lines) != 1 || !strings.Contains(lines[0], "UID 1 RFC822.SIZE "+strconv.Itoa(size)) || !strings.Contains(lines[0], `(("Alice" NIL "alice" "a.b32.i2p"))`) {
+		t.Fatalf("bad fetch response: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a5", "UID FETCH 2 BODY[TEXT]")
+	if len(lines) != 3 || lines[1] != "hi there" || !strings.Contains(lines[0], `FETCH (UID 2 BODY[TEXT] {10}`) || !strings.Contains(lines[2], `\Seen`) {
+		t.Fatalf("bad body fetch: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a6", "SEARCH UNSEEN FROM alice")
+	if !contains(lines, "* SEARCH 1") {
+		t.Fatalf("bad search: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a7", `STORE 1 +FLAGS (\Deleted)`)
+	if len(lines) != 1 || !strings.Contains(lines[0], `\Deleted`) {
+		t.Fatalf("bad store: %q", lines)
+	}
+	lines, status = roundTrip(t, c, "a8", "EXPUNGE")
+	if !strings.HasPrefix(status, "OK") || !contains(lines, "* 1 EXPUNGE") {
+		t.Fatalf("bad expunge: %q %s", lines, status)
+	}
+	msgs, _ := md.ListCur()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message left, have %d", len(msgs))
+	}
+	flags := msgs[0].GetFlags()
+	if len(flags) != 1 || flags[0] != maildir.Seen {
+		t.Fatalf("bad flags on disk: %v", flags)
+	}
+	// new mail shows up after noop
+	md.Deliver(strings.NewReader(testMessage))
+	lines, _ = roundTrip(t, c, "a9", "NOOP")
+	if !contains(lines, "* 2 EXISTS") {
+		t.Fatalf("new message not reported: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a10", "UID SEARCH ALL")
+	if !contains(lines, "* SEARCH 2 3") {
+		t.Fatalf("uids not stable: %q", lines)
+	}
+	roundTrip(t, c, "a11", "LOGOUT")
+}
+
+func TestFolders(t *testing.T) {
+	c, md, cleanup := testSession(t)
+	defer cleanup()
+	// sieve files mail into folders
+	junk, err := md.EnsureFolder("Junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk.Deliver(strings.NewReader(testMessage))
+	roundTrip(t, c, "a1", "LOGIN test secret")
+	for tag, cmd := range map[string]string{"a2": "CREATE Work.", "a3": "CREATE Work.Old", "a4": "CREATE Lists.Go"} {
+		if _, status := roundTrip(t, c, tag, cmd); !strings.HasPrefix(status, "OK") {
+			t.Fatalf("%s failed: %s", cmd, status)
+		}
+	}
+	_, status := roundTrip(t, c, "a5", "CREATE Work")
+	if !strings.HasPrefix(status, "NO [ALREADYEXISTS]") {
+		t.Fatalf("created folder twice: %s", status)
+	}
+	lines, _ := roundTrip(t, c, "a6", `LIST "" *`)
+	want := []string{
+		`* LIST (\HasNoChildren) "." INBOX`,
+		`* LIST (\HasNoChildren \Junk) "." "Junk"`,
+		`* LIST (\Noselect \HasChildren) "." "Lists"`,
+		`* LIST (\HasNoChildren) "." "Lists.Go"`,
+		`* LIST (\HasChildren) "." "Work"`,
+		`* LIST (\HasNoChildren) "." "Work.Old"`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("bad list: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a7", `LIST "" %`)
+	if len(lines) != 4 || contains(lines, `* LIST (\HasNoChildren) "." "Work.Old"`) {
+		t.Fatalf("bad list of top level: %q", lines)
+	}
+	lines, _ = roundTrip(t, c, "a8", "STATUS Junk (MESSAGES UNSEEN)")
+	if !contains(lines, `* STATUS "Junk" (MESSAGES 1 UNSEEN 1)`) {
+		t.Fatalf("bad status: %q", lines)
+	}
+	lines, status = roundTrip(t, c, "a9", "SELECT Junk")
+	if !strings.HasPrefix(status, "OK") || !contains(lines, "* 1 EXISTS") {
+		t.Fatalf("select junk failed: %q %s", lines, status)
+	}
+	_, status = roundTrip(t, c, "a10", "COPY 1 Work.Old")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("copy failed: %s", status)
+	}
+	_, status = roundTrip(t, c, "a11", "COPY 1 Nowhere")
+	if !strings.HasPrefix(status, "NO [TRYCREATE]") {
+		t.Fatalf("copied to missing folder: %s", status)
+	}
+	_, status = roundTrip(t, c, "a12", "DELETE Junk")
+	if !strings.HasPrefix(status, "NO [INUSE]") {
+		t.Fatalf("deleted selected folder: %s", status)
+	}
+	_, status = roundTrip(t, c, "a13", "RENAME Work Archive")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("rename failed: %s", status)
+	}
+	old, err := md.Folder("Archive.Old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := old.ListNew(); len(msgs) != 1 {
+		t.Fatalf("copied message not in renamed folder: %v", msgs)
+	}
+	_, status = roundTrip(t, c, "a14", "DELETE Lists.Go")
+	if !strings.HasPrefix(status, "OK") || md.HasFolder("Lists.Go") {
+		t.Fatalf("delete failed: %s", status)
+	}
+	for tag, cmd := range map[string]string{"a15": "DELETE INBOX", "a16": "RENAME INBOX Old", "a17": "DELETE Nowhere"} {
+		if _, status = roundTrip(t, c, tag, cmd); !strings.HasPrefix(status, "NO") {
+			t.Fatalf("%s worked: %s", cmd, status)
+		}
+	}
+}
+
+func TestBodyStructure(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=xx\r\n\r\n--xx\r\nContent-Type: text/plain\r\n\r\nhello\r\n--xx\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=a.bin\r\n\r\nAAAA\r\n--xx--\r\n"
+	p := parsePart([]byte(msg), "text/plain")
+	if len(p.children) != 2 {
+		t.Fatalf("expected 2 parts, have %d", len(p.children))
+	}
+	data, err := sectionContent(p, "2")
+	if err != nil || !bytes.Equal(data, []byte("AAAA")) {
+		t.Fatalf("bad part 2: %q %v", data, err)
+	}
+	bs := bodyStructure(p, true)
+	if !strings.Contains(bs, `("ATTACHMENT" ("FILENAME" "a.bin"))`) || !strings.Contains(bs, `"MIXED"`) {
+		t.Fatalf("bad body structure: %s", bs)
+	}
+}
+
+func contains(lines []string, s string) bool {
+	for _, l := range lines {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCommandTooBig(t *testing.T) {
+	c, _, cleanup := testSession(t)
+	defer cleanup()
+	// literals over the limit are refused before the continuation request
+	c.PrintfLine("a1 LOGIN {%d}", maxUnauthCommandSize+1)
+	line, err := c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "a1 BAD [TOOBIG]") {
+		t.Fatalf("big literal before login not refused: %q %v", line, err)
+	}
+	// the session goes on
+	_, status := roundTrip(t, c, "a2", "LOGIN test secret")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("login after refused command failed: %s", status)
+	}
+	_, status = roundTrip(t, c, "a3", "NOOP")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("noop failed: %s", status)
+	}
+	// a literal that fits after login is accepted
+	c.PrintfLine("a4 APPEND INBOX {%d}", len(testMessage))
+	line, err = c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "+") {
+		t.Fatalf("no continuation: %q %v", line, err)
+	}
+	c.W.WriteString(testMessage)
+	c.PrintfLine("")
+	for {
+		line, err = c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "a4 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(line, "a4 OK") {
+		t.Errorf("append failed: %q", line)
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	c, _, cleanup := testSession(t)
+	defer cleanup()
+	// a line with no end in sight gets the client hung up on
+	go func() {
+		c.W.WriteString("a1 LOGIN " + strings.Repeat("x", maxUnauthCommandSize) + "\r\n")
+		c.W.Flush()
+	}()
+	line, err := c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "* BYE") {
+		t.Fatalf("expected BYE, got %q %v", line, err)
+	}
+	if _, err = c.ReadLine(); err == nil {
+		t.Error("connection still open")
+	}
+}
+
+func TestAuthenticateTooBig(t *testing.T) {
+	c, _, cleanup := testSession(t)
+	defer cleanup()
+	c.PrintfLine("a1 AUTHENTICATE PLAIN")
+	line, err := c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "+") {
+		t.Fatalf("no continuation: %q %v", line, err)
+	}
+	// a response with no end in sight gets the client hung up on
+	go func() {
+		c.W.WriteString(strings.Repeat("x", maxUnauthCommandSize+1) + "\r\n")
+		c.W.Flush()
+	}()
+	line, err = c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "* BYE") {
+		t.Fatalf("expected BYE, got %q %v", line, err)
+	}
+	if _, err = c.ReadLine(); err == nil {
+		t.Error("connection still open")
+	}
+}
@@ -0,0 +1,90 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeliverStress(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mds := []MailDir{testMailDir(t), testMailDir(t), testMailDir(t)}
+	const workers = 16
+	const perWorker = 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				md := mds[(w+i)%len(mds)]
+				body := fmt.Sprintf("Subject: %s %d %d\r\n\r\n%s\r\n", md, w, i, strings.Repeat("x", i*100))
+				if _, err := md.Deliver(strings.NewReader(body)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("working directory changed from %s to %s", wd, now)
+	}
+	seen := make(map[string]bool)
+	total := 0
+	for _, md := range mds {
+		msgs, err := md.ListNew()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(msgs)
+		for _, msg := range msgs {
+			data, err := ioutil.ReadFile(msg.Filepath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := string(data)
+			if !strings.HasPrefix(body, fmt.Sprintf("Subject: %s ", md)) {
+				t.Errorf("message for another maildir in %s: %q", md, body[:strings.Index(body, "\r\n")])
+			}
+			if seen[body] {
+				t.Errorf("message delivered twice: %q", body[:strings.Index(body, "\r\n")])
+			}
+			seen[body] = true
+		}
+		tmp, err := ioutil.ReadDir(md.Temp(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tmp) != 0 {
+			t.Errorf("%d files left in tmp of %s", len(tmp), md)
+		}
+	}
+	if total != workers*perWorker {
+		t.Errorf("delivered %d messages, want %d", total, workers*perWorker)
+	}
+}
+
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("read failed")
+}
+
+func TestDeliverFailureCleansUp(t *testing.T) {
+	md := testMailDir(t)
+	if _, err := md.Deliver(failReader{}); err == nil {
+		t.Fatal("expected delivery error")
+	}
+	tmp, _ := ioutil.ReadDir(md.Temp(""))
+	msgs, _ := md.ListNew()
+	if len(tmp) != 0 || len(msgs) != 0 {
+		t.Errorf("failed delivery left %d tmp and %d new files", len(tmp), len(msgs))
+	}
+}
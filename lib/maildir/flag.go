@@ -1,5 +1,9 @@
 package maildir
 
+import (
+	"sort"
+)
+
 // maildir flag
 type Flag rune
 
@@ -11,9 +15,54 @@ func (f Flag) String() string {
 	return string(f)
 }
 
+// return true if this flag can be stored in a filename
+// uppercase letters are standard flags, lowercase letters are keywords
+func (f Flag) Valid() bool {
+	return (f >= 'A' && f <= 'Z') || (f >= 'a' && f <= 'z')
+}
+
 const Passed = Flag('P')
 const Replied = Flag('R')
 const Seen = Flag('S')
 const Trashed = Flag('T')
 const Draft = Flag('D')
 const Flagged = Flag('F')
+
+// sort flags in ascii order as the maildir spec wants, dropping duplicates and invalid flags
+func sortFlags(flags []Flag) (sorted []Flag) {
+	for _, f := range flags {
+		if f.Valid() && !hasFlag(sorted, f) {
+			sorted = append(sorted, f)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return
+}
+
+// format flags for the info part of a filename
+func formatFlags(flags []Flag) (str string) {
+	for _, f := range sortFlags(flags) {
+		str += f.String()
+	}
+	return
+}
+
+// parse the flags in the info part of a filename
+func parseFlags(str string) []Flag {
+	var flags []Flag
+	for _, r := range str {
+		flags = append(flags, Flag(r))
+	}
+	return sortFlags(flags)
+}
+
+func hasFlag(flags []Flag, flag Flag) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package maildir
+
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// file that marks a maildir as a Maildir++ folder
+const folderMarker = "maildirfolder"
+
+var _ mailstore.FolderStore = MailDir("")
+
+// clean up a folder name, '/' also separates nested folders
+func folderName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "/", ".")
+	for _, part := range strings.Split(name, ".") {
+		if part == "" || strings.ContainsAny(part, "\x00\\") {
+			return "", mailstore.ErrBadFolder
+		}
+	}
+	return name, nil
+}
+
+// get a Maildir++ sub folder, it may not exist
+func (d MailDir) Folder(name string) (f MailDir, err error) {
+	name, err = folderName(name)
+	if err == nil {
+		f = MailDir(filepath.Join(d.Filepath(), "."+name))
+	}
+	return
+}
+
+// return true if this maildir has a folder
+func (d MailDir) HasFolder(name string) bool {
+	f, err := d.Folder(name)
+	if err == nil {
+		_, err = os.Stat(filepath.Join(f.Filepath(), "cur"))
+	}
+	return err == nil
+}
+
+// get a folder, creating it if it doesn't exist
+func (d MailDir) EnsureFolder(name string) (f MailDir, err error) {
+	f, err = d.Folder(name)
+	if err == nil {
+		err = f.Ensure()
+	}
+	if err == nil {
+		var mf *os.File
+		mf, err = os.OpenFile(filepath.Join(f.Filepath(), folderMarker), os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			err = mf.Close()
+		}
+	}
+	return
+}
+
+// list the names of all folders in this maildir sorted by name
+func (d MailDir) Folders() (names []string, err error) {
+	var f *os.File
+	f, err = os.Open(d.Filepath())
+	if err != nil {
+		return
+	}
+	var infos []os.FileInfo
+	infos, err = f.Readdir(0)
+	f.Close()
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() && len(name) > 1 && name[0] == '.' && name != ".." && d.HasFolder(name[1:]) {
+			names = append(names, name[1:])
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// open a folder that exists
+func (d MailDir) OpenFolder(name string) (st mailstore.Store, err error) {
+	var f MailDir
+	f, err = d.Folder(name)
+	if err == nil {
+		if d.HasFolder(name) {
+			st = f
+		} else {
+			err = mailstore.ErrNoSuchFolder
+		}
+	}
+	return
+}
+
+// create a new folder
+func (d MailDir) CreateFolder(name string) (err error) {
+	if d.HasFolder(name) {
+		return mailstore.ErrFolderExists
+	}
+	_, err = d.EnsureFolder(name)
+	return
+}
+
+// rename a folder and the folders inside it
+func (d MailDir) RenameFolder(oldname, newname string) (err error) {
+	oldname, err = folderName(oldname)
+	if err == nil {
+		newname, err = folderName(newname)
+	}
+	if err != nil {
+		return
+	}
+	if !d.HasFolder(oldname) {
+		return mailstore.ErrNoSuchFolder
+	}
+	if d.HasFolder(newname) {
+		return mailstore.ErrFolderExists
+	}
+	if strings.HasPrefix(newname, oldname+".") {
+		return mailstore.ErrBadFolder
+	}
+	var names []string
+	names, err = d.Folders()
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		if name == oldname || strings.HasPrefix(name, oldname+".") {
+			to := newname + strings.TrimPrefix(name, oldname)
+			err = os.Rename(filepath.Join(d.Filepath(), "."+name), filepath.Join(d.Filepath(), "."+to))
+			forgetIndexes(filepath.Join(d.Filepath(), "."+name))
+		}
+	}
+	return
+}
+
+// delete a folder and all messages in it, folders inside it are kept
+func (d MailDir) DeleteFolder(name string) (err error) {
+	var f MailDir
+	f, err = d.Folder(name)
+	if err == nil {
+		if d.HasFolder(name) {
+			err = os.RemoveAll(f.Filepath())
+			forgetIndexes(f.Filepath())
+		} else {
+			err = mailstore.ErrNoSuchFolder
+		}
+	}
+	return
+}
+
+// move a message in new or cur to another store
+// moves between maildirs keep the message's name and flags
+func (d MailDir) Move(msg mailstore.Message, to mailstore.Store) (m mailstore.Message, err error) {
+	subdir := filepath.Base(filepath.Dir(msg.Filepath()))
+	if subdir != "new" && subdir != "cur" {
+		subdir = "cur"
+	}
+	src := filepath.Join(d.Filepath(), subdir, msg.Filename())
+	if md, ok := to.(MailDir); ok {
+		dst := filepath.Join(md.Filepath(), subdir, msg.Filename())
+		err = os.Rename(src, dst)
+		if err == nil {
+			m = Message(dst)
+			d.unindexed(src)
+			md.indexed(dst)
+		}
+		return
+	}
+	// other stores get a copy
+	var f *os.File
+	f, err = os.Open(src)
+	if err == nil {
+		m, err = to.Deliver(f)
+		f.Close()
+	}
+	if err == nil {
+		err = d.Remove(Message(src))
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package maildir
+
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testMailDir(t *testing.T) MailDir {
+	md := MailDir(filepath.Join(t.TempDir(), "mail"))
+	if err := md.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+func TestFolders(t *testing.T) {
+	md := testMailDir(t)
+	for _, name := range []string{"Sent", "Lists", "Lists/go", "Trash"} {
+		if err := md.CreateFolder(name); err != nil {
+			t.Fatalf("create %s: %s", name, err)
+		}
+	}
+	if err := md.CreateFolder("Sent"); err != mailstore.ErrFolderExists {
+		t.Errorf("creating existing folder gave %v", err)
+	}
+	for _, name := range []string{"", "a..b", ".hidden", "a/"} {
+		if err := md.CreateFolder(name); err != mailstore.ErrBadFolder {
+			t.Errorf("creating %q gave %v", name, err)
+		}
+	}
+	names, err := md.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"Lists", "Lists.go", "Sent", "Trash"}) {
+		t.Errorf("bad folder list %q", names)
+	}
+
+	if err = md.RenameFolder("Lists", "Lists.sub"); err != mailstore.ErrBadFolder {
+		t.Errorf("renaming into itself gave %v", err)
+	}
+	if err = md.RenameFolder("Lists", "Sent"); err != mailstore.ErrFolderExists {
+		t.Errorf("renaming onto existing folder gave %v", err)
+	}
+	if err = md.RenameFolder("Lists", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err = md.DeleteFolder("Trash"); err != nil {
+		t.Fatal(err)
+	}
+	if err = md.DeleteFolder("Trash"); err != mailstore.ErrNoSuchFolder {
+		t.Errorf("deleting missing folder gave %v", err)
+	}
+	names, _ = md.Folders()
+	if !reflect.DeepEqual(names, []string{"Archive", "Archive.go", "Sent"}) {
+		t.Errorf("bad folder list after rename %q", names)
+	}
+	if _, err = md.OpenFolder("Lists"); err != mailstore.ErrNoSuchFolder {
+		t.Errorf("opening renamed folder gave %v", err)
+	}
+}
+
+func TestMoveKeepsFlags(t *testing.T) {
+	md := testMailDir(t)
+	msg, err := md.Deliver(strings.NewReader("Subject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := md.ProcessNew(Message(msg.Filepath()), Seen, Flagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = md.CreateFolder("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := md.OpenFolder("Archive")
+	moved, err := md.Move(cur, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Filename() != cur.Filename() {
+		t.Errorf("move changed name from %s to %s", cur.Filename(), moved.Filename())
+	}
+	list, _ := archive.List()
+	if len(list) != 1 || list[0].Filepath() != moved.Filepath() {
+		t.Errorf("moved message not in folder: %v", list)
+	}
+	if list, _ = md.List(); len(list) != 0 {
+		t.Errorf("moved message still in inbox: %v", list)
+	}
+
+	// new messages stay new
+	msg, _ = md.Deliver(strings.NewReader("Subject: new\r\n\r\n"))
+	_, err = md.Move(msg, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = archive.ListNew(); len(list) != 1 {
+		t.Errorf("new message not new in folder: %v", list)
+	}
+}
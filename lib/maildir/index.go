@@ -0,0 +1,411 @@
+package maildir
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file in the maildir the index is saved in
+const indexFile = "bdsmail.index"
+
+var _ mailstore.IndexedStore = MailDir("")
+
+// what the index knows about 1 message
+type indexEntry struct {
+	// path relative to the maildir, new/ or cur/ and the filename
+	Path     string             `json:"path"`
+	Size     int64              `json:"size"`
+	WireSize int64              `json:"wire_size"`
+	Date     time.Time          `json:"date"`
+	Envelope mailstore.Envelope `json:"envelope"`
+}
+
+// index of the messages in a maildir by unique name
+// the directory listing is the truth, the index caches what is expensive to read
+type index struct {
+	mtx     sync.Mutex
+	dir     MailDir
+	entries map[string]*indexEntry
+	loaded  bool
+	dirty   bool
+}
+
+// indexes of all maildirs used by this process by path
+var indexes = struct {
+	sync.Mutex
+	m map[string]*index
+}{m: make(map[string]*index)}
+
+// get the index of this maildir
+func (d MailDir) index() *index {
+	path := d.Filepath()
+	indexes.Lock()
+	defer indexes.Unlock()
+	ix, ok := indexes.m[path]
+	if !ok {
+		ix = &index{dir: MailDir(path), entries: make(map[string]*indexEntry)}
+		indexes.m[path] = ix
+	}
+	return ix
+}
+
+// load the saved index, must hold the lock
+func (ix *index) load() {
+	if ix.loaded {
+		return
+	}
+	ix.loaded = true
+	f, err := os.Open(filepath.Join(ix.dir.Filepath(), indexFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = json.NewDecoder(bufio.NewReader(f)).Decode(&ix.entries); err != nil {
+		log.Warnf("rebuilding broken index of %s: %s", ix.dir, err.Error())
+		ix.entries = make(map[string]*indexEntry)
+		ix.dirty = true
+	}
+	for name, e := range ix.entries {
+		if e.WireSize < e.Size {
+			// saved by an older version, read it again
+			delete(ix.entries, name)
+			ix.dirty = true
+		}
+	}
+}
+
+// save the index if it changed, must hold the lock
+func (ix *index) save() (err error) {
+	if !ix.dirty {
+		return
+	}
+	fname := filepath.Join(ix.dir.Filepath(), indexFile)
+	tmp := ix.dir.TempFile()
+	var f *os.File
+	f, err = os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(ix.entries)
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err == nil {
+		ix.dirty = false
+	} else {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// read the size, date and envelope of a message
+func readEntry(fpath string) (e *indexEntry, err error) {
+	var f *os.File
+	f, err = os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		return
+	}
+	e = &indexEntry{
+		Size: info.Size(),
+		Date: info.ModTime(),
+	}
+	hdr, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if hdr != nil {
+		e.Envelope = mailstore.Envelope{
+			Date:      hdr.Get("Date"),
+			Subject:   hdr.Get("Subject"),
+			From:      hdr.Get("From"),
+			Sender:    hdr.Get("Sender"),
+			ReplyTo:   hdr.Get("Reply-To"),
+			To:        strings.Join(hdr["To"], ", "),
+			Cc:        strings.Join(hdr["Cc"], ", "),
+			Bcc:       strings.Join(hdr["Bcc"], ", "),
+			InReplyTo: hdr.Get("In-Reply-To"),
+			MessageID: hdr.Get("Message-Id"),
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err == nil {
+		e.WireSize, err = wireSize(f)
+	}
+	return
+}
+
+// get the size of a message with bare line feeds turned into CRLF
+func wireSize(r io.Reader) (n int64, err error) {
+	br := bufio.NewReader(r)
+	var prev byte
+	for {
+		var c byte
+		c, err = br.ReadByte()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if c == '\n' && prev != '\r' {
+			n++
+		}
+		n++
+		prev = c
+	}
+}
+
+// note that a message file was added or renamed, must hold the lock
+func (ix *index) note(subdir, fname string) {
+	rel := filepath.Join(subdir, fname)
+	name := Message(fname).Name()
+	if e, ok := ix.entries[name]; ok {
+		if e.Path != rel {
+			// renamed, contents are the same
+			e.Path = rel
+			ix.dirty = true
+		}
+		return
+	}
+	e, err := readEntry(filepath.Join(ix.dir.Filepath(), rel))
+	if err == nil {
+		e.Path = rel
+		ix.entries[name] = e
+		ix.dirty = true
+	}
+}
+
+// bring the index up to date with the directory listing, must hold the lock
+func (ix *index) sync() (err error) {
+	ix.load()
+	present := make(map[string]bool)
+	for _, sd := range []string{"new", "cur"} {
+		var f *os.File
+		f, err = os.Open(filepath.Join(ix.dir.Filepath(), sd))
+		if err != nil {
+			return
+		}
+		var names []string
+		names, err = f.Readdirnames(0)
+		f.Close()
+		if err != nil {
+			return
+		}
+		for _, fname := range names {
+			present[Message(fname).Name()] = true
+			ix.note(sd, fname)
+		}
+	}
+	for name := range ix.entries {
+		if !present[name] {
+			delete(ix.entries, name)
+			ix.dirty = true
+		}
+	}
+	if serr := ix.save(); serr != nil {
+		log.Warnf("failed to save index of %s: %s", ix.dir, serr.Error())
+	}
+	return
+}
+
+// update the index of this maildir after a message file was added or renamed
+// does nothing if the index was not used yet
+func (d MailDir) indexed(fpath string) {
+	ix := d.index()
+	ix.mtx.Lock()
+	if ix.loaded {
+		ix.note(filepath.Base(filepath.Dir(fpath)), filepath.Base(fpath))
+	}
+	ix.mtx.Unlock()
+}
+
+// update the index of this maildir after a message was removed
+func (d MailDir) unindexed(fpath string) {
+	ix := d.index()
+	ix.mtx.Lock()
+	if ix.loaded {
+		name := Message(fpath).Name()
+		if _, ok := ix.entries[name]; ok {
+			delete(ix.entries, name)
+			ix.dirty = true
+		}
+	}
+	ix.mtx.Unlock()
+}
+
+func (ix *index) info(name string, e *indexEntry) mailstore.MessageInfo {
+	msg := Message(filepath.Join(ix.dir.Filepath(), e.Path))
+	return mailstore.MessageInfo{
+		Message:  msg,
+		Name:     name,
+		Size:     e.Size,
+		WireSize: e.WireSize,
+		New:      filepath.Dir(e.Path) == "new",
+		Flags:    formatFlags(msg.GetFlags()),
+		Date:     e.Date,
+		Envelope: e.Envelope,
+	}
+}
+
+// get a message by unique name, must hold the lock
+// ok is false if the index doesn't know the message or it moved since
+func (ix *index) find(name string) (msg Message, ok bool) {
+	var e *indexEntry
+	e, ok = ix.entries[name]
+	if ok {
+		msg = Message(filepath.Join(ix.dir.Filepath(), e.Path))
+		_, err := os.Stat(msg.Filepath())
+		ok = err == nil
+	}
+	return
+}
+
+// find a message in new or cur by its unique name
+// the directory is only listed when the index doesn't know where the message is
+func (d MailDir) Find(name string) (msg Message, err error) {
+	if name == "" || strings.Contains(name, "/") {
+		err = ErrNoSuchMessage
+		return
+	}
+	ix := d.index()
+	ix.mtx.Lock()
+	defer ix.mtx.Unlock()
+	ix.load()
+	msg, ok := ix.find(name)
+	if !ok {
+		err = ix.sync()
+		if err == nil {
+			msg, ok = ix.find(name)
+		}
+		if err == nil && !ok {
+			err = ErrNoSuchMessage
+		}
+	}
+	return
+}
+
+// list all messages in new and cur with their info ordered by delivery time
+func (d MailDir) ListInfo() ([]mailstore.MessageInfo, error) {
+	return d.Search(nil)
+}
+
+// list messages whose info matches, all messages if match is nil
+// results are ordered by delivery time
+func (d MailDir) Search(match func(*mailstore.MessageInfo) bool) (infos []mailstore.MessageInfo, err error) {
+	ix := d.index()
+	ix.mtx.Lock()
+	err = ix.sync()
+	if err == nil {
+		for name, e := range ix.entries {
+			info := ix.info(name, e)
+			if match == nil || match(&info) {
+				infos = append(infos, info)
+			}
+		}
+	}
+	ix.mtx.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Date.Equal(infos[j].Date) {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Date.Before(infos[j].Date)
+	})
+	return
+}
+
+// get the info of 1 message by unique name
+func (d MailDir) Info(name string) (info mailstore.MessageInfo, err error) {
+	ix := d.index()
+	ix.mtx.Lock()
+	defer ix.mtx.Unlock()
+	err = ix.sync()
+	if err == nil {
+		e, ok := ix.entries[name]
+		if ok {
+			info = ix.info(name, e)
+		} else {
+			err = ErrNoSuchMessage
+		}
+	}
+	return
+}
+
+// set the delivery time of a message
+func (d MailDir) SetDate(msg mailstore.Message, date time.Time) (err error) {
+	err = os.Chtimes(msg.Filepath(), date, date)
+	if err == nil {
+		ix := d.index()
+		ix.mtx.Lock()
+		if e, ok := ix.entries[Message(msg.Filepath()).Name()]; ok && ix.loaded {
+			e.Date = date
+			ix.dirty = true
+		}
+		ix.mtx.Unlock()
+	}
+	return
+}
+
+// drop the cached indexes of a maildir and the folders in it after they were moved or deleted
+func forgetIndexes(path string) {
+	indexes.Lock()
+	for p := range indexes.m {
+		if p == path || strings.HasPrefix(p, path+".") {
+			delete(indexes.m, p)
+		}
+	}
+	indexes.Unlock()
+}
+
+// remove a message from this maildir
+func (d MailDir) Remove(msg mailstore.Message) (err error) {
+	err = msg.Remove()
+	if err == nil {
+		d.unindexed(msg.Filepath())
+	}
+	return
+}
+
+var _ mailstore.QuotaStore = MailDir("")
+
+// get the total size and number of messages in this maildir and all of its folders
+func (d MailDir) Usage() (bytes, messages int64, err error) {
+	dirs := []MailDir{d}
+	var names []string
+	names, err = d.Folders()
+	for _, name := range names {
+		f, _ := d.Folder(name)
+		dirs = append(dirs, f)
+	}
+	for _, md := range dirs {
+		if err != nil {
+			return
+		}
+		ix := md.index()
+		ix.mtx.Lock()
+		err = ix.sync()
+		for _, e := range ix.entries {
+			bytes += e.Size
+			messages++
+		}
+		ix.mtx.Unlock()
+	}
+	return
+}
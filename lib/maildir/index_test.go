@@ -0,0 +1,171 @@
+package maildir
+
+import (
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	md := testMailDir(t)
+	var msgs []mailstore.Message
+	for i := 0; i < 3; i++ {
+		msg, err := md.Deliver(strings.NewReader(fmt.Sprintf("From: a@b.i2p\r\nSubject: msg %d\r\n\r\nbody\r\n", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// order by delivery time
+		md.SetDate(msg, time.Unix(int64(1000+i), 0))
+		msgs = append(msgs, msg)
+	}
+	infos, err := md.ListInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("listed %d messages", len(infos))
+	}
+	for i, info := range infos {
+		if info.Envelope.Subject != fmt.Sprintf("msg %d", i) || info.Envelope.From != "a@b.i2p" || !info.New {
+			t.Errorf("bad info %+v", info)
+		}
+		if info.Size != int64(len("From: a@b.i2p\r\nSubject: msg 0\r\n\r\nbody\r\n")) {
+			t.Errorf("bad size %d", info.Size)
+		}
+	}
+
+	// changes through the maildir show up
+	cur, err := md.ProcessNew(Message(msgs[0].Filepath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = md.AddFlags(cur, Seen, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	if err = md.Remove(msgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ = md.ListInfo()
+	if len(infos) != 2 || infos[0].New || infos[0].Flags != "FS" || infos[1].Envelope.Subject != "msg 2" {
+		t.Errorf("index not updated: %+v", infos)
+	}
+
+	// changes made behind our back show up too
+	os.Remove(msgs[2].Filepath())
+	infos, _ = md.ListInfo()
+	if len(infos) != 1 {
+		t.Errorf("removed message still listed: %+v", infos)
+	}
+	found, err := md.Search(func(info *mailstore.MessageInfo) bool {
+		return strings.Contains(info.Envelope.Subject, "0")
+	})
+	if err != nil || len(found) != 1 {
+		t.Errorf("search found %v %v", found, err)
+	}
+}
+
+func TestIndexSaved(t *testing.T) {
+	md := testMailDir(t)
+	msg, err := md.Deliver(strings.NewReader("Subject: original\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = md.ListInfo(); err != nil {
+		t.Fatal(err)
+	}
+	// a new process loads the saved index instead of reading the message
+	ioutil.WriteFile(msg.Filepath(), []byte("Subject: changed\r\n\r\n"), 0600)
+	forgetIndexes(md.Filepath())
+	info, err := md.Info(Message(msg.Filepath()).Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Envelope.Subject != "original" {
+		t.Errorf("index was not loaded from disk, got subject %q", info.Envelope.Subject)
+	}
+
+	// a broken index is rebuilt
+	ioutil.WriteFile(md.Filepath()+"/"+indexFile, []byte("garbage"), 0600)
+	forgetIndexes(md.Filepath())
+	info, err = md.Info(Message(msg.Filepath()).Name())
+	if err != nil || info.Envelope.Subject != "changed" {
+		t.Errorf("broken index not rebuilt: %+v %v", info, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	md := testMailDir(t)
+	msg, err := md.Deliver(strings.NewReader("Subject: find\n\nme\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := Message(msg.Filepath()).Name()
+	found, err := md.Find(name)
+	if err != nil || found.Filepath() != msg.Filepath() {
+		t.Fatalf("found %q %v", found, err)
+	}
+	// moved behind our back
+	moved := md.Cur(name + infoSep + "S")
+	if err = os.Rename(msg.Filepath(), moved); err != nil {
+		t.Fatal(err)
+	}
+	found, err = md.Find(name)
+	if err != nil || found.Filepath() != moved {
+		t.Errorf("moved message found at %q %v", found, err)
+	}
+	if _, err = md.Find("nonexistent"); err != ErrNoSuchMessage {
+		t.Errorf("found a message that doesn't exist: %v", err)
+	}
+	// bare line feeds count as CRLF for clients
+	info, err := md.Info(name)
+	if err != nil || info.Size != 18 || info.WireSize != 21 {
+		t.Errorf("bad sizes %+v %v", info, err)
+	}
+}
+
+func BenchmarkAddFlags(b *testing.B) {
+	md := MailDir(b.TempDir())
+	md.Ensure()
+	var msgs []Message
+	for i := 0; i < 10000; i++ {
+		msg, _ := md.Deliver(strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\n", i)))
+		msgs = append(msgs, Message(msg.Filepath()))
+	}
+	md.ListInfo()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx := i % len(msgs)
+		msgs[idx], _ = md.AddFlags(msgs[idx], Flag('a'+rune(i/len(msgs)%26)))
+	}
+}
+
+func BenchmarkListInfo(b *testing.B) {
+	md := MailDir(b.TempDir())
+	md.Ensure()
+	for i := 0; i < 10000; i++ {
+		md.Deliver(strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\n", i)))
+	}
+	md.ListInfo()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		md.ListInfo()
+	}
+}
+
+func TestUsage(t *testing.T) {
+	md := testMailDir(t)
+	md.Deliver(strings.NewReader("12345"))
+	f, err := md.EnsureFolder("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Deliver(strings.NewReader("123"))
+	bytes, messages, err := md.Usage()
+	if err != nil || bytes != 8 || messages != 2 {
+		t.Errorf("usage is %d bytes %d messages %v", bytes, messages, err)
+	}
+}
@@ -2,18 +2,22 @@ package maildir
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/majestrate/bdsmail/lib/mailstore"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 // maildir mailbox protocol
 type MailDir string
 
+var ErrNoSuchMessage = errors.New("no such message")
+
 // get absolute filepath for this maildir
 func (d MailDir) Filepath() (str string) {
 	str, _ = filepath.Abs(string(d))
@@ -45,13 +49,15 @@ func (d MailDir) Ensure() (err error) {
 // get a string of the current filename to use
 func (d MailDir) File() (fname string) {
 	hostname, err := os.Hostname()
-	if err == nil {
-		b := make([]byte, 8)
-		io.ReadFull(rand.Reader, b)
-		fname = fmt.Sprintf("%x%d%d.%s", b, time.Now().Unix(), os.Getpid(), hostname)
-	} else {
-		log.Fatal("hostname() call failed", err)
+	if err != nil {
+		log.Warnf("hostname() call failed: %s", err.Error())
+		hostname = "localhost"
 	}
+	// the maildir spec escapes characters that can't be in the hostname part
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	b := make([]byte, 8)
+	io.ReadFull(rand.Reader, b)
+	fname = fmt.Sprintf("%x%d%d.%s", b, time.Now().Unix(), os.Getpid(), hostname)
 	return
 }
 
@@ -80,61 +86,61 @@ func (d MailDir) Cur(fname string) (f string) {
 	return
 }
 
+// how many names to try before giving up on creating a tmp file
+const deliverRetries = 10
+
+// fsync a directory so renames into it are durable
+func syncDir(dir string) (err error) {
+	var f *os.File
+	f, err = os.Open(dir)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	return
+}
+
 // deliver mail to this maildir
+// the message is written to tmp and synced to disk before it is renamed into new
 // return messsage that was delivered
 func (d MailDir) Deliver(body io.Reader) (msg mailstore.Message, err error) {
-	var oldwd string
-	oldwd, err = os.Getwd()
+	var f *os.File
+	var fname string
+	for tries := 0; tries < deliverRetries; tries++ {
+		fname = d.File()
+		// never reuse a tmp file someone else is writing
+		f, err = os.OpenFile(d.Temp(fname), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	tmp := d.Temp(fname)
+	_, err = io.Copy(f, body)
 	if err == nil {
-		// no error getting working directory, let's begin
-
-		// when done chdir to previous directory
-		defer func() {
-			err := os.Chdir(oldwd)
-			if err != nil {
-				log.Fatal("chdir failed", err)
-			}
-		}()
-		// chdir to maildir
-		err = os.Chdir(d.Filepath())
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		fn := d.New(fname)
+		err = os.Rename(tmp, fn)
 		if err == nil {
-			fname := d.File()
-			for {
-				_, err = os.Stat(d.Temp(fname))
-				if os.IsNotExist(err) {
-					break
-				}
-				time.Sleep(time.Second * 2)
-				fname = d.File()
-			}
-			// set err to nil
-			err = nil
-			var f *os.File
-			// create tmp file
-			f, err = os.Create(d.Temp(fname))
-			if err == nil {
-				// success creation
-				err = f.Close()
-			}
-			// try writing file
-			if err == nil {
-				f, err = os.OpenFile(d.Temp(fname), os.O_CREATE|os.O_WRONLY, 0600)
-				if err == nil {
-					// write body
-					_, err = io.Copy(f, body)
-					f.Close()
-					if err == nil {
-						fn := d.New(fname)
-						err = os.Rename(d.Temp(fname), fn)
-						if err == nil {
-							// delivered
-							msg = Message(fn)
-						}
-					}
-				}
+			// delivered even if syncing new fails
+			msg = Message(fn)
+			d.indexed(fn)
+			if serr := syncDir(filepath.Dir(fn)); serr != nil {
+				log.Warnf("failed to sync %s: %s", filepath.Dir(fn), serr.Error())
 			}
 		}
 	}
+	if err != nil {
+		// don't leave partial messages around
+		os.Remove(tmp)
+	}
 	return
 }
 
@@ -190,76 +196,116 @@ func (d MailDir) Process(msg mailstore.Message) (m mailstore.Message, err error)
 }
 
 // process new message and move it to the cur directory
+// the flags are set on it if any are given
 func (d MailDir) ProcessNew(msg Message, flags ...Flag) (m Message, err error) {
 	// find message
 	fname := d.New(msg.Filename())
 	_, err = os.Stat(fname)
 	if err == nil {
-		var newname string
-		// message exists and is accessable
+		newname := d.Cur(msg.Filename())
 		if len(flags) > 0 {
-			var fl string
-			for _, f := range flags {
-				fl += f.String()
-			}
-			// set flags
-			newname = d.Cur(fmt.Sprintf("%s:2,%s", msg.Name(), fl))
-		} else {
-			// don't touch flags
-			newname = d.Cur(msg.Filename())
+			newname = d.Cur(msg.Name() + infoSep + formatFlags(flags))
 		}
 		err = os.Rename(fname, newname)
 		if err == nil {
 			m = Message(newname)
+			d.indexed(newname)
 		}
 	}
 	return
 }
 
-// process message in cur and change its flags if specified
+// process message in cur and add flags to it if specified
 func (d MailDir) ProcessCur(msg Message, flags ...Flag) (err error) {
-	fname := d.Cur(msg.Filename())
-	_, err = os.Stat(fname)
-	if err == nil {
-		// message exists and is accessable
-		if len(flags) > 0 {
-			var fl string
-			for _, f := range flags {
-				fl += f.String()
-			}
-			// set message flags
-			err = os.Rename(fname, d.Cur(fmt.Sprintf("%s:2,%s", msg.Name(), fl)))
-		} else {
-			// don't touch the message's flags if non are provided
-		}
+	_, err = os.Stat(d.Cur(msg.Filename()))
+	if err == nil && len(flags) > 0 {
+		_, err = d.AddFlags(msg, flags...)
 	}
 	return
 }
 
-// return true if this message is in cur directory
-func (d MailDir) IsCur(msg Message) (is bool, err error) {
-	_, err = os.Stat(d.Cur(msg.Filepath()))
-	if os.IsNotExist(err) {
-		err = nil
-	} else {
-		is = true
+// how many times to retry changing flags of a message that was renamed by someone else
+const flagRetries = 10
+
+// change the flags of a message by renaming it into cur
+// returns the message after being renamed
+func (d MailDir) changeFlags(msg Message, change func([]Flag) []Flag) (m Message, err error) {
+	for tries := 0; tries < flagRetries; tries++ {
+		// find where the message is now
+		msg, err = d.Find(msg.Name())
+		if err != nil {
+			return
+		}
+		fname := d.Cur(msg.Name() + infoSep + formatFlags(change(msg.GetFlags())))
+		if fname == msg.Filepath() {
+			m = msg
+			return
+		}
+		err = os.Rename(msg.Filepath(), fname)
+		if err == nil {
+			m = Message(fname)
+			d.indexed(fname)
+			return
+		}
+		if !os.IsNotExist(err) {
+			return
+		}
 	}
 	return
 }
 
-// return true if this message is in cur directory
-func (d MailDir) IsNew(msg Message) (is bool, err error) {
-	_, err = os.Stat(d.New(msg.Filepath()))
-	if os.IsNotExist(err) {
-		err = nil
-	} else {
+// set the flags of a message, replacing any flags it had
+// returns the message after being renamed
+func (d MailDir) SetFlags(msg Message, flags ...Flag) (Message, error) {
+	return d.changeFlags(msg, func([]Flag) []Flag {
+		return flags
+	})
+}
+
+// add flags to a message
+// returns the message after being renamed
+func (d MailDir) AddFlags(msg Message, flags ...Flag) (Message, error) {
+	return d.changeFlags(msg, func(old []Flag) []Flag {
+		return append(old, flags...)
+	})
+}
+
+// remove flags from a message
+// returns the message after being renamed
+func (d MailDir) RemoveFlags(msg Message, flags ...Flag) (Message, error) {
+	return d.changeFlags(msg, func(old []Flag) (keep []Flag) {
+		for _, f := range old {
+			if !hasFlag(flags, f) {
+				keep = append(keep, f)
+			}
+		}
+		return
+	})
+}
+
+// return true if a file exists
+func exists(fname string) (is bool, err error) {
+	_, err = os.Stat(fname)
+	if err == nil {
 		is = true
+	} else if os.IsNotExist(err) {
+		err = nil
 	}
 	return
 }
 
+// return true if this message is in cur directory
+func (d MailDir) IsCur(msg Message) (bool, error) {
+	return exists(d.Cur(msg.Filename()))
+}
+
+// return true if this message is in new directory
+func (d MailDir) IsNew(msg Message) (bool, error) {
+	return exists(d.New(msg.Filename()))
+}
+
 // open message in cur directory
 func (d MailDir) OpenMessage(msg Message) (f *os.File, err error) {
-	f, err = os.Open(d.Cur(msg.Filepath()))
+	f, err = os.Open(d.Cur(msg.Filename()))
 	return
 }
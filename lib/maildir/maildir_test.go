@@ -0,0 +1,147 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// deliver a message and move it to cur
+func testMessage(t *testing.T, md MailDir, flags ...Flag) Message {
+	msg, err := md.Deliver(strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := md.ProcessNew(Message(msg.Filepath()), flags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestGetFlags(t *testing.T) {
+	for _, tc := range []struct {
+		path  string
+		flags []Flag
+	}{
+		{"/mail/cur/123.host", nil},
+		{"/mail/cur/123.host:2,", nil},
+		{"/mail/cur/123.host:2,S", []Flag{Seen}},
+		{"/mail/cur/123.host:2,TSF", []Flag{Flagged, Seen, Trashed}},
+		{"/mail/cur/123.host:2,SS", []Flag{Seen}},
+		{"/mail/cur/123.host:2,Sa", []Flag{Seen, 'a'}},
+		// commas before the info must not confuse parsing
+		{"/mail,box/cur/123,x.host:2,R", []Flag{Replied}},
+		{"/mail/cur/123.host:1,S", nil},
+	} {
+		msg := Message(tc.path)
+		if got := msg.GetFlags(); !reflect.DeepEqual(got, tc.flags) {
+			t.Errorf("flags of %s are %q, want %q", tc.path, got, tc.flags)
+		}
+	}
+	if Message("/mail/cur/123.host:2,S").Name() != "123.host" {
+		t.Error("bad message name")
+	}
+}
+
+func TestFlagOps(t *testing.T) {
+	md := testMailDir(t)
+	msg := testMessage(t, md, Seen, Draft)
+	if !strings.HasSuffix(msg.Filename(), ":2,DS") {
+		t.Fatalf("flags not sorted in %s", msg.Filename())
+	}
+	m, err := md.AddFlags(msg, Flagged, Seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(m.Filename(), ":2,DFS") {
+		t.Errorf("bad flags after add: %s", m.Filename())
+	}
+	// old name still finds the message
+	m, err = md.RemoveFlags(msg, Draft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(m.Filename(), ":2,FS") {
+		t.Errorf("bad flags after remove: %s", m.Filename())
+	}
+	m, err = md.SetFlags(m, Replied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.GetFlags(), []Flag{Replied}) || !m.HasFlag(Replied) || m.HasFlag(Seen) {
+		t.Errorf("bad flags after set: %s", m.Filename())
+	}
+	if err = md.ProcessCur(m, Seen); err != nil {
+		t.Fatal(err)
+	}
+	found, err := md.Find(msg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(found.Filename(), ":2,RS") {
+		t.Errorf("process cur did not add flags: %s", found.Filename())
+	}
+	if _, err = md.Find("missing"); err != ErrNoSuchMessage {
+		t.Errorf("finding missing message gave %v", err)
+	}
+	if _, err = md.Find("../cur"); err != ErrNoSuchMessage {
+		t.Errorf("finding bad name gave %v", err)
+	}
+}
+
+func TestFlagsOnNewMessage(t *testing.T) {
+	md := testMailDir(t)
+	msg, err := md.Deliver(strings.NewReader("Subject: new\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, _ := md.IsNew(Message(msg.Filepath())); !is {
+		t.Fatal("delivered message not new")
+	}
+	m, err := md.AddFlags(Message(msg.Filepath()), Seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, _ := md.IsCur(m); !is {
+		t.Error("flagged message not moved to cur")
+	}
+	if is, _ := md.IsNew(m); is {
+		t.Error("flagged message still new")
+	}
+	f, err := md.OpenMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(body) != "Subject: new\r\n\r\n" {
+		t.Errorf("bad body %q", body)
+	}
+}
+
+func TestConcurrentFlags(t *testing.T) {
+	md := testMailDir(t)
+	msg := testMessage(t, md)
+	flags := []Flag{Seen, Flagged, Replied, Passed, Draft}
+	var wg sync.WaitGroup
+	for _, f := range flags {
+		wg.Add(1)
+		go func(f Flag) {
+			defer wg.Done()
+			if _, err := md.AddFlags(msg, f); err != nil {
+				t.Error(err)
+			}
+		}(f)
+	}
+	wg.Wait()
+	m, err := md.Find(msg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetFlags(); !reflect.DeepEqual(got, sortFlags(flags)) {
+		t.Errorf("lost flags with concurrent adds: %q", got)
+	}
+}
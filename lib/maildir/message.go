@@ -6,6 +6,9 @@ import (
 	"strings"
 )
 
+// separates a message's unique name from the flags in its filename
+const infoSep = ":2,"
+
 type Message string
 
 func (m Message) Filepath() string {
@@ -21,19 +24,22 @@ func (m Message) Remove() error {
 	return os.Remove(m.Filepath())
 }
 
+// get the unique name of this message without its flags
 func (m Message) Name() string {
 	return strings.Split(m.Filename(), ":")[0]
 }
 
-// get flags on this message
+// get flags on this message sorted in ascii order
 func (m Message) GetFlags() (flags []Flag) {
-	s := m.Filepath()
-	if strings.Count(s, ":2,") == 1 {
-		// we have flags
-		f := strings.Split(s, ",")[1]
-		for _, fl := range f {
-			flags = append(flags, Flag(fl))
-		}
+	fname := m.Filename()
+	idx := strings.Index(fname, infoSep)
+	if idx >= 0 {
+		flags = parseFlags(fname[idx+len(infoSep):])
 	}
 	return
 }
+
+// return true if this message has a flag
+func (m Message) HasFlag(flag Flag) bool {
+	return hasFlag(m.GetFlags(), flag)
+}
@@ -0,0 +1,31 @@
+package mailstore
+
+import (
+	"errors"
+)
+
+var ErrNoSuchFolder = errors.New("no such folder")
+var ErrFolderExists = errors.New("folder already exists")
+var ErrBadFolder = errors.New("bad folder name")
+
+// folder spam is filed in
+const JunkFolder = "Junk"
+
+// a store that has sub folders
+// nested folder names are separated by '.'
+type FolderStore interface {
+	Store
+	// list the names of all folders
+	Folders() ([]string, error)
+	// get a folder that exists
+	OpenFolder(name string) (Store, error)
+	// create a new folder
+	CreateFolder(name string) error
+	// rename a folder and the folders inside it
+	RenameFolder(oldname, newname string) error
+	// delete a folder and all messages in it
+	DeleteFolder(name string) error
+	// move a message in this store to another store keeping its flags
+	// returns the message after being moved
+	Move(msg Message, to Store) (Message, error)
+}
@@ -0,0 +1,44 @@
+package mailstore
+
+import (
+	"time"
+)
+
+// header fields of a message that describe its envelope
+type Envelope struct {
+	Date      string `json:"date,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	From      string `json:"from,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	ReplyTo   string `json:"reply_to,omitempty"`
+	To        string `json:"to,omitempty"`
+	Cc        string `json:"cc,omitempty"`
+	Bcc       string `json:"bcc,omitempty"`
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// cached information about a message in a store
+type MessageInfo struct {
+	Message Message
+	// unique name of the message
+	Name string
+	// size in bytes
+	Size int64
+	// size in bytes with CRLF line endings, as sent to imap clients
+	WireSize int64
+	// message was not processed yet
+	New bool
+	// maildir flag letters set on the message
+	Flags string
+	// when the message was delivered
+	Date     time.Time
+	Envelope Envelope
+}
+
+// a store that keeps an index of its messages
+type IndexedStore interface {
+	Store
+	// list all messages with their info ordered by delivery time
+	ListInfo() ([]MessageInfo, error)
+}
@@ -1,7 +1,25 @@
 package mailstore
 
+import (
+	"io"
+)
+
+// delivery status notifications the sender of a message asked for with smtp parameters (RFC 3461)
+type DSN struct {
+	// RET of MAIL FROM, "FULL", "HDRS" or empty if not given
+	Ret string
+	// ENVID of MAIL FROM decoded from xtext, empty if not given
+	EnvID string
+	// NOTIFY of RCPT TO by recipiant, missing if not given
+	Notify map[string]string
+	// ORCPT of RCPT TO by recipiant as "addr-type;address" decoded from xtext, missing if not given
+	ORcpt map[string]string
+}
+
 type SendQueue interface {
 	Ensure() error
-	Offer(msg Message) error
-	Pop() (Message, bool)
+	// queue a message for delivery to the recipiants of an smtp envelope
+	Enqueue(from string, to []string, body io.Reader) (Message, error)
+	// queue a message like Enqueue with the delivery status notifications its sender asked for, dsn may be nil
+	EnqueueDSN(from string, to []string, dsn *DSN, body io.Reader) (Message, error)
 }
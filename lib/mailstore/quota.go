@@ -0,0 +1,18 @@
+package mailstore
+
+import (
+	"errors"
+)
+
+// the message would take the store over its quota, retrying later may work
+var ErrMailboxFull = errors.New("mailbox full")
+
+// the message is bigger than the whole quota of the store, it will never fit
+var ErrOverQuota = errors.New("message exceeds storage quota")
+
+// a store that knows how much it holds
+type QuotaStore interface {
+	Store
+	// total size in bytes and number of messages in the store
+	Usage() (int64, int64, error)
+}
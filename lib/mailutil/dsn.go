@@ -0,0 +1,245 @@
+package mailutil
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/util"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// what happened to a recipiant in a delivery status notification
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+)
+
+// values of the RET and NOTIFY smtp parameters
+const (
+	RetFull       = "FULL"
+	RetHeaders    = "HDRS"
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// local part of the address delivery status notifications come from
+const MailerDaemon = "MAILER-DAEMON"
+
+var (
+	replyRE  = regexp.MustCompile(`^([245])[0-9][0-9][ -]`)
+	statusRE = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+)
+
+// return true if a NOTIFY parameter asks for notifications of an event
+// without NOTIFY only failures are reported
+func Notifies(notify, event string) bool {
+	if notify == "" {
+		return event == NotifyFailure
+	}
+	for _, ev := range strings.Split(notify, ",") {
+		if strings.EqualFold(ev, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// get the enhanced status code of an smtp reply like "550 5.1.1 no such user"
+// returns the class of the reply code if it has none or empty string if it's not an smtp reply
+func ReplyStatus(reply string) string {
+	match := replyRE.FindStringSubmatch(reply)
+	if match == nil {
+		return ""
+	}
+	if status := statusRE.FindString(reply[4:]); status != "" && status[0] == match[1][0] {
+		return status
+	}
+	return match[1] + ".0.0"
+}
+
+// status of 1 recipiant in a delivery status notification
+type ReportRecipient struct {
+	// address we delivered or tried delivering to
+	Final string
+	// ORCPT the sender gave as "addr-type;address", empty if not given
+	Original string
+	// one of the Action values
+	Action string
+	// enhanced status code like 5.1.1
+	Status string
+	// smtp reply or our own error text saying what went wrong, empty for none
+	Diagnostic string
+}
+
+// delivery status notification (RFC 3464)
+type Report struct {
+	// hostname of the mta making the report, the report is from MAILER-DAEMON at it
+	Hostname string
+	// ENVID the sender gave, empty if not given
+	EnvID string
+	// when we got the original message, zero if not known
+	Arrival time.Time
+	// only return the header of the original message
+	HeadersOnly bool
+	Recipients  []ReportRecipient
+}
+
+// get the action most worth telling the sender about
+func (r *Report) action() (action string) {
+	for _, rcpt := range r.Recipients {
+		switch rcpt.Action {
+		case ActionFailed:
+			return ActionFailed
+		case ActionDelayed:
+			action = ActionDelayed
+		default:
+			if action == "" {
+				action = rcpt.Action
+			}
+		}
+	}
+	return
+}
+
+// make a value fit on 1 header line
+func oneLine(str string) string {
+	return strings.Join(strings.Fields(str), " ")
+}
+
+// write a delivery status notification going to an address
+// msg is the original message or nil to not return it
+func WriteReport(wr io.Writer, to string, r *Report, msg io.Reader) (err error) {
+	bw := bufio.NewWriter(wr)
+	mw := multipart.NewWriter(bw)
+	action := r.action()
+	subject := "Delivery Status Notification (Success)"
+	switch action {
+	case ActionFailed:
+		subject = "Undelivered Mail Returned to Sender"
+	case ActionDelayed:
+		subject = "Delayed Mail (still being retried)"
+	}
+	c := textproto.NewWriter(bw)
+	c.PrintfLine("From: Mail Delivery System <%s@%s>", MailerDaemon, r.Hostname)
+	c.PrintfLine("To: <%s>", to)
+	c.PrintfLine("Subject: %s", subject)
+	c.PrintfLine("Date: %s", time.Now().Format(time.RFC1123Z))
+	c.PrintfLine("Message-ID: <%s@%s>", util.RandStr(20), r.Hostname)
+	c.PrintfLine("Auto-Submitted: auto-replied")
+	c.PrintfLine("MIME-Version: 1.0")
+	c.PrintfLine("Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"", mw.Boundary())
+	c.PrintfLine("")
+	c.PrintfLine("This is a MIME-encapsulated message.")
+	c.PrintfLine("")
+	// human readable part
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "text/plain; charset=us-ascii")
+	var w io.Writer
+	w, err = mw.CreatePart(hdr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", r.Hostname)
+	switch action {
+	case ActionFailed:
+		fmt.Fprintf(w, "Your message could not be delivered to one or more recipients.\r\n")
+	case ActionDelayed:
+		fmt.Fprintf(w, "Your message could not be delivered yet, we will keep trying.\r\n")
+	default:
+		fmt.Fprintf(w, "Your message was successfully delivered as you asked to be told.\r\n")
+	}
+	fmt.Fprintf(w, "\r\n")
+	for _, rcpt := range r.Recipients {
+		if rcpt.Diagnostic == "" {
+			fmt.Fprintf(w, "<%s>: %s\r\n", rcpt.Final, rcpt.Action)
+		} else {
+			fmt.Fprintf(w, "<%s>: %s\r\n", rcpt.Final, oneLine(rcpt.Diagnostic))
+		}
+	}
+	// machine readable part
+	hdr = make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "message/delivery-status")
+	w, err = mw.CreatePart(hdr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", r.Hostname)
+	if r.EnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", oneLine(r.EnvID))
+	}
+	if !r.Arrival.IsZero() {
+		fmt.Fprintf(w, "Arrival-Date: %s\r\n", r.Arrival.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range r.Recipients {
+		fmt.Fprintf(w, "\r\nFinal-Recipient: rfc822; %s\r\n", rcpt.Final)
+		if rcpt.Original != "" {
+			fmt.Fprintf(w, "Original-Recipient: %s\r\n", oneLine(rcpt.Original))
+		}
+		fmt.Fprintf(w, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(w, "Status: %s\r\n", rcpt.Status)
+		if rcpt.Diagnostic != "" {
+			diag := "X-Bdsmail"
+			if ReplyStatus(rcpt.Diagnostic) != "" {
+				diag = "smtp"
+			}
+			fmt.Fprintf(w, "Diagnostic-Code: %s; %s\r\n", diag, oneLine(rcpt.Diagnostic))
+		}
+	}
+	// the original message
+	if msg != nil {
+		hdr = make(textproto.MIMEHeader)
+		if r.HeadersOnly {
+			hdr.Set("Content-Type", "text/rfc822-headers")
+		} else {
+			hdr.Set("Content-Type", "message/rfc822")
+		}
+		w, err = mw.CreatePart(hdr)
+		if err != nil {
+			return
+		}
+		if r.HeadersOnly {
+			err = copyHeader(w, msg)
+		} else {
+			_, err = io.Copy(w, msg)
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = mw.Close()
+	if err == nil {
+		err = bw.Flush()
+	}
+	return
+}
+
+// copy the header of a message up to the blank line ending it
+func copyHeader(w io.Writer, msg io.Reader) (err error) {
+	r := bufio.NewReader(msg)
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if _, e := io.WriteString(w, line); e != nil {
+			return e
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+	}
+}
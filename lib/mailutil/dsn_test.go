@@ -0,0 +1,89 @@
+package mailutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestReplyStatus(t *testing.T) {
+	for in, out := range map[string]string{
+		"550 5.1.1 no such user":  "5.1.1",
+		"452 too many recipients": "4.0.0",
+		"550 4.1.1 confused":      "5.0.0",
+		"disk on fire":            "",
+	} {
+		if got := ReplyStatus(in); got != out {
+			t.Errorf("ReplyStatus(%q) = %q want %q", in, got, out)
+		}
+	}
+}
+
+func TestNotifies(t *testing.T) {
+	if !Notifies("", NotifyFailure) || Notifies("", NotifySuccess) {
+		t.Errorf("default NOTIFY is not FAILURE")
+	}
+	if Notifies(NotifyNever, NotifyFailure) || !Notifies("SUCCESS,DELAY", NotifySuccess) {
+		t.Errorf("NOTIFY not followed")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	orig := "From: alice@example.i2p\r\nSubject: hello\r\n\r\nsecret body\r\n"
+	r := &Report{
+		Hostname:    "test.b32.i2p",
+		EnvID:       "QQ314159",
+		HeadersOnly: true,
+		Recipients: []ReportRecipient{
+			{
+				Final:      "bob@example.i2p",
+				Original:   "rfc822;bob@example.i2p",
+				Action:     ActionFailed,
+				Status:     "5.1.1",
+				Diagnostic: "550 5.1.1 no such user",
+			},
+		},
+	}
+	var buff bytes.Buffer
+	err := WriteReport(&buff, "alice@example.i2p", r, strings.NewReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(&buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := msg.Header.Get("From"); !strings.Contains(from, "MAILER-DAEMON@test.b32.i2p") {
+		t.Errorf("bad From %q", from)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("bad content type %q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types, bodies []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(data))
+	}
+	if len(types) != 3 || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("bad parts %v", types)
+	}
+	for _, line := range []string{"Reporting-MTA: dns; test.b32.i2p", "Original-Envelope-Id: QQ314159", "Final-Recipient: rfc822; bob@example.i2p", "Original-Recipient: rfc822;bob@example.i2p", "Action: failed", "Status: 5.1.1", "Diagnostic-Code: smtp; 550 5.1.1 no such user"} {
+		if !strings.Contains(bodies[1], line+"\r\n") {
+			t.Errorf("delivery status missing %q:\n%s", line, bodies[1])
+		}
+	}
+	if !strings.Contains(bodies[2], "Subject: hello") || strings.Contains(bodies[2], "secret body") {
+		t.Errorf("bad returned header %q", bodies[2])
+	}
+}
@@ -0,0 +1,2 @@
+// managesieve server from RFC 5804 for uploading sieve scripts
+package managesieve
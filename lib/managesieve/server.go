@@ -0,0 +1,500 @@
+package managesieve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/db"
+	"github.com/majestrate/bdsmail/lib/model"
+	"github.com/majestrate/bdsmail/lib/sieve"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// function that authenticates a user
+type UserAuthenticator func(string, string) (bool, error)
+
+// storage for sieve scripts, implemented by db.DB
+type ScriptStore interface {
+	ListSieveScripts(user string) ([]*model.SieveScript, error)
+	GetSieveScript(user, name string) (*model.SieveScript, error)
+	PutSieveScript(user, name, script string) error
+	DeleteSieveScript(user, name string) error
+	RenameSieveScript(user, oldname, newname string) error
+	ActivateSieveScript(user, name string) error
+}
+
+// default largest script size in bytes
+const DefaultMaxScriptSize = 64 * 1024
+
+// most scripts a user can have
+const maxScripts = 64
+
+// managesieve server
+type Server struct {
+	// where scripts are kept
+	Scripts ScriptStore
+	// login authenticator
+	Auth UserAuthenticator
+	// largest script in bytes
+	MaxScriptSize int64
+	// tls config
+	TLS *tls.Config
+}
+
+func New() *Server {
+	return &Server{
+		MaxScriptSize: DefaultMaxScriptSize,
+	}
+}
+
+// serve managesieve via a net.Listener
+func (s *Server) Serve(l net.Listener) (err error) {
+	defer l.Close()
+	for {
+		var c net.Conn
+		c, err = l.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		sess := &session{
+			s:  s,
+			nc: c,
+		}
+		sess.setConn(c)
+		go sess.Run()
+	}
+}
+
+// managesieve session
+type session struct {
+	s  *Server
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+	// logged in user, empty if not authenticated
+	user string
+	tls  bool
+}
+
+func (m *session) setConn(c net.Conn) {
+	m.nc = c
+	m.r = bufio.NewReader(c)
+	m.w = bufio.NewWriter(c)
+}
+
+// quote a string for a response
+func quote(str string) string {
+	if strings.ContainsAny(str, "\r\n") {
+		return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str) + `"`
+}
+
+// send a response line
+func (m *session) line(format string, args ...interface{}) {
+	fmt.Fprintf(m.w, format+"\r\n", args...)
+}
+
+// send a final response and flush
+func (m *session) respond(status, code, text string) {
+	resp := status
+	if code != "" {
+		resp += " (" + code + ")"
+	}
+	if text != "" {
+		resp += " " + quote(text)
+	}
+	m.line("%s", resp)
+	m.w.Flush()
+}
+
+func (m *session) ok(text string) {
+	m.respond("OK", "", text)
+}
+
+func (m *session) no(code, text string) {
+	m.respond("NO", code, text)
+}
+
+// send capabilities
+func (m *session) capabilities() {
+	m.line(`"IMPLEMENTATION" "bdsmail"`)
+	m.line(`"SASL" "PLAIN"`)
+	m.line(`"SIEVE" %s`, quote(strings.Join(sieve.Extensions, " ")))
+	if m.s.TLS != nil && !m.tls {
+		m.line(`"STARTTLS"`)
+	}
+	m.line(`"MAXREDIRECTS" "4"`)
+	m.line(`"VERSION" "1.0"`)
+	if m.user != "" {
+		m.line(`"OWNER" %s`, quote(m.user))
+	}
+}
+
+// error for bad command syntax
+var errSyntax = errors.New("syntax error")
+
+// read a command and its arguments
+func (m *session) readCommand() (cmd string, args []string, err error) {
+	var line string
+	line, err = m.readLine()
+	if err != nil {
+		return
+	}
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		switch line[0] {
+		case '"':
+			var str string
+			str, line, err = parseQuoted(line)
+			if err != nil {
+				return
+			}
+			args = append(args, str)
+		case '{':
+			// literal, rest of command continues on the next line
+			end := strings.Index(line, "}")
+			if end < 0 || end != len(line)-1 {
+				err = errSyntax
+				return
+			}
+			var n int64
+			n, err = strconv.ParseInt(strings.TrimSuffix(line[1:end], "+"), 10, 64)
+			if err != nil || n < 0 || n > m.s.MaxScriptSize {
+				err = errSyntax
+				return
+			}
+			buf := make([]byte, n)
+			_, err = io.ReadFull(m.r, buf)
+			if err != nil {
+				return
+			}
+			args = append(args, string(buf))
+			line, err = m.readLine()
+			if err != nil {
+				return
+			}
+		default:
+			end := strings.Index(line, " ")
+			if end < 0 {
+				end = len(line)
+			}
+			if cmd == "" {
+				cmd = strings.ToUpper(line[:end])
+			} else {
+				args = append(args, line[:end])
+			}
+			line = line[end:]
+		}
+	}
+	if cmd == "" {
+		err = errSyntax
+	}
+	return
+}
+
+// read 1 line without the line ending
+func (m *session) readLine() (line string, err error) {
+	line, err = m.r.ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	return
+}
+
+// parse a quoted string at the start of a line, returns the rest of the line
+func parseQuoted(line string) (str, rest string, err error) {
+	var sb strings.Builder
+	for idx := 1; idx < len(line); idx++ {
+		c := line[idx]
+		if c == '\\' && idx+1 < len(line) {
+			idx++
+			c = line[idx]
+		} else if c == '"' {
+			return sb.String(), line[idx+1:], nil
+		}
+		sb.WriteByte(c)
+	}
+	return "", "", errSyntax
+}
+
+// check a script name
+func validName(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r == '/' {
+			return false
+		}
+	}
+	return true
+}
+
+// respond to a db error
+func (m *session) dbError(err error) {
+	switch err {
+	case db.ErrNoSuchScript:
+		m.no("NONEXISTENT", "no such script")
+	case db.ErrScriptExists:
+		m.no("ALREADYEXISTS", "script already exists")
+	case db.ErrScriptActive:
+		m.no("ACTIVE", "script is active")
+	default:
+		log.Errorf("managesieve: %s", err.Error())
+		m.no("TRYLATER", "internal error")
+	}
+}
+
+// check a script, responds and returns false if it's bad
+func (m *session) checkScript(script string) bool {
+	if int64(len(script)) > m.s.MaxScriptSize {
+		m.no("QUOTA/MAXSIZE", "script too big")
+		return false
+	}
+	_, err := sieve.Parse(script)
+	if err != nil {
+		m.no("", err.Error())
+		return false
+	}
+	return true
+}
+
+// check that there is room for another script
+func (m *session) haveSpace(name string, size int64) bool {
+	if size > m.s.MaxScriptSize {
+		m.no("QUOTA/MAXSIZE", "script too big")
+		return false
+	}
+	scripts, err := m.s.Scripts.ListSieveScripts(m.user)
+	if err != nil {
+		m.dbError(err)
+		return false
+	}
+	if len(scripts) >= maxScripts {
+		for _, sc := range scripts {
+			if sc.Name == name {
+				return true
+			}
+		}
+		m.no("QUOTA/MAXSCRIPTS", "too many scripts")
+		return false
+	}
+	return true
+}
+
+// log in with sasl plain
+func (m *session) authenticate(args []string) {
+	if len(args) == 0 || strings.ToUpper(args[0]) != "PLAIN" {
+		m.no("", "unsupported mechanism")
+		return
+	}
+	var resp string
+	if len(args) > 1 {
+		resp = args[1]
+	} else {
+		// ask for the response
+		m.line(`""`)
+		m.w.Flush()
+		line, err := m.readLine()
+		if err != nil {
+			return
+		}
+		if line == `"*"` {
+			m.no("", "authentication cancelled")
+			return
+		}
+		resp, _, err = parseQuoted(line)
+		if err != nil {
+			if strings.HasPrefix(line, "{") {
+				m.no("", "send the response as a quoted string")
+			} else {
+				m.no("", "bad response")
+			}
+			return
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	parts := bytes.Split(decoded, []byte{0})
+	if err != nil || len(parts) != 3 {
+		m.no("", "bad response")
+		return
+	}
+	user, passwd := string(parts[1]), string(parts[2])
+	ok := false
+	if m.s.Auth != nil {
+		ok, _ = m.s.Auth(user, passwd)
+	}
+	if !ok {
+		m.no("AUTH-TOO-WEAK", "authentication failed")
+		return
+	}
+	m.user = user
+	m.ok("logged in")
+}
+
+// run managesieve session mainloop
+func (m *session) Run() {
+	defer m.nc.Close()
+	m.capabilities()
+	m.ok("bdsmail managesieve ready")
+	for {
+		cmd, args, err := m.readCommand()
+		if err == errSyntax {
+			m.no("", "syntax error")
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if !m.handle(cmd, args) {
+			return
+		}
+	}
+}
+
+// handle a command, returns false to end the session
+func (m *session) handle(cmd string, args []string) bool {
+	switch cmd {
+	case "CAPABILITY":
+		m.capabilities()
+		m.ok("")
+		return true
+	case "NOOP":
+		if len(args) > 0 {
+			m.respond("OK", "TAG "+quote(args[0]), "done")
+		} else {
+			m.ok("done")
+		}
+		return true
+	case "LOGOUT":
+		m.ok("bye")
+		return false
+	case "STARTTLS":
+		if m.s.TLS == nil || m.tls {
+			m.no("", "no tls")
+			return true
+		}
+		m.ok("begin tls")
+		tc := tls.Server(m.nc, m.s.TLS)
+		if err := tc.Handshake(); err != nil {
+			log.Errorf("managesieve starttls: %s", err.Error())
+			return false
+		}
+		m.setConn(tc)
+		m.tls = true
+		m.capabilities()
+		m.ok("tls started")
+		return true
+	case "AUTHENTICATE":
+		if m.user != "" {
+			m.no("", "already logged in")
+		} else {
+			m.authenticate(args)
+		}
+		return true
+	}
+	if m.user == "" {
+		m.no("", "log in first")
+		return true
+	}
+	scripts := m.s.Scripts
+	switch cmd {
+	case "UNAUTHENTICATE":
+		m.user = ""
+		m.ok("logged out")
+	case "LISTSCRIPTS":
+		list, err := scripts.ListSieveScripts(m.user)
+		if err != nil {
+			m.dbError(err)
+			break
+		}
+		for _, sc := range list {
+			if sc.Active {
+				m.line("%s ACTIVE", quote(sc.Name))
+			} else {
+				m.line("%s", quote(sc.Name))
+			}
+		}
+		m.ok("")
+	case "GETSCRIPT":
+		if len(args) != 1 {
+			m.no("", "GETSCRIPT takes a name")
+			break
+		}
+		sc, err := scripts.GetSieveScript(m.user, args[0])
+		if err != nil {
+			m.dbError(err)
+			break
+		}
+		m.line("{%d}\r\n%s", len(sc.Script), sc.Script)
+		m.ok("")
+	case "HAVESPACE":
+		if len(args) != 2 || !validName(args[0]) {
+			m.no("", "HAVESPACE takes a name and size")
+			break
+		}
+		size, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			m.no("", "bad size")
+		} else if m.haveSpace(args[0], size) {
+			m.ok("")
+		}
+	case "PUTSCRIPT":
+		if len(args) != 2 || !validName(args[0]) {
+			m.no("", "PUTSCRIPT takes a name and script")
+			break
+		}
+		if m.haveSpace(args[0], int64(len(args[1]))) && m.checkScript(args[1]) {
+			if err := scripts.PutSieveScript(m.user, args[0], args[1]); err != nil {
+				m.dbError(err)
+			} else {
+				m.ok("")
+			}
+		}
+	case "CHECKSCRIPT":
+		if len(args) != 1 {
+			m.no("", "CHECKSCRIPT takes a script")
+		} else if m.checkScript(args[0]) {
+			m.ok("")
+		}
+	case "SETACTIVE":
+		if len(args) != 1 {
+			m.no("", "SETACTIVE takes a name")
+		} else if err := scripts.ActivateSieveScript(m.user, args[0]); err != nil {
+			m.dbError(err)
+		} else {
+			m.ok("")
+		}
+	case "DELETESCRIPT":
+		if len(args) != 1 {
+			m.no("", "DELETESCRIPT takes a name")
+		} else if err := scripts.DeleteSieveScript(m.user, args[0]); err != nil {
+			m.dbError(err)
+		} else {
+			m.ok("")
+		}
+	case "RENAMESCRIPT":
+		if len(args) != 2 || !validName(args[1]) {
+			m.no("", "RENAMESCRIPT takes 2 names")
+		} else if err := scripts.RenameSieveScript(m.user, args[0], args[1]); err != nil {
+			m.dbError(err)
+		} else {
+			m.ok("")
+		}
+	default:
+		m.no("", "unknown command")
+	}
+	return true
+}
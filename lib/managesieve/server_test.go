@@ -0,0 +1,131 @@
+package managesieve
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/db"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConn struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+// send a command
+func (c *testConn) send(format string, args ...interface{}) {
+	fmt.Fprintf(c.c, format+"\r\n", args...)
+}
+
+// read lines until the final response, returns all lines
+func (c *testConn) response(status string) []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			if !strings.HasPrefix(line, status) {
+				c.t.Fatalf("expected %s got %q", status, line)
+			}
+			return lines
+		}
+	}
+}
+
+func testServer(t *testing.T) *testConn {
+	d, err := db.NewDB(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	srv := New()
+	srv.MaxScriptSize = 1024
+	srv.Scripts = d
+	srv.Auth = func(user, passwd string) (bool, error) {
+		return user == "alice" && passwd == "secret", nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		l.Close()
+		d.Close()
+	})
+	c := &testConn{t: t, c: nc, r: bufio.NewReader(nc)}
+	c.response("OK")
+	return c
+}
+
+func TestManageSieve(t *testing.T) {
+	c := testServer(t)
+	c.send(`LISTSCRIPTS`)
+	c.response("NO")
+	c.send(`AUTHENTICATE "PLAIN" "%s"`, base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong")))
+	c.response("NO")
+	c.send(`AUTHENTICATE "PLAIN"`)
+	if line, _ := c.r.ReadString('\n'); line != "\"\"\r\n" {
+		t.Fatalf("expected continuation got %q", line)
+	}
+	c.send(`"%s"`, base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")))
+	c.response("OK")
+
+	script := "require \"fileinto\";\r\nfileinto \"lists\";\r\n"
+	c.send("PUTSCRIPT \"lists\" {%d+}\r\n%s", len(script), script)
+	c.response("OK")
+	c.send("PUTSCRIPT \"bad\" {5+}\r\nkeep ")
+	if lines := c.response("NO"); !strings.Contains(lines[0], "line 1") {
+		t.Errorf("expected syntax error got %q", lines[0])
+	}
+	c.send(`CHECKSCRIPT "fileinto \"x\";"`)
+	c.response("NO")
+	c.send(`HAVESPACE "big" 4096`)
+	if lines := c.response("NO"); !strings.Contains(lines[0], "QUOTA/MAXSIZE") {
+		t.Errorf("expected quota error got %q", lines[0])
+	}
+
+	c.send(`SETACTIVE "lists"`)
+	c.response("OK")
+	c.send(`LISTSCRIPTS`)
+	if lines := c.response("OK"); len(lines) != 2 || lines[0] != `"lists" ACTIVE` {
+		t.Errorf("bad script list %q", lines)
+	}
+	c.send(`GETSCRIPT "lists"`)
+	lines := c.response("OK")
+	if got := strings.Join(lines[1:len(lines)-1], "\r\n"); lines[0] != fmt.Sprintf("{%d}", len(script)) || got != script {
+		t.Errorf("bad script %q", lines)
+	}
+	c.send(`DELETESCRIPT "lists"`)
+	if lines := c.response("NO"); lines[0] != "NO (ACTIVE) \"script is active\"" {
+		t.Errorf("expected active error got %q", lines[0])
+	}
+	c.send(`RENAMESCRIPT "lists" "mail"`)
+	c.response("OK")
+	c.send(`SETACTIVE ""`)
+	c.response("OK")
+	c.send(`DELETESCRIPT "mail"`)
+	c.response("OK")
+	c.send(`GETSCRIPT "mail"`)
+	c.response("NO (NONEXISTENT)")
+	c.send(`LOGOUT`)
+	c.response("OK")
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"time"
+)
+
+// how long a greylisted triple that never retried is remembered
+const GreylistPendingTime = 24 * time.Hour
+
+// a (remote host, sender, recipiant) triple seen by the greylist
+type GreylistEntry struct {
+	Id int64 `xorm:"pk autoincr"`
+	// remote host the mail came from, the base32 address for i2p destinations
+	Host string `xorm:"host unique(triple)"`
+	// envelope sender
+	Sender string `xorm:"sender unique(triple)"`
+	// envelope recipiant
+	Recipient string `xorm:"recipient unique(triple)"`
+	// when the triple was first tried
+	FirstSeen time.Time `xorm:"first_seen"`
+	// when the triple was last let through
+	LastSeen time.Time `xorm:"last_seen index"`
+	// the triple retried after the delay and is whitelisted
+	Passed bool `xorm:"passed"`
+}
+
+// check if mail for this triple is let through at now
+// mail is let through once the triple retries after delay and for lifetime after the last time it was let through
+// updates the entry, returns true if the mail is let through
+func (e *GreylistEntry) Check(now time.Time, delay, lifetime time.Duration) (pass bool) {
+	if e.Passed && now.Sub(e.LastSeen) <= lifetime {
+		e.LastSeen = now
+		return true
+	}
+	if e.Passed || e.FirstSeen.IsZero() || now.Sub(e.FirstSeen) > GreylistPendingTime {
+		// new or expired, start over
+		e.FirstSeen = now
+		e.LastSeen = time.Time{}
+		e.Passed = false
+	}
+	if now.Sub(e.FirstSeen) >= delay {
+		e.Passed = true
+		e.LastSeen = now
+	}
+	return e.Passed
+}
+
+// check if this entry can be forgotten at now
+func (e *GreylistEntry) Expired(now time.Time, lifetime time.Duration) bool {
+	if e.Passed {
+		return now.Sub(e.LastSeen) > lifetime
+	}
+	return now.Sub(e.FirstSeen) > GreylistPendingTime
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreylistCheck(t *testing.T) {
+	var e GreylistEntry
+	now := time.Unix(10000, 0)
+	delay := 5 * time.Minute
+	lifetime := 24 * time.Hour * 30
+	if e.Check(now, delay, lifetime) {
+		t.Fatal("first attempt let through")
+	}
+	if e.Check(now.Add(time.Minute), delay, lifetime) {
+		t.Fatal("retry before delay let through")
+	}
+	now = now.Add(delay)
+	if !e.Check(now, delay, lifetime) {
+		t.Fatal("retry after delay not let through")
+	}
+	now = now.Add(lifetime)
+	if !e.Check(now, delay, lifetime) || e.Expired(now, lifetime) {
+		t.Fatal("whitelisted triple not let through")
+	}
+	// whitelisting ends after lifetime without mail
+	now = now.Add(lifetime + time.Second)
+	if !e.Expired(now, lifetime) {
+		t.Fatal("whitelisted triple did not expire")
+	}
+	if e.Check(now, delay, lifetime) {
+		t.Fatal("expired triple let through")
+	}
+	// a triple that never retried starts over
+	now = now.Add(GreylistPendingTime + time.Second)
+	if !e.Expired(now, lifetime) || e.Check(now, delay, lifetime) {
+		t.Fatal("stale pending triple let through")
+	}
+	if !e.Check(now, 0, lifetime) {
+		t.Fatal("no delay did not let through")
+	}
+}
@@ -1,74 +1,222 @@
 package model
 
 import (
-	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
 	"github.com/majestrate/bdsmail/lib/base91"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
 	"io"
+	"runtime"
+	"strconv"
 	"strings"
 )
 
 // a hashed+salted login cred
+// stored as a PHC string like $argon2id$v=19$m=19456,t=2,p=1$salt$hash
+// creds made by older versions are a base91 hash and salt split by login_cred_delim
+// their hash only depends on the password's length so they never check, users who have one need a password reset
 type LoginCred string
 
 const login_cred_delim = " "
 
-// how many iterations of sha256 to use
-const num_sha_digest_iteration = 1024 * 1024
+// algorithms of login creds
+const (
+	CredArgon2id = "argon2id"
+	CredScrypt   = "scrypt"
+	// base91 iterated sha256 from older versions, never checked
+	CredLegacy = "legacy"
+)
+
+// argon2id cost of new login creds, memory is in KiB
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+)
+
+// scrypt cost of new login creds, N is 1 << scryptLogN
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
 
-// generate a new login cred, generates random salt and stores as hashed
+// bytes of salt and hash in new login creds
+const (
+	credSaltLen = 16
+	credHashLen = 32
+)
+
+// limits how many passwords are hashed at once so many logins can't use up all memory
+var hashSlots = make(chan struct{}, runtime.NumCPU())
+
+var b64 = base64.RawStdEncoding
+
+// parsed login cred
+type credParts struct {
+	alg    string
+	params map[string]int
+	salt   []byte
+	hash   []byte
+}
+
+// generate a new argon2id login cred with a random salt
 func NewLoginCred(secret string) LoginCred {
-	slt := make([]byte, 64)
-	io.ReadFull(rand.Reader, slt)
-	h := credHash([]byte(secret), slt)
-	hs := string(base91.Encode(h))
-	ss := string(base91.Encode(slt))
-	return LoginCred(hs + login_cred_delim + ss)
+	return NewLoginCredWith(CredArgon2id, secret)
+}
+
+// generate a new login cred with a random salt using an algorithm, CredArgon2id or CredScrypt
+func NewLoginCredWith(alg, secret string) LoginCred {
+	c := &credParts{
+		alg:  alg,
+		salt: make([]byte, credSaltLen),
+	}
+	io.ReadFull(rand.Reader, c.salt)
+	switch alg {
+	case CredScrypt:
+		c.params = map[string]int{"ln": scryptLogN, "r": scryptR, "p": scryptP}
+	default:
+		c.alg = CredArgon2id
+		c.params = map[string]int{"m": argon2Memory, "t": argon2Time, "p": argon2Threads}
+	}
+	c.hash = c.compute([]byte(secret), credHashLen)
+	return LoginCred(c.String())
+}
+
+// encode as a PHC string
+func (c *credParts) String() string {
+	var params string
+	switch c.alg {
+	case CredArgon2id:
+		params = fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, c.params["m"], c.params["t"], c.params["p"])
+	case CredScrypt:
+		params = fmt.Sprintf("ln=%d,r=%d,p=%d", c.params["ln"], c.params["r"], c.params["p"])
+	}
+	return "$" + c.alg + "$" + params + "$" + b64.EncodeToString(c.salt) + "$" + b64.EncodeToString(c.hash)
+}
+
+// hash a password with the algorithm and parameters of this cred
+// returns nil if the parameters are bad
+func (c *credParts) compute(passwd []byte, keyLen int) (h []byte) {
+	hashSlots <- struct{}{}
+	defer func() {
+		<-hashSlots
+	}()
+	switch c.alg {
+	case CredArgon2id:
+		m, t, p := c.params["m"], c.params["t"], c.params["p"]
+		if m > 0 && t > 0 && p > 0 && p < 256 {
+			h = argon2.IDKey(passwd, c.salt, uint32(t), uint32(m), uint8(p), uint32(keyLen))
+		}
+	case CredScrypt:
+		ln, r, p := c.params["ln"], c.params["r"], c.params["p"]
+		if ln > 0 && ln < 32 {
+			h, _ = scrypt.Key(passwd, c.salt, 1<<uint(ln), r, p, keyLen)
+		}
+	}
+	return
 }
 
-// hash login credential with a salt
-func credHash(data, salt []byte) (h []byte) {
-	l := len(data) + len(salt)
-	d := make([]byte, l+sha256.Size)
-	copy(d, data)
-	copy(d[:len(data)], salt)
-	i := num_sha_digest_iteration
-	for i > 0 {
-		_h := sha256.Sum256(d)
-		copy(d[l:], _h[:])
-		i--
-	}
-	h = make([]byte, sha256.Size)
-	copy(h, d[l:])
+// parse a login cred, returns nil if it's malformed
+func (cred LoginCred) parse() (c *credParts) {
+	str := string(cred)
+	if !strings.HasPrefix(str, "$") {
+		p := strings.Split(str, login_cred_delim)
+		if len(p) == 2 {
+			c = &credParts{alg: CredLegacy}
+			c.hash, _ = base91.Decode([]byte(p[0]))
+			c.salt, _ = base91.Decode([]byte(p[1]))
+		}
+		return
+	}
+	// $alg[$v=version]$params$salt$hash
+	p := strings.Split(str[1:], "$")
+	if len(p) == 5 && p[1] == fmt.Sprintf("v=%d", argon2.Version) {
+		p = append(p[:1], p[2:]...)
+	}
+	if len(p) != 4 || (p[0] != CredArgon2id && p[0] != CredScrypt) {
+		return nil
+	}
+	c = &credParts{
+		alg:    p[0],
+		params: make(map[string]int),
+	}
+	for _, param := range strings.Split(p[1], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil
+		}
+		c.params[kv[0]] = n
+	}
+	var err error
+	c.salt, err = b64.DecodeString(p[2])
+	if err == nil {
+		c.hash, err = b64.DecodeString(p[3])
+	}
+	if err != nil {
+		return nil
+	}
 	return
 }
 
-// check if this password matches this login cred
+// get the algorithm of this login cred, empty string if it's malformed
+func (cred LoginCred) Algorithm() string {
+	if c := cred.parse(); c != nil {
+		return c.alg
+	}
+	return ""
+}
+
+// check if this password matches this login cred in constant time
 func (cred LoginCred) Check(passwd string) (is bool) {
-	h := cred.hash()
-	s := cred.salt()
-	r := credHash([]byte(passwd), s)
-	if len(h) > 0 {
-		is = bytes.Equal(h, r[:])
+	c := cred.parse()
+	if c != nil && len(c.hash) > 0 {
+		r := c.compute([]byte(passwd), len(c.hash))
+		is = len(r) == len(c.hash) && subtle.ConstantTimeCompare(c.hash, r) == 1
 	}
 	return
 }
 
+// return true if this login cred should be replaced by a new one after the password is checked
+// because it is from an older version or hashed with less work than new creds
+func (cred LoginCred) NeedsRehash() bool {
+	c := cred.parse()
+	if c == nil {
+		return true
+	}
+	switch c.alg {
+	case CredArgon2id:
+		return c.params["m"] < argon2Memory || c.params["t"] < argon2Time || len(c.hash) < credHashLen
+	case CredScrypt:
+		return c.params["ln"] < scryptLogN || c.params["r"] < scryptR || len(c.hash) < credHashLen
+	}
+	return true
+}
+
+// return true if this login cred can't be checked and the password must be reset by the admin
+func (cred LoginCred) NeedsReset() bool {
+	return cred.Algorithm() == CredLegacy
+}
+
 // get hash part
 func (cred LoginCred) hash() (h []byte) {
-	p := strings.Split(string(cred), login_cred_delim)
-	if len(p) == 2 {
-		h, _ = base91.Decode([]byte(p[0]))
+	if c := cred.parse(); c != nil {
+		h = c.hash
 	}
 	return
 }
 
 // get salt part
 func (cred LoginCred) salt() (s []byte) {
-	p := strings.Split(string(cred), login_cred_delim)
-	if len(p) == 2 {
-		s, _ = base91.Decode([]byte(p[1]))
+	if c := cred.parse(); c != nil {
+		s = c.salt
 	}
 	return
 }
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -17,3 +18,49 @@ func TestLoginCredHash(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// make a cred the way older versions did
+// cred for hunter2 made by an older version
+const legacyCred = LoginCred("b8}ATSN+Xt1:V}[i,<MaNx6V<w80!vV]qZ8CN]SB gw_,$k_i$Js@+a{iPPAJ2i~RR2W<mCLU#G(Ic,WC")
+
+func TestLoginCredFormat(t *testing.T) {
+	cred := NewLoginCred("hunter2")
+	if !strings.HasPrefix(string(cred), "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("bad argon2id cred %s", cred)
+	}
+	if cred.NeedsRehash() {
+		t.Errorf("new cred needs rehash")
+	}
+	cred = NewLoginCredWith(CredScrypt, "hunter2")
+	if !strings.HasPrefix(string(cred), "$scrypt$ln=15,r=8,p=1$") {
+		t.Errorf("bad scrypt cred %s", cred)
+	}
+	if !cred.Check("hunter2") || cred.Check("hunter3") || cred.NeedsRehash() {
+		t.Errorf("scrypt cred does not work")
+	}
+	for _, bad := range []LoginCred{"", "$argon2id$v=19$m=1$abc", "$md5$x$y$z", "$argon2id$v=19$m=0,t=0,p=0$c2FsdA$aGFzaA"} {
+		if bad.Check("") {
+			t.Errorf("malformed cred %q passed", bad)
+		}
+	}
+}
+
+func TestLoginCredLegacy(t *testing.T) {
+	cred := legacyCred
+	if cred.Algorithm() != CredLegacy {
+		t.Fatalf("legacy cred parsed as %q", cred.Algorithm())
+	}
+	// the legacy hash only depends on the password's length so no password checks
+	for _, passwd := range []string{"hunter2", "xxxxxxx", "1234567", ""} {
+		if cred.Check(passwd) {
+			t.Errorf("legacy cred checked with %q", passwd)
+		}
+	}
+	if !cred.NeedsReset() || NewLoginCred("hunter2").NeedsReset() {
+		t.Errorf("wrong creds need a reset")
+	}
+	weak := LoginCred("$argon2id$v=19$m=1024,t=1,p=1$" + b64.EncodeToString([]byte("saltsaltsaltsalt")) + "$" + b64.EncodeToString([]byte("x")))
+	if !weak.NeedsRehash() {
+		t.Errorf("cheap cred does not need rehash")
+	}
+}
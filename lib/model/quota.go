@@ -0,0 +1,57 @@
+package model
+
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+)
+
+// storage limits of a user, values <= 0 are unlimited
+type Quota struct {
+	// total size of all messages in bytes
+	Bytes int64
+	// number of messages
+	Messages int64
+}
+
+// what a user's mail takes up
+type Usage struct {
+	Bytes    int64
+	Messages int64
+}
+
+// get the quota of this user, zero fields of the user use the server default and negative fields are unlimited
+func (u *User) Quota(def Quota) (q Quota) {
+	q = def
+	if u.QuotaBytes != 0 {
+		q.Bytes = u.QuotaBytes
+	}
+	if u.QuotaMessages != 0 {
+		q.Messages = u.QuotaMessages
+	}
+	return
+}
+
+// get how much storage this user's mail takes up including all folders
+func (u *User) Usage() (us Usage, err error) {
+	us.Bytes, us.Messages, err = u.MailDir().Usage()
+	return
+}
+
+// check if a message of this size fits in the quota given the current usage
+// returns mailstore.ErrOverQuota if it never will and mailstore.ErrMailboxFull if it does not fit now
+func (q Quota) Check(us Usage, size int64) error {
+	if q.Bytes > 0 && size > q.Bytes {
+		return mailstore.ErrOverQuota
+	}
+	if q.Bytes > 0 && us.Bytes+size > q.Bytes {
+		return mailstore.ErrMailboxFull
+	}
+	if q.Messages > 0 && us.Messages+1 > q.Messages {
+		return mailstore.ErrMailboxFull
+	}
+	return nil
+}
+
+// true if there is no limit
+func (q Quota) Unlimited() bool {
+	return q.Bytes <= 0 && q.Messages <= 0
+}
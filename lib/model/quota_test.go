@@ -0,0 +1,35 @@
+package model
+
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	def := Quota{Bytes: 100, Messages: 0}
+	u := &User{QuotaMessages: 2}
+	q := u.Quota(def)
+	if q.Bytes != 100 || q.Messages != 2 {
+		t.Errorf("bad quota %+v", q)
+	}
+	for _, tc := range []struct {
+		us   Usage
+		size int64
+		err  error
+	}{
+		{Usage{}, 10, nil},
+		{Usage{Bytes: 90, Messages: 1}, 10, nil},
+		{Usage{Bytes: 90, Messages: 1}, 11, mailstore.ErrMailboxFull},
+		{Usage{Bytes: 10, Messages: 2}, 1, mailstore.ErrMailboxFull},
+		{Usage{}, 101, mailstore.ErrOverQuota},
+	} {
+		if err := q.Check(tc.us, tc.size); err != tc.err {
+			t.Errorf("check %+v with size %d gave %v, want %v", tc.us, tc.size, err, tc.err)
+		}
+	}
+	u.QuotaBytes = -1
+	u.QuotaMessages = -1
+	if q = u.Quota(def); !q.Unlimited() || q.Check(Usage{Bytes: 1000, Messages: 1000}, 1000) != nil {
+		t.Errorf("unlimited quota %+v is limited", q)
+	}
+}
@@ -0,0 +1,14 @@
+package model
+
+// a user's sieve script
+type SieveScript struct {
+	Id int64 `xorm:"pk autoincr"`
+	// name of user who owns this script
+	Owner string `xorm:"owner unique(owner_name)"`
+	// name of script
+	Name string `xorm:"name unique(owner_name)"`
+	// script source
+	Script string `xorm:"script text"`
+	// only the active script is run on delivery
+	Active bool `xorm:"active"`
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/sasl"
 )
 
 // mail user info
@@ -10,18 +11,46 @@ type User struct {
 	Name string `xorm:"pk"`
 	// login credential, if empty string login is not allowed
 	Login string `xorm:"login"`
+	// SCRAM-SHA-256 credentials, empty until the password is set or used to log in
+	Scram string `xorm:"scram"`
 	// path to maildir
 	MailDirPath string `xorm:"maildir"`
+	// disabled users cannot log in
+	Disabled bool `xorm:"disabled"`
+	// storage quota in bytes, 0 for the server default, -1 for unlimited
+	QuotaBytes int64 `xorm:"quota_bytes"`
+	// message count quota, 0 for the server default, -1 for unlimited
+	QuotaMessages int64 `xorm:"quota_messages"`
 }
 
 // check if user's login is correct given password
 func (u *User) CheckLogin(passwd string) (ok bool) {
-	if len(u.Login) > 0 {
+	if len(u.Login) > 0 && !u.Disabled {
 		ok = LoginCred(u.Login).Check(passwd)
 	}
 	return
 }
 
+// return true if the user has a login cred from an older version that must be reset before they can log in
+func (u *User) NeedsPasswordReset() bool {
+	return len(u.Login) > 0 && LoginCred(u.Login).NeedsReset()
+}
+
+// set the password of a user
+func (u *User) SetPassword(passwd string) {
+	u.Login = string(NewLoginCred(passwd))
+	u.Scram = sasl.NewScramCred(passwd).String()
+}
+
+// get the credentials to check SCRAM-SHA-256 logins of this user, nil if they can't log in with it
+func (u *User) ScramCred() *sasl.ScramCred {
+	if len(u.Login) == 0 || u.Disabled {
+		return nil
+	}
+	c, _ := sasl.ParseScramCred(u.Scram)
+	return c
+}
+
 // get user's maildir
 func (u *User) MailDir() maildir.MailDir {
 	return maildir.MailDir(u.MailDirPath)
@@ -0,0 +1,126 @@
+package pop3
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+// longest unique id a client must accept (RFC 1939)
+const maxUIDLen = 70
+
+// a message in a maildrop
+type message struct {
+	msg mailstore.Message
+	// unique id that stays the same across sessions
+	uid  string
+	size int64
+	// marked for deletion with DELE
+	deleted bool
+	// sent whole with RETR in this session
+	retrieved bool
+}
+
+// a store that removes messages and keeps its index up to date
+type remover interface {
+	Remove(mailstore.Message) error
+}
+
+// get the unique id of a message from its unique name in the store
+// the name doesn't change when the message is processed or its flags change
+// names with characters not allowed in a unique id are hashed
+func uidOf(name string) string {
+	if idx := strings.IndexByte(name, ':'); idx >= 0 {
+		name = name[:idx]
+	}
+	ok := len(name) > 0 && len(name) <= maxUIDLen
+	for _, c := range []byte(name) {
+		ok = ok && c >= 0x21 && c <= 0x7e
+	}
+	if ok {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// find a user's store and list all its messages with their sizes and unique ids
+// new messages are processed first so they show up
+func (s *Server) getMessages(user string) (st mailstore.Store, msgs []*message, err error) {
+	if s.Local == nil {
+		err = errors.New("could't find mail store")
+		return
+	}
+	var has bool
+	st, has = s.Local.FindStoreFor(user)
+	if !has {
+		err = errors.New("no such local user")
+		return
+	}
+	var ms []mailstore.Message
+	ms, err = st.ListNew()
+	// move new mail into cur
+	if err == nil {
+		for _, m := range ms {
+			_, err = st.Process(m)
+			if err != nil {
+				log.Errorf("error processing maildir: %s", err.Error())
+			}
+		}
+	}
+	// get list of messages from the index if the store has one
+	if ist, ok := st.(mailstore.IndexedStore); ok {
+		var infos []mailstore.MessageInfo
+		infos, err = ist.ListInfo()
+		for _, info := range infos {
+			msgs = append(msgs, &message{
+				msg:  info.Message,
+				uid:  uidOf(info.Name),
+				size: info.Size,
+			})
+		}
+		return
+	}
+	ms, err = st.List()
+	if err == nil {
+		for _, msg := range ms {
+			var info os.FileInfo
+			info, err = os.Stat(msg.Filepath())
+			if err != nil {
+				return
+			}
+			msgs = append(msgs, &message{
+				msg:  msg,
+				uid:  uidOf(msg.Filename()),
+				size: info.Size(),
+			})
+		}
+	}
+	return
+}
+
+// try to get exclusive access to a user's maildrop, returns false if another session has it
+func (s *Server) lock(user string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.locked == nil {
+		s.locked = make(map[string]bool)
+	}
+	user = strings.ToLower(user)
+	if s.locked[user] {
+		return false
+	}
+	s.locked[user] = true
+	return true
+}
+
+// give up exclusive access to a user's maildrop
+func (s *Server) unlock(user string) {
+	s.mtx.Lock()
+	delete(s.locked, strings.ToLower(user))
+	s.mtx.Unlock()
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/sasl"
 	"github.com/majestrate/bdsmail/lib/starttls"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -14,21 +15,40 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // function that authenticates a user
 type UserAuthenticator func(string, string) (bool, error)
 
+// how long a session may be idle before we hang up (RFC 1939 autologout timer)
+const idleTimeout = 10 * time.Minute
+
 // pop3 server
 type Server struct {
 	// obtains a mail store given a user
 	Local mailstore.MailRouter
 	// login authenticator
 	Auth UserAuthenticator
+	// gets the scram credentials of a user, nil to not offer SCRAM-SHA-256
+	Scram func(user string) *sasl.ScramCred
+	// when USER/PASS and plaintext sasl mechanisms may be used
+	Policy sasl.Policy
+	// gets the storage used by a user and their quota in octets, limit <= 0 is unlimited
+	// nil to not report quotas
+	Quota func(user string) (used, limit int64, err error)
+	// called with each message a user deleted without retrieving it before it is removed, nil does nothing
+	// clients delete every message they downloaded so those say nothing about the message
+	Deleted func(user string, msg mailstore.Message)
 	// server name
 	name string
 	// tls config
 	TLS *tls.Config
+
+	// users whose maildrop a session has locked
+	mtx    sync.Mutex
+	locked map[string]bool
 }
 
 func New() *Server {
@@ -38,41 +58,6 @@ func New() *Server {
 	}
 }
 
-// get all messages in mail store
-func (s *Server) getMessages(user string) (msgs []mailstore.Message, err error) {
-	// get user's mail store
-	var st mailstore.Store
-	if s.Local == nil {
-		err = errors.New("could't find mail store")
-		return
-	}
-	var has bool
-	st, has = s.Local.FindStoreFor(user)
-	if !has {
-		err = errors.New("no such local user")
-		return
-	}
-	var ms []mailstore.Message
-	ms, err = st.ListNew()
-	// move new mail into cur	msgs
-	if err == nil {
-		for _, m := range ms {
-			_, err = st.Process(m)
-			if err != nil {
-				log.Errorf("error processing maildir: %s", err.Error())
-			}
-		}
-	}
-	// get list of messages
-	ms, err = st.List()
-	if err == nil {
-		for _, msg := range ms {
-			msgs = append(msgs, msg)
-		}
-	}
-	return
-}
-
 func (s *Server) checkUser(user, passwd string) (allowed bool) {
 	if s.Auth != nil {
 		allowed, _ = s.Auth(user, passwd)
@@ -80,23 +65,56 @@ func (s *Server) checkUser(user, passwd string) (allowed bool) {
 	return
 }
 
-// get all messages and octet count
-func (s *Server) obtainMessages(user string) (msgs []mailstore.Message, o int64, err error) {
-	msgs, err = s.getMessages(user)
-	if err == nil {
-		for _, msg := range msgs {
-			var info os.FileInfo
-			info, err = os.Stat(msg.Filepath())
-			if err == nil && !info.IsDir() {
-				o += info.Size()
-			}
+// sasl.Authenticator for a pop3 server
+type popAuth struct {
+	s *Server
+}
+
+func (a popAuth) Plain(user, passwd string) bool {
+	return a.s.checkUser(user, passwd)
+}
+
+func (a popAuth) Scram(user string) *sasl.ScramCred {
+	if a.s.Scram == nil {
+		return nil
+	}
+	return a.s.Scram(user)
+}
+
+// get the sasl mechanisms we offer
+func (s *Server) mechanisms(secure bool) (mechs []string) {
+	for _, mech := range s.Policy.Mechanisms(secure) {
+		if mech != sasl.ScramSHA256 || s.Scram != nil {
+			mechs = append(mechs, mech)
 		}
-	} else {
-		log.Errorf("pop3: %s", err.Error())
 	}
 	return
 }
 
+// describe a user's quota usage for the login reply, empty if there is no quota
+func (s *Server) quotaInfo(user string) (info string) {
+	if s.Quota == nil {
+		return
+	}
+	used, limit, err := s.Quota(user)
+	if err != nil {
+		log.Errorf("pop3: failed to get quota of %s: %s", user, err.Error())
+	} else if limit > 0 {
+		info = fmt.Sprintf(", %d of %d octets of quota used", used, limit)
+	}
+	return
+}
+
+// states of a pop3 session (RFC 1939)
+const (
+	// client has not logged in
+	stateAuthorization = iota
+	// client logged in and has the maildrop locked
+	stateTransaction
+	// client said QUIT after logging in, deleted messages are removed
+	stateUpdate
+)
+
 // pop3 session handler
 type pop3Session struct {
 	// network connection
@@ -104,31 +122,30 @@ type pop3Session struct {
 	c  *textproto.Conn
 	// parent server
 	s *Server
-	// are we in transaction state?
-	transaction bool
+	// one of the state values
+	state int
+	// client said QUIT
+	quit bool
+	// STLS was done or the connection started with tls
+	tls bool
 	// current user
 	user string
-	// messages we have in this transaction
-	msgs []mailstore.Message
-	// how many octets we have for all messages
-	octs int64
-	// messages to delete
-	dels []mailstore.Message
+	// store of the user's maildrop
+	st mailstore.Store
+	// messages in the maildrop when the user logged in
+	msgs []*message
 }
 
 // run pop3 session mainloop
 func (p *pop3Session) Run() {
 	// send banner
 	err := p.OK("POP3 Server Ready")
-	for err == nil {
+	for err == nil && !p.quit {
+		p.nc.SetReadDeadline(time.Now().Add(idleTimeout))
 		var line string
 		line, err = p.c.ReadLine()
 		if err == nil {
-			if strings.ToUpper(line) == "QUIT" {
-				// check for quit command
-				err = p.OK("k bai")
-				break
-			} else if p.transaction {
+			if p.state == stateTransaction {
 				err = p.handleTransactionLine(line)
 			} else {
 				err = p.handleLine(line)
@@ -138,192 +155,392 @@ func (p *pop3Session) Run() {
 	if err != nil && err != io.EOF {
 		log.Errorf("error in pop3 session: %s", err.Error())
 	}
+	// messages are only removed after QUIT, a dropped session keeps them all
+	if p.state != stateAuthorization {
+		p.s.unlock(p.user)
+	}
 	// close connection
 	p.c.Close()
-	// delete old messages
-	for _, msg := range p.dels {
-		os.Remove(msg.Filepath())
+}
+
+// split a command line into its upper cased keyword and arguments
+func parseLine(line string) (cmd string, args []string) {
+	parts := strings.Fields(line)
+	if len(parts) > 0 {
+		cmd = strings.ToUpper(parts[0])
+		args = parts[1:]
+	}
+	return
+}
+
+// get a message that is not deleted by its message number
+// returns the error to send if there is no such message
+func (p *pop3Session) message(arg string) (msg *message, reply string) {
+	idx, err := strconv.Atoi(arg)
+	if err != nil || idx < 1 || idx > len(p.msgs) {
+		return nil, "no such message"
+	}
+	msg = p.msgs[idx-1]
+	if msg.deleted {
+		return nil, fmt.Sprintf("message %d already deleted", idx)
+	}
+	return
+}
+
+// count messages that are not deleted and their size
+func (p *pop3Session) stat() (count int, octs int64) {
+	for _, msg := range p.msgs {
+		if !msg.deleted {
+			count++
+			octs += msg.size
+		}
+	}
+	return
+}
+
+// send a message, only the header and the first lines of the body if lines >= 0
+func (p *pop3Session) sendMessage(msg *message, lines int) (err error) {
+	var f *os.File
+	f, err = os.Open(msg.msg.Filepath())
+	if err != nil {
+		log.Errorf("pop3: %s", err.Error())
+		return p.Error("[SYS/TEMP] cannot read message")
+	}
+	defer f.Close()
+	if lines < 0 {
+		err = p.OK(fmt.Sprintf("%d octets", msg.size))
+	} else {
+		err = p.OK("top of message follows")
+	}
+	if err != nil {
+		return
+	}
+	// the dot writer ends lines with CRLF and escapes lines starting with a dot
+	dw := p.c.DotWriter()
+	r := bufio.NewReader(f)
+	body := false
+	for err == nil && (!body || lines != 0) {
+		var line string
+		line, err = r.ReadString('\n')
+		if len(line) > 0 {
+			if body {
+				lines--
+			} else if strings.TrimRight(line, "\r\n") == "" {
+				body = true
+			}
+			io.WriteString(dw, line)
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		// ending the message would make a truncated one look whole, hang up instead
+		return
+	}
+	return dw.Close()
+}
+
+// remove messages marked for deletion and end the session
+func (p *pop3Session) update() (err error) {
+	p.state = stateUpdate
+	p.quit = true
+	failed := 0
+	for _, msg := range p.msgs {
+		if !msg.deleted {
+			continue
+		}
+		if p.s.Deleted != nil && !msg.retrieved {
+			p.s.Deleted(p.user, msg.msg)
+		}
+		var e error
+		if r, ok := p.st.(remover); ok {
+			e = r.Remove(msg.msg)
+		} else {
+			e = msg.msg.Remove()
+		}
+		if e != nil && !os.IsNotExist(e) {
+			log.Errorf("pop3: failed to remove %s: %s", msg.msg.Filepath(), e.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return p.Error(fmt.Sprintf("[SYS/TEMP] %d deleted messages not removed", failed))
+	}
+	count, _ := p.stat()
+	return p.OK(fmt.Sprintf("%s POP3 server signing off (%d messages left)", p.s.name, count))
+}
+
+// send the capabilities we have in the current state (RFC 2449)
+func (p *pop3Session) capa() (err error) {
+	err = p.OK("capability list follows")
+	if err != nil {
+		return
+	}
+	dw := p.c.DotWriter()
+	if p.state == stateAuthorization {
+		if p.s.Policy.Allows(sasl.Plain, p.secure()) {
+			fmt.Fprintf(dw, "USER\r\n")
+		}
+		if mechs := p.s.mechanisms(p.secure()); len(mechs) > 0 {
+			fmt.Fprintf(dw, "SASL %s\r\n", strings.Join(mechs, " "))
+		}
+		if p.s.TLS != nil && !p.tls {
+			fmt.Fprintf(dw, "STLS\r\n")
+		}
 	}
+	fmt.Fprintf(dw, "TOP\r\n")
+	fmt.Fprintf(dw, "UIDL\r\n")
+	fmt.Fprintf(dw, "PIPELINING\r\n")
+	fmt.Fprintf(dw, "RESP-CODES\r\n")
+	fmt.Fprintf(dw, "AUTH-RESP-CODE\r\n")
+	fmt.Fprintf(dw, "EXPIRE NEVER\r\n")
+	fmt.Fprintf(dw, "IMPLEMENTATION bdsmail\r\n")
+	return dw.Close()
 }
 
 // handle line when in transaction mode
 func (p *pop3Session) handleTransactionLine(line string) (err error) {
-	var info os.FileInfo
-	var idx int
-	parts := strings.Split(line, " ")
-	cmd := strings.ToUpper(parts[0])
+	cmd, args := parseLine(line)
 	switch cmd {
-	case "DELE":
-		if len(parts) == 2 {
-			idx, err = strconv.Atoi(parts[1])
-			if err == nil && (idx > 0 && idx <= len(p.msgs)) {
-				// valid, add it to delete
-				p.dels = append(p.dels, p.msgs[idx-1])
-				p.OK("")
+	case "QUIT":
+		err = p.update()
+	case "NOOP":
+		err = p.OK("")
+	case "CAPA":
+		err = p.capa()
+	case "STAT":
+		count, octs := p.stat()
+		err = p.c.PrintfLine("+OK %d %d", count, octs)
+	case "LIST":
+		if len(args) == 1 {
+			// 1 message
+			msg, reply := p.message(args[0])
+			if msg == nil {
+				err = p.Error(reply)
 			} else {
-				// invalid
-				err = p.Error(err.Error())
+				err = p.c.PrintfLine("+OK %s %d", args[0], msg.size)
 			}
-		}
-	case "RETR":
-		if len(parts) == 2 {
-			idx, err = strconv.Atoi(parts[1])
-			if err == nil && (idx > 0 && idx <= len(p.msgs)) {
-				// valid
-				msg := p.msgs[idx-1].Filepath()
-				var f *os.File
-				f, err = os.Open(msg)
-				if err == nil {
-					r := bufio.NewReader(f)
-					info, err = f.Stat()
-					if err == nil {
-						err = p.c.PrintfLine("+OK %d octets", info.Size())
-						for err == nil {
-							// send line
-							line, err = r.ReadString(10)
-							if err == io.EOF {
-								err = nil
-								break
-							} else if err == nil {
-								line = strings.Trim(line, "\r")
-								line = strings.Trim(line, "\n")
-								if line == "." {
-									line = " ."
-								}
-								// send line
-								err = p.c.PrintfLine(line)
-							} else {
-								// error
-								break
-							}
-						}
+		} else if len(args) == 0 {
+			// all messages
+			count, octs := p.stat()
+			err = p.c.PrintfLine("+OK %d messages (%d octets)", count, octs)
+			if err == nil {
+				dw := p.c.DotWriter()
+				for idx, msg := range p.msgs {
+					if !msg.deleted {
+						fmt.Fprintf(dw, "%d %d\r\n", idx+1, msg.size)
 					}
-					f.Close()
-					// end
-					err = p.c.PrintfLine(".")
-				} else {
-					err = p.Error(err.Error())
 				}
-			} else {
-				// invalid
-				err = p.Error("bad message")
+				err = dw.Close()
 			}
 		} else {
 			err = p.Error("invalid syntax")
 		}
-		break
 	case "UIDL":
-		if len(parts) == 2 {
+		if len(args) == 1 {
 			// 1 message
-			idx, err = strconv.Atoi(parts[1])
-			if err == nil && (idx > 0 && idx <= len(p.msgs)) {
-				// valid
-				err = p.OK(parts[1] + " " + p.msgs[idx-1].Filename())
+			msg, reply := p.message(args[0])
+			if msg == nil {
+				err = p.Error(reply)
 			} else {
-				// invalid
-				err = p.Error("bad message")
-			}
-		} else {
-			// all messages
-			p.OK("")
-			dw := p.c.DotWriter()
-			for idx, msg := range p.msgs {
-				fmt.Fprintf(dw, "%d %s\r\n", 1+idx, msg.Filename())
-			}
-			// FLUSH :D
-			err = dw.Close()
-		}
-		// begin
-		break
-	case "STAT":
-		// begin
-		_, err = fmt.Fprintf(p.c.W, "+OK %d %d", len(p.msgs), p.octs)
-
-		if err == nil {
-			// done writing list
-			err = p.c.PrintfLine("")
-		} else {
-			err = p.Error(err.Error())
-		}
-		break
-	case "LIST":
-		if len(parts) == 2 {
-			// 1 message
-			idx, err = strconv.Atoi(parts[1])
-			if err == nil {
-				if idx > 0 && idx <= len(p.msgs) {
-					info, err = os.Stat(p.msgs[idx-1].Filepath())
-					if err == nil {
-						err = p.c.PrintfLine("+OK %d %d", idx, info.Size())
-					}
-				} else {
-					// no existing message
-					err = p.Error("no such message")
-				}
+				err = p.c.PrintfLine("+OK %s %s", args[0], msg.uid)
 			}
-		} else {
+		} else if len(args) == 0 {
 			// all messages
-			err = p.c.PrintfLine("+OK %d messages (%d octets)", len(p.msgs), p.octs)
+			err = p.OK("unique-id listing follows")
 			if err == nil {
 				dw := p.c.DotWriter()
-				for i, msg := range p.msgs {
-					info, err = os.Stat(msg.Filepath())
-					if err == nil {
-						// write out entry
-						fmt.Fprintf(dw, "%d %d\r\n", i+1, info.Size())
-					} else {
-						log.Errorf("error in pop3, stat(): %s", err.Error())
+				for idx, msg := range p.msgs {
+					if !msg.deleted {
+						fmt.Fprintf(dw, "%d %s\r\n", idx+1, msg.uid)
 					}
 				}
-				// FLUSH IT !!! :-DDDDD
 				err = dw.Close()
 			}
+		} else {
+			err = p.Error("invalid syntax")
+		}
+	case "RETR":
+		if len(args) != 1 {
+			err = p.Error("invalid syntax")
+		} else if msg, reply := p.message(args[0]); msg == nil {
+			err = p.Error(reply)
+		} else {
+			msg.retrieved = true
+			err = p.sendMessage(msg, -1)
 		}
-		break
+	case "TOP":
+		var lines int
+		if len(args) == 2 {
+			lines, err = strconv.Atoi(args[1])
+		}
+		if len(args) != 2 || err != nil || lines < 0 {
+			err = p.Error("invalid syntax")
+		} else if msg, reply := p.message(args[0]); msg == nil {
+			err = p.Error(reply)
+		} else {
+			err = p.sendMessage(msg, lines)
+		}
+	case "DELE":
+		if len(args) != 1 {
+			err = p.Error("invalid syntax")
+		} else if msg, reply := p.message(args[0]); msg == nil {
+			err = p.Error(reply)
+		} else {
+			msg.deleted = true
+			err = p.OK(fmt.Sprintf("message %s deleted", args[0]))
+		}
+	case "RSET":
+		for _, msg := range p.msgs {
+			msg.deleted = false
+		}
+		count, octs := p.stat()
+		err = p.OK(fmt.Sprintf("maildrop has %d messages (%d octets)", count, octs))
+	case "USER", "PASS", "APOP", "AUTH", "STLS":
+		err = p.Error("already logged in")
 	default:
 		err = p.Error("bad command")
 	}
 	return
 }
 
+// return true if passwords can be sent in the clear in this session
+func (p *pop3Session) secure() bool {
+	return p.tls || sasl.Secure(p.nc)
+}
+
+// enter transaction state as a user that logged in
+func (p *pop3Session) login(user string) (err error) {
+	if !p.s.lock(user) {
+		return p.Error("[IN-USE] maildrop already locked by another session")
+	}
+	st, msgs, err := p.s.getMessages(user)
+	if err != nil {
+		p.s.unlock(user)
+		log.Errorf("pop3: %s", err.Error())
+		return p.Error("[SYS/TEMP] " + err.Error())
+	}
+	p.user = user
+	p.st = st
+	p.msgs = msgs
+	p.state = stateTransaction
+	count, octs := p.stat()
+	return p.c.PrintfLine("+OK %s maildrop logged in, you have %d messages (%d octets)%s", p.user, count, octs, p.s.quotaInfo(p.user))
+}
+
+// handle AUTH command
+func (p *pop3Session) auth(args []string) (err error) {
+	mechs := p.s.mechanisms(p.secure())
+	if len(args) == 0 {
+		// list mechanisms
+		err = p.OK("")
+		if err == nil {
+			dw := p.c.DotWriter()
+			for _, mech := range mechs {
+				fmt.Fprintf(dw, "%s\r\n", mech)
+			}
+			err = dw.Close()
+		}
+		return
+	}
+	if len(args) > 2 {
+		return p.Error("invalid syntax")
+	}
+	mech := strings.ToUpper(args[0])
+	offered := false
+	for _, m := range mechs {
+		offered = offered || m == mech
+	}
+	srv, e := sasl.NewServer(mech, popAuth{p.s})
+	if e != nil || (!offered && p.s.Policy.Allows(mech, p.secure())) {
+		return p.Error("unrecognized authentication type")
+	}
+	if !offered {
+		return p.Error("encryption required for requested authentication mechanism")
+	}
+	initial := ""
+	if len(args) == 2 {
+		initial = args[1]
+	}
+	var user string
+	user, err = sasl.Exchange(srv, initial, func(chal string) error {
+		return p.c.PrintfLine("+ %s", chal)
+	}, p.c.ReadLine)
+	switch {
+	case err == nil:
+		err = p.login(user)
+	case errors.Is(err, sasl.ErrCanceled):
+		err = p.Error("authentication canceled")
+	case errors.Is(err, sasl.ErrMalformed):
+		err = p.Error("cannot decode response")
+	case errors.Is(err, sasl.ErrAuthFailed):
+		log.Warnf("pop3: failed %s login from %s", mech, p.nc.RemoteAddr())
+		err = p.Error("[AUTH] bad login")
+	}
+	return
+}
+
 // handle 1 line of input when not in transaction mode
 func (p *pop3Session) handleLine(line string) (err error) {
-	parts := strings.Split(line, " ")
-	cmd := strings.ToUpper(parts[0])
+	cmd, args := parseLine(line)
+	// the argument of USER and PASS is the rest of the line, passwords can have spaces
+	arg := ""
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		arg = line[idx+1:]
+	}
 	c := p.c
 	switch cmd {
+	case "QUIT":
+		p.quit = true
+		err = p.OK(p.s.name + " POP3 server signing off")
+	case "CAPA":
+		err = p.capa()
 	case "STLS":
 		if p.s.TLS == nil {
 			err = p.Error("no TLS supported")
+		} else if p.tls {
+			err = p.Error("already using TLS")
 		} else {
 			p.OK("Begin TLS negotiation")
 			p.c, _, err = starttls.HandleStartTLS(p.nc, p.s.TLS)
-			if err != nil {
+			if err == nil {
+				p.tls = true
+				p.user = ""
+			} else {
 				c.Close()
 			}
 		}
 	case "NOOP":
 		err = p.OK("")
-		break
+	case "AUTH":
+		err = p.auth(args)
+	case "APOP":
+		// APOP needs the password stored in the clear, use AUTH SCRAM-SHA-256 instead
+		err = p.Error("APOP not supported")
 	case "PASS":
-		if p.s.checkUser(p.user, line[5:]) {
-			p.msgs, p.octs, err = p.s.obtainMessages(p.user)
-			if err == nil {
-				err = p.c.PrintfLine("+OK %s maildrop logged in, you have %d messages (%d octets)", p.user, len(p.msgs), p.octs)
-				p.transaction = err == nil
-			} else {
-				err = p.Error(err.Error())
-			}
+		if !p.s.Policy.Allows(sasl.Plain, p.secure()) {
+			err = p.Error("encryption required, use STLS first")
+		} else if p.user == "" {
+			err = p.Error("USER first")
+		} else if p.s.checkUser(p.user, arg) {
+			err = p.login(p.user)
 		} else {
-			err = p.Error("bad login")
+			log.Warnf("pop3: failed login from %s", p.nc.RemoteAddr())
+			p.user = ""
+			err = p.Error("[AUTH] bad login")
 		}
-		break
 	case "USER":
-		if len(parts) > 1 {
-			p.user = line[5:]
+		if !p.s.Policy.Allows(sasl.Plain, p.secure()) {
+			err = p.Error("encryption required, use STLS first")
+		} else if len(args) == 0 {
+			err = p.Error("invalid syntax")
+		} else {
+			p.user = arg
+			err = p.OK("you may try login as " + p.user)
 		}
-		err = p.OK("you may try login as " + p.user)
-		break
+	case "STAT", "LIST", "UIDL", "RETR", "TOP", "DELE", "RSET":
+		err = p.Error("not logged in")
 	default:
 		err = p.Error("bad command")
 	}
@@ -346,15 +563,18 @@ func (p *pop3Session) Error(msg string) (err error) {
 }
 
 // serve sessions with connections accepted from a net.Listener
+// l can be a tls listener for pop3s
 func (s *Server) Serve(l net.Listener) (err error) {
 	for err == nil {
 		var c net.Conn
 		c, err = l.Accept()
 		if err == nil {
+			_, isTLS := c.(*tls.Conn)
 			p := &pop3Session{
-				nc: c,
-				c:  textproto.NewConn(c),
-				s:  s,
+				nc:  c,
+				c:   textproto.NewConn(c),
+				s:   s,
+				tls: isTLS,
 			}
 			go p.Run()
 		}
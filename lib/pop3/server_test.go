@@ -0,0 +1,350 @@
+package pop3
+
+import (
+	"encoding/base64"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// routes alice to 1 maildir
+type testRouter struct {
+	md maildir.MailDir
+}
+
+func (r testRouter) FindStoreFor(user string) (mailstore.Store, bool) {
+	return r.md, user == "alice"
+}
+
+// start a server for alice with password "hunter2" and some messages
+func testServer(t *testing.T, msgs ...string) (*Server, maildir.MailDir, string) {
+	md := maildir.MailDir(filepath.Join(t.TempDir(), "alice"))
+	if err := md.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	for idx, msg := range msgs {
+		m, err := md.Deliver(strings.NewReader(msg))
+		if err == nil {
+			// keep messages in the order given
+			err = md.SetDate(m, time.Now().Add(time.Duration(idx-len(msgs))*time.Minute))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := New()
+	srv.Local = testRouter{md}
+	srv.Auth = func(user, passwd string) (bool, error) {
+		return user == "alice" && passwd == "hunter2", nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return srv, md, l.Addr().String()
+}
+
+// test client of a pop3 session
+type testConn struct {
+	*textproto.Conn
+	t *testing.T
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConn{textproto.NewConn(nc), t}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	c.ok("")
+	return c
+}
+
+// read a status line and check it starts with +OK and then a prefix
+func (c *testConn) ok(prefix string) string {
+	c.t.Helper()
+	line, err := c.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "+OK") || !strings.HasPrefix(strings.TrimSpace(line[3:]), prefix) {
+		c.t.Fatalf("expected +OK %s, got %q", prefix, line)
+	}
+	return line
+}
+
+// read a status line and check it starts with -ERR and then a prefix
+func (c *testConn) err(prefix string) {
+	c.t.Helper()
+	line, err := c.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "-ERR") || !strings.HasPrefix(strings.TrimSpace(line[4:]), prefix) {
+		c.t.Fatalf("expected -ERR %s, got %q", prefix, line)
+	}
+}
+
+// send a command and read a multi-line reply
+func (c *testConn) multi(cmd string) []string {
+	c.t.Helper()
+	c.PrintfLine("%s", cmd)
+	c.ok("")
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return lines
+}
+
+// log in as alice
+func (c *testConn) login() {
+	c.t.Helper()
+	c.PrintfLine("USER alice")
+	c.ok("")
+	c.PrintfLine("PASS hunter2")
+	c.ok("alice maildrop logged in")
+}
+
+func has(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	msg1 = "Subject: one\n\nfirst line\n.hidden dot\nthird line\n"
+	msg2 = "Subject: two\n\nhello\n"
+)
+
+func TestCapa(t *testing.T) {
+	_, _, addr := testServer(t)
+	c := dial(t, addr)
+	capa := c.multi("CAPA")
+	for _, want := range []string{"USER", "SASL PLAIN LOGIN", "TOP", "UIDL", "PIPELINING", "RESP-CODES", "AUTH-RESP-CODE"} {
+		if !has(capa, want) {
+			t.Errorf("CAPA is missing %s: %v", want, capa)
+		}
+	}
+	c.login()
+	capa = c.multi("capa")
+	if has(capa, "USER") || !has(capa, "TOP") {
+		t.Errorf("wrong CAPA in transaction state: %v", capa)
+	}
+}
+
+func TestAuthorizationState(t *testing.T) {
+	_, _, addr := testServer(t, msg1)
+	c := dial(t, addr)
+	for _, cmd := range []string{"STAT", "LIST", "RETR 1", "DELE 1", "RSET", "TOP 1 0", "UIDL"} {
+		c.PrintfLine(cmd)
+		c.err("not logged in")
+	}
+	c.PrintfLine("PASS hunter2")
+	c.err("USER first")
+	c.PrintfLine("USER alice")
+	c.ok("")
+	c.PrintfLine("PASS wrong")
+	c.err("[AUTH]")
+	c.PrintfLine("APOP alice c4c9334bac560ecc979e58001b3e22fb")
+	c.err("")
+	mechs := c.multi("AUTH")
+	if !has(mechs, "PLAIN") {
+		t.Errorf("AUTH doesn't list PLAIN: %v", mechs)
+	}
+	c.PrintfLine("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00alice\x00hunter2")))
+	c.ok("alice maildrop logged in, you have 1 messages")
+	c.PrintfLine("USER bob")
+	c.err("")
+	c.PrintfLine("QUIT")
+	c.ok("")
+}
+
+func TestTransactionState(t *testing.T) {
+	_, _, addr := testServer(t, msg1, msg2)
+	c := dial(t, addr)
+	c.login()
+	c.PrintfLine("STAT")
+	c.ok("2 " + strconv.Itoa(len(msg1)+len(msg2)))
+	list := c.multi("LIST")
+	if len(list) != 2 || list[0] != "1 "+strconv.Itoa(len(msg1)) || list[1] != "2 "+strconv.Itoa(len(msg2)) {
+		t.Errorf("bad LIST: %v", list)
+	}
+	c.PrintfLine("LIST 2")
+	c.ok("2 " + strconv.Itoa(len(msg2)))
+	c.PrintfLine("LIST 3")
+	c.err("no such message")
+	c.PrintfLine("NOOP")
+	c.ok("")
+
+	// lines starting with a dot are byte stuffed
+	body := c.multi("RETR 1")
+	if strings.Join(body, "\n")+"\n" != msg1 {
+		t.Errorf("bad RETR: %q", body)
+	}
+	top := c.multi("TOP 1 1")
+	if strings.Join(top, "\n") != "Subject: one\n\nfirst line" {
+		t.Errorf("bad TOP 1 1: %q", top)
+	}
+	top = c.multi("TOP 1 0")
+	if strings.Join(top, "\n") != "Subject: one\n" {
+		t.Errorf("bad TOP 1 0: %q", top)
+	}
+	c.PrintfLine("TOP 1")
+	c.err("")
+
+	c.PrintfLine("DELE 1")
+	c.ok("")
+	c.PrintfLine("DELE 1")
+	c.err("message 1 already deleted")
+	for _, cmd := range []string{"RETR 1", "TOP 1 0", "LIST 1", "UIDL 1"} {
+		c.PrintfLine(cmd)
+		c.err("message 1 already deleted")
+	}
+	c.PrintfLine("STAT")
+	c.ok("1 " + strconv.Itoa(len(msg2)))
+	if list = c.multi("LIST"); len(list) != 1 || !strings.HasPrefix(list[0], "2 ") {
+		t.Errorf("deleted message in LIST: %v", list)
+	}
+	if uidl := c.multi("UIDL"); len(uidl) != 1 || !strings.HasPrefix(uidl[0], "2 ") {
+		t.Errorf("deleted message in UIDL: %v", uidl)
+	}
+	c.PrintfLine("RSET")
+	c.ok("maildrop has 2 messages")
+	c.PrintfLine("STAT")
+	c.ok("2 ")
+}
+
+func TestUpdateState(t *testing.T) {
+	_, md, addr := testServer(t, msg1, msg2)
+	count := func() int {
+		msgs, err := md.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+
+	// deletions are forgotten when the connection drops without QUIT
+	c := dial(t, addr)
+	c.login()
+	c.PrintfLine("DELE 1")
+	c.ok("")
+	c.Close()
+	c = dial(t, addr)
+	c.login()
+	if n := count(); n != 2 {
+		t.Fatalf("dropped session deleted mail, %d messages left", n)
+	}
+	uidl := c.multi("UIDL")
+
+	// QUIT removes them
+	c.PrintfLine("DELE 1")
+	c.ok("")
+	c.PrintfLine("QUIT")
+	c.ok("")
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("connection still open after QUIT")
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("%d messages left after QUIT", n)
+	}
+
+	// unique ids stay the same across sessions
+	c = dial(t, addr)
+	c.login()
+	again := c.multi("UIDL")
+	if len(again) != 1 || strings.Fields(again[0])[1] != strings.Fields(uidl[1])[1] {
+		t.Errorf("unique id changed: %v then %v", uidl, again)
+	}
+}
+
+func TestDeletedUnread(t *testing.T) {
+	srv, _, addr := testServer(t, msg1, msg2)
+	var deleted []string
+	srv.Deleted = func(user string, msg mailstore.Message) {
+		deleted = append(deleted, user+" "+msg.Filename())
+	}
+	c := dial(t, addr)
+	c.login()
+	uidl := c.multi("UIDL")
+	c.multi("RETR 1")
+	c.multi("TOP 2 0")
+	for _, cmd := range []string{"DELE 1", "DELE 2", "QUIT"} {
+		c.PrintfLine(cmd)
+		c.ok("")
+	}
+	// only the message that was not downloaded
+	if len(deleted) != 1 || !strings.HasPrefix(deleted[0], "alice "+strings.Fields(uidl[1])[1]) {
+		t.Errorf("wrong messages reported deleted unread: %v", deleted)
+	}
+}
+
+func TestMaildropLock(t *testing.T) {
+	_, _, addr := testServer(t, msg1)
+	c := dial(t, addr)
+	c.login()
+	other := dial(t, addr)
+	other.PrintfLine("USER alice")
+	other.ok("")
+	other.PrintfLine("PASS hunter2")
+	other.err("[IN-USE]")
+	// still in authorization state
+	other.PrintfLine("STAT")
+	other.err("not logged in")
+	c.PrintfLine("QUIT")
+	c.ok("")
+	c.ReadLine()
+	other.PrintfLine("PASS hunter2")
+	other.ok("alice maildrop logged in")
+}
+
+func TestPipelining(t *testing.T) {
+	_, _, addr := testServer(t, msg1, msg2)
+	c := dial(t, addr)
+	// send all commands before reading any replies
+	c.W.WriteString("USER alice\r\nPASS hunter2\r\nSTAT\r\nDELE 2\r\nLIST\r\nQUIT\r\n")
+	c.W.Flush()
+	c.ok("")
+	c.ok("alice maildrop logged in")
+	c.ok("2 ")
+	c.ok("")
+	c.ok("")
+	if list, err := c.ReadDotLines(); err != nil || len(list) != 1 {
+		t.Errorf("bad LIST: %v %v", list, err)
+	}
+	c.ok("")
+}
+
+func TestUID(t *testing.T) {
+	for name, want := range map[string]string{
+		"1700000000.M1P2.host:2,S": "1700000000.M1P2.host",
+		"1700000000.M1P2.host":     "1700000000.M1P2.host",
+	} {
+		if got := uidOf(name); got != want {
+			t.Errorf("uid of %q is %q, not %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"has space", strings.Repeat("x", maxUIDLen+1), ""} {
+		if uid := uidOf(name); len(uid) != 40 {
+			t.Errorf("uid of %q is %q, not hashed", name, uid)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+// server side sasl mechanisms (RFC 4422) shared by the smtp and pop3 servers
+package sasl
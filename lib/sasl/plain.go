@@ -0,0 +1,71 @@
+package sasl
+
+import (
+	"bytes"
+)
+
+// PLAIN mechanism (RFC 4616)
+type plainServer struct {
+	auth    Authenticator
+	started bool
+	user    string
+}
+
+func (p *plainServer) Next(resp []byte) ([]byte, bool, error) {
+	if resp == nil && !p.started {
+		// ask for the credentials
+		p.started = true
+		return []byte{}, false, nil
+	}
+	p.started = true
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, ErrMalformed
+	}
+	authz, user, passwd := string(parts[0]), string(parts[1]), string(parts[2])
+	if authz != "" && authz != user {
+		// we don't let users act as others
+		return nil, false, ErrAuthFailed
+	}
+	if user == "" || !p.auth.Plain(user, passwd) {
+		return nil, false, ErrAuthFailed
+	}
+	p.user = user
+	return nil, true, nil
+}
+
+func (p *plainServer) Username() string {
+	return p.user
+}
+
+// LOGIN mechanism, asks for the username then the password
+type loginServer struct {
+	auth    Authenticator
+	started bool
+	name    string
+	user    string
+}
+
+func (l *loginServer) Next(resp []byte) ([]byte, bool, error) {
+	if resp == nil && !l.started {
+		l.started = true
+		return []byte("Username:"), false, nil
+	}
+	l.started = true
+	if l.name == "" {
+		if len(resp) == 0 {
+			return nil, false, ErrMalformed
+		}
+		l.name = string(resp)
+		return []byte("Password:"), false, nil
+	}
+	if !l.auth.Plain(l.name, string(resp)) {
+		return nil, false, ErrAuthFailed
+	}
+	l.user = l.name
+	return nil, true, nil
+}
+
+func (l *loginServer) Username() string {
+	return l.user
+}
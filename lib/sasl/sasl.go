@@ -0,0 +1,164 @@
+package sasl
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+)
+
+// names of the mechanisms we support
+const (
+	Plain       = "PLAIN"
+	Login       = "LOGIN"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+// the client gave bad credentials
+var ErrAuthFailed = errors.New("authentication failed")
+
+// the client sent something we could not parse
+var ErrMalformed = errors.New("malformed sasl response")
+
+// the client canceled the exchange with "*"
+var ErrCanceled = errors.New("authentication canceled")
+
+// we don't support the mechanism
+var ErrUnknownMechanism = errors.New("unknown sasl mechanism")
+
+// checks the credentials mechanisms are given
+type Authenticator interface {
+	// check a username and password
+	Plain(username, password string) bool
+	// get the scram credentials of a user, nil if they can't log in with scram
+	Scram(username string) *ScramCred
+}
+
+// server side of 1 mechanism exchange
+type Server interface {
+	// process a response from the client, the first call gets the initial response or nil if there was none
+	// returns the next challenge or done once the client is authenticated
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// get the authenticated username once done
+	Username() string
+}
+
+// start the server side of a mechanism
+func NewServer(mech string, auth Authenticator) (Server, error) {
+	switch strings.ToUpper(mech) {
+	case Plain:
+		return &plainServer{auth: auth}, nil
+	case Login:
+		return &loginServer{auth: auth}, nil
+	case ScramSHA256:
+		return &scramServer{auth: auth}, nil
+	}
+	return nil, ErrUnknownMechanism
+}
+
+// return true if a mechanism sends the password in the clear
+func Plaintext(mech string) bool {
+	mech = strings.ToUpper(mech)
+	return mech == Plain || mech == Login
+}
+
+// when mechanisms that send the password in the clear may be used
+type Policy int
+
+const (
+	// plaintext mechanisms need a secure connection
+	RequireTLS = Policy(iota)
+	// plaintext mechanisms can always be used
+	AllowPlaintext
+)
+
+// parse a policy from config, "tls" or "always"
+func ParsePolicy(str string) (p Policy, err error) {
+	switch strings.ToLower(str) {
+	case "", "tls":
+		p = RequireTLS
+	case "always":
+		p = AllowPlaintext
+	default:
+		err = errors.New("plaintext auth policy must be tls or always, not " + str)
+	}
+	return
+}
+
+// return true if a mechanism can be used on a connection that is secure or not
+func (p Policy) Allows(mech string, secure bool) bool {
+	return secure || p == AllowPlaintext || !Plaintext(mech)
+}
+
+// get the mechanisms to offer on a connection that is secure or not
+func (p Policy) Mechanisms(secure bool) (mechs []string) {
+	for _, mech := range []string{Plain, Login, ScramSHA256} {
+		if p.Allows(mech, secure) {
+			mechs = append(mechs, mech)
+		}
+	}
+	return
+}
+
+// return true if passwords can be sent over a connection in the clear, it is TLS or over loopback
+func Secure(conn net.Conn) bool {
+	if conn == nil {
+		return false
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return true
+	}
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP.IsLoopback()
+	}
+	return false
+}
+
+// run a mechanism over a line based protocol where challenges and responses are base64
+// initial is the initial response sent with the command, empty if there was none and "=" if it was empty
+// send writes a challenge and recv reads the next line from the client
+// returns the authenticated username
+func Exchange(srv Server, initial string, send func(challenge string) error, recv func() (string, error)) (user string, err error) {
+	var resp []byte
+	if initial == "=" {
+		resp = []byte{}
+	} else if initial != "" {
+		resp, err = base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			err = ErrMalformed
+			return
+		}
+	}
+	for {
+		var chal []byte
+		var done bool
+		chal, done, err = srv.Next(resp)
+		if err != nil {
+			return
+		}
+		if done {
+			user = srv.Username()
+			return
+		}
+		err = send(base64.StdEncoding.EncodeToString(chal))
+		if err != nil {
+			return
+		}
+		var line string
+		line, err = recv()
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "*" {
+			err = ErrCanceled
+			return
+		}
+		resp, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			err = ErrMalformed
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+	"testing"
+)
+
+type testAuth map[string]string
+
+func (a testAuth) Plain(user, passwd string) bool {
+	p, ok := a[user]
+	return ok && p == passwd
+}
+
+func (a testAuth) Scram(user string) *ScramCred {
+	if p, ok := a[user]; ok {
+		c := NewScramCred(p)
+		// round trip through storage
+		c, _ = ParseScramCred(c.String())
+		return c
+	}
+	return nil
+}
+
+var auth = testAuth{"alice": "pencil"}
+
+// run an exchange with the client's lines
+func exchange(mech, initial string, lines ...string) (user string, chals []string, err error) {
+	srv, err := NewServer(mech, auth)
+	if err != nil {
+		return
+	}
+	user, err = Exchange(srv, initial, func(c string) error {
+		chals = append(chals, c)
+		return nil
+	}, func() (string, error) {
+		if len(lines) == 0 {
+			return "", errors.New("client ran out of lines")
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
+	})
+	return
+}
+
+func b64(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+func TestPlain(t *testing.T) {
+	if user, _, err := exchange(Plain, b64("\x00alice\x00pencil")); err != nil || user != "alice" {
+		t.Errorf("initial response: %q %v", user, err)
+	}
+	user, chals, err := exchange(Plain, "", b64("alice\x00alice\x00pencil"))
+	if err != nil || user != "alice" || len(chals) != 1 || chals[0] != "" {
+		t.Errorf("continuation: %q %v %v", user, chals, err)
+	}
+	if _, _, err = exchange(Plain, b64("bob\x00alice\x00pencil")); err != ErrAuthFailed {
+		t.Errorf("acting as another user gave %v", err)
+	}
+	if _, _, err = exchange(Plain, "", "*"); err != ErrCanceled {
+		t.Errorf("cancel gave %v", err)
+	}
+	if _, _, err = exchange(Plain, "!!"); err != ErrMalformed {
+		t.Errorf("bad base64 gave %v", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	user, chals, err := exchange(Login, "", b64("alice"), b64("pencil"))
+	if err != nil || user != "alice" || len(chals) != 2 || chals[0] != b64("Username:") {
+		t.Errorf("login: %q %v %v", user, chals, err)
+	}
+	if _, _, err = exchange(Login, b64("alice"), b64("crayon")); err != ErrAuthFailed {
+		t.Errorf("bad password gave %v", err)
+	}
+}
+
+// client side of scram for tests
+func scramClient(t *testing.T, user, passwd string) (string, []string, error) {
+	clientFirst := "n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	var final, verifier string
+	srv, _ := NewServer(ScramSHA256, auth)
+	var chals []string
+	step := 0
+	got, err := Exchange(srv, b64("n,,"+clientFirst), func(c string) error {
+		data, _ := base64.StdEncoding.DecodeString(c)
+		chals = append(chals, string(data))
+		return nil
+	}, func() (string, error) {
+		step++
+		if step == 2 {
+			if chals[1] != verifier {
+				t.Errorf("bad server signature %q want %q", chals[1], verifier)
+			}
+			return "", nil
+		}
+		serverFirst := chals[0]
+		var nonce, salt string
+		for _, attr := range strings.Split(serverFirst, ",") {
+			switch attr[:2] {
+			case "r=":
+				nonce = attr[2:]
+			case "s=":
+				salt = attr[2:]
+			}
+		}
+		saltb, _ := base64.StdEncoding.DecodeString(salt)
+		salted := pbkdf2.Key([]byte(passwd), saltb, ScramIterations, 32, sha256.New)
+		clientKey := scramHMAC(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		withoutProof := "c=" + b64("n,,") + ",r=" + nonce
+		authMsg := clientFirst + "," + serverFirst + "," + withoutProof
+		sig := scramHMAC(storedKey[:], authMsg)
+		proof := make([]byte, len(sig))
+		for i := range sig {
+			proof[i] = clientKey[i] ^ sig[i]
+		}
+		mac := hmac.New(sha256.New, scramHMAC(salted, "Server Key"))
+		mac.Write([]byte(authMsg))
+		verifier = "v=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		final = withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+		return b64(final), nil
+	})
+	return got, chals, err
+}
+
+func TestScram(t *testing.T) {
+	user, chals, err := scramClient(t, "alice", "pencil")
+	if err != nil || user != "alice" || len(chals) != 2 {
+		t.Fatalf("scram: %q %v %v", user, chals, err)
+	}
+	if !strings.HasPrefix(chals[0], "r=fyko+d2lbbFgONRv9qkxdawL") || !strings.Contains(chals[0], ",i=4096") {
+		t.Errorf("bad server first message %q", chals[0])
+	}
+	if _, _, err = scramClient(t, "alice", "crayon"); err != ErrAuthFailed {
+		t.Errorf("bad password gave %v", err)
+	}
+	if _, _, err = scramClient(t, "bob", "pencil"); err != ErrAuthFailed {
+		t.Errorf("unknown user gave %v", err)
+	}
+	// probing an unknown user always gives the same salt
+	_, first, _ := scramClient(t, "bob", "pencil")
+	_, again, _ := scramClient(t, "bob", "crayon")
+	salt := func(chal string) string {
+		return chal[strings.Index(chal, ",s="):]
+	}
+	if len(first) == 0 || len(again) == 0 || salt(first[0]) != salt(again[0]) {
+		t.Errorf("unknown user got different salts: %q %q", first, again)
+	}
+	_, other, _ := scramClient(t, "carol", "pencil")
+	if len(other) == 0 || salt(other[0]) == salt(first[0]) {
+		t.Errorf("unknown users share a salt: %q %q", first, other)
+	}
+	SetFakeKey([]byte("secret"))
+	_, keyed, _ := scramClient(t, "bob", "pencil")
+	if len(keyed) == 0 || salt(keyed[0]) == salt(first[0]) {
+		t.Errorf("salt didn't change with the key: %q", keyed)
+	}
+	if _, _, err = exchange(ScramSHA256, b64("p=tls-unique,,n=alice,r=abc")); err != ErrMalformed {
+		t.Errorf("channel binding gave %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	if got := strings.Join(RequireTLS.Mechanisms(false), " "); got != ScramSHA256 {
+		t.Errorf("insecure mechanisms %q", got)
+	}
+	if got := strings.Join(RequireTLS.Mechanisms(true), " "); got != "PLAIN LOGIN SCRAM-SHA-256" {
+		t.Errorf("secure mechanisms %q", got)
+	}
+	if !AllowPlaintext.Allows(Plain, false) || RequireTLS.Allows("login", false) {
+		t.Errorf("policy not followed")
+	}
+	if _, err := ParsePolicy("sometimes"); err == nil {
+		t.Errorf("bad policy parsed")
+	}
+}
@@ -0,0 +1,268 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pbkdf2 iterations of new scram credentials, the least RFC 7677 allows
+const ScramIterations = 4096
+
+// what we keep to check SCRAM-SHA-256 logins, it can't be used to log in by itself
+type ScramCred struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, msg)
+	return mac.Sum(nil)
+}
+
+// make scram credentials for a password with a random salt
+// the password is used as is without SASLprep
+func NewScramCred(password string) *ScramCred {
+	c := &ScramCred{
+		Salt:       make([]byte, 16),
+		Iterations: ScramIterations,
+	}
+	io.ReadFull(rand.Reader, c.Salt)
+	salted := pbkdf2.Key([]byte(password), c.Salt, c.Iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	c.StoredKey = storedKey[:]
+	c.ServerKey = scramHMAC(salted, "Server Key")
+	return c
+}
+
+// secret key fake credentials of unknown users are made with
+var fakeKey []byte
+var fakeMtx sync.Mutex
+
+// set the secret key fake scram credentials of unknown users are made with
+// it should stay the same across restarts so an unknown user's salt never changes
+// until it is set a random key is used for the life of the process
+func SetFakeKey(key []byte) {
+	fakeMtx.Lock()
+	fakeKey = append([]byte(nil), key...)
+	fakeMtx.Unlock()
+}
+
+// make up scram credentials for a user that doesn't exist
+// they are the same every time for a name like a real user's and cost no pbkdf2
+func fakeScramCred(name string) *ScramCred {
+	fakeMtx.Lock()
+	if fakeKey == nil {
+		fakeKey = make([]byte, 32)
+		io.ReadFull(rand.Reader, fakeKey)
+	}
+	key := fakeKey
+	fakeMtx.Unlock()
+	return &ScramCred{
+		Salt:       scramHMAC(key, "salt\x00"+name)[:16],
+		Iterations: ScramIterations,
+		StoredKey:  scramHMAC(key, "stored\x00"+name),
+		ServerKey:  scramHMAC(key, "server\x00"+name),
+	}
+}
+
+// encode as SCRAM-SHA-256$iterations:salt$StoredKey:ServerKey
+func (c *ScramCred) String() string {
+	b64 := base64.StdEncoding
+	return fmt.Sprintf("%s$%d:%s$%s:%s", ScramSHA256, c.Iterations, b64.EncodeToString(c.Salt), b64.EncodeToString(c.StoredKey), b64.EncodeToString(c.ServerKey))
+}
+
+// parse scram credentials made by String
+func ParseScramCred(str string) (c *ScramCred, err error) {
+	err = errors.New("bad scram credentials")
+	p := strings.Split(str, "$")
+	if len(p) != 3 || p[0] != ScramSHA256 {
+		return nil, err
+	}
+	iter := strings.Split(p[1], ":")
+	keys := strings.Split(p[2], ":")
+	if len(iter) != 2 || len(keys) != 2 {
+		return nil, err
+	}
+	b64 := base64.StdEncoding
+	c = new(ScramCred)
+	var e error
+	c.Iterations, e = strconv.Atoi(iter[0])
+	if e == nil && c.Iterations > 0 {
+		c.Salt, e = b64.DecodeString(iter[1])
+	}
+	if e == nil {
+		c.StoredKey, e = b64.DecodeString(keys[0])
+	}
+	if e == nil {
+		c.ServerKey, e = b64.DecodeString(keys[1])
+	}
+	if e != nil || c.Iterations <= 0 || len(c.StoredKey) != sha256.Size || len(c.ServerKey) != sha256.Size {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SCRAM-SHA-256 mechanism without channel binding (RFC 5802, RFC 7677)
+type scramServer struct {
+	auth  Authenticator
+	state int
+	// gs2 header the client sent
+	gs2 string
+	// client-first-message-bare
+	clientFirst string
+	// server-first-message
+	serverFirst string
+	// client nonce and ours
+	nonce string
+	name  string
+	cred  *ScramCred
+	// the user has no credentials, the exchange goes on so it looks like a bad password
+	fake bool
+	user string
+}
+
+const (
+	scramStart = iota
+	scramFinal
+	scramDone
+)
+
+// decode a saslname
+func scramName(str string) (string, error) {
+	if strings.Contains(strings.Replace(strings.Replace(str, "=2C", "", -1), "=3D", "", -1), "=") {
+		return "", ErrMalformed
+	}
+	return strings.Replace(strings.Replace(str, "=2C", ",", -1), "=3D", "=", -1), nil
+}
+
+// parse scram attributes into a map, returns them in order of their names too
+func scramAttrs(msg string) (attrs map[string]string, names []string, err error) {
+	attrs = make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, nil, ErrMalformed
+		}
+		attrs[attr[:1]] = attr[2:]
+		names = append(names, attr[:1])
+	}
+	return
+}
+
+func (s *scramServer) Next(resp []byte) ([]byte, bool, error) {
+	switch s.state {
+	case scramStart:
+		if resp == nil {
+			// ask for the client first message
+			return []byte{}, false, nil
+		}
+		return s.first(string(resp))
+	case scramFinal:
+		return s.final(string(resp))
+	}
+	if len(resp) != 0 {
+		return nil, false, ErrMalformed
+	}
+	return nil, true, nil
+}
+
+// handle client-first-message
+func (s *scramServer) first(msg string) ([]byte, bool, error) {
+	// gs2-header is cbind-flag "," [authzid] ","
+	p := strings.SplitN(msg, ",", 3)
+	if len(p) != 3 {
+		return nil, false, ErrMalformed
+	}
+	if p[0] != "n" && p[0] != "y" {
+		// channel binding is not supported
+		return nil, false, ErrMalformed
+	}
+	var authz string
+	if p[1] != "" {
+		if !strings.HasPrefix(p[1], "a=") {
+			return nil, false, ErrMalformed
+		}
+		var err error
+		authz, err = scramName(p[1][2:])
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	s.gs2 = p[0] + "," + p[1] + ","
+	s.clientFirst = p[2]
+	attrs, names, err := scramAttrs(s.clientFirst)
+	if err != nil || len(names) < 2 || names[0] != "n" || names[1] != "r" || attrs["r"] == "" {
+		return nil, false, ErrMalformed
+	}
+	s.name, err = scramName(attrs["n"])
+	if err != nil || s.name == "" {
+		return nil, false, ErrMalformed
+	}
+	if authz != "" && authz != s.name {
+		return nil, false, ErrAuthFailed
+	}
+	s.cred = s.auth.Scram(s.name)
+	if s.cred == nil {
+		s.fake = true
+		s.cred = fakeScramCred(s.name)
+	}
+	snonce := make([]byte, 18)
+	io.ReadFull(rand.Reader, snonce)
+	s.nonce = attrs["r"] + base64.StdEncoding.EncodeToString(snonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.cred.Salt), s.cred.Iterations)
+	s.state = scramFinal
+	return []byte(s.serverFirst), false, nil
+}
+
+// handle client-final-message
+func (s *scramServer) final(msg string) ([]byte, bool, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return nil, false, ErrMalformed
+	}
+	withoutProof := msg[:idx]
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+	if err != nil {
+		return nil, false, ErrMalformed
+	}
+	attrs, names, err := scramAttrs(withoutProof)
+	if err != nil || len(names) < 2 || names[0] != "c" || names[1] != "r" {
+		return nil, false, ErrMalformed
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2)) || attrs["r"] != s.nonce {
+		return nil, false, ErrMalformed
+	}
+	authMsg := s.clientFirst + "," + s.serverFirst + "," + withoutProof
+	clientSig := scramHMAC(s.cred.StoredKey, authMsg)
+	if len(proof) != len(clientSig) {
+		return nil, false, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSig[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.cred.StoredKey) != 1 || s.fake {
+		return nil, false, ErrAuthFailed
+	}
+	s.user = s.name
+	s.state = scramDone
+	return []byte("v=" + base64.StdEncoding.EncodeToString(scramHMAC(s.cred.ServerKey, authMsg))), false, nil
+}
+
+func (s *scramServer) Username() string {
+	return s.user
+}
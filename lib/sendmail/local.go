@@ -10,14 +10,19 @@ type LocalDeliverJob struct {
 	st     mailstore.Store
 	result chan bool
 	fpath  string
+	// checks if a message of this size fits in the store, nil for no quota
+	quota func(int64) error
+	err   error
 }
 
 // new local delivery job
-func NewLocalDelivery(st mailstore.Store, fpath string) DeliverJob {
+// quota checks if a message of a size fits in the store, nil for no quota
+func NewLocalDelivery(st mailstore.Store, fpath string, quota func(int64) error) *LocalDeliverJob {
 	return &LocalDeliverJob{
 		st:     st,
 		result: make(chan bool),
 		fpath:  fpath,
+		quota:  quota,
 	}
 }
 
@@ -31,17 +36,40 @@ func (l *LocalDeliverJob) Wait() bool {
 	return <-l.result
 }
 
+// get why delivery failed after Wait returned false
+func (l *LocalDeliverJob) Error() error {
+	return l.err
+}
+
 // run local delivery
 func (l *LocalDeliverJob) Run() {
 	var msg mailstore.Message
+	if l.st == nil {
+		l.err = ErrNoLocalMailDelivery
+		log.Warnf("local delivery failed: %s", l.err.Error())
+		l.result <- false
+		return
+	}
 	f, err := os.Open(l.fpath)
+	if err == nil && l.quota != nil {
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err == nil {
+			err = l.quota(info.Size())
+		}
+		if err != nil {
+			f.Close()
+		}
+	}
 	if err == nil {
 		msg, err = l.st.Deliver(f)
 		f.Close()
 	}
+	l.err = err
 	if err != nil {
 		log.Warnf("local delivery failed: %s", err.Error())
 		l.result <- false
+		return
 	}
 	// inform result
 	l.result <- msg != nil
@@ -0,0 +1,498 @@
+package sendmail
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/mailutil"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// delivery state of a recipiant
+type RecipState int
+
+const (
+	// not delivered yet
+	Pending = RecipState(iota)
+	// delivered
+	Delivered
+	// gave up and bounced
+	Bounced
+)
+
+func (st RecipState) String() string {
+	switch st {
+	case Delivered:
+		return "delivered"
+	case Bounced:
+		return "bounced"
+	}
+	return "pending"
+}
+
+// delivery status of 1 recipiant of a queued message
+type Recipient struct {
+	// email address
+	Addr string `json:"addr"`
+	// delivery state
+	State RecipState `json:"state"`
+	// number of failed attempts so far
+	Attempts int `json:"attempts"`
+	// when to try delivering again
+	NextAttempt time.Time `json:"next_attempt"`
+	// error from the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// enhanced status code of the last attempt
+	Status string `json:"status,omitempty"`
+	// NOTIFY the sender gave for this recipiant
+	Notify string `json:"notify,omitempty"`
+	// ORCPT the sender gave for this recipiant
+	ORcpt string `json:"orcpt,omitempty"`
+}
+
+// delivery status of a queued message
+type Entry struct {
+	// envelope sender
+	From string `json:"from"`
+	// who the message goes to
+	Recipients []*Recipient `json:"recipients"`
+	// when the message was queued
+	Queued time.Time `json:"queued"`
+	// RET the sender gave
+	Ret string `json:"ret,omitempty"`
+	// ENVID the sender gave
+	EnvID string `json:"envid,omitempty"`
+}
+
+// return true if every recipiant was delivered or bounced
+func (e *Entry) Done() bool {
+	for _, r := range e.Recipients {
+		if r.State == Pending {
+			return false
+		}
+	}
+	return true
+}
+
+// gets the envelope sender and recipiants of a message queued without one
+type Envelope func(msg mailstore.Message) (from string, to []string, err error)
+
+// sends a delivery status notification about a queued message to its sender
+type Reporter func(from string, r *mailutil.Report, msg mailstore.Message)
+
+// name of the directory in the queue's maildir holding delivery state
+const queueStateDir = "state"
+
+// longest time to wait between delivery attempts
+const maxRetryDelay = time.Second * 1024
+
+// durable outbound mail queue
+// messages are queued in cur with their envelope in a delivery state file
+// messages dropped in new without an envelope get one from Envelope and are moved to cur
+// messages are removed once every recipiant is delivered or bounced
+type Queue struct {
+	// sends mail, its Retries limits delivery attempts per recipiant and Bounce is called when we give up
+	Mailer *Mailer
+	// gets the envelope of messages dropped in new
+	Envelope Envelope
+	// sends delivery status notifications of bounced recipiants and of delivered ones that asked for them
+	// nil calls Mailer.Bounce for each bounced recipiant instead
+	Report Reporter
+	// maildir messages are queued in
+	md maildir.MailDir
+	// names of messages being delivered right now
+	busy map[string]bool
+	mtx  sync.Mutex
+	// current time, swapped out in tests
+	now func() time.Time
+}
+
+// create a durable queue in a maildir
+func NewQueue(md maildir.MailDir) *Queue {
+	return &Queue{
+		md:   md,
+		busy: make(map[string]bool),
+		now:  time.Now,
+	}
+}
+
+// ensure the queue's directories exist
+func (q *Queue) Ensure() (err error) {
+	err = q.md.Ensure()
+	if err == nil {
+		err = os.MkdirAll(q.stateDir(), 0700)
+	}
+	return
+}
+
+func (q *Queue) stateDir() string {
+	return filepath.Join(q.md.Filepath(), queueStateDir)
+}
+
+// filepath of a message's delivery state
+func (q *Queue) statePath(msg maildir.Message) string {
+	return filepath.Join(q.stateDir(), msg.Name()+".json")
+}
+
+// load the delivery state of a message
+func (q *Queue) Load(msg maildir.Message) (e *Entry, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(q.statePath(msg))
+	if err == nil {
+		e = new(Entry)
+		err = json.Unmarshal(data, e)
+	}
+	return
+}
+
+// atomically write the delivery state of a message
+func (q *Queue) save(msg maildir.Message, e *Entry) (err error) {
+	var data []byte
+	data, err = json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+	fname := q.statePath(msg)
+	tmpname := fname + ".tmp"
+	var f *os.File
+	f, err = os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpname, fname)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return
+}
+
+// remove a message that should not be sent
+// returns false if it is being delivered right now
+func (q *Queue) Remove(msg maildir.Message) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.busy[msg.Name()] {
+		return false
+	}
+	q.remove(msg)
+	return true
+}
+
+// remove a finished message and its delivery state
+func (q *Queue) remove(msg maildir.Message) {
+	err := msg.Remove()
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove sent message %s: %s", msg.Filepath(), err.Error())
+	}
+	err = os.Remove(q.statePath(msg))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove queue state of %s: %s", msg.Name(), err.Error())
+	}
+}
+
+// create the delivery state for the recipiants of an envelope, dsn may be nil
+func (q *Queue) envelopeEntry(from string, to []string, dsn *mailstore.DSN) (e *Entry) {
+	e = &Entry{
+		From:   from,
+		Queued: q.now(),
+	}
+	if dsn != nil {
+		e.Ret = dsn.Ret
+		e.EnvID = dsn.EnvID
+	}
+	seen := make(map[string]bool)
+	for _, addr := range to {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			r := &Recipient{
+				Addr:        addr,
+				NextAttempt: e.Queued,
+			}
+			if dsn != nil {
+				r.Notify = dsn.Notify[addr]
+				r.ORcpt = dsn.ORcpt[addr]
+			}
+			e.Recipients = append(e.Recipients, r)
+		}
+	}
+	return
+}
+
+// queue a message for delivery to the recipiants of an smtp envelope
+// the envelope is stored in the message's delivery state before the message becomes visible to Flush
+func (q *Queue) Enqueue(from string, to []string, body io.Reader) (m mailstore.Message, err error) {
+	return q.EnqueueDSN(from, to, nil, body)
+}
+
+// queue a message like Enqueue with the delivery status notifications its sender asked for, dsn may be nil
+func (q *Queue) EnqueueDSN(from string, to []string, dsn *mailstore.DSN, body io.Reader) (m mailstore.Message, err error) {
+	fname := q.md.File()
+	tmpname := q.md.Temp(fname)
+	var f *os.File
+	f, err = os.OpenFile(tmpname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	msg := maildir.Message(q.md.Cur(fname))
+	if err == nil {
+		err = q.save(msg, q.envelopeEntry(from, to, dsn))
+	}
+	if err == nil {
+		err = os.Rename(tmpname, msg.Filepath())
+		if err != nil {
+			os.Remove(q.statePath(msg))
+		}
+	}
+	if err == nil {
+		m = msg
+	} else {
+		os.Remove(tmpname)
+	}
+	return
+}
+
+// create the delivery state of a message queued without an envelope
+func (q *Queue) newEntry(msg maildir.Message) (e *Entry, err error) {
+	if q.Envelope == nil {
+		err = errors.New("queue has no envelope getter")
+		return
+	}
+	var from string
+	var to []string
+	from, to, err = q.Envelope(msg)
+	if err == nil {
+		e = q.envelopeEntry(from, to, nil)
+	}
+	return
+}
+
+// record the delivery state of all new messages and move them to cur
+func (q *Queue) accept() {
+	msgs, err := q.md.ListNew()
+	if err != nil {
+		log.Errorf("failed to list new outbound messages: %s", err.Error())
+		return
+	}
+	for _, m := range msgs {
+		msg := maildir.Message(m.Filepath())
+		e, err := q.newEntry(msg)
+		if err == nil {
+			err = q.save(msg, e)
+		}
+		if err == nil {
+			_, err = q.md.ProcessNew(msg)
+		}
+		if err != nil {
+			log.Errorf("failed to queue outbound message %s: %s", msg.Filepath(), err.Error())
+		}
+	}
+}
+
+// how long to wait before trying again after a number of failed attempts
+func retryDelay(attempts int) (d time.Duration) {
+	d = time.Second
+	for i := 0; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return
+}
+
+// queue new messages and start delivery of everything that is due
+// returns without waiting for deliveries to finish
+func (q *Queue) Flush() {
+	q.accept()
+	msgs, err := q.md.ListCur()
+	if err != nil {
+		log.Errorf("failed to list outbound messages: %s", err.Error())
+		return
+	}
+	now := q.now()
+	for _, msg := range msgs {
+		e, err := q.Load(msg)
+		if os.IsNotExist(err) {
+			// queued before we tracked state, start over
+			e, err = q.newEntry(msg)
+			if err == nil {
+				err = q.save(msg, e)
+			}
+		}
+		if err != nil {
+			log.Errorf("bad outbound message %s: %s", msg.Filepath(), err.Error())
+			continue
+		}
+		if !q.due(e, now) {
+			continue
+		}
+		q.mtx.Lock()
+		busy := q.busy[msg.Name()]
+		if !busy {
+			q.busy[msg.Name()] = true
+		}
+		q.mtx.Unlock()
+		if !busy {
+			go q.deliver(msg, e)
+		}
+	}
+}
+
+// return true if a message is finished or has a recipiant due for delivery
+func (q *Queue) due(e *Entry, now time.Time) bool {
+	if e.Done() {
+		return true
+	}
+	for _, r := range e.Recipients {
+		if r.State == Pending && !r.NextAttempt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt delivery to all due recipiants of a message and record the outcome
+func (q *Queue) deliver(msg maildir.Message, e *Entry) {
+	defer func() {
+		q.mtx.Lock()
+		delete(q.busy, msg.Name())
+		q.mtx.Unlock()
+	}()
+	if len(e.Recipients) == 0 {
+		log.Warnf("%s not deliverable, no valid recipiants", msg.Filepath())
+		if q.Mailer.Bounce != nil {
+			q.Mailer.Bounce("", e.From, msg.Filepath(), errors.New("mail not deliverable"))
+		}
+		q.remove(msg)
+		return
+	}
+	now := q.now()
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var failed, delivered []*Recipient
+	for _, r := range e.Recipients {
+		if r.State != Pending || r.NextAttempt.After(now) {
+			continue
+		}
+		wg.Add(1)
+		go func(r *Recipient) {
+			err := q.Mailer.Attempt(r.Addr, e.From, msg)
+			r.Status = Status(err)
+			if err == nil {
+				r.State = Delivered
+				r.LastError = ""
+				mtx.Lock()
+				delivered = append(delivered, r)
+				mtx.Unlock()
+			} else {
+				r.Attempts++
+				r.LastError = err.Error()
+				r.NextAttempt = q.now().Add(retryDelay(r.Attempts))
+				log.Warnf("failed to deliver message to %s from %s: %s", r.Addr, e.From, err.Error())
+				if IsPermanent(err) || (q.Mailer.Retries > 0 && r.Attempts >= q.Mailer.Retries) {
+					mtx.Lock()
+					failed = append(failed, r)
+					mtx.Unlock()
+				}
+			}
+			wg.Done()
+		}(r)
+	}
+	wg.Wait()
+	for _, r := range failed {
+		log.Errorf("delivery of message to %s failed", r.Addr)
+		r.State = Bounced
+	}
+	if len(failed) > 0 || len(delivered) > 0 {
+		// save before reporting so a restart does not report twice
+		err := q.save(msg, e)
+		if err != nil {
+			log.Errorf("failed to save queue state of %s: %s", msg.Name(), err.Error())
+		}
+		q.report(msg, e, failed, delivered)
+	}
+	if e.Done() {
+		q.remove(msg)
+		return
+	}
+	err := q.save(msg, e)
+	if err != nil {
+		log.Errorf("failed to save queue state of %s: %s", msg.Name(), err.Error())
+	}
+}
+
+// send delivery status notifications for recipiants that bounced or were delivered
+func (q *Queue) report(msg maildir.Message, e *Entry, failed, delivered []*Recipient) {
+	if e.From == "" {
+		// never notify the null sender
+		return
+	}
+	if q.Report == nil {
+		for _, r := range failed {
+			if q.Mailer.Bounce != nil && mailutil.Notifies(r.Notify, mailutil.NotifyFailure) {
+				q.Mailer.Bounce(r.Addr, e.From, msg.Filepath(), errors.New(r.LastError))
+			}
+		}
+		return
+	}
+	rep := &mailutil.Report{
+		EnvID:       e.EnvID,
+		Arrival:     e.Queued,
+		HeadersOnly: e.Ret == mailutil.RetHeaders,
+	}
+	for _, r := range failed {
+		if mailutil.Notifies(r.Notify, mailutil.NotifyFailure) {
+			rep.Recipients = append(rep.Recipients, mailutil.ReportRecipient{
+				Final:      r.Addr,
+				Original:   r.ORcpt,
+				Action:     mailutil.ActionFailed,
+				Status:     r.Status,
+				Diagnostic: r.LastError,
+			})
+		}
+	}
+	for _, r := range delivered {
+		if mailutil.Notifies(r.Notify, mailutil.NotifySuccess) {
+			rep.Recipients = append(rep.Recipients, mailutil.ReportRecipient{
+				Final:    r.Addr,
+				Original: r.ORcpt,
+				Action:   q.deliveredAction(r.Addr),
+				Status:   r.Status,
+			})
+		}
+	}
+	if len(rep.Recipients) > 0 && rep.Recipients[0].Action != mailutil.ActionFailed {
+		// RET is only for failures, who got it is said by the header
+		rep.HeadersOnly = true
+	}
+	if len(rep.Recipients) > 0 {
+		q.Report(e.From, rep, msg)
+	}
+}
+
+// get the action of a delivered recipiant, mail going off to other servers is only relayed
+func (q *Queue) deliveredAction(addr string) string {
+	if q.Mailer.transport(addr) == nil && q.Mailer.localStore(addr) != nil {
+		return mailutil.ActionDelivered
+	}
+	return mailutil.ActionRelayed
+}
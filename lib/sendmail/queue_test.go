@@ -0,0 +1,309 @@
+package sendmail
+
+import (
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/mailutil"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a local store that fails a number of deliveries first
+type flakyStore struct {
+	maildir.MailDir
+	fails int
+	mtx   sync.Mutex
+}
+
+func (st *flakyStore) Deliver(r io.Reader) (mailstore.Message, error) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.fails > 0 {
+		st.fails--
+		return nil, errors.New("disk on fire")
+	}
+	return st.MailDir.Deliver(r)
+}
+
+type testRouter map[string]mailstore.Store
+
+func (r testRouter) FindStoreFor(user string) (st mailstore.Store, has bool) {
+	st, has = r[user]
+	return
+}
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func newTestQueue(dir string, mailer *Mailer, clock *testClock) *Queue {
+	q := NewQueue(maildir.MailDir(filepath.Join(dir, "outbound")))
+	q.Mailer = mailer
+	q.now = clock.now
+	q.Envelope = func(msg mailstore.Message) (string, []string, error) {
+		return "sender@test", []string{"alice@test", "bob@test", "alice@test"}, nil
+	}
+	return q
+}
+
+// wait for all deliveries in flight to finish
+func (q *Queue) wait() {
+	for {
+		q.mtx.Lock()
+		n := len(q.busy)
+		q.mtx.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueResume(t *testing.T) {
+	dir := t.TempDir()
+	alice := maildir.MailDir(filepath.Join(dir, "alice"))
+	bob := &flakyStore{MailDir: maildir.MailDir(filepath.Join(dir, "bob")), fails: 2}
+	alice.Ensure()
+	bob.Ensure()
+	mailer := NewMailer()
+	mailer.Local = testRouter{"alice@test": alice, "bob@test": bob}
+	mailer.Retries = 5
+	clock := &testClock{t: time.Unix(1000, 0)}
+
+	q := newTestQueue(dir, mailer, clock)
+	if err := q.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := q.md.Deliver(strings.NewReader("Subject: test\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Flush()
+	q.wait()
+
+	msgs, _ := q.md.ListCur()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 queued message, got %d", len(msgs))
+	}
+	e, err := q.Load(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Recipients) != 2 {
+		t.Fatalf("expected 2 recipiants, got %d", len(e.Recipients))
+	}
+	for _, r := range e.Recipients {
+		switch r.Addr {
+		case "alice@test":
+			if r.State != Delivered {
+				t.Fatalf("alice not delivered: %s", r.State)
+			}
+		case "bob@test":
+			if r.State != Pending || r.Attempts != 1 || r.LastError == "" {
+				t.Fatalf("bad state for bob: %+v", r)
+			}
+			if !r.NextAttempt.After(clock.t) {
+				t.Fatalf("bob retry not scheduled: %s", r.NextAttempt)
+			}
+		}
+	}
+
+	// not due yet, nothing happens
+	q.Flush()
+	q.wait()
+	e, _ = q.Load(msgs[0])
+	if e.Recipients[1].Attempts != 1 {
+		t.Fatalf("retried before due: %+v", e.Recipients[1])
+	}
+
+	// restart with a new queue and let time pass
+	q = newTestQueue(dir, mailer, clock)
+	for i := 0; i < 2; i++ {
+		clock.t = clock.t.Add(maxRetryDelay)
+		q.Flush()
+		q.wait()
+	}
+	msgs, _ = q.md.ListCur()
+	if len(msgs) != 0 {
+		t.Fatalf("message not removed after delivery")
+	}
+	for _, md := range []maildir.MailDir{alice, bob.MailDir} {
+		got, _ := md.ListNew()
+		if len(got) != 1 {
+			t.Fatalf("%s got %d messages", md, len(got))
+		}
+	}
+}
+
+func TestQueueBounce(t *testing.T) {
+	dir := t.TempDir()
+	bob := &flakyStore{MailDir: maildir.MailDir(filepath.Join(dir, "bob")), fails: 100}
+	bob.Ensure()
+	var bounced []string
+	mailer := NewMailer()
+	mailer.Local = testRouter{"alice@test": bob, "bob@test": bob}
+	mailer.Retries = 2
+	mailer.Bounce = func(recip, from, fpath string, err error) {
+		bounced = append(bounced, recip)
+	}
+	clock := &testClock{t: time.Unix(1000, 0)}
+	q := newTestQueue(dir, mailer, clock)
+	q.Ensure()
+	q.md.Deliver(strings.NewReader("Subject: test\r\n\r\nhi\r\n"))
+	for i := 0; i < 3; i++ {
+		q.Flush()
+		q.wait()
+		clock.t = clock.t.Add(maxRetryDelay)
+	}
+	if len(bounced) != 2 {
+		t.Fatalf("expected 2 bounces, got %v", bounced)
+	}
+	msgs, _ := q.md.ListCur()
+	if len(msgs) != 0 {
+		t.Fatalf("bounced message not removed")
+	}
+}
+
+func TestQueueQuota(t *testing.T) {
+	dir := t.TempDir()
+	alice := maildir.MailDir(filepath.Join(dir, "alice"))
+	bob := maildir.MailDir(filepath.Join(dir, "bob"))
+	alice.Ensure()
+	bob.Ensure()
+	var bounced []string
+	mailer := NewMailer()
+	mailer.Local = testRouter{"alice@test": alice, "bob@test": bob}
+	mailer.Retries = 5
+	mailer.Bounce = func(recip, from, fpath string, err error) {
+		bounced = append(bounced, recip)
+	}
+	full := true
+	mailer.Quota = func(recip string, size int64) error {
+		if recip == "alice@test" {
+			return mailstore.ErrOverQuota
+		}
+		if full {
+			return mailstore.ErrMailboxFull
+		}
+		return nil
+	}
+	clock := &testClock{t: time.Unix(1000, 0)}
+	q := newTestQueue(dir, mailer, clock)
+	q.Ensure()
+	q.md.Deliver(strings.NewReader("Subject: test\r\n\r\nhi\r\n"))
+	q.Flush()
+	q.wait()
+	// over quota bounces right away, a full mailbox is retried
+	if len(bounced) != 1 || bounced[0] != "alice@test" {
+		t.Fatalf("expected alice to bounce, got %v", bounced)
+	}
+	full = false
+	clock.t = clock.t.Add(maxRetryDelay)
+	q.Flush()
+	q.wait()
+	got, _ := bob.ListNew()
+	if len(got) != 1 {
+		t.Fatalf("bob got %d messages after making room", len(got))
+	}
+	if got, _ = alice.ListNew(); len(got) != 0 {
+		t.Fatalf("message over quota was delivered")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if retryDelay(1) != 2*time.Second {
+		t.Fatalf("bad delay %s", retryDelay(1))
+	}
+	if retryDelay(100) != maxRetryDelay {
+		t.Fatalf("delay not capped: %s", retryDelay(100))
+	}
+}
+
+func TestQueueEnvelope(t *testing.T) {
+	dir := t.TempDir()
+	alice := maildir.MailDir(filepath.Join(dir, "alice"))
+	bob := maildir.MailDir(filepath.Join(dir, "bob"))
+	alice.Ensure()
+	bob.Ensure()
+	mailer := NewMailer()
+	mailer.Local = testRouter{"alice@test": alice, "bob@test": bob}
+	clock := &testClock{t: time.Unix(1000, 0)}
+	q := newTestQueue(dir, mailer, clock)
+	q.Envelope = nil
+	q.Ensure()
+	// bob is only in the envelope like a bcc recipiant, carol is only in the header
+	_, err := q.Enqueue("sender@test", []string{"alice@test", "bob@test"}, strings.NewReader("To: alice@test, carol@test\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Flush()
+	q.wait()
+	for _, md := range []maildir.MailDir{alice, bob} {
+		got, _ := md.ListNew()
+		if len(got) != 1 {
+			t.Fatalf("%s got %d messages", md, len(got))
+		}
+	}
+	msgs, _ := q.md.ListCur()
+	if len(msgs) != 0 {
+		t.Fatalf("message not removed after delivery")
+	}
+}
+
+func TestQueueReport(t *testing.T) {
+	dir := t.TempDir()
+	alice := maildir.MailDir(filepath.Join(dir, "alice"))
+	bob := &flakyStore{MailDir: maildir.MailDir(filepath.Join(dir, "bob")), fails: 100}
+	carol := &flakyStore{MailDir: maildir.MailDir(filepath.Join(dir, "carol")), fails: 100}
+	alice.Ensure()
+	bob.Ensure()
+	carol.Ensure()
+	mailer := NewMailer()
+	mailer.Local = testRouter{"alice@test": alice, "bob@test": bob, "carol@test": carol}
+	mailer.Retries = 1
+	clock := &testClock{t: time.Unix(1000, 0)}
+	q := newTestQueue(dir, mailer, clock)
+	var reports []*mailutil.Report
+	q.Report = func(from string, r *mailutil.Report, msg mailstore.Message) {
+		reports = append(reports, r)
+	}
+	q.Ensure()
+	dsn := &mailstore.DSN{
+		EnvID:  "id1",
+		Notify: map[string]string{"alice@test": "SUCCESS", "carol@test": "NEVER"},
+		ORcpt:  map[string]string{"alice@test": "rfc822;Alice@test"},
+	}
+	_, err := q.EnqueueDSN("sender@test", []string{"alice@test", "bob@test", "carol@test"}, dsn, strings.NewReader("Subject: test\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Flush()
+	q.wait()
+	// alice asked to hear of success, bob gets the default failure notice and carol asked for none
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(reports))
+	}
+	r := reports[0]
+	if r.EnvID != "id1" || len(r.Recipients) != 2 {
+		t.Fatalf("bad report %+v", r)
+	}
+	got := make(map[string]mailutil.ReportRecipient)
+	for _, rcpt := range r.Recipients {
+		got[rcpt.Final] = rcpt
+	}
+	if a := got["alice@test"]; a.Action != mailutil.ActionDelivered || a.Original != "rfc822;Alice@test" || a.Status != "2.0.0" {
+		t.Errorf("bad success report %+v", a)
+	}
+	if b := got["bob@test"]; b.Action != mailutil.ActionFailed || b.Diagnostic != "disk on fire" {
+		t.Errorf("bad failure report %+v", b)
+	}
+}
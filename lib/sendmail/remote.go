@@ -1,6 +1,7 @@
 package sendmail
 
 import (
+	"bytes"
 	"github.com/majestrate/bdsmail/lib/smtp"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -22,6 +23,8 @@ type RemoteDeliverJob struct {
 	from  string
 
 	fpath string
+	// rewrites the message body, nil for no rewriting
+	body func(io.Reader) io.Reader
 
 	result chan bool
 }
@@ -87,38 +90,23 @@ func (d *RemoteDeliverJob) tryDeliver(cl *smtp.Client) (err error) {
 		return
 	}
 	defer f.Close()
-	// mail from
-	err = cl.Mail(d.from)
-	if err != nil {
-		log.Errorf("mail: %s", err.Error())
-		return
-	}
-	// recpt to
-	err = cl.Rcpt(d.recip)
-	if err != nil {
-		log.Errorf("rcpt %s: %s", d.recip, err.Error())
-		return
-	}
-	// data
-	var wr io.WriteCloser
-	wr, err = cl.Data()
-	if err != nil {
-		log.Errorf("data: %s", err.Error())
-		return
-	}
-	// write body
-	var buff [2048]byte
-	_, err = io.CopyBuffer(wr, f, buff[:])
-	if err != io.EOF && err != nil {
-		log.Errorf("write: %s", err.Error())
-		return
+	var r io.Reader = f
+	var size int64 = -1
+	if d.body != nil {
+		// rewritten size is only known after rewriting
+		var buff bytes.Buffer
+		_, err = buff.ReadFrom(d.body(f))
+		if err != nil {
+			log.Errorf("failed to rewrite message: %s", err.Error())
+			return
+		}
+		r, size = &buff, int64(buff.Len())
+	} else if st, e := f.Stat(); e == nil {
+		size = st.Size()
 	}
-	// ... flush
-	err = wr.Close()
+	err = cl.SendMail(d.from, []string{d.recip}, size, r)
 	if err != nil {
-		return
+		log.Errorf("send to %s: %s", d.recip, err.Error())
 	}
-	// reset
-	err = cl.Reset()
 	return
 }
@@ -3,15 +3,61 @@ package sendmail
 import (
 	"errors"
 	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/mailutil"
 	"github.com/majestrate/bdsmail/lib/smtp"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"net/textproto"
 	"strings"
 	"sync"
 )
 
 var ErrNoLocalMailDelivery = errors.New("no local mail store for user")
 
+// recipiant address cannot be delivered to
+var ErrBadAddress = errors.New("bad email address")
+
+// we have no way to reach the recipiant's server
+var ErrNoRoute = errors.New("no route to recipiant")
+
+// return true if retrying delivery after an error will not help
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrBadAddress) || errors.Is(err, ErrNoRoute) || errors.Is(err, mailstore.ErrOverQuota) {
+		return true
+	}
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code >= 500
+}
+
+// get the enhanced status code of a delivery error for delivery status notifications
+func Status(err error) string {
+	switch {
+	case err == nil:
+		return "2.0.0"
+	case errors.Is(err, mailstore.ErrOverQuota):
+		return "5.2.2"
+	case errors.Is(err, mailstore.ErrMailboxFull):
+		return "4.2.2"
+	case errors.Is(err, ErrBadAddress):
+		return "5.1.3"
+	case errors.Is(err, ErrNoRoute):
+		return "5.4.4"
+	}
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		if status := mailutil.ReplyStatus(te.Error()); status != "" {
+			return status
+		}
+	}
+	// could not reach the server or store the mail
+	return "4.4.1"
+}
+
+// rewrites the envelope and message of mail going to a remote recipiant
+// returns the new recipiant, sender and a function that rewrites the message body
+type Rewriter func(recip, from string) (string, string, func(io.Reader) io.Reader, error)
+
 // mail bounce handler
 // paramters are (recipiant email address, from email address, the filepath of the message, network related error or nil for regular bounce)
 type Bouncer func(string, string, string, error)
@@ -49,6 +95,14 @@ type Mailer struct {
 	Resolve Resolver
 	// delivery success hook, called with (recipiant email address, from email address)
 	Success func(string, string)
+	// rewrites mail going to remote recipiants, nil for no rewriting
+	Rewrite Rewriter
+	// called on new connections after helo with the network and address dialed, nil does nothing
+	Setup func(*smtp.Client, string, string) error
+	// checks if a message of a size fits in a local recipiant's quota, nil for no quotas
+	Quota func(recip string, size int64) error
+	// networks other than smtp we deliver over
+	Transports []Transport
 	// for pipelining
 	conns map[string]*connection
 	// mutex for conns
@@ -131,6 +185,14 @@ func (s *Mailer) getConn(n, addr, localname string, dial Dialer) (sc *connection
 				cl.Quit()
 				return
 			}
+			if s.Setup != nil {
+				err = s.Setup(cl, n, addr)
+				if err != nil {
+					log.Errorf("failed to set up connection to %s: %s", addr, err.Error())
+					cl.Quit()
+					return
+				}
+			}
 			sc = &connection{
 				cl:   cl,
 				addr: addr,
@@ -142,82 +204,163 @@ func (s *Mailer) getConn(n, addr, localname string, dial Dialer) (sc *connection
 	return
 }
 
-// try delivering mail
-// returns a DeliveryJob that can be cancelled
-func (s *Mailer) Deliver(recip, from string, msg mailstore.Message) (d DeliverJob) {
-	log.Infof("Delivering %s to %s from %s", msg.Filepath(), recip, from)
-	dialer := s.Dial
-	if dialer == nil {
-		dialer = net.Dial
+// get the resolver to use for remote domains
+func (s *Mailer) resolver() Resolver {
+	if s.Resolve != nil {
+		return s.Resolve
 	}
-
-	bounce := s.Bounce
-
-	resolver := s.Resolve
-
-	if resolver == nil {
-		resolver = func(name string) (a net.Addr, err error) {
-			log.Debugf("mx lookup for %s", name)
-			var mx []*net.MX
-			mx, err = net.LookupMX(name)
-			if err != nil && mx != nil {
-				for _, m := range mx {
-					var ips []net.IP
-					log.Debugf("resolve mx record %s", m.Host)
-					ips, err = net.LookupIP(m.Host)
-					if err == nil {
-						for _, ip := range ips {
-							a, err = net.ResolveIPAddr("ip", ip.String())
-							if err == nil {
-								log.Debugf("resolved %s to %s", name, a)
-								return
-							}
+	return func(name string) (a net.Addr, err error) {
+		log.Debugf("mx lookup for %s", name)
+		var mx []*net.MX
+		mx, err = net.LookupMX(name)
+		if err != nil && mx != nil {
+			for _, m := range mx {
+				var ips []net.IP
+				log.Debugf("resolve mx record %s", m.Host)
+				ips, err = net.LookupIP(m.Host)
+				if err == nil {
+					for _, ip := range ips {
+						a, err = net.ResolveIPAddr("ip", ip.String())
+						if err == nil {
+							log.Debugf("resolved %s to %s", name, a)
+							return
 						}
 					}
 				}
 			}
-			return
 		}
+		return
 	}
-	var st mailstore.Store
+}
+
+// get the transport that delivers mail for a recipiant or nil for smtp
+func (s *Mailer) transport(recip string) Transport {
+	for _, t := range s.Transports {
+		if t.Handles(recip) {
+			return t
+		}
+	}
+	return nil
+}
+
+// get the local mail store for a recipiant or nil if it's remote
+func (s *Mailer) localStore(recip string) (st mailstore.Store) {
 	if s.Local != nil {
 		st, _ = s.Local.FindStoreFor(recip)
 	}
+	return
+}
+
+// get the quota check for a local recipiant or nil if there are no quotas
+func (s *Mailer) localQuota(recip string) func(int64) error {
+	if s.Quota == nil {
+		return nil
+	}
+	return func(size int64) error {
+		return s.Quota(recip, size)
+	}
+}
+
+// make a function that visits a pooled connection to the server of a remote recipiant
+func (s *Mailer) remoteVisitor(recip string) func(func(*smtp.Client) error) error {
+	dialer := s.Dial
+	if dialer == nil {
+		dialer = net.Dial
+	}
+	resolver := s.resolver()
+	return func(f func(*smtp.Client) error) error {
+		parts := strings.Split(recip, "@")
+		if len(parts) == 2 {
+			r_addr := parts[1]
+			a, err := resolver(r_addr)
+			if err == nil {
+				err = s.visitConn(a.Network(), a.String(), r_addr, dialer, f)
+			} else {
+				log.Warnf("failed to resolve %s: %s", r_addr, err.Error())
+			}
+			return err
+		}
+		log.Warnf("bad email address %s", recip)
+		return ErrBadAddress
+	}
+}
 
+// try delivering mail
+// returns a DeliveryJob that can be cancelled
+func (s *Mailer) Deliver(recip, from string, msg mailstore.Message) (d DeliverJob) {
+	log.Infof("Delivering %s to %s from %s", msg.Filepath(), recip, from)
+	if t := s.transport(recip); t != nil {
+		d = &transportJob{
+			t:      t,
+			bounce: s.Bounce,
+			recip:  recip,
+			from:   from,
+			msg:    msg,
+			result: make(chan bool),
+		}
+		return
+	}
+	st := s.localStore(recip)
 	if st == nil {
-		d = &RemoteDeliverJob{
+		j := &RemoteDeliverJob{
 			unlimited: s.Retries == 0,
 			cancel:    false,
 			retries:   s.Retries,
-			visit: func(f func(*smtp.Client) error) error {
-				parts := strings.Split(recip, "@")
-				if len(parts) == 2 {
-					r_addr := parts[1]
-					a, err := resolver(r_addr)
-					if err == nil {
-						err = s.visitConn(a.Network(), a.String(), r_addr, dialer, f)
-					} else {
-						log.Warnf("failed to resolve %s: %s", r_addr, err.Error())
-					}
-					return err
-				} else {
-					log.Warnf("bad email address %s", recip)
-				}
-				return nil
-			},
-			bounce:    bounce,
+			bounce:    s.Bounce,
 			recip:     recip,
 			from:      from,
 			fpath:     msg.Filepath(),
 			result:    make(chan bool),
 			delivered: s.Success,
 		}
+		var err error
+		if s.Rewrite != nil {
+			j.recip, j.from, j.body, err = s.Rewrite(recip, from)
+		}
+		if err == nil {
+			j.visit = s.remoteVisitor(j.recip)
+		} else {
+			j.visit = func(func(*smtp.Client) error) error {
+				return err
+			}
+		}
+		d = j
 	} else {
-		d = &LocalDeliverJob{
-			st:     st,
-			result: make(chan bool),
-			fpath:  msg.Filepath(),
+		d = NewLocalDelivery(st, msg.Filepath(), s.localQuota(recip))
+	}
+	return
+}
+
+// make 1 attempt at delivering mail without retrying or bouncing
+// returns nil if the message was delivered
+func (s *Mailer) Attempt(recip, from string, msg mailstore.Message) (err error) {
+	log.Infof("Delivering %s to %s from %s", msg.Filepath(), recip, from)
+	st := s.localStore(recip)
+	if t := s.transport(recip); t != nil {
+		err = t.Send(recip, from, msg)
+	} else if st == nil {
+		d := &RemoteDeliverJob{
+			recip: recip,
+			from:  from,
+			fpath: msg.Filepath(),
+		}
+		if s.Rewrite != nil {
+			d.recip, d.from, d.body, err = s.Rewrite(recip, from)
+		}
+		if err == nil {
+			err = s.remoteVisitor(d.recip)(d.tryDeliver)
 		}
+	} else {
+		j := NewLocalDelivery(st, msg.Filepath(), s.localQuota(recip))
+		go j.Run()
+		if !j.Wait() {
+			if err = j.Error(); err == nil {
+				err = ErrNoLocalMailDelivery
+			}
+		}
+	}
+	if err == nil && s.Success != nil {
+		s.Success(recip, from)
 	}
 	return
 }
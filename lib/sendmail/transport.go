@@ -0,0 +1,45 @@
+package sendmail
+
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	log "github.com/sirupsen/logrus"
+)
+
+// a network other than smtp that mail can be delivered over
+type Transport interface {
+	// return true if we deliver mail for this recipiant
+	Handles(recip string) bool
+	// make 1 attempt at delivering a message
+	Send(recip, from string, msg mailstore.Message) error
+}
+
+// delivery job over a transport, tries once and bounces on failure
+type transportJob struct {
+	t      Transport
+	bounce Bouncer
+	recip  string
+	from   string
+	msg    mailstore.Message
+	result chan bool
+}
+
+// transport delivery is not cancelable
+func (j *transportJob) Cancel() {
+}
+
+// wait for completion
+func (j *transportJob) Wait() bool {
+	return <-j.result
+}
+
+// run delivery
+func (j *transportJob) Run() {
+	err := j.t.Send(j.recip, j.from, j.msg)
+	if err != nil {
+		log.Errorf("delivery of message to %s failed: %s", j.recip, err.Error())
+		if j.bounce != nil {
+			j.bounce(j.recip, j.from, j.msg.Filepath(), err)
+		}
+	}
+	j.result <- err == nil
+}
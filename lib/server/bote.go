@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/bote"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/sendmail"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"time"
+)
+
+// get the bote gateway or nil if not configured
+func (s *Server) boteGateway() *bote.Gateway {
+	s.btmtx.RLock()
+	defer s.btmtx.RUnlock()
+	return s.bt
+}
+
+// set up the bote gateway from config
+func (s *Server) reloadBote() {
+	var gw *bote.Gateway
+	str, _ := s.conf.Get("bote_api")
+	if len(str) > 0 {
+		gw = bote.New(bote.NewClient(str), s.conf.Bote)
+		gw.LocalUser = s.localUser
+		gw.Deliver = s.deliverBote
+		str, _ = s.conf.Get("bote_poll")
+		if secs, err := strconv.Atoi(str); err == nil && secs > 0 {
+			gw.Poll = time.Second * time.Duration(secs)
+		}
+		log.Infof("Using bote node at %s for %d identities", gw.Client.URL, len(gw.Identities))
+	}
+	s.btmtx.Lock()
+	s.bt = gw
+	s.btmtx.Unlock()
+}
+
+// get the user name of one of our mail addresses
+func (s *Server) localUser(email string) (user string, ok bool) {
+	name, server := splitEmail(email)
+	if len(name) > 0 && s.session != nil && (server == s.session.B32() || server == s.inserv.Hostname) {
+		user, ok = name, true
+	}
+	return
+}
+
+// put mail received over bote through the filters
+func (s *Server) deliverBote(user, from string, body io.Reader) (err error) {
+	var msg mailstore.Message
+	msg, err = s.inserv.Inbound.Deliver(body)
+	if err == nil {
+		s.chnl <- &MailEvent{
+			Addr:   "bote",
+			Sender: from,
+			Recip:  user + "@" + s.session.B32(),
+			File:   msg.Filepath(),
+			Bote:   true,
+		}
+	}
+	return
+}
+
+// sendmail transport for bote addresses that follows config reloads
+type boteTransport struct {
+	s *Server
+}
+
+func (t boteTransport) Handles(recip string) bool {
+	gw := t.s.boteGateway()
+	return gw != nil && gw.Handles(recip)
+}
+
+func (t boteTransport) Send(recip, from string, msg mailstore.Message) error {
+	gw := t.s.boteGateway()
+	if gw == nil {
+		return sendmail.ErrNoRoute
+	}
+	return gw.Send(recip, from, msg)
+}
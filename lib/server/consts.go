@@ -2,3 +2,45 @@ package server
 
 // the default admin login
 const DEFAULT_ADMIN_LOGIN = "admin"
+
+// the default largest message size in bytes
+const DEFAULT_MAX_MESSAGE_SIZE = 32 * 1024 * 1024
+
+// the default storage quota of a user in bytes
+const DEFAULT_QUOTA_BYTES = 1024 * 1024 * 1024
+
+// the default message count quota of a user, 0 for unlimited
+const DEFAULT_QUOTA_MESSAGES = 0
+
+// the default most smtp sessions at once from all remote hosts
+const DEFAULT_MAX_CONNECTIONS = 128
+
+// the default most smtp sessions at once from 1 remote destination
+const DEFAULT_MAX_CONNECTIONS_PER_HOST = 4
+
+// the default most messages 1 remote destination may send per hour
+const DEFAULT_MAX_MESSAGES_PER_HOUR = 120
+
+// the default most recipiants of 1 message
+const DEFAULT_MAX_RECIPIENTS = 100
+
+// the default seconds a remote destination that sends too much mail is banned for
+const DEFAULT_BAN_TIME = 60 * 60
+
+// the default seconds an unseen sender must wait before retrying, 0 disables greylisting
+const DEFAULT_GREYLIST_DELAY = 2 * 60
+
+// the default seconds a sender that got past the greylist stays whitelisted
+const DEFAULT_GREYLIST_LIFETIME = 35 * 24 * 60 * 60
+
+// the default spam score from 0 to 1 that mail is spam at, 0 turns the classifier off
+const DEFAULT_SPAM_THRESHOLD = 0.9
+
+// the default policy for plaintext logins, "tls" only allows them after STARTTLS or on loopback
+const DEFAULT_PLAINTEXT_AUTH = "tls"
+
+// the default file with the secret key fake scram credentials of unknown users are made with
+const DEFAULT_SCRAM_KEYFILE = "scram-key"
+
+// the default key type of generated tls certificates, ecdsa, ed25519 or rsa
+const DEFAULT_TLS_KEYTYPE = "ecdsa"
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	mail "github.com/majestrate/bdsmail/lib/mailutil"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// send a delivery status notification about a message to its sender from the null sender
+func (s *Server) report(from string, r *mail.Report, msg mailstore.Message) {
+	if from == "" {
+		// never notify the null sender
+		return
+	}
+	r.Hostname = s.inserv.Hostname
+	var body io.Reader
+	f, err := os.Open(msg.Filepath())
+	if err == nil {
+		defer f.Close()
+		body = f
+	} else {
+		log.Warnf("sending report to %s without the original message: %s", from, err.Error())
+	}
+	buff := new(bytes.Buffer)
+	st, local := s.FindStoreFor(from)
+	if local {
+		err = mail.WriteRecvHeader(buff, from, "127.0.0.1", "127.0.0.1", s.outserv.Hostname, s.outserv.Appname)
+	}
+	if err == nil {
+		err = mail.WriteReport(buff, from, r, body)
+	}
+	if err == nil {
+		if local {
+			_, err = st.Deliver(buff)
+		} else {
+			_, err = s.outq.Enqueue("", []string{from}, buff)
+		}
+	}
+	if err == nil {
+		log.Infof("sent delivery status notification about %s to %s", msg.Filepath(), from)
+	} else {
+		log.Errorf("failed to send delivery status notification to %s: %s", from, err.Error())
+	}
+}
+
+// make a delivery status notification about the recipiant of a mail event
+// returns nil if the sender did not ask to be told about the event, one of the mail.Notify values
+func eventReport(ev *MailEvent, event, action, status, diagnostic string) (r *mail.Report) {
+	r = &mail.Report{
+		Recipients: []mail.ReportRecipient{
+			{
+				Final:      ev.Recip,
+				Action:     action,
+				Status:     status,
+				Diagnostic: diagnostic,
+			},
+		},
+	}
+	var notify string
+	if ev.DSN != nil {
+		notify = ev.DSN.Notify[ev.Recip]
+		r.EnvID = ev.DSN.EnvID
+		r.HeadersOnly = ev.DSN.Ret == mail.RetHeaders
+		r.Recipients[0].Original = ev.DSN.ORcpt[ev.Recip]
+	}
+	if !mail.Notifies(notify, event) {
+		return nil
+	}
+	if info, err := os.Stat(ev.File); err == nil {
+		r.Arrival = info.ModTime()
+	}
+	return
+}
+
+// tell the sender a message was delivered to a local recipiant if it asked to be told
+func (s *Server) notifyDelivered(ev *MailEvent) {
+	if r := eventReport(ev, mail.NotifySuccess, mail.ActionDelivered, "2.0.0", ""); r != nil {
+		// RET is only for failures, who got it is said by the header
+		r.HeadersOnly = true
+		s.report(ev.Sender, r, maildir.Message(ev.File))
+	}
+}
+
+// map the recipiants of delivery status notification requests to new addresses
+func rewriteDSN(dsn *mailstore.DSN, rewrite func(string) string) *mailstore.DSN {
+	if dsn == nil {
+		return nil
+	}
+	re := &mailstore.DSN{
+		Ret:    dsn.Ret,
+		EnvID:  dsn.EnvID,
+		Notify: make(map[string]string),
+		ORcpt:  make(map[string]string),
+	}
+	for addr, notify := range dsn.Notify {
+		re.Notify[rewrite(addr)] = notify
+	}
+	for addr, orcpt := range dsn.ORcpt {
+		re.ORcpt[rewrite(addr)] = orcpt
+	}
+	return re
+}
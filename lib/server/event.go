@@ -1,5 +1,9 @@
 package server
 
+import (
+	"github.com/majestrate/bdsmail/lib/mailstore"
+)
+
 // event fired when we got a new mail message
 type MailEvent struct {
 	// remote address of sender
@@ -10,4 +14,14 @@ type MailEvent struct {
 	Sender string
 	// file containg the message
 	File string
+	// mail came from the clearnet through the gateway
+	Inet bool
+	// mail came from i2p-bote through the bote gateway
+	Bote bool
+	// mail is spam
+	Spam bool
+	// score the spam classifier gave the mail or 0 if it was not scored
+	SpamScore float64
+	// delivery status notifications the sender asked for or nil if it asked for none
+	DSN *mailstore.DSN
 }
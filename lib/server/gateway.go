@@ -0,0 +1,186 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/gateway"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/sendmail"
+	"github.com/majestrate/bdsmail/lib/smtp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// get the clearnet gateway or nil if we are not a gateway
+func (s *Server) gateway() *gateway.Gateway {
+	s.gwmtx.RLock()
+	defer s.gwmtx.RUnlock()
+	return s.gw
+}
+
+// set up the clearnet gateway from config
+func (s *Server) reloadGateway() {
+	var gw *gateway.Gateway
+	str, _ := s.conf.Get("gateway_domains")
+	if len(str) > 0 {
+		var i2pdomain string
+		if s.session != nil {
+			i2pdomain = s.session.B32()
+		}
+		gw = gateway.New(strings.Split(str, ","), i2pdomain, s.conf.Rewrite)
+		gw.Smarthost, _ = s.conf.Get("gateway_smarthost")
+		gw.SmarthostUser, _ = s.conf.Get("gateway_smarthost_user")
+		gw.SmarthostPassword, _ = s.conf.Get("gateway_smarthost_password")
+		gw.Proxy, _ = s.conf.Get("gateway_socks_proxy")
+		str, _ = s.conf.Get("gateway_relay_i2p")
+		gw.RelayI2P = str == "1" || str == "yes" || str == "true"
+		log.Infof("Gateway to clearnet for %s", strings.Join(gw.Domains, ", "))
+		s.inetserv.Hostname = gw.Domains[0]
+	}
+	s.gwmtx.Lock()
+	s.gw = gw
+	s.gwmtx.Unlock()
+}
+
+// dial out
+func (s *Server) dial(network, addr string) (c net.Conn, err error) {
+	if network == "i2p" {
+		c, err = s.session.Dial(network, addr)
+	} else if gw := s.gateway(); gw != nil {
+		c, err = gw.Dial(network, addr)
+	} else {
+		err = sendmail.ErrNoRoute
+	}
+	return
+}
+
+// find the server for a mail domain
+func (s *Server) resolve(domain string) (a net.Addr, err error) {
+	if strings.HasSuffix(domain, ".i2p") {
+		alias, ok := s.conf.Aliases.MX(domain)
+		if ok {
+			domain = alias
+		}
+		a, err = s.session.LookupI2P(domain)
+	} else if gw := s.gateway(); gw != nil {
+		a, err = gw.Resolve(domain)
+	} else {
+		err = sendmail.ErrNoRoute
+	}
+	return
+}
+
+// set up a new outbound smtp connection
+func (s *Server) setupConn(cl *smtp.Client, network, addr string) (err error) {
+	if network == "i2p" {
+		return
+	}
+	if gw := s.gateway(); gw != nil {
+		err = gw.Setup(cl, addr)
+	}
+	return
+}
+
+// rewrite outbound mail crossing between i2p and clearnet
+func (s *Server) rewriteMail(recip, from string) (string, string, func(io.Reader) io.Reader, error) {
+	gw := s.gateway()
+	if gw == nil {
+		return recip, from, nil, nil
+	}
+	rw := gw.Rewrite
+	if inet, ok := rw.DecodeI2P(recip); ok {
+		// i2p address standing for a clearnet address
+		recip = inet
+	}
+	toInet := !gateway.IsI2P(recip)
+	if toInet == !gateway.IsI2P(from) {
+		// not crossing networks
+		return recip, from, nil, nil
+	}
+	if toInet {
+		from = rw.ToInet(from)
+	} else {
+		from = rw.ToI2P(from)
+	}
+	return recip, from, func(r io.Reader) io.Reader {
+		return rw.Header(r, toInet)
+	}, nil
+}
+
+// accept clearnet mail only for our gateway domains
+func (s *Server) acceptInetRecip(recip string) bool {
+	gw := s.gateway()
+	return gw != nil && gw.AcceptsRecipient(recip)
+}
+
+// handle mail from the clearnet
+// local recipiants go through the filters, other i2p recipiants get the mail relayed
+func (s *Server) handleGatewayMail(remote net.Addr, from string, to []string, dsn *mailstore.DSN, fpath string) {
+	gw := s.gateway()
+	if gw == nil {
+		os.Remove(fpath)
+		return
+	}
+	var local, relay []string
+	dsn = rewriteDSN(dsn, gw.Rewrite.ToI2P)
+	for _, recip := range to {
+		addr := gw.Rewrite.ToI2P(recip)
+		if _, has := s.FindStoreFor(addr); has {
+			local = append(local, addr)
+		} else if gateway.IsI2P(addr) && !strings.HasSuffix(addr, "@"+s.session.B32()) {
+			relay = append(relay, addr)
+		} else {
+			log.Warnf("gateway mail for unknown recipiant %s", recip)
+		}
+	}
+	if len(relay) > 0 {
+		f, err := os.Open(fpath)
+		if err == nil {
+			_, err = s.outq.EnqueueDSN(from, relay, dsn, f)
+			f.Close()
+		}
+		if err == nil {
+			log.Infof("relaying clearnet mail from %s to %s", from, strings.Join(relay, ", "))
+		} else {
+			log.Errorf("failed to relay clearnet mail: %s", err.Error())
+		}
+	}
+	if len(local) == 0 {
+		os.Remove(fpath)
+		return
+	}
+	for idx, fname := range s.splitSpool(from, local, fpath) {
+		s.chnl <- &MailEvent{
+			Addr:   remote.String(),
+			Sender: from,
+			Recip:  local[idx],
+			File:   fname,
+			Inet:   true,
+			DSN:    dsn,
+		}
+	}
+}
+
+// relay mail from i2p to the clearnet if the recipiant stands for a clearnet address
+// returns true if the mail was queued
+func (s *Server) relayToInet(ev *MailEvent) bool {
+	gw := s.gateway()
+	if gw == nil || !gw.RelayI2P || ev.Inet {
+		return false
+	}
+	if _, ok := gw.Rewrite.DecodeI2P(ev.Recip); !ok {
+		return false
+	}
+	f, err := os.Open(ev.File)
+	if err == nil {
+		_, err = s.outq.EnqueueDSN(ev.Sender, []string{ev.Recip}, ev.DSN, f)
+		f.Close()
+	}
+	if err != nil {
+		log.Errorf("failed to relay mail to clearnet: %s", err.Error())
+		return false
+	}
+	log.Infof("relaying mail from %s to clearnet for %s", ev.Sender, ev.Recip)
+	return true
+}
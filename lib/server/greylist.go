@@ -0,0 +1,47 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// check a triple of inbound mail against the greylist
+func (s *Server) greylist(host, from, recip string) (bool, error) {
+	if s.dao == nil || s.greyDelay <= 0 {
+		return true, nil
+	}
+	pass, err := s.dao.Greylist(host, from, recip, s.greyDelay, s.greyLifetime)
+	if err == nil && !pass {
+		log.Infof("greylisted mail from %s to %s via %s", from, recip, host)
+	}
+	return pass, err
+}
+
+// read greylist settings from config
+func (s *Server) reloadGreylist() (err error) {
+	var delay, lifetime int
+	delay, err = s.confInt("greylist_delay", DEFAULT_GREYLIST_DELAY)
+	if err == nil {
+		lifetime, err = s.confInt("greylist_lifetime", DEFAULT_GREYLIST_LIFETIME)
+	}
+	if err == nil {
+		s.greyDelay = time.Second * time.Duration(delay)
+		s.greyLifetime = time.Second * time.Duration(lifetime)
+	}
+	return
+}
+
+// forget expired greylist entries every hour
+func (s *Server) expireGreylist() {
+	for s.mailer != nil {
+		if s.dao != nil {
+			n, err := s.dao.ExpireGreylist(s.greyLifetime)
+			if err != nil {
+				log.Errorf("failed to expire greylist: %s", err.Error())
+			} else if n > 0 {
+				log.Infof("expired %d greylist entries", n)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/smtp"
+	"strconv"
+	"time"
+)
+
+// get an integer from config or a default if it's not set
+func (s *Server) confInt(key string, def int) (n int, err error) {
+	n = def
+	str, _ := s.conf.Get(key)
+	if len(str) > 0 {
+		n, err = strconv.Atoi(str)
+	}
+	return
+}
+
+// set limits on remote hosts from config
+func (s *Server) reloadLimits() (err error) {
+	var limits smtp.Limits
+	var bantime int
+	limits.MaxConns, err = s.confInt("max_connections", DEFAULT_MAX_CONNECTIONS)
+	if err == nil {
+		limits.MaxConnsPerHost, err = s.confInt("max_connections_per_host", DEFAULT_MAX_CONNECTIONS_PER_HOST)
+	}
+	if err == nil {
+		limits.MaxMessagesPerHour, err = s.confInt("max_messages_per_hour", DEFAULT_MAX_MESSAGES_PER_HOUR)
+	}
+	if err == nil {
+		limits.MaxRecipients, err = s.confInt("max_recipients", DEFAULT_MAX_RECIPIENTS)
+	}
+	if err == nil {
+		bantime, err = s.confInt("ban_time", DEFAULT_BAN_TIME)
+	}
+	if err != nil {
+		return
+	}
+	limits.BanTime = time.Second * time.Duration(bantime)
+	s.inserv.SetLimits(limits)
+	s.inetserv.SetLimits(limits)
+	// our own users are only limited in recipiants
+	s.outserv.SetLimits(smtp.Limits{MaxRecipients: limits.MaxRecipients})
+	return
+}
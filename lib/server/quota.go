@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/model"
+)
+
+// check if a message of this size fits in a local recipiant's quota
+// recipiants that are not local to us have no quota
+func (s *Server) checkQuota(recip string, size int64) (err error) {
+	if s.dao == nil {
+		return
+	}
+	if _, has := s.FindStoreFor(recip); !has {
+		return
+	}
+	err = s.dao.VisitUser(recip, func(u *model.User) (e error) {
+		q := u.Quota(s.quota)
+		if q.Unlimited() {
+			return
+		}
+		var us model.Usage
+		us, e = u.Usage()
+		if e == nil {
+			e = q.Check(us, size)
+		}
+		return
+	})
+	return
+}
+
+// check the quota of a recipiant of mail from the clearnet
+func (s *Server) checkInetQuota(recip string, size int64) error {
+	gw := s.gateway()
+	if gw == nil {
+		return nil
+	}
+	return s.checkQuota(gw.Rewrite.ToI2P(recip), size)
+}
+
+// get the quota and usage of a local user
+func (s *Server) userQuota(name string) (q model.Quota, us model.Usage, err error) {
+	if s.dao == nil {
+		return
+	}
+	err = s.dao.VisitUser(name, func(u *model.User) (e error) {
+		q = u.Quota(s.quota)
+		us, e = u.Usage()
+		return
+	})
+	return
+}
+
+// get the storage used by a pop3 user and their storage quota
+func (s *Server) popQuota(user string) (used, limit int64, err error) {
+	q, us, err := s.userQuota(user)
+	return us.Bytes, q.Bytes, err
+}
@@ -1,29 +1,38 @@
 package server
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/majestrate/bdsmail/lib/bote"
 	"github.com/majestrate/bdsmail/lib/config"
 	"github.com/majestrate/bdsmail/lib/db"
+	"github.com/majestrate/bdsmail/lib/dkim"
+	"github.com/majestrate/bdsmail/lib/filter"
+	"github.com/majestrate/bdsmail/lib/gateway"
 	"github.com/majestrate/bdsmail/lib/i2p"
+	"github.com/majestrate/bdsmail/lib/imap"
 	"github.com/majestrate/bdsmail/lib/maildir"
 	"github.com/majestrate/bdsmail/lib/mailstore"
 	mail "github.com/majestrate/bdsmail/lib/mailutil"
+	"github.com/majestrate/bdsmail/lib/managesieve"
 	"github.com/majestrate/bdsmail/lib/model"
 	"github.com/majestrate/bdsmail/lib/pop3"
+	"github.com/majestrate/bdsmail/lib/sasl"
 	"github.com/majestrate/bdsmail/lib/sendmail"
 	"github.com/majestrate/bdsmail/lib/smtp"
 	"github.com/majestrate/bdsmail/lib/starttls"
 	"github.com/majestrate/bdsmail/lib/util"
 	"github.com/majestrate/bdsmail/lib/web"
+	"github.com/majestrate/bdsmail/lib/web/admin"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -46,18 +55,31 @@ type Server struct {
 
 	// unexported fields
 
-	// lua interpreter core
 	conf config.Config
 
 	inserv  *smtp.Server
 	outserv *smtp.Server
+	// smtp server for mail from the clearnet
+	inetserv *smtp.Server
 
 	// listener for smtp recv server
 	maillistener net.Listener
 	// listener for smtp send server
 	smtplistener net.Listener
+	// listener for implicit tls submission or nil when not configured
+	smtpslistener net.Listener
+	// listener for submission that requires auth or nil when not configured
+	submissionlistener net.Listener
 	// listener for pop3 server
 	poplistener net.Listener
+	// listener for pop3s or nil when not configured
+	popslistener net.Listener
+	// listener for imap server
+	imaplistener net.Listener
+	// listener for managesieve server
+	sievelistener net.Listener
+	// listener for clearnet smtp server or nil when not a gateway
+	inetlistener net.Listener
 	// stream session with i2p router
 	session i2p.Session
 	// listener for web server
@@ -66,8 +88,10 @@ type Server struct {
 	chnl chan *MailEvent
 	// directory holding all users's maildirs
 	mail string
-	// lock to use to ensure 1 thread accessing lua
-	luamtx sync.RWMutex
+	// scripted mail filters or nil for none
+	filter *filter.Engine
+	// lock held while swapping filter scripts
+	filtermtx sync.RWMutex
 	// filepath to configuration
 	configFname string
 	// database access object
@@ -76,12 +100,49 @@ type Server struct {
 	webHandler http.Handler
 	// mail sender
 	mailer *sendmail.Mailer
+	// signs outbound mail or nil if our destination can't sign
+	signer *dkim.Signer
+	// durable outbound mail queue
+	outq *sendmail.Queue
+	// clearnet gateway or nil when not a gateway
+	gw *gateway.Gateway
+	// lock held while swapping gateway config
+	gwmtx sync.RWMutex
+	// i2p-bote gateway or nil when not configured
+	bt *bote.Gateway
+	// lock held while swapping bote config
+	btmtx sync.RWMutex
 	// pop3 server
 	pop *pop3.Server
+	// imap server
+	imap *imap.Server
+	// managesieve server
+	sieve *managesieve.Server
+	// quota of users who don't have their own
+	quota model.Quota
+	// how long unseen senders wait before retrying, 0 for no greylisting
+	greyDelay time.Duration
+	// how long senders stay whitelisted after getting past the greylist
+	greyLifetime time.Duration
+	// spam score mail is spam at, 0 for no classifier
+	spamThreshold float64
+	// file spam into the junk folder instead of only tagging it
+	spamJunk bool
+	// learn spam from pop3 users deleting tagged mail without reading it
+	spamTrainPOP3 bool
 	// tls config
 	TLS *tls.Config
 }
 
+// listen for implicit tls connections using the tls config of a server
+func (s *Server) listenTLS(addr string, config func() *tls.Config) (l net.Listener, err error) {
+	l, err = net.Listen("tcp", addr)
+	if err == nil {
+		l = starttls.NewListener(l, config)
+	}
+	return
+}
+
 // bind network services
 func (s *Server) Bind() (err error) {
 	// bind web ui
@@ -106,6 +167,72 @@ func (s *Server) Bind() (err error) {
 		return
 	}
 
+	// bind pop3s server if configured
+	addr, ok = s.conf.Get("bindpop3s")
+	if ok && addr != "" {
+		log.Infof("binding pop3s server to %s", addr)
+		s.popslistener, err = s.listenTLS(addr, func() *tls.Config {
+			return s.pop.TLS
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// bind smtps submission server if configured
+	addr, ok = s.conf.Get("bindsmtps")
+	if ok && addr != "" {
+		log.Infof("binding smtps submission server to %s", addr)
+		s.smtpslistener, err = s.listenTLS(addr, func() *tls.Config {
+			return s.outserv.TLS
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// bind submission server if configured
+	addr, ok = s.conf.Get("bindsubmission")
+	if ok && addr != "" {
+		log.Infof("binding submission server to %s", addr)
+		s.submissionlistener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+	}
+
+	// bind imap server
+	addr, ok = s.conf.Get("bindimap")
+	if !ok {
+		addr = "127.0.0.1:1143"
+	}
+	log.Infof("binding imap server to %s", addr)
+	s.imaplistener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	// bind managesieve server
+	addr, ok = s.conf.Get("bindmanagesieve")
+	if !ok {
+		addr = "127.0.0.1:4190"
+	}
+	log.Infof("binding managesieve server to %s", addr)
+	s.sievelistener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	// bind clearnet smtp server if we are a gateway
+	addr, ok = s.conf.Get("bindinet")
+	if ok && s.gateway() != nil {
+		log.Infof("binding clearnet smtp server to %s", addr)
+		s.inetlistener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+	}
+
 	// keyfile for i2p destination
 	keyfile, ok := s.conf.Get("i2pkeyfile")
 	if !ok {
@@ -140,19 +267,21 @@ func (s *Server) Bind() (err error) {
 			log.Infof("We are %s", session.B32())
 			s.mailer = sendmail.NewMailer()
 			s.mailer.Retries = 10
-			s.mailer.Dial = session.Dial
-			s.mailer.Resolve = func(addr string) (net.Addr, error) {
-				a, ok := s.conf.Aliases.MX(addr)
-				if ok {
-					addr = a
-				}
-				return session.LookupI2P(addr)
+			s.mailer.Dial = s.dial
+			s.mailer.Resolve = s.resolve
+			s.mailer.Rewrite = s.prepareMail
+			s.mailer.Setup = s.setupConn
+			s.mailer.Transports = []sendmail.Transport{boteTransport{s}}
+			if gw := s.gateway(); gw != nil {
+				gw.Rewrite.I2PDomain = session.B32()
 			}
 			s.mailer.Local = s
+			s.mailer.Quota = s.checkQuota
 			s.mailer.Success = func(recip, from string) {
 				log.Infof("Delievered mail to %s from %s", recip, from)
 			}
 			s.mailer.Bounce = s.Bounce
+			s.setupSigner()
 		} else {
 			// close session we got an error setting up local smtp listener
 			session.Close()
@@ -161,56 +290,38 @@ func (s *Server) Bind() (err error) {
 	return
 }
 
+// tell the sender of a message that it could not be delivered to a recipiant
 func (s *Server) Bounce(recip, from, fpath string, e error) {
-
-	buff := new(bytes.Buffer)
-	mail.WriteRecvHeader(buff, from, "127.0.0.1", "127.0.0.1", s.outserv.Hostname, s.outserv.Appname)
-	f, err := os.Open(fpath)
-	if err == nil {
-		reason := "unknown error"
-		if e != nil {
-			reason = e.Error()
-		}
-		mail.WriteBounceMail(buff, from, reason, f)
-		f.Close()
-		st, ok := s.FindStoreFor(from)
-		if ok {
-			var msg mailstore.Message
-			msg, err = st.Deliver(buff)
-			if err == nil {
-				log.Infof("wrote bounce mail to %s", msg.Filepath())
-			} else {
-				log.Errorf("failed to deliver bounce: %s", err.Error())
-			}
-		} else {
-			log.Errorf("failed to find mail store for %s", from)
-		}
-	} else {
-		log.Errorf("failed to open mail message for bounce: %s", err.Error())
+	if recip == "" {
+		log.Errorf("not bouncing %s to %s, it has no recipiants", fpath, from)
+		return
 	}
-}
-
-// dial out
-func (s *Server) dial(net, addr string) (c net.Conn, err error) {
-	if strings.HasSuffix(addr, ".i2p") {
-		c, err = s.session.Dial(net, addr)
-	} else {
-		// TODO: over tor?
-		// c, err = net.Dial(net, addr)
-		err = errors.New("cannot dial outside of i2p")
+	reason := "unknown error"
+	if e != nil {
+		reason = e.Error()
 	}
-	return
+	s.report(from, &mail.Report{
+		Recipients: []mail.ReportRecipient{
+			{
+				Final:      recip,
+				Action:     mail.ActionFailed,
+				Status:     sendmail.Status(e),
+				Diagnostic: reason,
+			},
+		},
+	}, maildir.Message(fpath))
 }
 
 // queue mail to be filtered
-func (s *Server) queueMail(addr net.Addr, from string, to []string, fpath string) {
-	// for each recip fire a mail event
-	for _, recip := range to {
+func (s *Server) queueMail(addr net.Addr, from string, to []string, dsn *mailstore.DSN, fpath string) {
+	// for each recip fire a mail event with its own file
+	for idx, fname := range s.splitSpool(from, to, fpath) {
 		ev := &MailEvent{
 			Addr:   addr.String(),
 			Sender: from,
-			Recip:  recip,
-			File:   fpath,
+			Recip:  to[idx],
+			File:   fname,
+			DSN:    dsn,
 		}
 		s.chnl <- ev
 	}
@@ -235,13 +346,61 @@ func (s *Server) FindStoreFor(email string) (st mailstore.Store, has bool) {
 func (s *Server) gotMail(ev *MailEvent) (err error) {
 	log.Info("we got mail for ", ev.Recip, " from ", ev.Sender)
 	st, has := s.FindStoreFor(ev.Recip)
-	if !has {
-		st, _ = s.dao.FindStoreFor("postmaster")
+	if !has && s.relayToInet(ev) {
+		os.Remove(ev.File)
+		return
+	}
+	stores := []mailstore.Store{st}
+	if has {
+		var info os.FileInfo
+		info, err = os.Stat(ev.File)
+		if err == nil {
+			err = s.checkQuota(ev.Recip, info.Size())
+		}
+		if errors.Is(err, mailstore.ErrOverQuota) || errors.Is(err, mailstore.ErrMailboxFull) {
+			// the mail was already accepted so bounce it
+			log.Warnf("not delivering mail for %s: %s", ev.Recip, err.Error())
+			s.rejectMail(ev, sendmail.Status(err), err.Error())
+			os.Remove(ev.File)
+			return
+		} else if err != nil {
+			log.Errorf("failed to check quota of %s: %s", ev.Recip, err.Error())
+			err = nil
+		}
+		user, _ := splitEmail(ev.Recip)
+		if ev.Spam && s.spamJunk {
+			// spam skips the recipiant's sieve script
+			junk, jerr := ensureFolder(st, mailstore.JunkFolder)
+			if jerr == nil {
+				stores = []mailstore.Store{junk}
+			} else {
+				log.Warnf("can't file spam for %s into %s: %s", ev.Recip, mailstore.JunkFolder, jerr.Error())
+			}
+		} else {
+			// the recipiant's sieve script picks where it goes
+			stores = s.runSieve(ev, user, st)
+		}
+	} else {
+		st, has = s.dao.FindStoreFor("postmaster")
+		if has && st != nil {
+			stores = []mailstore.Store{st}
+		} else {
+			log.Errorf("no postmaster to take mail for %s from %s", ev.Recip, ev.Sender)
+			stores = nil
+		}
 	}
 	// deliver locally
-	j := sendmail.NewLocalDelivery(st, ev.File)
-	go j.Run()
-	ok := j.Wait()
+	ok := false
+	for _, st := range stores {
+		j := sendmail.NewLocalDelivery(st, ev.File, nil)
+		go j.Run()
+		if j.Wait() {
+			ok = true
+		}
+	}
+	if ok {
+		s.notifyDelivered(ev)
+	}
 	if ok && s.Handler != nil {
 		s.Handler.GotMail(ev)
 	}
@@ -249,10 +408,53 @@ func (s *Server) gotMail(ev *MailEvent) (err error) {
 	return
 }
 
-// run a lua filter given a mail event
-// return the code returned by the lua function
-func (s *Server) runFilter(filtername string, ev *MailEvent) int {
-	return 0
+// run a filter function given a mail event
+// return the verdict returned by the filter script
+func (s *Server) runFilter(filtername string, ev *filter.Event, hit filter.Verdict) (v filter.Verdict) {
+	s.filtermtx.RLock()
+	defer s.filtermtx.RUnlock()
+	if s.filter == nil {
+		return
+	}
+	var err error
+	v, err = s.filter.Run(filtername, ev, hit)
+	if err != nil {
+		log.Errorf("filter %s failed: %s", filtername, err.Error())
+		v = filter.Pass
+	}
+	return
+}
+
+// create the event given to filter scripts, parses the message header
+func filterEvent(ev *MailEvent) *filter.Event {
+	fev := &filter.Event{
+		Addr:   ev.Addr,
+		Recip:  ev.Recip,
+		Sender: ev.Sender,
+		File:   ev.File,
+	}
+	f, err := os.Open(ev.File)
+	if err == nil {
+		fev.Header, err = textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+		f.Close()
+	}
+	if err != nil {
+		log.Warnf("failed to read header of %s: %s", ev.File, err.Error())
+	}
+	if fev.Header == nil {
+		fev.Header = make(textproto.MIMEHeader)
+	}
+	return fev
+}
+
+// filters run on inbound mail in order and the verdict they give on a hit
+var filterStages = []struct {
+	name string
+	hit  filter.Verdict
+}{
+	{"whitelist", filter.Accept},
+	{"blacklist", filter.Drop},
+	{"checkspam", filter.Spam},
 }
 
 // check that a remote address is valid for the recipiant
@@ -282,38 +484,65 @@ func (s *Server) i2pSenderIsValid(addr string, from string) (valid bool) {
 // checks mail message against whitelist, blacklist and
 // checkspam filters sequentially
 func (s *Server) filterMail(ev *MailEvent) (err error) {
-	// check invalid address for i2p
-	if !s.i2pSenderIsValid(ev.Addr, ev.Sender) {
-		// bad address
-		log.Warnf("bad i2p address from %s", ev.Sender)
-		err = errors.New("Bad i2p address")
-		return
+	fev := filterEvent(ev)
+	// check signature or invalid address for i2p, clearnet and bote senders cannot be checked
+	if !ev.Inet && !ev.Bote {
+		signer, verr := s.verifyMail(ev, fev.Header.Get("From"))
+		if verr == nil {
+			// signed mail is authentic even when relayed
+			log.Infof("mail from %s signed by %s", ev.Sender, signer)
+			fev.Signer = signer
+		} else if errors.Is(verr, dkim.ErrBadSignature) {
+			// the sender is forged so don't bounce it
+			log.Warnf("rejected mail for %s with bad signature from %s: %s", ev.Recip, ev.Sender, verr.Error())
+			os.Remove(ev.File)
+			return
+		} else {
+			if !errors.Is(verr, dkim.ErrNoSignature) {
+				log.Warnf("could not verify signature on mail from %s: %s", ev.Sender, verr.Error())
+			}
+			if !s.i2pSenderIsValid(ev.Addr, ev.Sender) {
+				// bad address, the sender is forged so don't bounce it
+				log.Warnf("rejected mail for %s with bad i2p address from %s", ev.Recip, ev.Sender)
+				os.Remove(ev.File)
+				return
+			}
+		}
 	}
-
-	// check whitelist filter
-	if s.runFilter("whitelist", ev) == 1 {
-		// explicit whitelist
-		err = s.gotMail(ev)
-		return
+	if serr := s.stripSpam(ev); serr != nil {
+		log.Errorf("failed to strip spam headers: %s", serr.Error())
 	}
-	// check blacklist filter
-	if s.runFilter("blacklist", ev) == 1 {
-		// drop message
-		log.WithFields(log.Fields{
-			"addr":   ev.Addr,
-			"recip":  ev.Recip,
-			"sender": ev.Sender,
-		}).Info("message hit blacklist")
-		return
+	fields := log.Fields{
+		"addr":   ev.Addr,
+		"recip":  ev.Recip,
+		"sender": ev.Sender,
 	}
-	if s.runFilter("checkspam", ev) == 1 {
-		// we got a spam message
-		log.WithFields(log.Fields{
-			"addr":   ev.Addr,
-			"recip":  ev.Recip,
-			"sender": ev.Sender,
-		}).Info("message hit spam filter")
-		return
+	for idx := 0; idx < len(filterStages) && !ev.Spam; idx++ {
+		stage := filterStages[idx]
+		switch s.runFilter(stage.name, fev, stage.hit) {
+		case filter.Accept:
+			// explicitly accepted
+			err = s.gotMail(ev)
+			return
+		case filter.Drop:
+			// drop message
+			log.WithFields(fields).Infof("message hit %s", stage.name)
+			os.Remove(ev.File)
+			return
+		case filter.Spam:
+			// we got a spam message
+			log.WithFields(fields).Info("message hit spam filter")
+			ev.Spam = true
+		}
+	}
+	if !ev.Spam && s.classifySpam(ev) {
+		log.WithFields(fields).Infof("message classified as spam with score %.3f", ev.SpamScore)
+		ev.Spam = true
+	}
+	if ev.Spam {
+		if terr := s.tagSpam(ev); terr != nil {
+			log.Errorf("failed to tag spam: %s", terr.Error())
+		}
 	}
 	// this mail was accepted
 	err = s.gotMail(ev)
@@ -331,6 +560,17 @@ func (s *Server) Run() {
 		}
 	}()
 
+	// run clearnet smtp acceptor
+	if s.inetlistener != nil {
+		go func() {
+			log.Info("Serving clearnet SMTP server on ", s.inetlistener.Addr())
+			err := s.inetserv.Serve(s.inetlistener)
+			if err != nil {
+				log.Fatal("clearnet smtp died ", err)
+			}
+		}()
+	}
+
 	// run web ui
 	go func() {
 		if s.webHandler == nil {
@@ -352,23 +592,73 @@ func (s *Server) Run() {
 		}
 	}()
 
+	// run submission acceptors
+	if s.smtpslistener != nil {
+		go func() {
+			log.Info("Serving SMTPS submission server on ", s.smtpslistener.Addr())
+			err := s.outserv.ServeSubmission(s.smtpslistener)
+			if err != nil {
+				log.Fatal("smtps submission server died ", err)
+			}
+		}()
+	}
+	if s.submissionlistener != nil {
+		go func() {
+			log.Info("Serving submission server on ", s.submissionlistener.Addr())
+			err := s.outserv.ServeSubmission(s.submissionlistener)
+			if err != nil {
+				log.Fatal("submission server died ", err)
+			}
+		}()
+	}
+
 	// run outbound mail flusher
 	go func() {
 		log.Info("Outbound mail flusher started")
+		s.outq.Mailer = s.mailer
+		s.outq.Report = s.report
 		for s.mailer != nil {
 			// flush outbound messages
-			s.flushOutboundMailQueue()
+			s.outq.Flush()
 			time.Sleep(time.Second * 10)
 		}
 		log.Info("Outbound mail flusher exited")
 	}()
 
+	// run greylist expiry
+	go s.expireGreylist()
+
+	// run bote fetcher
+	go func() {
+		for s.mailer != nil {
+			poll := time.Minute
+			if gw := s.boteGateway(); gw != nil {
+				err := gw.Fetch()
+				if err != nil {
+					log.Errorf("failed to fetch bote mail: %s", err.Error())
+				}
+				poll = gw.Poll
+			}
+			time.Sleep(poll)
+		}
+	}()
+
 	// run pop3 server
 	go func() {
 		if s.dao != nil {
 			s.pop.Auth = s.dao.CheckUserLogin
+			s.pop.Scram = s.Scram
 			s.pop.Local = s.dao
 		}
+		if s.popslistener != nil {
+			go func() {
+				log.Info("Serving POP3S server on ", s.popslistener.Addr())
+				err := s.pop.Serve(s.popslistener)
+				if err != nil {
+					log.Fatalf("POP3S server died: %s", err.Error())
+				}
+			}()
+		}
 		log.Info("Serving POP3 server")
 		err := s.pop.Serve(s.poplistener)
 		if err != nil {
@@ -376,6 +666,32 @@ func (s *Server) Run() {
 		}
 	}()
 
+	// run imap server
+	go func() {
+		if s.dao != nil {
+			s.imap.Auth = s.dao.CheckUserLogin
+			s.imap.Local = s.dao
+		}
+		log.Info("Serving IMAP server")
+		err := s.imap.Serve(s.imaplistener)
+		if err != nil {
+			log.Fatalf("IMAP server died: %s", err.Error())
+		}
+	}()
+
+	// run managesieve server
+	go func() {
+		if s.dao != nil {
+			s.sieve.Auth = s.dao.CheckUserLogin
+			s.sieve.Scripts = s.dao
+		}
+		log.Info("Serving ManageSieve server")
+		err := s.sieve.Serve(s.sievelistener)
+		if err != nil {
+			log.Fatalf("ManageSieve server died: %s", err.Error())
+		}
+	}()
+
 	log.Debug("run mail")
 	for {
 		// filtering
@@ -392,6 +708,7 @@ func (s *Server) Run() {
 			}
 		} else {
 			log.Info("Ingoring message with invalid recipiant ", recip)
+			os.Remove(ev.File)
 		}
 	}
 }
@@ -412,91 +729,36 @@ func (s *Server) allowRecip(recip string) (allow bool) {
 	return
 }
 
-// send all pending outbound messages
-func (s *Server) flushOutboundMailQueue() {
-	log.Debug("flush outbound messages")
-	for {
-		msg, has := s.outserv.Outbound.Pop()
-		if !has {
-			return
-		}
-		f, err := os.Open(msg.Filepath())
+// get the sender and recipiants of an outbound message queued without an envelope from its header
+func (s *Server) outboundEnvelope(msg mailstore.Message) (from string, to []string, err error) {
+	var f *os.File
+	f, err = os.Open(msg.Filepath())
+	if err == nil {
+		c := textproto.NewConn(f)
+		var hdr textproto.MIMEHeader
+		hdr, err = c.ReadMIMEHeader()
+		c.Close()
 		if err == nil {
-			c := textproto.NewConn(f)
-			hdr, err := c.ReadMIMEHeader()
-			if err == nil {
-				var to []string
-				var from string
-				from = hdr.Get("From")
-				for _, h := range []string{"To", "Cc"} {
-					vs, ok := hdr[h]
-					if ok {
-						to = append(to, vs...)
+			from = hdr.Get("From")
+			for _, h := range []string{"To", "Cc"} {
+				for _, r := range hdr[h] {
+					r = normalizeEmail(r)
+					if len(r) > 0 {
+						to = append(to, r)
 					}
 				}
-				c.Close()
-				go s.sendOutboundMessage(from, to, msg)
-			} else {
-				log.Errorf("bad outboud message %s: %s", msg.Filepath(), err.Error())
-				c.Close()
-			}
-		} else {
-			log.Errorf("failed to open outbound message %s: %s", msg.Filepath(), err.Error())
-		}
-	}
-}
-
-// send 1 outbound message
-func (s *Server) sendOutboundMessage(from string, to []string, msg mailstore.Message) {
-	log.Infof("Sending outbound mail %s", msg.Filename())
-	var recips []string
-	servers := make(map[string]int)
-	for _, r := range to {
-		r = normalizeEmail(r)
-		if len(r) > 0 {
-			recips = append(recips, r)
-			parts := strings.Split(r, "@")
-			server := parts[1]
-			// find remote servers
-			if server != s.session.B32() {
-				num, ok := servers[server]
-				if ok {
-					servers[server] = num + 1
-				} else {
-					servers[server] = 1
-				}
 			}
 		}
 	}
-
-	if len(recips) == 0 {
-		log.Warnf("%s not deliverable, no valid recipiants", msg.Filepath())
-		s.Bounce("", from, msg.Filepath(), errors.New("mail not deliverable"))
-		msg.Remove()
-		return
-	}
-
-	var jobs []sendmail.DeliverJob
-
-	// deliver to all
-	for _, recip := range recips {
-		// fire off delivery job
-		d := s.mailer.Deliver(recip, from, msg)
-		jobs = append(jobs, d)
-		go d.Run()
-	}
-
-	for _, j := range jobs {
-		j.Wait()
-	}
-
-	msg.Remove()
-
 	return
 }
 
 func (s *Server) PermitSend(from, username string) bool {
 	user, server := splitEmail(from)
+	if gw := s.gateway(); gw != nil && gw.AcceptsRecipient(from) {
+		// our users can send as their clearnet address
+		user, server = strings.Split(from, "@")[0], s.session.B32()
+	}
 	return username == user && (server == s.inserv.Hostname || server == s.session.B32())
 }
 
@@ -505,17 +767,32 @@ func (s *Server) Plain(username, password string) bool {
 	return good
 }
 
+// get the scram credentials of a user, nil if they have none
+func (s *Server) Scram(username string) (cred *sasl.ScramCred) {
+	if s.dao == nil {
+		return
+	}
+	s.dao.VisitUser(username, func(u *model.User) error {
+		cred = u.ScramCred()
+		return nil
+	})
+	return
+}
+
 // handle mail for sending from inet to i2p
-func (s *Server) handleInetMail(remote net.Addr, from string, to []string, fpath string) {
+func (s *Server) handleInetMail(remote net.Addr, from string, to []string, dsn *mailstore.DSN, fpath string) {
 	log.Debugf("handle send mail from %s", remote)
 	parts := strings.Split(from, "@")
-	if len(parts) == 2 && (parts[1] == s.inserv.Hostname || parts[1] == s.session.B32()) {
+	gw := s.gateway()
+	if len(parts) == 2 && (parts[1] == s.inserv.Hostname || parts[1] == s.session.B32() || (gw != nil && gw.AcceptsRecipient(from))) {
 		// accepted for outbound mail
 		log.Infof("outbound message queued: %s", fpath)
 	} else {
 		log.Errorf("bad outbound mail from %s", from)
-		// remove file
-		os.Remove(fpath)
+		// remove from queue
+		if !s.outq.Remove(maildir.Message(fpath)) {
+			log.Errorf("outbound mail %s is already being sent", fpath)
+		}
 	}
 }
 
@@ -534,10 +811,34 @@ func (s *Server) Stop() {
 		s.smtplistener.Close()
 		s.smtplistener = nil
 	}
+	if s.smtpslistener != nil {
+		s.smtpslistener.Close()
+		s.smtpslistener = nil
+	}
+	if s.submissionlistener != nil {
+		s.submissionlistener.Close()
+		s.submissionlistener = nil
+	}
+	if s.popslistener != nil {
+		s.popslistener.Close()
+		s.popslistener = nil
+	}
 	if s.weblistener != nil {
 		s.weblistener.Close()
 		s.weblistener = nil
 	}
+	if s.imaplistener != nil {
+		s.imaplistener.Close()
+		s.imaplistener = nil
+	}
+	if s.sievelistener != nil {
+		s.sievelistener.Close()
+		s.sievelistener = nil
+	}
+	if s.inetlistener != nil {
+		s.inetlistener.Close()
+		s.inetlistener = nil
+	}
 	log.Info("Server Stopped")
 }
 
@@ -583,8 +884,9 @@ func (s *Server) ReloadConfig() (err error) {
 	if err != nil {
 		return
 	}
-	// set pop3 server maildir getter
+	// set pop3 and imap server maildir getter
 	s.pop.Local = s.dao
+	s.imap.Local = s.dao
 
 	str, _ = s.conf.Get("outbound_maildir")
 	if len(str) == 0 {
@@ -594,11 +896,16 @@ func (s *Server) ReloadConfig() (err error) {
 	log.Info("using outbound mail in ", str)
 	s.outserv.Auth = s
 	s.outserv.Inbound = maildir.MailDir(str)
-	s.outserv.Outbound = maildir.MailQueue(maildir.MailDir(str))
-	err = s.outserv.Outbound.Ensure()
-	if err != nil {
-		return
+	// only initialize outbound queue if not initialized, it tracks deliveries in flight
+	if s.outq == nil {
+		s.outq = sendmail.NewQueue(maildir.MailDir(str))
+		s.outq.Envelope = s.outboundEnvelope
+		err = s.outq.Ensure()
+		if err != nil {
+			return
+		}
 	}
+	s.outserv.Outbound = s.outq
 	err = s.outserv.Inbound.Ensure()
 	if err != nil {
 		return
@@ -617,24 +924,98 @@ func (s *Server) ReloadConfig() (err error) {
 	s.inserv.Hostname = domain
 	s.outserv.Hostname = domain
 
-	tkey, _ := s.conf.Get("tls_keyfile")
-	if len(tkey) == 0 {
-		tkey = "tls-privkey.pem"
+	// when passwords may be sent without tls
+	str, _ = s.conf.Get("plaintext_auth")
+	if len(str) == 0 {
+		str = DEFAULT_PLAINTEXT_AUTH
 	}
+	var policy sasl.Policy
+	policy, err = sasl.ParsePolicy(str)
+	if err != nil {
+		return
+	}
+	s.outserv.AuthPolicy = policy
+	s.pop.Policy = policy
 
-	tcert, _ := s.conf.Get("tls_cert")
-	if len(tcert) == 0 {
-		tcert = "tls-cert.pem"
+	// key that keeps scram probes of unknown users the same across restarts
+	str, _ = s.conf.Get("scram_keyfile")
+	if len(str) == 0 {
+		str = DEFAULT_SCRAM_KEYFILE
+	}
+	var key []byte
+	key, err = loadSecret(str, 32)
+	if err != nil {
+		return
+	}
+	sasl.SetFakeKey(key)
+
+	// largest message we accept
+	maxsize := int64(DEFAULT_MAX_MESSAGE_SIZE)
+	str, _ = s.conf.Get("max_message_size")
+	if len(str) > 0 {
+		maxsize, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	s.inserv.MaxSize = maxsize
+	s.outserv.MaxSize = maxsize
+	s.inetserv.MaxSize = maxsize
+
+	// largest imap command, big enough to APPEND the largest message by default
+	cmdsize := int64(0)
+	if maxsize > 0 {
+		cmdsize = maxsize + 64*1024
+	}
+	str, _ = s.conf.Get("imap_max_command_size")
+	if len(str) > 0 {
+		cmdsize, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	s.imap.MaxCommandSize = int(cmdsize)
+
+	// default user quotas
+	quota := model.Quota{Bytes: DEFAULT_QUOTA_BYTES, Messages: DEFAULT_QUOTA_MESSAGES}
+	str, _ = s.conf.Get("quota_bytes")
+	if len(str) > 0 {
+		quota.Bytes, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	str, _ = s.conf.Get("quota_messages")
+	if len(str) > 0 {
+		quota.Messages, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	s.quota = quota
+
+	err = s.reloadLimits()
+	if err != nil {
+		return
+	}
+	err = s.reloadGreylist()
+	if err != nil {
+		return
+	}
+	err = s.reloadSpam()
+	if err != nil {
+		return
 	}
 
 	log.Info("Ensuring TLS key and certs...")
-	s.TLS, err = starttls.GenTLS(domain, "bdsmail", tcert, tkey, 2048)
+	err = s.reloadTLS(domain)
 	if err != nil {
-		log.Errorf("failed to generate tls key/cert: %s", err.Error())
+		log.Errorf("failed to load tls key/cert: %s", err.Error())
 		return
 	}
-	s.outserv.TLS = s.TLS
-	s.pop.TLS = s.TLS
+	s.inetserv.Inbound = s.inserv.Inbound
+	s.reloadGateway()
+	s.reloadBote()
 
 	// only initialize dao if not initialized
 	if s.dao == nil {
@@ -651,7 +1032,7 @@ func (s *Server) ReloadConfig() (err error) {
 			err = dao.Ensure()
 			if err == nil {
 				// ensure regular utility users
-				for _, name := range []string{"postmaster", "admin", "abuse"} {
+				for _, name := range []string{"postmaster", DEFAULT_ADMIN_LOGIN, "abuse"} {
 					err = dao.EnsureUser(name, func(u *model.User) error {
 						u.MailDirPath = filepath.Join(s.mail, name)
 						return nil
@@ -675,13 +1056,52 @@ func (s *Server) ReloadConfig() (err error) {
 					log.Errorf("failed to ensure users: %s", err.Error())
 				}
 			} else {
-				log.Error("database ensure failed: %s", err.Error())
+				log.Errorf("database ensure failed: %s", err.Error())
 			}
 		}
 	}
+	err = s.reloadFilter()
+	if err != nil {
+		return
+	}
 	assetsdir, ok := s.conf.Get("assets")
 	if ok && s.dao != nil {
-		s.webHandler = web.NewMiddleware(assetsdir, s.dao)
+		s.webHandler = web.NewMiddleware(web.Config{
+			AssetsDir: assetsdir,
+			DB:        s.dao,
+			Outbound:  s.outserv.Outbound,
+			Domain:    domain,
+			AdminUser: DEFAULT_ADMIN_LOGIN,
+			MailRoot:  s.mail,
+			Queues: []admin.Queue{
+				{Name: "inbound", Store: s.inserv.Inbound},
+				{Name: "outbound", Store: s.outserv.Inbound},
+			},
+			Quota: s.quota,
+			Train: s.trainSpam,
+		})
+	}
+	return
+}
+
+// load the filter script from config, replacing any loaded one
+func (s *Server) reloadFilter() (err error) {
+	var eng *filter.Engine
+	str, _ := s.conf.Get("filter_script")
+	if len(str) > 0 {
+		log.Info("Loading filter script ", str)
+		eng, err = filter.Load(str)
+		if err != nil {
+			log.Errorf("failed to load filter script: %s", err.Error())
+			return
+		}
+	}
+	s.filtermtx.Lock()
+	old := s.filter
+	s.filter = eng
+	s.filtermtx.Unlock()
+	if old != nil {
+		old.Close()
 	}
 	return
 }
@@ -697,9 +1117,22 @@ func New() (s *Server) {
 		outserv: &smtp.Server{
 			Appname: Appname,
 		},
-		pop: pop3.New(),
+		inetserv: &smtp.Server{
+			Appname: Appname,
+		},
+		pop:   pop3.New(),
+		imap:  imap.New(),
+		sieve: managesieve.New(),
 	}
 	s.inserv.Handler = s.queueMail
 	s.outserv.Handler = s.handleInetMail
+	s.inetserv.Handler = s.handleGatewayMail
+	s.inetserv.Recipient = s.acceptInetRecip
+	s.inserv.Quota = s.checkQuota
+	s.outserv.Quota = s.checkQuota
+	s.inetserv.Quota = s.checkInetQuota
+	s.pop.Quota = s.popQuota
+	s.pop.Deleted = s.popDeleted
+	s.inserv.Greylist = s.greylist
 	return
 }
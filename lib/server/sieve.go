@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/mailutil"
+	"github.com/majestrate/bdsmail/lib/sieve"
+	"github.com/majestrate/bdsmail/lib/util"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// most addresses a script can redirect 1 message to
+const maxRedirects = 4
+
+// run the recipiant's active sieve script and do the actions it asks for
+// returns the stores the message goes to
+func (s *Server) runSieve(ev *MailEvent, user string, st mailstore.Store) (stores []mailstore.Store) {
+	stores = []mailstore.Store{st}
+	sc, err := s.dao.ActiveSieveScript(user)
+	if err != nil {
+		log.Errorf("failed to get sieve script for %s: %s", user, err.Error())
+	}
+	if sc == nil {
+		return
+	}
+	script, err := sieve.Parse(sc.Script)
+	if err != nil {
+		log.Errorf("sieve script %s of %s is broken: %s", sc.Name, user, err.Error())
+		return
+	}
+	msg := &sieve.Message{
+		From: ev.Sender,
+		To:   ev.Recip,
+	}
+	f, err := os.Open(ev.File)
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			msg.Size = fi.Size()
+			msg.Header, err = textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+		}
+		f.Close()
+	}
+	if err != nil {
+		log.Warnf("failed to read %s for sieve: %s", ev.File, err.Error())
+	}
+	res, err := script.Run(msg)
+	if err != nil {
+		log.Warnf("sieve script %s of %s failed: %s", sc.Name, user, err.Error())
+	}
+	stores = nil
+	if res.Keep {
+		stores = append(stores, st)
+	}
+	for _, name := range res.FileInto {
+		folder, err := ensureFolder(st, name)
+		if err == nil {
+			stores = append(stores, folder)
+		} else {
+			log.Warnf("can't file mail for %s into %s, keeping it", user, name)
+			stores = append(stores, st)
+		}
+	}
+	if len(res.Redirect) > 0 && redirectLoop(msg.Header, ev.Recip) {
+		log.Warnf("not redirecting mail for %s from %s, it was redirected by %s before", user, ev.Sender, ev.Recip)
+		res.Redirect = nil
+	}
+	for idx, addr := range res.Redirect {
+		if idx == maxRedirects {
+			log.Warnf("sieve script of %s redirects to too many addresses", user)
+			break
+		}
+		s.sieveRedirect(ev, addr)
+	}
+	if res.Reject != "" {
+		s.rejectMail(ev, "5.7.1", res.Reject)
+	}
+	if res.Vacation != nil {
+		s.sieveVacation(ev, msg.Header, res.Vacation, st)
+	}
+	return
+}
+
+// return true if a message was redirected by recip before
+// we stamp redirected mail with a Delivered-To header so A -> B -> A loops stop at A
+func redirectLoop(hdr textproto.MIMEHeader, recip string) bool {
+	recip = strings.ToLower(normalizeEmail(recip))
+	if recip == "" {
+		return false
+	}
+	for _, v := range hdr["Delivered-To"] {
+		if strings.ToLower(normalizeEmail(v)) == recip {
+			return true
+		}
+	}
+	return false
+}
+
+// send a copy of a message to another address
+// the envelope sender is the recipiant so the other side can check it came from us
+func (s *Server) sieveRedirect(ev *MailEvent, addr string) {
+	f, err := os.Open(ev.File)
+	if err == nil {
+		stamp := strings.NewReader("Delivered-To: " + ev.Recip + "\r\n")
+		_, err = s.outq.Enqueue(ev.Recip, []string{addr}, io.MultiReader(stamp, f))
+		f.Close()
+	}
+	if err == nil {
+		log.Infof("redirected mail for %s to %s", ev.Recip, addr)
+	} else {
+		log.Errorf("failed to redirect mail for %s to %s: %s", ev.Recip, addr, err.Error())
+	}
+}
+
+// send a rejection back to the sender of mail for a local recipiant
+func (s *Server) rejectMail(ev *MailEvent, status, reason string) {
+	log.Infof("rejected mail for %s from %s: %s", ev.Recip, ev.Sender, reason)
+	if r := eventReport(ev, mailutil.NotifyFailure, mailutil.ActionFailed, status, reason); r != nil {
+		s.report(ev.Sender, r, maildir.Message(ev.File))
+	}
+}
+
+// return true if we should not send an autoreply to a message
+func noAutoReply(sender string, hdr textproto.MIMEHeader) bool {
+	local := strings.ToLower(sender)
+	if idx := strings.Index(local, "@"); idx >= 0 {
+		local = local[:idx]
+	}
+	if local == "" || local == "mailer-daemon" || local == "postmaster" || strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return true
+	}
+	if auto := strings.ToLower(hdr.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		return true
+	}
+	switch strings.ToLower(hdr.Get("Precedence")) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return hdr.Get("List-Id") != "" || hdr.Get("List-Unsubscribe") != ""
+}
+
+// return true if one of addrs is in the to or cc header
+func addressedTo(hdr textproto.MIMEHeader, addrs []string) bool {
+	for _, h := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		for _, v := range hdr[h] {
+			list, _ := mail.ParseAddressList(v)
+			for _, a := range list {
+				for _, addr := range addrs {
+					if strings.EqualFold(a.Address, addr) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// send a vacation autoreply at most once per sender every few days
+func (s *Server) sieveVacation(ev *MailEvent, hdr textproto.MIMEHeader, vac *sieve.Vacation, st mailstore.Store) {
+	if noAutoReply(ev.Sender, hdr) || !addressedTo(hdr, append([]string{ev.Recip}, vac.Addresses...)) {
+		return
+	}
+	md, ok := st.(maildir.MailDir)
+	if !ok {
+		return
+	}
+	// replies sent are tracked by the modification time of a file per sender and handle
+	handle := vac.Handle
+	if handle == "" {
+		handle = vac.Subject + "\x00" + vac.Reason
+	}
+	dir := filepath.Join(md.Filepath(), "vacation")
+	fname := filepath.Join(dir, fmt.Sprintf("%x", sha256.Sum256([]byte(handle+"\x00"+strings.ToLower(ev.Sender)))))
+	fi, err := os.Stat(fname)
+	if err == nil && time.Since(fi.ModTime()) < time.Duration(vac.Days)*24*time.Hour {
+		return
+	}
+	from := vac.From
+	if from == "" {
+		from = ev.Recip
+	}
+	subject := vac.Subject
+	if subject == "" {
+		subject = "Auto: " + hdr.Get("Subject")
+	}
+	buff := new(bytes.Buffer)
+	c := textproto.NewWriter(bufio.NewWriter(buff))
+	c.PrintfLine("From: %s", from)
+	c.PrintfLine("To: %s", ev.Sender)
+	c.PrintfLine("Subject: %s", mime.QEncoding.Encode("utf-8", subject))
+	c.PrintfLine("Date: %s", time.Now().Format(time.RFC1123Z))
+	c.PrintfLine("Message-ID: <%s@%s>", util.RandStr(20), s.inserv.Hostname)
+	if id := hdr.Get("Message-Id"); id != "" {
+		c.PrintfLine("In-Reply-To: %s", id)
+		c.PrintfLine("References: %s", id)
+	}
+	c.PrintfLine("Auto-Submitted: auto-replied (vacation)")
+	c.PrintfLine("MIME-Version: 1.0")
+	reason := strings.Replace(strings.Replace(vac.Reason, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	if !vac.Mime {
+		// a mime reason has its own header
+		c.PrintfLine("Content-Type: text/plain; charset=utf-8")
+		c.PrintfLine("")
+	}
+	c.W.WriteString(reason)
+	c.W.Flush()
+	// the null sender can't be checked over i2p so the recipiant is the envelope sender
+	_, err = s.outq.Enqueue(ev.Recip, []string{ev.Sender}, buff)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(fname, nil, 0600)
+	}
+	if err == nil {
+		now := time.Now()
+		err = os.Chtimes(fname, now, now)
+	}
+	if err == nil {
+		log.Infof("sent vacation reply from %s to %s", ev.Recip, ev.Sender)
+	} else {
+		log.Errorf("failed to send vacation reply from %s to %s: %s", ev.Recip, ev.Sender, err.Error())
+	}
+}
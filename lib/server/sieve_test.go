@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestRedirectLoop(t *testing.T) {
+	hdr := textproto.MIMEHeader{
+		"Delivered-To": {"bob@bob.i2p", "<Alice@alice.i2p>"},
+	}
+	if !redirectLoop(hdr, "alice@alice.i2p") {
+		t.Error("missed mail alice redirected before")
+	}
+	if redirectLoop(hdr, "carol@carol.i2p") {
+		t.Error("carol never redirected this mail")
+	}
+	if redirectLoop(nil, "alice@alice.i2p") {
+		t.Error("loop in mail with no headers")
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/bote"
+	"github.com/majestrate/bdsmail/lib/dkim"
+	"github.com/majestrate/bdsmail/lib/gateway"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+// set up signing outbound mail with our destination's key
+func (s *Server) setupSigner() {
+	key, err := s.session.SigningKey()
+	if err != nil {
+		log.Warnf("not signing outbound mail: %s, generate a new i2pkeyfile to sign mail", err.Error())
+		return
+	}
+	s.signer = dkim.NewSigner(key)
+	log.Info("signing outbound mail with our destination key")
+}
+
+// return true if a mail domain is ours
+func (s *Server) isOurDomain(domain string) bool {
+	domain = strings.ToLower(domain)
+	return domain == s.session.B32() || domain == strings.ToLower(s.inserv.Hostname)
+}
+
+// rewrite outbound mail and sign what we send into i2p
+func (s *Server) prepareMail(recip, from string) (string, string, func(io.Reader) io.Reader, error) {
+	recip, from, body, err := s.rewriteMail(recip, from)
+	signer := s.signer
+	if err != nil || signer == nil || !gateway.IsI2P(recip) || bote.IsBote(recip) {
+		return recip, from, body, err
+	}
+	domain := dkim.FromDomain(from)
+	if from == "" {
+		// delivery status notifications come from MAILER-DAEMON at our hostname
+		domain = strings.ToLower(s.inserv.Hostname)
+	}
+	if !s.isOurDomain(domain) {
+		return recip, from, body, nil
+	}
+	return recip, from, func(r io.Reader) io.Reader {
+		if body != nil {
+			r = body(r)
+		}
+		return signer.Sign(domain, r)
+	}, nil
+}
+
+// find the signing key of an i2p mail domain
+func (s *Server) lookupSigningKey(domain string) (pk ed25519.PublicKey, err error) {
+	name := s.parseFromI2PAddr("postmaster@" + domain)
+	if name == "" {
+		err = errors.New("not an i2p domain: " + domain)
+		return
+	}
+	a, err := s.session.LookupI2P(name)
+	if err == nil && strings.HasSuffix(domain, ".b32.i2p") && a.Base32Addr().String() != domain {
+		err = errors.New("lookup of " + domain + " gave the wrong destination")
+	}
+	if err == nil {
+		pk, err = a.SigningPublicKey()
+	}
+	return
+}
+
+// verify the signature on inbound mail
+// returns the signing domain if it's good and matches the from header
+func (s *Server) verifyMail(ev *MailEvent, from string) (domain string, err error) {
+	var f *os.File
+	f, err = os.Open(ev.File)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	domain, err = dkim.Verify(f, s.lookupSigningKey)
+	if err == nil && domain != dkim.FromDomain(from) {
+		err = errors.New("signed by " + domain + " which is not the domain of " + from)
+		domain = ""
+	}
+	return
+}
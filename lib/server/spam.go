@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/bayes"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/model"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// header set on mail we think is spam
+const spamFlagHeader = "X-Spam-Flag"
+
+// header with the classifier's score of mail we think is spam
+const spamScoreHeader = "X-Spam-Score"
+
+// start of every spam header, we remove them from mail we get
+const spamHeaderPrefix = "X-Spam-"
+
+// get a folder of a store, creating it if it doesn't exist
+func ensureFolder(st mailstore.Store, name string) (folder mailstore.Store, err error) {
+	fs, ok := st.(mailstore.FolderStore)
+	if !ok {
+		err = errors.New("mail store has no folders")
+		return
+	}
+	err = fs.CreateFolder(name)
+	if err == nil || err == mailstore.ErrFolderExists {
+		folder, err = fs.OpenFolder(name)
+	}
+	return
+}
+
+// read spam filter settings from config
+func (s *Server) reloadSpam() (err error) {
+	threshold := DEFAULT_SPAM_THRESHOLD
+	str, _ := s.conf.Get("spam_threshold")
+	if len(str) > 0 {
+		threshold, err = strconv.ParseFloat(str, 64)
+		if err != nil {
+			return
+		}
+	}
+	str, _ = s.conf.Get("spam_action")
+	switch str {
+	case "", "junk":
+		s.spamJunk = true
+	case "tag":
+		s.spamJunk = false
+	default:
+		err = fmt.Errorf("invalid spam_action: %s", str)
+		return
+	}
+	str, _ = s.conf.Get("spam_train_pop3")
+	s.spamTrainPOP3 = str == "1" || str == "yes" || str == "true"
+	s.spamThreshold = threshold
+	return
+}
+
+// get the spam corpora for a local user, everyone's corpus is always included
+func (s *Server) spamCorpora(user string) (cs []*bayes.Corpus) {
+	c, err := bayes.Open(filepath.Join(s.mail, bayes.FileName))
+	if err == nil {
+		cs = append(cs, c)
+	} else {
+		log.Errorf("failed to open spam corpus: %s", err.Error())
+	}
+	if s.dao == nil {
+		return
+	}
+	s.dao.VisitUser(user, func(u *model.User) error {
+		c, err = bayes.Open(filepath.Join(u.MailDirPath, bayes.FileName))
+		if err == nil {
+			cs = append(cs, c)
+		} else {
+			log.Errorf("failed to open spam corpus of %s: %s", user, err.Error())
+		}
+		return nil
+	})
+	return
+}
+
+// score mail for a local recipiant with the bayesian classifier
+// returns true if it is spam
+func (s *Server) classifySpam(ev *MailEvent) (spam bool) {
+	user, ok := s.localUser(ev.Recip)
+	if !ok || s.spamThreshold <= 0 {
+		return
+	}
+	score, err := bayes.ScoreFile(ev.File, s.spamCorpora(user)...)
+	if err != nil {
+		log.Errorf("failed to classify mail for %s: %s", ev.Recip, err.Error())
+		return
+	}
+	ev.SpamScore = score
+	return score >= s.spamThreshold
+}
+
+// rewrite a message file through a temp file
+// rewrite returns false to keep the file as it is
+func (s *Server) rewriteSpool(ev *MailEvent, rewrite func(r *bufio.Reader, w *bufio.Writer) (bool, error)) (err error) {
+	tmp := ev.File + ".tmp"
+	if md, ok := s.inserv.Inbound.(maildir.MailDir); ok {
+		tmp = md.TempFile()
+	}
+	var in, out *os.File
+	in, err = os.Open(ev.File)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err = os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(out)
+	changed, err := rewrite(bufio.NewReader(in), w)
+	if err == nil {
+		err = w.Flush()
+	}
+	out.Close()
+	if err == nil && changed {
+		err = os.Rename(tmp, ev.File)
+	} else {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// add spam headers to the top of a message file
+func (s *Server) tagSpam(ev *MailEvent) error {
+	return s.rewriteSpool(ev, func(r *bufio.Reader, w *bufio.Writer) (bool, error) {
+		fmt.Fprintf(w, "%s: YES\r\n", spamFlagHeader)
+		if ev.SpamScore > 0 {
+			fmt.Fprintf(w, "%s: %.3f\r\n", spamScoreHeader, ev.SpamScore)
+		}
+		_, err := io.Copy(w, r)
+		return true, err
+	})
+}
+
+// copy a message without its X-Spam-* headers, returns true if it had any
+func stripSpamHeaders(r *bufio.Reader, w *bufio.Writer) (stripped bool, err error) {
+	skip := false
+	for err == nil {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		// folded lines belong to the header before them
+		if len(line) == 0 || (line[0] != ' ' && line[0] != '\t') {
+			skip = len(line) >= len(spamHeaderPrefix) && strings.EqualFold(string(line[:len(spamHeaderPrefix)]), spamHeaderPrefix)
+		}
+		if skip {
+			stripped = true
+		} else {
+			w.Write(line)
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of header
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	return
+}
+
+// remove spam headers the sender put on a message so only ours are trusted
+func (s *Server) stripSpam(ev *MailEvent) error {
+	return s.rewriteSpool(ev, stripSpamHeaders)
+}
+
+// check if a message was tagged as spam by us, incoming spam headers are stripped so the tag is ours
+func isTaggedSpam(fpath string) bool {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hdr, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	return strings.EqualFold(hdr.Get(spamFlagHeader), "yes")
+}
+
+// a pop3 user deleted a message without retrieving it
+// when turned on, deleting unread mail we tagged as spam confirms it
+func (s *Server) popDeleted(user string, msg mailstore.Message) {
+	if s.spamTrainPOP3 && isTaggedSpam(msg.Filepath()) {
+		s.trainSpam(user, msg, true)
+	}
+}
+
+// learn a message of a local user as spam or ham
+func (s *Server) trainSpam(user string, msg mailstore.Message, spam bool) {
+	err := bayes.TrainFile(msg.Filepath(), spam, s.spamCorpora(user)...)
+	if err == nil {
+		log.Infof("learned %s of %s as spam=%v", msg.Filepath(), user, spam)
+	} else {
+		log.Errorf("failed to learn %s of %s: %s", msg.Filepath(), user, err.Error())
+	}
+}
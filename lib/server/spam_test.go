@@ -0,0 +1,27 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStripSpamHeaders(t *testing.T) {
+	for in, want := range map[string]string{
+		"X-Spam-Flag: NO\r\nSubject: hi\r\nx-spam-score: 0.1\r\n\tfolded\r\n\r\nX-Spam-Flag: in the body\r\n": "Subject: hi\r\n\r\nX-Spam-Flag: in the body\r\n",
+		"Subject: hi\nX-Spam-Status: No\n": "Subject: hi\n",
+		"Subject: hi\r\n\r\nbody\r\n":      "Subject: hi\r\n\r\nbody\r\n",
+	} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		stripped, err := stripSpamHeaders(bufio.NewReader(strings.NewReader(in)), w)
+		w.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want || stripped != (in != want) {
+			t.Errorf("stripped %q to %q (%v), not %q", in, buf.String(), stripped, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/util"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// give each of n recipiants its own file of a spooled message
+// filtering, tagging and removing one recipiant's file doesn't touch the others
+// the first recipiant keeps fpath, the others get a hard link or a copy at a path from tmpfile
+// returns the files made before an error, which the caller still owns
+func splitSpool(fpath string, n int, tmpfile func() string) (fpaths []string, err error) {
+	if n <= 0 {
+		return
+	}
+	fpaths = append(fpaths, fpath)
+	for len(fpaths) < n {
+		fname := tmpfile()
+		err = os.Link(fpath, fname)
+		if err != nil {
+			// no hard links on this filesystem
+			err = copySpool(fpath, fname)
+		}
+		if err != nil {
+			return
+		}
+		fpaths = append(fpaths, fname)
+	}
+	return
+}
+
+// copy a spooled message to a new file
+func copySpool(src, dst string) (err error) {
+	var in, out *os.File
+	in, err = os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(dst)
+	}
+	return
+}
+
+// get a path for another recipiant's file of a spooled message
+func (s *Server) spoolFile(fpath string) string {
+	if md, ok := s.inserv.Inbound.(maildir.MailDir); ok {
+		return md.TempFile()
+	}
+	return fpath + "." + util.RandStr(8)
+}
+
+// give each recipiant of a spooled message its own file
+// recipiants we could not make a file for get a bounce
+func (s *Server) splitSpool(from string, to []string, fpath string) (fpaths []string) {
+	fpaths, err := splitSpool(fpath, len(to), func() string {
+		return s.spoolFile(fpath)
+	})
+	if err != nil {
+		log.Errorf("failed to spool %s for %d recipiants: %s", fpath, len(to), err.Error())
+		for _, recip := range to[len(fpaths):] {
+			s.Bounce(recip, from, fpath, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSplitSpool(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "msg")
+	body := "Subject: hi\r\n\r\nhello\r\n"
+	if err := os.WriteFile(fpath, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	tmpfile := func() string {
+		n++
+		return filepath.Join(dir, "tmp"+strconv.Itoa(n))
+	}
+	fpaths, err := splitSpool(fpath, 3, tmpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fpaths) != 3 || fpaths[0] != fpath {
+		t.Fatalf("bad spool files %v", fpaths)
+	}
+	// the first recipiant's mail is tagged then delivered and removed
+	tagged := fpaths[0] + ".spam"
+	os.WriteFile(tagged, []byte("X-Spam-Flag: YES\r\n"+body), 0600)
+	if err = os.Rename(tagged, fpaths[0]); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(fpaths[0])
+	// the other recipiants still have the message as it came in
+	for _, fname := range fpaths[1:] {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Errorf("%s changed to %q", fname, data)
+		}
+	}
+	// a file for each recipiant or an error
+	if _, err = splitSpool(fpath, 2, tmpfile); err == nil {
+		t.Error("split a removed file")
+	}
+}
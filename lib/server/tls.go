@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/majestrate/bdsmail/lib/config"
+	"github.com/majestrate/bdsmail/lib/starttls"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// organization of the certificates we generate
+const tlsOrg = "bdsmail"
+
+// listeners that get their own certificate from the local ca
+var tlsListeners = []string{"smtp", "pop3", "imap", "managesieve", "inet"}
+
+// certificate and private key files
+type certFiles struct {
+	cert string
+	key  string
+}
+
+// return true if the local ca is turned on in config
+func localCA(conf *config.Config) bool {
+	str, _ := conf.Get("tls_ca")
+	return str == "1" || str == "yes" || str == "true"
+}
+
+// get the files of the local ca and the certificate of each listener from config
+// ca is nil when the local ca is off, then every listener uses tls_cert and tls_keyfile
+func tlsFiles(conf *config.Config) (ca *certFiles, files map[string]certFiles) {
+	files = make(map[string]certFiles)
+	if !localCA(conf) {
+		f := certFiles{cert: "tls-cert.pem", key: "tls-privkey.pem"}
+		if str, _ := conf.Get("tls_cert"); str != "" {
+			f.cert = str
+		}
+		if str, _ := conf.Get("tls_keyfile"); str != "" {
+			f.key = str
+		}
+		for _, name := range tlsListeners {
+			files[name] = f
+		}
+		return
+	}
+	ca = &certFiles{cert: "tls-ca-cert.pem", key: "tls-ca-privkey.pem"}
+	if str, _ := conf.Get("tls_ca_cert"); str != "" {
+		ca.cert = str
+	}
+	if str, _ := conf.Get("tls_ca_keyfile"); str != "" {
+		ca.key = str
+	}
+	dir, _ := conf.Get("tls_dir")
+	if dir == "" {
+		dir = "tls"
+	}
+	for _, name := range tlsListeners {
+		files[name] = certFiles{
+			cert: filepath.Join(dir, name+"-cert.pem"),
+			key:  filepath.Join(dir, name+"-privkey.pem"),
+		}
+	}
+	return
+}
+
+// get the certificate files our listeners use, the local ca's comes first
+func CertFiles(conf *config.Config) (fnames []string) {
+	ca, files := tlsFiles(conf)
+	if ca != nil {
+		fnames = append(fnames, ca.cert)
+	}
+	seen := make(map[string]bool)
+	for _, name := range tlsListeners {
+		if f := files[name].cert; !seen[f] {
+			seen[f] = true
+			fnames = append(fnames, f)
+		}
+	}
+	return
+}
+
+// load or generate the certificates of our listeners
+func (s *Server) reloadTLS(domain string) (err error) {
+	keytype, _ := s.conf.Get("tls_keytype")
+	if keytype == "" {
+		keytype = DEFAULT_TLS_KEYTYPE
+	}
+	keytype = strings.ToLower(keytype)
+	if _, err = starttls.GenerateKey(keytype); err != nil {
+		return
+	}
+	cafiles, files := tlsFiles(&s.conf)
+	var ca *starttls.CA
+	if cafiles != nil {
+		ca, err = starttls.LoadCA(cafiles.cert, cafiles.key, tlsOrg, keytype)
+		if err != nil {
+			return
+		}
+		log.Infof("using local ca %s with fingerprint %s", cafiles.cert, starttls.Fingerprint(ca.Cert))
+	}
+	configs := make(map[certFiles]*tls.Config)
+	listeners := make(map[string]*tls.Config)
+	for _, name := range tlsListeners {
+		f := files[name]
+		cfg, ok := configs[f]
+		if !ok {
+			if ca != nil {
+				err = os.MkdirAll(filepath.Dir(f.cert), 0700)
+				if err != nil {
+					return
+				}
+			}
+			cert := &starttls.Cert{
+				Hosts:    []string{domain, "localhost", "127.0.0.1", "::1"},
+				Org:      tlsOrg,
+				CertFile: f.cert,
+				KeyFile:  f.key,
+				KeyType:  keytype,
+				CA:       ca,
+			}
+			err = cert.Load()
+			if err != nil {
+				return
+			}
+			cfg = cert.Config()
+			configs[f] = cfg
+		}
+		listeners[name] = cfg
+	}
+	s.TLS = listeners["smtp"]
+	s.outserv.TLS = listeners["smtp"]
+	s.inetserv.TLS = listeners["inet"]
+	s.pop.TLS = listeners["pop3"]
+	s.imap.TLS = listeners["imap"]
+	s.sieve.TLS = listeners["managesieve"]
+	return
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"crypto/rand"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strings"
 )
@@ -24,7 +27,20 @@ func (s *Server) parseFromI2PAddr(email string) (name string) {
 	return
 }
 
-var re_email = regexp.MustCompile(`[a-zA-Z0-9\._\-]+@[a-zA-Z0-9\.]+[a-zA-Z0-9]\.i2p`)
+// read a secret key from a file, the file is made with a random key of size bytes if it doesn't exist
+func loadSecret(fname string, size int) (key []byte, err error) {
+	key, err = os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		key = make([]byte, size)
+		_, err = io.ReadFull(rand.Reader, key)
+		if err == nil {
+			err = os.WriteFile(fname, key, 0600)
+		}
+	}
+	return
+}
+
+var re_email = regexp.MustCompile(`[a-zA-Z0-9\._\-=+]+@[a-zA-Z0-9\.]+[a-zA-Z0-9]\.i2p`)
 
 func normalizeEmail(email string) (e string) {
 	e = re_email.Copy().FindString(email)
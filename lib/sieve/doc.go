@@ -0,0 +1,4 @@
+// sieve mail filtering language from RFC 5228
+//
+// supports the fileinto, reject, envelope and vacation extensions
+package sieve
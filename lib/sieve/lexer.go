@@ -0,0 +1,288 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tEOF = tokenKind(iota)
+	tIdent
+	tTag
+	tNumber
+	tString
+	tLBracket
+	tRBracket
+	tLParen
+	tRParen
+	tLBrace
+	tRBrace
+	tComma
+	tSemi
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tIdent:
+		return "identifier"
+	case tTag:
+		return "tag"
+	case tNumber:
+		return "number"
+	case tString:
+		return "string"
+	case tLBracket:
+		return "'['"
+	case tRBracket:
+		return "']'"
+	case tLParen:
+		return "'('"
+	case tRParen:
+		return "')'"
+	case tLBrace:
+		return "'{'"
+	case tRBrace:
+		return "'}'"
+	case tComma:
+		return "','"
+	case tSemi:
+		return "';'"
+	}
+	return "end of script"
+}
+
+type token struct {
+	kind tokenKind
+	// identifier or tag name in lower case, or string value
+	str  string
+	num  int64
+	line int
+}
+
+// a syntax error in a script
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// splits a script into tokens
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// skip whitespace and comments
+func (l *lexer) skip() (err error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return
+		}
+	}
+	return
+}
+
+// read next token
+func (l *lexer) next() (t token, err error) {
+	err = l.skip()
+	if err != nil {
+		return
+	}
+	t.line = l.line
+	if l.pos >= len(l.src) {
+		t.kind = tEOF
+		return
+	}
+	c := l.src[l.pos]
+	switch c {
+	case '[':
+		t.kind = tLBracket
+	case ']':
+		t.kind = tRBracket
+	case '(':
+		t.kind = tLParen
+	case ')':
+		t.kind = tRParen
+	case '{':
+		t.kind = tLBrace
+	case '}':
+		t.kind = tRBrace
+	case ',':
+		t.kind = tComma
+	case ';':
+		t.kind = tSemi
+	}
+	if t.kind != tEOF {
+		l.pos++
+		return
+	}
+	switch {
+	case c == '"':
+		t.kind = tString
+		t.str, err = l.quoted()
+	case c == ':':
+		l.pos++
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		if start == l.pos {
+			err = l.errorf("empty tag")
+		}
+		t.kind = tTag
+		t.str = strings.ToLower(l.src[start:l.pos])
+	case c >= '0' && c <= '9':
+		t.kind = tNumber
+		t.num, err = l.number()
+	case isIdentStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		t.str = strings.ToLower(l.src[start:l.pos])
+		if t.str == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			t.kind = tString
+			t.str, err = l.multiline()
+		} else {
+			t.kind = tIdent
+		}
+	default:
+		err = l.errorf("unexpected character %q", c)
+	}
+	return
+}
+
+// read a quoted string
+func (l *lexer) quoted() (str string, err error) {
+	var sb strings.Builder
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			str = sb.String()
+			return
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+		sb.WriteByte(c)
+	}
+	err = l.errorf("unterminated string")
+	return
+}
+
+// read a multi-line string after text:
+func (l *lexer) multiline() (str string, err error) {
+	// rest of the line may only have whitespace or a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", l.errorf("expected newline after text:")
+	}
+	l.pos++
+	l.line++
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var line string
+		if end < 0 {
+			line = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			line = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+			l.line++
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			str = sb.String()
+			return
+		}
+		if strings.HasPrefix(line, "..") {
+			// dot stuffed
+			line = line[1:]
+		}
+		sb.WriteString(line + "\r\n")
+	}
+	err = l.errorf("unterminated multi-line string")
+	return
+}
+
+// read a number with an optional K, M or G quantifier
+func (l *lexer) number() (n int64, err error) {
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+	n, err = strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return 0, l.errorf("bad number %s", l.src[start:l.pos])
+	}
+	if l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case 'k', 'K':
+			n <<= 10
+			l.pos++
+		case 'm', 'M':
+			n <<= 20
+			l.pos++
+		case 'g', 'G':
+			n <<= 30
+			l.pos++
+		}
+	}
+	return
+}
@@ -0,0 +1,129 @@
+package sieve
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// compares values with a match type and comparator
+type matcher struct {
+	// is, contains or matches
+	typ string
+	// i;octet or i;ascii-casemap
+	cmp string
+	// address part to compare for address tests
+	part string
+}
+
+// lower case ascii letters only
+func asciiLower(str string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, str)
+}
+
+// return true if value matches any of the keys
+func (m *matcher) any(value string, keys []string) bool {
+	for _, key := range keys {
+		if m.match(value, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *matcher) match(value, key string) bool {
+	if m.cmp == "i;ascii-casemap" {
+		value, key = asciiLower(value), asciiLower(key)
+	}
+	switch m.typ {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcard([]rune(value), []rune(key))
+	}
+	return value == key
+}
+
+// match a value against a pattern with * and ? wildcards, \ escapes the next character
+func wildcard(value, pattern []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// collapse runs of *
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for idx := 0; idx <= len(value); idx++ {
+				if wildcard(value[idx:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(value) == 0 || value[0] != pattern[0] {
+				return false
+			}
+		}
+		value, pattern = value[1:], pattern[1:]
+	}
+	return len(value) == 0
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+// decode mime encoded words in a header value
+func decodeHeader(v string) string {
+	dec, err := wordDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return dec
+}
+
+// get the addresses in a header value
+func parseAddresses(v string) (addrs []string) {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			addrs = append(addrs, strings.Trim(v, "<>"))
+		}
+		return
+	}
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+	}
+	return
+}
+
+// get part of an address
+func addressPart(addr, part string) string {
+	idx := strings.LastIndex(addr, "@")
+	switch part {
+	case "localpart":
+		if idx >= 0 {
+			return addr[:idx]
+		}
+	case "domain":
+		if idx >= 0 {
+			return addr[idx+1:]
+		}
+		return ""
+	}
+	return addr
+}
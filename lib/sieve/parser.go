@@ -0,0 +1,191 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// an argument to a command or test
+type arg struct {
+	kind tokenKind
+	tag  string
+	num  int64
+	strs []string
+	line int
+}
+
+// a parsed command or test
+type node struct {
+	name  string
+	args  []arg
+	tests []*node
+	block []*node
+	// command has a block
+	hasBlock bool
+	line     int
+}
+
+type parser struct {
+	l   *lexer
+	tok token
+}
+
+func (p *parser) advance() (err error) {
+	p.tok, err = p.l.next()
+	return
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(kind tokenKind) (err error) {
+	if p.tok.kind != kind {
+		return p.errorf("expected %s, got %s", kind, p.tok.kind)
+	}
+	return p.advance()
+}
+
+// parse commands until end of block or script
+func (p *parser) commands(end tokenKind) (cmds []*node, err error) {
+	for p.tok.kind != end {
+		if p.tok.kind != tIdent {
+			return nil, p.errorf("expected command, got %s", p.tok.kind)
+		}
+		var n *node
+		n, err = p.command()
+		if err != nil {
+			return
+		}
+		cmds = append(cmds, n)
+	}
+	return
+}
+
+func (p *parser) command() (n *node, err error) {
+	n = &node{name: p.tok.str, line: p.tok.line}
+	if err = p.advance(); err != nil {
+		return
+	}
+	if err = p.arguments(n); err != nil {
+		return
+	}
+	switch p.tok.kind {
+	case tSemi:
+		err = p.advance()
+	case tLBrace:
+		if err = p.advance(); err != nil {
+			return
+		}
+		n.hasBlock = true
+		n.block, err = p.commands(tRBrace)
+		if err == nil {
+			err = p.advance()
+		}
+	default:
+		err = p.errorf("expected ';' or '{' after %s, got %s", n.name, p.tok.kind)
+	}
+	return
+}
+
+// parse arguments and tests of a command or test
+func (p *parser) arguments(n *node) (err error) {
+	for {
+		a := arg{kind: p.tok.kind, line: p.tok.line}
+		switch p.tok.kind {
+		case tTag:
+			a.tag = p.tok.str
+		case tNumber:
+			a.num = p.tok.num
+		case tString:
+			a.strs = []string{p.tok.str}
+		case tLBracket:
+			a.kind = tString
+			a.strs, err = p.stringList()
+			if err != nil {
+				return
+			}
+			n.args = append(n.args, a)
+			continue
+		case tIdent:
+			var t *node
+			t, err = p.test()
+			if err == nil {
+				n.tests = []*node{t}
+			}
+			return
+		case tLParen:
+			n.tests, err = p.testList()
+			return
+		default:
+			return
+		}
+		n.args = append(n.args, a)
+		if err = p.advance(); err != nil {
+			return
+		}
+	}
+}
+
+func (p *parser) stringList() (strs []string, err error) {
+	if err = p.advance(); err != nil {
+		return
+	}
+	for {
+		if p.tok.kind != tString {
+			return nil, p.errorf("expected string in list, got %s", p.tok.kind)
+		}
+		strs = append(strs, p.tok.str)
+		if err = p.advance(); err != nil {
+			return
+		}
+		if p.tok.kind == tRBracket {
+			err = p.advance()
+			return
+		}
+		if err = p.expect(tComma); err != nil {
+			return
+		}
+	}
+}
+
+func (p *parser) test() (n *node, err error) {
+	n = &node{name: p.tok.str, line: p.tok.line}
+	if err = p.advance(); err != nil {
+		return
+	}
+	err = p.arguments(n)
+	return
+}
+
+func (p *parser) testList() (tests []*node, err error) {
+	if err = p.advance(); err != nil {
+		return
+	}
+	for {
+		if p.tok.kind != tIdent {
+			return nil, p.errorf("expected test, got %s", p.tok.kind)
+		}
+		var t *node
+		t, err = p.test()
+		if err != nil {
+			return
+		}
+		tests = append(tests, t)
+		if p.tok.kind == tRParen {
+			err = p.advance()
+			return
+		}
+		if err = p.expect(tComma); err != nil {
+			return
+		}
+	}
+}
+
+// parse script source into commands
+func parse(src string) (cmds []*node, err error) {
+	p := &parser{l: &lexer{src: src, line: 1}}
+	if err = p.advance(); err == nil {
+		cmds, err = p.commands(tEOF)
+	}
+	return
+}
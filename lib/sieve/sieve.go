@@ -0,0 +1,628 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// extensions we support for require
+var Extensions = []string{"envelope", "fileinto", "reject", "vacation", "comparator-i;octet", "comparator-i;ascii-casemap"}
+
+// a message being filtered
+type Message struct {
+	// parsed header
+	Header textproto.MIMEHeader
+	// size in bytes
+	Size int64
+	// envelope sender and recipiant
+	From string
+	To   string
+}
+
+// vacation autoreply from RFC 5230
+type Vacation struct {
+	// days between replies to the same sender
+	Days int
+	// subject of reply, empty for the default
+	Subject string
+	// from address of reply, empty for the recipiant
+	From string
+	// other addresses of the user
+	Addresses []string
+	// reason is a mime entity instead of text
+	Mime bool
+	// identifies this vacation, empty to use the reason
+	Handle string
+	// body of reply
+	Reason string
+}
+
+// the actions a script decided on
+type Result struct {
+	// deliver to the inbox
+	Keep bool
+	// folders to deliver to
+	FileInto []string
+	// addresses to redirect to
+	Redirect []string
+	// reason for rejecting, empty if not rejected
+	Reject string
+	// autoreply or nil
+	Vacation *Vacation
+}
+
+// state of running a script
+type runner struct {
+	msg *Message
+	res *Result
+	// implicit keep was cancelled
+	cancelled bool
+	stopped   bool
+	err       error
+}
+
+type cmdFunc func(r *runner)
+type testFunc func(r *runner) bool
+
+// a compiled script
+type Script struct {
+	cmds []cmdFunc
+}
+
+// parse and check a script
+func Parse(src string) (s *Script, err error) {
+	var nodes []*node
+	nodes, err = parse(src)
+	if err != nil {
+		return
+	}
+	c := &compiler{required: make(map[string]bool)}
+	var cmds []cmdFunc
+	cmds, err = c.block(nodes, true)
+	if err == nil {
+		s = &Script{cmds: cmds}
+	}
+	return
+}
+
+// run a script on a message
+// on runtime errors the message is kept and the error returned
+func (s *Script) Run(msg *Message) (res *Result, err error) {
+	if msg.Header == nil {
+		msg.Header = make(textproto.MIMEHeader)
+	}
+	r := &runner{msg: msg, res: new(Result)}
+	runBlock(r, s.cmds)
+	if r.err == nil && r.res.Reject != "" && (r.res.Keep || len(r.res.FileInto) > 0 || len(r.res.Redirect) > 0) {
+		r.err = errors.New("reject can't be used with keep, fileinto or redirect")
+	}
+	if r.err != nil {
+		return &Result{Keep: true}, r.err
+	}
+	if !r.cancelled {
+		r.res.Keep = true
+	}
+	return r.res, nil
+}
+
+func runBlock(r *runner, cmds []cmdFunc) {
+	for _, cmd := range cmds {
+		if r.stopped || r.err != nil {
+			return
+		}
+		cmd(r)
+	}
+}
+
+type compiler struct {
+	required map[string]bool
+}
+
+func errorAt(n *node, format string, args ...interface{}) error {
+	return &SyntaxError{Line: n.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// what a tag takes after it
+type tagSpec map[string]tokenKind
+
+// split arguments into tags and positional arguments
+// tags that take a value have it stored in the arg for the tag
+func splitArgs(n *node, spec tagSpec) (tags map[string]arg, pos []arg, err error) {
+	tags = make(map[string]arg)
+	for idx := 0; idx < len(n.args); idx++ {
+		a := n.args[idx]
+		if a.kind != tTag {
+			pos = append(pos, a)
+			continue
+		}
+		if len(pos) > 0 {
+			return nil, nil, errorAt(n, "tag :%s after positional arguments of %s", a.tag, n.name)
+		}
+		kind, ok := spec[a.tag]
+		if !ok {
+			return nil, nil, errorAt(n, "%s does not take :%s", n.name, a.tag)
+		}
+		if _, dup := tags[a.tag]; dup {
+			return nil, nil, errorAt(n, "duplicate :%s", a.tag)
+		}
+		if kind != tEOF {
+			idx++
+			if idx >= len(n.args) || n.args[idx].kind != kind {
+				return nil, nil, errorAt(n, ":%s needs a %s", a.tag, kind)
+			}
+			v := n.args[idx]
+			v.tag = a.tag
+			a = v
+		}
+		tags[a.tag] = a
+	}
+	return
+}
+
+// check positional argument kinds
+func checkArgs(n *node, pos []arg, kinds ...tokenKind) error {
+	if len(pos) != len(kinds) {
+		return errorAt(n, "%s takes %d arguments, got %d", n.name, len(kinds), len(pos))
+	}
+	for idx := range kinds {
+		if pos[idx].kind != kinds[idx] {
+			return errorAt(n, "argument %d of %s must be a %s", idx+1, n.name, kinds[idx])
+		}
+	}
+	return nil
+}
+
+// get a single string argument
+func singleString(n *node, a arg) (string, error) {
+	if len(a.strs) != 1 {
+		return "", errorAt(n, "%s needs a single string", n.name)
+	}
+	return a.strs[0], nil
+}
+
+func (c *compiler) need(n *node, ext string) error {
+	if !c.required[ext] {
+		return errorAt(n, "%s needs require \"%s\"", n.name, ext)
+	}
+	return nil
+}
+
+// compile a block of commands
+func (c *compiler) block(nodes []*node, top bool) (cmds []cmdFunc, err error) {
+	requireAllowed := top
+	for idx := 0; idx < len(nodes); idx++ {
+		n := nodes[idx]
+		if n.name == "require" {
+			if !requireAllowed {
+				return nil, errorAt(n, "require must come before other commands")
+			}
+			err = c.require(n)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		requireAllowed = false
+		var cmd cmdFunc
+		switch n.name {
+		case "if":
+			// collect elsif and else that follow
+			chain := []*node{n}
+			for idx+1 < len(nodes) && (nodes[idx+1].name == "elsif" || nodes[idx+1].name == "else") {
+				idx++
+				chain = append(chain, nodes[idx])
+				if nodes[idx].name == "else" {
+					break
+				}
+			}
+			cmd, err = c.ifChain(chain)
+		case "elsif", "else":
+			err = errorAt(n, "%s without if", n.name)
+		default:
+			if n.hasBlock {
+				err = errorAt(n, "%s does not take a block", n.name)
+			} else if len(n.tests) > 0 {
+				err = errorAt(n, "%s does not take a test", n.name)
+			} else {
+				cmd, err = c.action(n)
+			}
+		}
+		if err != nil {
+			return
+		}
+		cmds = append(cmds, cmd)
+	}
+	return
+}
+
+func (c *compiler) require(n *node) error {
+	_, pos, err := splitArgs(n, nil)
+	if err == nil {
+		err = checkArgs(n, pos, tString)
+	}
+	if err != nil {
+		return err
+	}
+	for _, ext := range pos[0].strs {
+		found := false
+		for _, e := range Extensions {
+			found = found || e == ext
+		}
+		if !found {
+			return errorAt(n, "unsupported extension %s", ext)
+		}
+		c.required[ext] = true
+	}
+	return nil
+}
+
+func (c *compiler) ifChain(chain []*node) (cmd cmdFunc, err error) {
+	var tests []testFunc
+	var blocks [][]cmdFunc
+	for _, n := range chain {
+		if !n.hasBlock {
+			return nil, errorAt(n, "%s needs a block", n.name)
+		}
+		if len(n.args) > 0 {
+			return nil, errorAt(n, "%s does not take arguments", n.name)
+		}
+		var t testFunc
+		if n.name == "else" {
+			if len(n.tests) > 0 {
+				return nil, errorAt(n, "else does not take a test")
+			}
+			t = func(*runner) bool { return true }
+		} else {
+			if len(n.tests) != 1 {
+				return nil, errorAt(n, "%s needs 1 test", n.name)
+			}
+			t, err = c.test(n.tests[0])
+			if err != nil {
+				return
+			}
+		}
+		var block []cmdFunc
+		block, err = c.block(n.block, false)
+		if err != nil {
+			return
+		}
+		tests = append(tests, t)
+		blocks = append(blocks, block)
+	}
+	cmd = func(r *runner) {
+		for idx, t := range tests {
+			if t(r) {
+				runBlock(r, blocks[idx])
+				return
+			}
+		}
+	}
+	return
+}
+
+// compile an action command
+func (c *compiler) action(n *node) (cmd cmdFunc, err error) {
+	switch n.name {
+	case "stop", "keep", "discard":
+		if len(n.args) > 0 {
+			return nil, errorAt(n, "%s does not take arguments", n.name)
+		}
+		switch n.name {
+		case "stop":
+			cmd = func(r *runner) { r.stopped = true }
+		case "keep":
+			cmd = func(r *runner) { r.res.Keep = true }
+		case "discard":
+			cmd = func(r *runner) { r.cancelled = true }
+		}
+		return
+	case "fileinto", "redirect", "reject":
+		if n.name != "redirect" {
+			if err = c.need(n, n.name); err != nil {
+				return
+			}
+		}
+		var pos []arg
+		_, pos, err = splitArgs(n, nil)
+		if err == nil {
+			err = checkArgs(n, pos, tString)
+		}
+		var str string
+		if err == nil {
+			str, err = singleString(n, pos[0])
+		}
+		if err != nil {
+			return
+		}
+		switch n.name {
+		case "fileinto":
+			if strings.EqualFold(str, "INBOX") {
+				cmd = func(r *runner) { r.res.Keep = true; r.cancelled = true }
+				return
+			}
+			cmd = func(r *runner) {
+				r.cancelled = true
+				r.res.FileInto = appendNew(r.res.FileInto, str)
+			}
+		case "redirect":
+			if !strings.Contains(str, "@") {
+				return nil, errorAt(n, "bad redirect address %s", str)
+			}
+			cmd = func(r *runner) {
+				r.cancelled = true
+				r.res.Redirect = appendNew(r.res.Redirect, str)
+			}
+		case "reject":
+			cmd = func(r *runner) {
+				if r.res.Reject != "" {
+					r.err = errors.New("more than 1 reject")
+					return
+				}
+				r.cancelled = true
+				r.res.Reject = str
+			}
+		}
+		return
+	case "vacation":
+		return c.vacation(n)
+	}
+	return nil, errorAt(n, "unknown command %s", n.name)
+}
+
+func appendNew(list []string, str string) []string {
+	for _, s := range list {
+		if s == str {
+			return list
+		}
+	}
+	return append(list, str)
+}
+
+func (c *compiler) vacation(n *node) (cmd cmdFunc, err error) {
+	if err = c.need(n, "vacation"); err != nil {
+		return
+	}
+	tags, pos, err := splitArgs(n, tagSpec{
+		"days":      tNumber,
+		"subject":   tString,
+		"from":      tString,
+		"addresses": tString,
+		"mime":      tEOF,
+		"handle":    tString,
+	})
+	if err == nil {
+		err = checkArgs(n, pos, tString)
+	}
+	v := &Vacation{Days: 7}
+	if err == nil {
+		v.Reason, err = singleString(n, pos[0])
+	}
+	for _, name := range []string{"subject", "from", "handle"} {
+		a, ok := tags[name]
+		if !ok || err != nil {
+			continue
+		}
+		var str string
+		str, err = singleString(n, a)
+		switch name {
+		case "subject":
+			v.Subject = str
+		case "from":
+			v.From = str
+		case "handle":
+			v.Handle = str
+		}
+	}
+	if err != nil {
+		return
+	}
+	if a, ok := tags["days"]; ok {
+		v.Days = int(a.num)
+		if v.Days < 1 {
+			v.Days = 1
+		}
+	}
+	v.Addresses = tags["addresses"].strs
+	_, v.Mime = tags["mime"]
+	cmd = func(r *runner) {
+		if r.res.Vacation != nil {
+			r.err = errors.New("more than 1 vacation")
+			return
+		}
+		r.res.Vacation = v
+	}
+	return
+}
+
+// compile a test
+func (c *compiler) test(n *node) (t testFunc, err error) {
+	switch n.name {
+	case "true", "false":
+		if len(n.args) > 0 || len(n.tests) > 0 {
+			return nil, errorAt(n, "%s does not take arguments", n.name)
+		}
+		val := n.name == "true"
+		return func(*runner) bool { return val }, nil
+	case "not":
+		if len(n.args) > 0 || len(n.tests) != 1 {
+			return nil, errorAt(n, "not takes 1 test")
+		}
+		var inner testFunc
+		inner, err = c.test(n.tests[0])
+		if err == nil {
+			t = func(r *runner) bool { return !inner(r) }
+		}
+		return
+	case "allof", "anyof":
+		if len(n.args) > 0 || len(n.tests) == 0 {
+			return nil, errorAt(n, "%s takes a test list", n.name)
+		}
+		var tests []testFunc
+		for _, tn := range n.tests {
+			var inner testFunc
+			inner, err = c.test(tn)
+			if err != nil {
+				return
+			}
+			tests = append(tests, inner)
+		}
+		all := n.name == "allof"
+		t = func(r *runner) bool {
+			for _, inner := range tests {
+				if inner(r) != all {
+					return !all
+				}
+			}
+			return all
+		}
+		return
+	}
+	if len(n.tests) > 0 {
+		return nil, errorAt(n, "%s does not take a test", n.name)
+	}
+	switch n.name {
+	case "exists":
+		var pos []arg
+		_, pos, err = splitArgs(n, nil)
+		if err == nil {
+			err = checkArgs(n, pos, tString)
+		}
+		if err != nil {
+			return
+		}
+		names := pos[0].strs
+		t = func(r *runner) bool {
+			for _, name := range names {
+				if len(r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+					return false
+				}
+			}
+			return true
+		}
+		return
+	case "size":
+		var tags map[string]arg
+		var pos []arg
+		tags, pos, err = splitArgs(n, tagSpec{"over": tEOF, "under": tEOF})
+		if err == nil {
+			err = checkArgs(n, pos, tNumber)
+		}
+		if err != nil {
+			return
+		}
+		_, over := tags["over"]
+		if _, under := tags["under"]; over == under {
+			return nil, errorAt(n, "size needs 1 of :over or :under")
+		}
+		limit := pos[0].num
+		t = func(r *runner) bool {
+			if over {
+				return r.msg.Size > limit
+			}
+			return r.msg.Size < limit
+		}
+		return
+	case "header", "address", "envelope":
+		return c.matchTest(n)
+	}
+	return nil, errorAt(n, "unknown test %s", n.name)
+}
+
+// compile header, address and envelope tests
+func (c *compiler) matchTest(n *node) (t testFunc, err error) {
+	spec := tagSpec{"is": tEOF, "contains": tEOF, "matches": tEOF, "comparator": tString}
+	isAddr := n.name != "header"
+	if isAddr {
+		spec["all"] = tEOF
+		spec["localpart"] = tEOF
+		spec["domain"] = tEOF
+	}
+	if n.name == "envelope" {
+		if err = c.need(n, "envelope"); err != nil {
+			return
+		}
+	}
+	tags, pos, err := splitArgs(n, spec)
+	if err == nil {
+		err = checkArgs(n, pos, tString, tString)
+	}
+	if err != nil {
+		return
+	}
+	m := &matcher{typ: "is", cmp: "i;ascii-casemap", part: "all"}
+	var types, parts []string
+	for tag := range tags {
+		switch tag {
+		case "is", "contains", "matches":
+			types = append(types, tag)
+		case "all", "localpart", "domain":
+			parts = append(parts, tag)
+		}
+	}
+	if len(types) > 1 || len(parts) > 1 {
+		return nil, errorAt(n, "conflicting tags for %s", n.name)
+	}
+	if len(types) == 1 {
+		m.typ = types[0]
+	}
+	if len(parts) == 1 {
+		m.part = parts[0]
+	}
+	if a, ok := tags["comparator"]; ok {
+		m.cmp, err = singleString(n, a)
+		if err != nil {
+			return
+		}
+		if m.cmp != "i;octet" && m.cmp != "i;ascii-casemap" {
+			return nil, errorAt(n, "unsupported comparator %s", m.cmp)
+		}
+	}
+	names, keys := pos[0].strs, pos[1].strs
+	switch n.name {
+	case "header":
+		t = func(r *runner) bool {
+			for _, name := range names {
+				for _, v := range r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+					if m.any(decodeHeader(v), keys) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	case "address":
+		t = func(r *runner) bool {
+			for _, name := range names {
+				for _, v := range r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+					for _, addr := range parseAddresses(v) {
+						if m.any(addressPart(addr, m.part), keys) {
+							return true
+						}
+					}
+				}
+			}
+			return false
+		}
+	case "envelope":
+		t = func(r *runner) bool {
+			for _, name := range names {
+				var addr string
+				switch strings.ToLower(name) {
+				case "from":
+					addr = r.msg.From
+				case "to":
+					addr = r.msg.To
+				default:
+					continue
+				}
+				if m.any(addressPart(addr, m.part), keys) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package sieve
+
+import (
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func testMessage() *Message {
+	return &Message{
+		Header: textproto.MIMEHeader{
+			"From":       {"Alice <alice@Example.b32.i2p>"},
+			"To":         {"bob@ourdest.b32.i2p, carol@ourdest.b32.i2p"},
+			"Subject":    {"=?utf-8?q?Weekly_report?="},
+			"List-Id":    {"<dev.lists.i2p>"},
+			"X-Priority": {"1"},
+		},
+		Size: 2048,
+		From: "alice@example.b32.i2p",
+		To:   "bob@ourdest.b32.i2p",
+	}
+}
+
+func run(t *testing.T, src string) *Result {
+	t.Helper()
+	s, err := Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	res, err := s.Run(testMessage())
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	return res
+}
+
+func TestActions(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want Result
+	}{
+		{``, Result{Keep: true}},
+		{`discard;`, Result{}},
+		{`require "fileinto"; fileinto "Lists"; fileinto "Lists";`, Result{FileInto: []string{"Lists"}}},
+		{`require ["fileinto"]; fileinto "INBOX";`, Result{Keep: true}},
+		{`redirect "other@dest.b32.i2p"; keep;`, Result{Keep: true, Redirect: []string{"other@dest.b32.i2p"}}},
+		{`require "reject"; reject text:
+go away
+..dotted
+.
+;`, Result{Reject: "go away\r\n.dotted\r\n"}},
+		{`discard; stop; keep;`, Result{}},
+		{`# comment
+/* block
+comment */ if false { discard; } elsif true { keep; } else { discard; }`, Result{Keep: true}},
+	} {
+		res := run(t, c.src)
+		if !reflect.DeepEqual(*res, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.src, *res, c.want)
+		}
+	}
+}
+
+func TestTests(t *testing.T) {
+	for src, want := range map[string]bool{
+		`header :contains "subject" "weekly"`:                        true,
+		`header :is "subject" "weekly report"`:                       true,
+		`header :is :comparator "i;octet" "subject" "weekly report"`: false,
+		`header :matches "subject" "W*ly ?eport"`:                    true,
+		`header :matches "subject" "W*ly"`:                           false,
+		`address :domain "from" "example.b32.i2p"`:                   true,
+		`address :localpart "to" "carol"`:                            true,
+		`address :all :is "from" "alice@example.b32.i2p"`:            true,
+		`envelope :domain "to" "ourdest.b32.i2p"`:                    true,
+		`envelope "from" "bob@ourdest.b32.i2p"`:                      false,
+		`exists ["list-id", "x-priority"]`:                           true,
+		`exists ["list-id", "x-spam"]`:                               false,
+		`size :over 1K`:                                              true,
+		`size :under 1K`:                                             false,
+		`not size :over 1M`:                                          true,
+		`allof (true, exists "list-id")`:                             true,
+		`anyof (false, header :contains "x-priority" "5")`:           false,
+		`header :matches "list-id" "<dev.\\*"`:                       false,
+		`header :matches "x-priority" "?"`:                           true,
+	} {
+		res := run(t, `require "envelope"; if `+src+` { discard; }`)
+		if got := !res.Keep; got != want {
+			t.Errorf("%s: got %v, want %v", src, got, want)
+		}
+	}
+}
+
+func TestVacation(t *testing.T) {
+	res := run(t, `require "vacation";
+vacation :days 3 :subject "away" :addresses ["bob@ourdest.b32.i2p"] "I am away";`)
+	want := &Vacation{Days: 3, Subject: "away", Addresses: []string{"bob@ourdest.b32.i2p"}, Reason: "I am away"}
+	if !res.Keep || !reflect.DeepEqual(res.Vacation, want) {
+		t.Errorf("got %+v %+v", res, res.Vacation)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, src := range []string{
+		`fileinto "x";`,
+		`require "fileinto"; keep; require "reject";`,
+		`require "nosuch";`,
+		`if true keep;`,
+		`else { keep; }`,
+		`keep`,
+		`header :is :contains "a" "b"`,
+		`if header :is "a" { keep; }`,
+		`if size 10 { keep; }`,
+		`if header :comparator "i;nosuch" "a" "b" { keep; }`,
+		`"unterminated`,
+		`redirect "noaddress";`,
+		`keep { discard; }`,
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%s: parsed without error", src)
+		}
+	}
+	// runtime errors keep the message
+	s, err := Parse(`require ["reject", "fileinto"]; fileinto "x"; reject "no";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Run(testMessage())
+	if err == nil || !reflect.DeepEqual(*res, Result{Keep: true}) {
+		t.Errorf("expected implicit keep on error, got %+v %v", *res, err)
+	}
+}
@@ -1,6 +1,11 @@
 package smtp
 
+import (
+	"github.com/majestrate/bdsmail/lib/sasl"
+)
+
 type Auth interface {
+	// checks the logins of sasl mechanisms
+	sasl.Authenticator
 	PermitSend(from, username string) bool
-	Plain(username, password string) bool
 }
@@ -0,0 +1,175 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+type Client struct {
+	smtp.Client
+}
+
+// create a new smtp client
+// wrapper function
+func NewClient(conn net.Conn, host string) (*Client, error) {
+	cl, err := smtp.NewClient(conn, host)
+	if err == nil {
+		return &Client{*cl}, nil
+	}
+	return nil, err
+}
+
+// get the server's size limit, 0 if it has none or didn't say
+func (c *Client) MaxSize() (size int64) {
+	if ok, param := c.Extension("SIZE"); ok {
+		size, _ = strconv.ParseInt(strings.TrimSpace(param), 10, 64)
+	}
+	return
+}
+
+// send a command, flushing unless we are pipelining
+func (c *Client) send(cmd string, flush bool) (err error) {
+	_, err = fmt.Fprintf(c.Text.W, "%s\r\n", cmd)
+	if err == nil && flush {
+		err = c.Text.W.Flush()
+	}
+	return
+}
+
+// read a reply expecting a code
+// returns the error reply if rejected and fails if the connection broke
+func (c *Client) expect(code int) (reply error, err error) {
+	_, _, reply = c.Text.ReadResponse(code)
+	if _, ok := reply.(*textproto.Error); reply != nil && !ok {
+		err = reply
+	}
+	return
+}
+
+// send a message in 1 transaction, size is the size of the message or -1 if not known
+// MAIL, RCPT and DATA are sent together when the server supports PIPELINING
+// returns the first error, the message is still sent to the recipiants that were accepted
+func (c *Client) SendMail(from string, to []string, size int64, msg io.Reader) (err error) {
+	params := ""
+	if ok, _ := c.Extension("SIZE"); ok && size >= 0 {
+		if max := c.MaxSize(); max > 0 && size > max {
+			return &textproto.Error{Code: 552, Msg: fmt.Sprintf("5.3.4 message size %d exceeds server limit %d", size, max)}
+		}
+		params += fmt.Sprintf(" SIZE=%d", size)
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params += " BODY=8BITMIME"
+	}
+	if !isASCII(from + strings.Join(to, "")) {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return &textproto.Error{Code: 553, Msg: "5.6.7 server does not support SMTPUTF8"}
+		}
+		params += " SMTPUTF8"
+	}
+	cmds := []string{"MAIL FROM:<" + from + ">" + params}
+	for _, recip := range to {
+		cmds = append(cmds, "RCPT TO:<"+recip+">")
+	}
+	cmds = append(cmds, "DATA")
+	last := len(cmds) - 1
+	// replies to commands in order, nil for accepted
+	var replies []error
+	var accepted int
+	pipelining, _ := c.Extension("PIPELINING")
+	if pipelining {
+		for _, cmd := range cmds {
+			if err = c.send(cmd, false); err != nil {
+				return
+			}
+		}
+		if err = c.Text.W.Flush(); err != nil {
+			return
+		}
+	}
+	for idx, cmd := range cmds {
+		if !pipelining {
+			if idx == last && accepted == 0 {
+				// no recipiants so no DATA
+				break
+			}
+			if err = c.send(cmd, true); err != nil {
+				return
+			}
+		}
+		code := 250
+		if idx == last {
+			code = 354
+		}
+		var reply error
+		reply, err = c.expect(code)
+		if err != nil {
+			return
+		}
+		replies = append(replies, reply)
+		if reply == nil && idx > 0 && idx < last {
+			accepted++
+		}
+		if idx == 0 && reply != nil && !pipelining {
+			// sender rejected
+			break
+		}
+	}
+	for _, reply := range replies {
+		if reply != nil {
+			err = reply
+			break
+		}
+	}
+	if len(replies) < len(cmds) || replies[last] != nil {
+		// no DATA, clear the transaction if it was started
+		if replies[0] == nil {
+			if e := c.Reset(); e != nil {
+				err = e
+			}
+		}
+		return
+	}
+	w := c.Text.DotWriter()
+	if accepted > 0 {
+		er := &errReader{r: msg}
+		_, e := io.Copy(w, er)
+		if er.err != nil {
+			// don't end a partial message, drop the connection instead
+			c.Close()
+			return er.err
+		}
+		if e != nil {
+			return e
+		}
+	}
+	if e := w.Close(); e != nil {
+		return e
+	}
+	reply, e := c.expect(250)
+	if e != nil {
+		return e
+	}
+	if err == nil {
+		err = reply
+	}
+	return
+}
+
+// reader that remembers its read error
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"errors"
+	mail "github.com/majestrate/bdsmail/lib/mailutil"
+	"strconv"
+	"strings"
+)
+
+// decode an xtext parameter value (RFC 3461)
+func decodeXtext(str string) (string, error) {
+	var sb strings.Builder
+	for idx := 0; idx < len(str); idx++ {
+		ch := str[idx]
+		if ch == '+' {
+			if idx+2 >= len(str) {
+				return "", errors.New("bad xtext")
+			}
+			hex := str[idx+1 : idx+3]
+			if strings.ToUpper(hex) != hex {
+				return "", errors.New("bad xtext")
+			}
+			b, err := strconv.ParseUint(hex, 16, 8)
+			if err != nil {
+				return "", errors.New("bad xtext")
+			}
+			ch = byte(b)
+			idx += 2
+		} else if ch < '!' || ch > '~' || ch == '=' {
+			return "", errors.New("bad xtext")
+		}
+		if ch < ' ' || ch > '~' {
+			// we only keep printable text
+			return "", errors.New("bad xtext")
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String(), nil
+}
+
+// parse the value of NOTIFY, returns it upper case
+func parseNotify(v string) (notify string, err error) {
+	notify = strings.ToUpper(v)
+	events := strings.Split(notify, ",")
+	seen := make(map[string]bool)
+	for _, ev := range events {
+		switch ev {
+		case mail.NotifyNever:
+			if len(events) > 1 {
+				err = errors.New("NOTIFY=NEVER can't be combined")
+			}
+		case mail.NotifySuccess, mail.NotifyFailure, mail.NotifyDelay:
+			if seen[ev] {
+				err = errors.New("NOTIFY repeats " + ev)
+			}
+		default:
+			err = errors.New("invalid NOTIFY")
+		}
+		seen[ev] = true
+	}
+	return
+}
+
+// parse the value of ORCPT, returns it as "addr-type;address" with the address decoded
+func parseORcpt(v string) (orcpt string, err error) {
+	idx := strings.Index(v, ";")
+	if idx <= 0 {
+		err = errors.New("invalid ORCPT")
+		return
+	}
+	var addr string
+	addr, err = decodeXtext(v[idx+1:])
+	if err != nil || addr == "" || len(v) > 500 {
+		err = errors.New("invalid ORCPT")
+		return
+	}
+	orcpt = v[:idx] + ";" + addr
+	return
+}
@@ -0,0 +1,213 @@
+package smtp
+
+import (
+	"github.com/majestrate/bdsmail/lib/i2p"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// default most recipiants of 1 message
+const DefaultMaxRecipients = 100
+
+// limits on what remote hosts may do, i2p destinations count as 1 host each
+// zero values are unlimited
+type Limits struct {
+	// most sessions at once from all hosts
+	MaxConns int
+	// most sessions at once from 1 host
+	MaxConnsPerHost int
+	// most messages 1 host may send per hour
+	MaxMessagesPerHour int
+	// most recipiants of 1 message, 0 uses DefaultMaxRecipients
+	MaxRecipients int
+	// how long a host that sends too many messages is refused, 0 to not ban
+	BanTime time.Duration
+}
+
+// tracks what remote hosts are doing to enforce limits
+type limiter struct {
+	mtx    sync.Mutex
+	limits Limits
+	// sessions open from all hosts
+	conns int
+	// sessions open per host
+	hostConns map[string]int
+	// when each host's messages in the last hour were accepted
+	sent map[string][]time.Time
+	// when each banned host's ban ends
+	bans map[string]time.Time
+	// when we last dropped expired state
+	swept time.Time
+	now   func() time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		hostConns: make(map[string]int),
+		sent:      make(map[string][]time.Time),
+		bans:      make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// get the name of the remote host we limit by
+func hostOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case i2p.I2PAddr:
+		return a.Base32Addr().String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+// drop old messages and expired bans, must hold the lock
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for host, until := range l.bans {
+		if !now.Before(until) {
+			delete(l.bans, host)
+		}
+	}
+	for host := range l.sent {
+		l.recent(host, now)
+	}
+}
+
+// get when a host sent messages in the last hour, must hold the lock
+func (l *limiter) recent(host string, now time.Time) []time.Time {
+	times := l.sent[host]
+	idx := 0
+	for idx < len(times) && now.Sub(times[idx]) >= time.Hour {
+		idx++
+	}
+	times = times[idx:]
+	if len(times) == 0 {
+		delete(l.sent, host)
+	} else {
+		l.sent[host] = times
+	}
+	return times
+}
+
+// check if a host is banned, must hold the lock
+func (l *limiter) banned(host string, now time.Time) bool {
+	until, ok := l.bans[host]
+	return ok && now.Before(until)
+}
+
+// start a session from a host
+// returns the reply to refuse it with or empty string if it may go on
+func (l *limiter) open(host string) string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.sweep(now)
+	if l.banned(host, now) {
+		return "421 4.7.0 too much mail from you, try again later"
+	}
+	if l.limits.MaxConns > 0 && l.conns >= l.limits.MaxConns {
+		return "421 4.3.2 too many connections, try again later"
+	}
+	if l.limits.MaxConnsPerHost > 0 && l.hostConns[host] >= l.limits.MaxConnsPerHost {
+		return "421 4.7.0 too many connections from you, try again later"
+	}
+	l.conns++
+	l.hostConns[host]++
+	return ""
+}
+
+// end a session from a host that open allowed
+func (l *limiter) close(host string) {
+	l.mtx.Lock()
+	l.conns--
+	if l.hostConns[host] <= 1 {
+		delete(l.hostConns, host)
+	} else {
+		l.hostConns[host]--
+	}
+	l.mtx.Unlock()
+}
+
+// check if a host may send another message, bans it if it sent too many
+func (l *limiter) allowMail(host string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	if l.banned(host, now) {
+		return false
+	}
+	if l.limits.MaxMessagesPerHour > 0 && len(l.recent(host, now)) >= l.limits.MaxMessagesPerHour {
+		if l.limits.BanTime > 0 {
+			l.bans[host] = now.Add(l.limits.BanTime)
+			log.Warnf("smtp: banning %s for %s after %d messages in an hour", host, l.limits.BanTime, len(l.sent[host]))
+		}
+		return false
+	}
+	return true
+}
+
+// note that a host sent a message
+func (l *limiter) sentMail(host string) {
+	l.mtx.Lock()
+	if l.limits.MaxMessagesPerHour > 0 {
+		l.sent[host] = append(l.sent[host], l.now())
+	}
+	l.mtx.Unlock()
+}
+
+// most recipiants of 1 message
+func (l *limiter) maxRecipients() (n int) {
+	l.mtx.Lock()
+	n = l.limits.MaxRecipients
+	l.mtx.Unlock()
+	if n <= 0 {
+		n = DefaultMaxRecipients
+	}
+	return
+}
+
+// get the limiter of this server
+func (s *Server) limiter() *limiter {
+	s.limitOnce.Do(func() {
+		s.limits = newLimiter()
+	})
+	return s.limits
+}
+
+// set the limits on remote hosts, safe to call while serving
+func (s *Server) SetLimits(limits Limits) {
+	l := s.limiter()
+	l.mtx.Lock()
+	l.limits = limits
+	l.mtx.Unlock()
+}
+
+// get the hosts that are banned and when their bans end
+func (s *Server) Bans() map[string]time.Time {
+	l := s.limiter()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	bans := make(map[string]time.Time)
+	for host, until := range l.bans {
+		if now.Before(until) {
+			bans[host] = until
+		}
+	}
+	return bans
+}
+
+// lift the ban on a host
+func (s *Server) Unban(host string) {
+	l := s.limiter()
+	l.mtx.Lock()
+	delete(l.bans, host)
+	delete(l.sent, host)
+	l.mtx.Unlock()
+}
@@ -0,0 +1,86 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiterBan(t *testing.T) {
+	l := newLimiter()
+	clock := time.Unix(1000, 0)
+	l.now = func() time.Time {
+		return clock
+	}
+	l.limits = Limits{MaxMessagesPerHour: 2, BanTime: time.Hour}
+	for i := 0; i < 2; i++ {
+		if !l.allowMail("a") {
+			t.Fatalf("message %d refused", i)
+		}
+		l.sentMail("a")
+	}
+	if l.allowMail("a") {
+		t.Fatal("third message allowed")
+	}
+	if !l.allowMail("b") {
+		t.Fatal("other host limited")
+	}
+	if reply := l.open("a"); !strings.HasPrefix(reply, "421 4.7.0") {
+		t.Errorf("banned host got %q", reply)
+	}
+	// ban and message window expire
+	clock = clock.Add(time.Hour)
+	if reply := l.open("a"); reply != "" {
+		t.Errorf("ban did not expire: %q", reply)
+	}
+	if !l.allowMail("a") {
+		t.Error("messages from last hour still counted")
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	srv, _, addr := testServer(t, 0)
+	srv.SetLimits(Limits{MaxConnsPerHost: 1, MaxMessagesPerHour: 1, MaxRecipients: 2, BanTime: time.Hour})
+	c := testDial(t, addr)
+	// second session from the same host is refused
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := textproto.NewConn(nc)
+	defer c2.Close()
+	if _, _, err = c2.ReadResponse(220); err == nil || err.(*textproto.Error).Code != 421 {
+		t.Errorf("expected 421 for second connection, got %v", err)
+	}
+	c.PrintfLine("HELO tester")
+	c.ReadResponse(250)
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	expectReply(t, c, 250, "2.1.0")
+	for _, r := range []string{"a", "b"} {
+		c.PrintfLine("RCPT TO:<%s@example.i2p>", r)
+		expectReply(t, c, 250, "2.1.5")
+	}
+	c.PrintfLine("RCPT TO:<c@example.i2p>")
+	if _, _, err := c.ReadResponse(250); err == nil || err.(*textproto.Error).Code != 452 {
+		t.Errorf("expected 452 for too many recipients, got %v", err)
+	}
+	c.PrintfLine("DATA")
+	expectReply(t, c, 354, "")
+	w := c.DotWriter()
+	w.Write([]byte("Subject: test\r\n\r\nhi\r\n"))
+	w.Close()
+	expectReply(t, c, 250, "2.0.0")
+	// over the hourly limit, the host gets banned
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	if _, _, err := c.ReadResponse(250); err == nil || err.(*textproto.Error).Code != 450 {
+		t.Errorf("expected 450 for too many messages, got %v", err)
+	}
+	if len(srv.Bans()) != 1 {
+		t.Errorf("host not banned: %v", srv.Bans())
+	}
+	srv.Unban("127.0.0.1")
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	expectReply(t, c, 250, "2.1.0")
+}
@@ -3,40 +3,35 @@ package smtp
 import (
 	"bytes"
 	"crypto/tls"
-	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/majestrate/bdsmail/lib/mailstore"
 	mail "github.com/majestrate/bdsmail/lib/mailutil"
+	"github.com/majestrate/bdsmail/lib/sasl"
 	"github.com/majestrate/bdsmail/lib/starttls"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"net"
-	"net/smtp"
 	"net/textproto"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
+	rcptToRE   = regexp.MustCompile(`^[Tt][Oo]:\s*<([^>]+)>\s*(.*)$`)
+	mailFromRE = regexp.MustCompile(`^[Ff][Rr][Oo][Mm]:\s*<([^>]*)>\s*(.*)$`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
 )
 
-type Client struct {
-	smtp.Client
-}
-
-// create a new smtp client
-// wrapper function
-func NewClient(conn net.Conn, host string) (*Client, error) {
-	cl, err := smtp.NewClient(conn, host)
-	if err == nil {
-		return &Client{*cl}, nil
-	}
-	return nil, err
-}
+// error returned while reading a message bigger than the size limit
+var ErrMessageTooBig = errors.New("message exceeds size limit")
 
 // smtp message handler
-type Handler func(remoteAddr net.Addr, from string, to []string, fpath string)
+// dsn holds the delivery status notifications the sender asked for or is nil if it asked for none
+type Handler func(remoteAddr net.Addr, from string, to []string, dsn *mailstore.DSN, fpath string)
 
 // serve smtp via a net.Listener
 func Serve(l net.Listener, h Handler, appname, hostname string) (err error) {
@@ -57,12 +52,28 @@ type Server struct {
 	Handler Handler
 	// mail storage for inbound mail
 	Inbound mailstore.Store
-	// outbound mail queue
+	// outbound mail queue, if set accepted mail is queued here with its envelope instead of going to Inbound
 	Outbound mailstore.SendQueue
 	// user authenticator for sending mail
 	Auth Auth
+	// when plaintext sasl mechanisms may be used
+	AuthPolicy sasl.Policy
+	// checks if we accept mail for a recipiant, nil accepts all
+	Recipient func(string) bool
+	// checks if a message of the given size fits in a recipiant's quota, nil for no quotas
+	// size is 0 if the client did not declare it
+	// should return mailstore.ErrOverQuota or mailstore.ErrMailboxFull when it does not fit
+	Quota func(recip string, size int64) error
+	// checks a (remote host, sender, recipiant) triple against the greylist, nil for no greylisting
+	// returns true to accept the recipiant, mail from authenticated users is not greylisted
+	Greylist func(host, from, recip string) (bool, error)
+	// largest message size in bytes we accept, 0 for no limit
+	MaxSize int64
 	// TLS Config
 	TLS *tls.Config
+
+	limitOnce sync.Once
+	limits    *limiter
 }
 
 type session struct {
@@ -71,18 +82,48 @@ type session struct {
 	nc         net.Conn
 	remoteName string
 	user       string
+	// STARTTLS was done or the connection started with tls
+	tls bool
+	// message submission session, clients must authenticate before MAIL
+	submission bool
+	// remote host limits apply to
+	host string
+	// current mail transaction
+	from string
+	to   []string
+	// MAIL was given, from is empty for the null sender
+	mailing bool
+	// delivery status notifications asked for with RET, ENVID, NOTIFY and ORCPT
+	dsn *mailstore.DSN
+	// size declared in MAIL FROM or 0
+	size int64
+	// sender asked for SMTPUTF8
+	utf8 bool
 }
 
 func (s *Server) newSession(conn net.Conn) *session {
+	_, isTLS := conn.(*tls.Conn)
 	return &session{
 		srv:  s,
 		conn: textproto.NewConn(conn),
 		nc:   conn,
+		tls:  isTLS,
+		host: hostOf(conn.RemoteAddr()),
 	}
 }
 
 // serve creates a new smtp sesion after a network connection is established
-func (s *Server) Serve(l net.Listener) (err error) {
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, false)
+}
+
+// serve message submission sessions where clients must authenticate before sending mail
+// l can be a tls listener for implicit tls submission
+func (s *Server) ServeSubmission(l net.Listener) error {
+	return s.serve(l, true)
+}
+
+func (s *Server) serve(l net.Listener, submission bool) (err error) {
 	defer l.Close()
 	for {
 		var conn net.Conn
@@ -94,9 +135,25 @@ func (s *Server) Serve(l net.Listener) (err error) {
 			return
 		}
 		session := s.newSession(conn)
-		go session.serve()
+		session.submission = submission
+		l := s.limiter()
+		if reply := l.open(session.host); reply != "" {
+			log.Infof("smtp: refusing connection from %s: %s", session.host, reply)
+			go refuse(conn, reply)
+			continue
+		}
+		go func() {
+			session.serve()
+			l.close(session.host)
+		}()
 	}
-	return
+}
+
+// send a reply to a connection we won't serve and hang up
+func refuse(conn net.Conn, reply string) {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte(reply + "\r\n"))
+	conn.Close()
 }
 
 // parse smtp line
@@ -110,16 +167,75 @@ func parseLine(line string) (cmd string, args string) {
 	return
 }
 
+// parse esmtp parameters of MAIL and RCPT, keys are upper case
+func parseParams(str string) (params map[string]string, err error) {
+	params = make(map[string]string)
+	for _, param := range strings.Fields(str) {
+		k, v := param, ""
+		if idx := strings.Index(param, "="); idx >= 0 {
+			k, v = param[:idx], param[idx+1:]
+		}
+		if k == "" {
+			err = errors.New("bad parameter " + param)
+			return
+		}
+		params[strings.ToUpper(k)] = v
+	}
+	return
+}
+
+// return true if a string is all ascii
+func isASCII(str string) bool {
+	for idx := 0; idx < len(str); idx++ {
+		if str[idx] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// send a reply line
+// replies are held back while the client has pipelined commands waiting so they go out together
+func (s *session) reply(format string, args ...interface{}) {
+	fmt.Fprintf(s.conn.W, format+"\r\n", args...)
+	if s.conn.R.Buffered() == 0 {
+		s.conn.W.Flush()
+	}
+}
+
+// clear the mail transaction
+func (s *session) reset() {
+	s.from = ""
+	s.to = nil
+	s.mailing = false
+	s.dsn = nil
+	s.size = 0
+	s.utf8 = false
+}
+
+// reader that fails once more than n bytes are read
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.exceeded = true
+		err = ErrMessageTooBig
+	}
+	return
+}
+
 // handles inbound connection
 func (s *session) serve() {
 	defer s.conn.Close()
-	var from string
-	var to []string
-	var body bytes.Buffer
-	c := s.conn
-	c.PrintfLine("220 %s %s SMTP is ready", s.srv.Hostname, s.srv.Appname)
+	s.reply("220 %s %s SMTP is ready", s.srv.Hostname, s.srv.Appname)
 	for {
-		line, err := c.ReadLine()
+		line, err := s.conn.ReadLine()
 		if err != nil {
 			break
 		}
@@ -127,130 +243,314 @@ func (s *session) serve() {
 		switch cmd {
 		case "EHLO", "HELO":
 			s.remoteName = args
-			c.PrintfLine("250-%s Hello %s", s.srv.Hostname, s.remoteName)
-			if s.srv.Auth != nil && cmd == "EHLO" {
-				c.PrintfLine("250-AUTH PLAIN")
-				if s.srv.TLS != nil {
-					c.PrintfLine("250-STARTTLS")
-				}
+			s.reset()
+			if cmd == "HELO" {
+				s.reply("250 %s Hello %s", s.srv.Hostname, s.remoteName)
+				break
 			}
-			c.PrintfLine("250 HELP")
-			from = ""
-			to = nil
-			body.Reset()
-		case "MAIL":
-			match := mailFromRE.Copy().FindStringSubmatch(args)
-			if match == nil {
-				// no match
-				c.PrintfLine("501 syntax error in parameters (invalid FROM)")
+			s.reply("250-%s Hello %s", s.srv.Hostname, s.remoteName)
+			s.reply("250-PIPELINING")
+			if s.srv.MaxSize > 0 {
+				s.reply("250-SIZE %d", s.srv.MaxSize)
 			} else {
-				if s.srv.Auth != nil && !s.srv.Auth.PermitSend(match[1], s.user) {
-					c.PrintfLine("450 4.7.1 not authorized to send")
-				} else {
-					from = match[1]
-					c.PrintfLine("250 Ok")
+				s.reply("250-SIZE")
+			}
+			s.reply("250-8BITMIME")
+			s.reply("250-SMTPUTF8")
+			s.reply("250-ENHANCEDSTATUSCODES")
+			s.reply("250-DSN")
+			if s.srv.Auth != nil {
+				s.reply("250-AUTH %s", strings.Join(s.srv.AuthPolicy.Mechanisms(s.secure()), " "))
+				if s.srv.TLS != nil && !s.tls {
+					s.reply("250-STARTTLS")
 				}
 			}
-			to = nil
-			body.Reset()
-
+			s.reply("250 HELP")
+		case "MAIL":
+			s.reset()
+			s.mail(args)
 		case "RSET":
-			c.PrintfLine("250 Ok")
-			from = ""
-			to = nil
-			body.Reset()
+			s.reset()
+			s.reply("250 2.0.0 Ok")
 		case "RCPT":
-			if from == "" {
-				c.PrintfLine("503 bad sequence of commands")
-			} else {
-				match := rcptToRE.Copy().FindStringSubmatch(args)
-				if match == nil {
-					// no match
-					c.PrintfLine("501 syntax error in parameters (invalid TO)")
-				} else {
-					if len(to) == 100 {
-						// too many recipiants
-						c.PrintfLine("452 too many recipients")
-					} else {
-						to = append(to, match[1])
-						c.PrintfLine("250 Ok")
-					}
-				}
-			}
+			s.rcpt(args)
 		case "DATA":
-			if from == "" || to == nil {
-				c.PrintfLine("503 bad sequence of commands, (MAIL & RCPT Required befored DATA)")
+			s.data()
+		case "STARTTLS":
+			if s.tls {
+				s.reply("503 5.5.1 TLS already active")
 				break
 			}
-			// read mail body
-			c.PrintfLine("354 Start giving me the mail yo, end with <CR><LF>.<CR><LF>")
-			// put recvived header
-			err = mail.WriteRecvHeader(&body, to[0], s.remoteName, s.nc.RemoteAddr().String(), s.srv.Hostname, s.srv.Appname)
-			dr := c.DotReader()
-			// deliver to maildir
-			mr := io.MultiReader(&body, dr)
-			var msg mailstore.Message
-			msg, err = s.srv.Inbound.Deliver(mr)
-			if err == nil {
-				if s.srv.Handler == nil {
-					// no handler
-				} else {
-					go s.srv.Handler(s.nc.RemoteAddr(), from, to, msg.Filepath())
-				}
-			}
-			if err == nil {
-				c.PrintfLine("250 Ok: Delivered")
-			} else {
-				log.Error("smtp server error: %s", err.Error())
-				c.PrintfLine("500 Error delivering message: %s", err.Error())
-			}
-			from = ""
-			to = nil
-			body.Reset()
-		case "STARTTLS":
 			nc, e := s.startTLS()
 			if e == nil {
-				c = nc
+				s.conn = nc
+				s.tls = true
+				// forget what the client said before TLS
+				s.remoteName = ""
+				s.reset()
 			} else {
-				c.Close()
+				s.conn.Close()
 				return
 			}
 		case "AUTH":
 			if s.srv.Auth == nil {
 				// XXX: should we always succeed?
-				c.PrintfLine("235 2.7.0 Authentication Succeeded")
-			} else {
-				parts := strings.Split(args, " ")
-				if len(parts) > 1 {
-					if parts[0] == "PLAIN" {
-						s.doPlainAuth(c, parts[1])
-					} else {
-						s.failLogin()
-					}
-				} else {
-					c.PrintfLine("535 5.7.8 Authentication credentials invalid")
-				}
+				s.reply("235 2.7.0 Authentication Succeeded")
+			} else if err = s.auth(args); err != nil {
+				return
 			}
 		case "QUIT":
-			c.PrintfLine("221 %s %s SMTP Closing transmssion channel", s.srv.Hostname, s.srv.Appname)
+			s.reply("221 2.0.0 %s %s SMTP Closing transmssion channel", s.srv.Hostname, s.srv.Appname)
 			return
 		case "NOOP":
-			c.PrintfLine("250 Ok")
-			break
+			s.reply("250 2.0.0 Ok")
 		case "HELP", "VRFY", "EXPN":
-			c.PrintfLine("502 command not implemented")
+			s.reply("502 5.5.1 command not implemented")
+		default:
+			s.reply("500 5.5.2 Syntax error, command unrecodnized")
+		}
+	}
+}
+
+// handle MAIL command
+func (s *session) mail(args string) {
+	match := mailFromRE.FindStringSubmatch(args)
+	if match == nil {
+		// no match
+		s.reply("501 5.5.4 syntax error in parameters (invalid FROM)")
+		return
+	}
+	params, err := parseParams(match[2])
+	if err != nil {
+		s.reply("501 5.5.4 %s", err.Error())
+		return
+	}
+	var size int64
+	for k, v := range params {
+		switch k {
+		case "SIZE":
+			size, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				s.reply("501 5.5.4 invalid SIZE")
+				return
+			}
+			if s.srv.MaxSize > 0 && size > s.srv.MaxSize {
+				s.reply("552 5.3.4 message size exceeds fixed maximium message size")
+				return
+			}
+		case "BODY":
+			v = strings.ToUpper(v)
+			if v != "7BIT" && v != "8BITMIME" {
+				s.reply("501 5.5.4 invalid BODY")
+				return
+			}
+		case "SMTPUTF8":
+			if v != "" {
+				s.reply("501 5.5.4 SMTPUTF8 takes no value")
+				return
+			}
+		case "RET":
+			v = strings.ToUpper(v)
+			if v != mail.RetFull && v != mail.RetHeaders {
+				s.reply("501 5.5.4 invalid RET")
+				return
+			}
+			s.dsnParams().Ret = v
+		case "ENVID":
+			v, err = decodeXtext(v)
+			if err != nil || v == "" || len(v) > 100 {
+				s.reply("501 5.5.4 invalid ENVID")
+				return
+			}
+			s.dsnParams().EnvID = v
+		default:
+			s.reply("555 5.5.4 unsupported parameter %s", k)
+			return
+		}
+	}
+	_, utf8 := params["SMTPUTF8"]
+	if !utf8 && !isASCII(match[1]) {
+		s.reply("553 5.6.7 non ascii address requires SMTPUTF8")
+		return
+	}
+	if s.submission && s.user == "" {
+		s.reply("530 5.7.0 Authentication required")
+		return
+	}
+	if s.user == "" && !s.srv.limiter().allowMail(s.host) {
+		s.reply("450 4.7.1 too many messages from you, try again later")
+		return
+	}
+	if s.srv.Auth != nil && !s.srv.Auth.PermitSend(match[1], s.user) {
+		s.reply("450 4.7.1 not authorized to send")
+		return
+	}
+	s.from = match[1]
+	s.mailing = true
+	s.size = size
+	s.utf8 = utf8
+	s.reply("250 2.1.0 Ok")
+}
+
+// handle RCPT command
+func (s *session) rcpt(args string) {
+	if !s.mailing {
+		s.reply("503 5.5.1 bad sequence of commands")
+		return
+	}
+	match := rcptToRE.FindStringSubmatch(args)
+	if match == nil {
+		// no match
+		s.reply("501 5.5.4 syntax error in parameters (invalid TO)")
+		return
+	}
+	params, err := parseParams(match[2])
+	if err != nil {
+		s.reply("501 5.5.4 %s", err.Error())
+		return
+	}
+	var notify, orcpt string
+	for k, v := range params {
+		switch k {
+		case "NOTIFY":
+			notify, err = parseNotify(v)
+			if err != nil {
+				s.reply("501 5.5.4 %s", err.Error())
+				return
+			}
+		case "ORCPT":
+			orcpt, err = parseORcpt(v)
+			if err != nil {
+				s.reply("501 5.5.4 %s", err.Error())
+				return
+			}
 		default:
-			c.PrintfLine("500 Syntax error, command unrecodnized")
+			s.reply("555 5.5.4 unsupported parameter %s", k)
+			return
+		}
+	}
+	if !s.utf8 && !isASCII(match[1]) {
+		s.reply("553 5.6.7 non ascii address requires SMTPUTF8")
+	} else if len(s.to) >= s.srv.limiter().maxRecipients() {
+		// too many recipiants
+		s.reply("452 4.5.3 too many recipients")
+	} else if s.srv.Recipient != nil && !s.srv.Recipient(match[1]) {
+		s.reply("550 5.7.1 relaying denied")
+	} else if !s.passGreylist(match[1]) {
+		s.reply("451 4.7.1 greylisted, try again later")
+	} else if err = s.checkQuota(match[1]); err != nil {
+		if errors.Is(err, mailstore.ErrOverQuota) {
+			s.reply("552 5.2.2 message exceeds recipient's storage quota")
+		} else if errors.Is(err, mailstore.ErrMailboxFull) {
+			s.reply("452 4.2.2 recipient's mailbox is full")
+		} else {
+			s.reply("451 4.3.0 cannot check recipient's quota")
+		}
+	} else {
+		s.to = append(s.to, match[1])
+		if notify != "" {
+			s.dsnParams().Notify[match[1]] = notify
+		}
+		if orcpt != "" {
+			s.dsnParams().ORcpt[match[1]] = orcpt
 		}
+		s.reply("250 2.1.5 Ok")
+	}
+}
+
+// get the delivery status notification parameters of the current mail transaction, creating them if needed
+func (s *session) dsnParams() *mailstore.DSN {
+	if s.dsn == nil {
+		s.dsn = &mailstore.DSN{
+			Notify: make(map[string]string),
+			ORcpt:  make(map[string]string),
+		}
+	}
+	return s.dsn
+}
+
+// check if the greylist lets mail for a recipiant through in the current mail transaction
+func (s *session) passGreylist(recip string) bool {
+	if s.srv.Greylist == nil || s.user != "" {
+		return true
+	}
+	pass, err := s.srv.Greylist(s.host, s.from, recip)
+	if err != nil {
+		log.Errorf("smtp: greylist check failed, accepting mail: %s", err.Error())
+		return true
+	}
+	return pass
+}
+
+// check the quota of a recipiant for the current mail transaction
+func (s *session) checkQuota(recip string) error {
+	if s.srv.Quota == nil {
+		return nil
+	}
+	return s.srv.Quota(recip, s.size)
+}
+
+// handle DATA command
+func (s *session) data() {
+	if !s.mailing {
+		s.reply("503 5.5.1 bad sequence of commands, (MAIL & RCPT Required befored DATA)")
+		return
+	}
+	if s.to == nil {
+		s.reply("554 5.5.1 no valid recipients")
+		return
+	}
+	from, to, dsn := s.from, s.to, s.dsn
+	s.reset()
+	// read mail body
+	s.reply("354 Start giving me the mail yo, end with <CR><LF>.<CR><LF>")
+	s.conn.W.Flush()
+	// put recvived header
+	var body bytes.Buffer
+	err := mail.WriteRecvHeader(&body, to[0], s.remoteName, s.nc.RemoteAddr().String(), s.srv.Hostname, s.srv.Appname)
+	dr := s.conn.DotReader()
+	var r io.Reader = dr
+	var lr *limitReader
+	if s.srv.MaxSize > 0 {
+		lr = &limitReader{r: dr, n: s.srv.MaxSize}
+		r = lr
+	}
+	// deliver to maildir
+	mr := io.MultiReader(&body, r)
+	var msg mailstore.Message
+	if err == nil {
+		if s.srv.Outbound == nil {
+			msg, err = s.srv.Inbound.Deliver(mr)
+		} else {
+			msg, err = s.srv.Outbound.EnqueueDSN(from, to, dsn, mr)
+		}
+	}
+	// read rest of message if we stopped early
+	io.Copy(ioutil.Discard, dr)
+	if err == nil {
+		if s.user == "" {
+			s.srv.limiter().sentMail(s.host)
+		}
+		if s.srv.Handler == nil {
+			// no handler
+		} else {
+			go s.srv.Handler(s.nc.RemoteAddr(), from, to, dsn, msg.Filepath())
+		}
+		s.reply("250 2.0.0 Ok: Delivered")
+	} else if lr != nil && lr.exceeded {
+		s.reply("552 5.3.4 message size exceeds fixed maximium message size")
+	} else {
+		log.Errorf("smtp server error: %s", err.Error())
+		s.reply("451 4.3.0 Error delivering message: %s", err.Error())
 	}
 }
 
 func (s *session) startTLS() (conn *textproto.Conn, err error) {
 	if s.srv.TLS == nil {
-		s.conn.PrintfLine("500 No STARTTLS")
+		s.conn.PrintfLine("454 4.7.0 No STARTTLS")
 		err = starttls.ErrTlsNotSupported
 	} else {
-		s.conn.PrintfLine("220 Ready to start TLS")
+		s.conn.PrintfLine("220 2.0.0 Ready to start TLS")
 		conn, _, err = starttls.HandleStartTLS(s.nc, s.srv.TLS)
 		if err != nil {
 			log.Errorf("starttls error: %s", err.Error())
@@ -259,29 +559,61 @@ func (s *session) startTLS() (conn *textproto.Conn, err error) {
 	return
 }
 
-func (s *session) doPlainAuth(c *textproto.Conn, str string) {
-	decoded, e := base64.StdEncoding.DecodeString(str)
-	if e == nil {
-		p := bytes.Split(decoded, []byte{0})
-		if len(p) == 3 {
-			user := string(p[1])
-			passwd := string(p[2])
-			if s.srv.Auth.Plain(user, passwd) {
-				s.user = user
-				c.PrintfLine("235 2.7.0 Authentication Succeeded")
-			} else {
-				s.failLogin()
-			}
-		} else {
-			s.failLogin()
-		}
-	} else {
-		s.failLogin()
-	}
+// return true if passwords can be sent in the clear in this session
+func (s *session) secure() bool {
+	return s.tls || sasl.Secure(s.nc)
 }
 
-func (s *session) failLogin() error {
-	s.conn.PrintfLine("454 4.7.0 Temporary authentication failure")
-	s.conn.Close()
-	return nil
+// handle AUTH command
+// returns an error if the connection broke
+func (s *session) auth(args string) (err error) {
+	parts := strings.Fields(args)
+	if s.user != "" {
+		s.reply("503 5.5.1 already authenticated")
+		return
+	}
+	if s.mailing {
+		s.reply("503 5.5.1 AUTH not allowed during a mail transaction")
+		return
+	}
+	if len(parts) == 0 || len(parts) > 2 {
+		s.reply("501 5.5.4 syntax error in parameters")
+		return
+	}
+	mech := strings.ToUpper(parts[0])
+	srv, e := sasl.NewServer(mech, s.srv.Auth)
+	if e != nil {
+		s.reply("504 5.5.4 unrecognized authentication type")
+		return
+	}
+	if !s.srv.AuthPolicy.Allows(mech, s.secure()) {
+		s.reply("538 5.7.11 encryption required for requested authentication mechanism")
+		return
+	}
+	initial := ""
+	if len(parts) == 2 {
+		initial = parts[1]
+	}
+	var user string
+	user, err = sasl.Exchange(srv, initial, func(chal string) error {
+		s.reply("334 %s", chal)
+		return s.conn.W.Flush()
+	}, s.conn.ReadLine)
+	switch {
+	case err == nil:
+		s.user = user
+		s.reply("235 2.7.0 Authentication successful")
+	case errors.Is(err, sasl.ErrCanceled):
+		s.reply("501 5.0.0 authentication canceled")
+	case errors.Is(err, sasl.ErrMalformed):
+		s.reply("501 5.5.2 cannot decode response")
+	case errors.Is(err, sasl.ErrAuthFailed):
+		log.Warnf("smtp: failed %s login from %s", mech, s.host)
+		s.reply("535 5.7.8 authentication credentials invalid")
+	default:
+		// connection broke
+		return
+	}
+	err = nil
+	return
 }
@@ -0,0 +1,464 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/sasl"
+	"github.com/majestrate/bdsmail/lib/starttls"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// start a server delivering into a temporary maildir
+func testServer(t *testing.T, maxsize int64) (*Server, maildir.MailDir, string) {
+	md := maildir.MailDir(filepath.Join(t.TempDir(), "inbound"))
+	if err := md.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Appname:  "test",
+		Hostname: "localhost",
+		Inbound:  md,
+		MaxSize:  maxsize,
+		Recipient: func(recip string) bool {
+			return !strings.HasPrefix(recip, "bad@")
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return srv, md, l.Addr().String()
+}
+
+// dial a server and read its greeting
+func testDial(t *testing.T, addr string) *textproto.Conn {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(nc)
+	t.Cleanup(func() {
+		c.Close()
+	})
+	if _, _, err = c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// check the next reply
+func expectReply(t *testing.T, c *textproto.Conn, code int, prefix string) {
+	t.Helper()
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("expected %d %s, got %v", code, prefix, err)
+	}
+	if !strings.HasPrefix(msg, prefix) {
+		t.Errorf("expected reply starting with %q, got %q", prefix, msg)
+	}
+}
+
+func countNew(t *testing.T, md maildir.MailDir) int {
+	msgs, err := md.ListNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(msgs)
+}
+
+func TestPipelining(t *testing.T) {
+	_, md, addr := testServer(t, 1024)
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO tester")
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{"PIPELINING", "SIZE 1024", "8BITMIME", "SMTPUTF8", "ENHANCEDSTATUSCODES"} {
+		if !strings.Contains(msg, "\n"+ext+"\n") {
+			t.Errorf("%s not advertised in %q", ext, msg)
+		}
+	}
+	// whole transaction in 1 write
+	_, err = c.W.WriteString("MAIL FROM:<alice@example.i2p> SIZE=20 BODY=8BITMIME\r\n" +
+		"RCPT TO:<bob@example.i2p>\r\n" +
+		"RCPT TO:<bad@example.i2p>\r\n" +
+		"DATA\r\n")
+	if err == nil {
+		err = c.W.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c, 250, "2.1.0")
+	expectReply(t, c, 250, "2.1.5")
+	_, _, err = c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 || !strings.HasPrefix(e.Msg, "5.7.1") {
+		t.Errorf("expected rejected recipiant, got %v", err)
+	}
+	expectReply(t, c, 354, "")
+	w := c.DotWriter()
+	w.Write([]byte("Subject: hi\r\n\r\nhello\r\n"))
+	w.Close()
+	expectReply(t, c, 250, "2.0.0")
+	if n := countNew(t, md); n != 1 {
+		t.Errorf("expected 1 message, got %d", n)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	_, md, addr := testServer(t, 100)
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO tester")
+	c.ReadResponse(250)
+	// declared size too big
+	c.PrintfLine("MAIL FROM:<alice@example.i2p> SIZE=1000")
+	_, _, err := c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 {
+		t.Errorf("expected 552 for declared size, got %v", err)
+	}
+	c.PrintfLine("MAIL FROM:<alice@example.i2p> FOO=BAR")
+	_, _, err = c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 555 {
+		t.Errorf("expected 555 for unknown parameter, got %v", err)
+	}
+	// undeclared size too big
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<bob@example.i2p>")
+	expectReply(t, c, 250, "2.1.5")
+	c.PrintfLine("DATA")
+	expectReply(t, c, 354, "")
+	w := c.DotWriter()
+	w.Write([]byte("Subject: big\r\n\r\n" + strings.Repeat("x", 500) + "\r\n"))
+	w.Close()
+	_, _, err = c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 || !strings.HasPrefix(e.Msg, "5.3.4") {
+		t.Errorf("expected 552 for message size, got %v", err)
+	}
+	// still in sync
+	c.PrintfLine("NOOP")
+	expectReply(t, c, 250, "2.0.0")
+	if n := countNew(t, md); n != 0 {
+		t.Errorf("oversized message was delivered")
+	}
+	tmp, _ := ioutil.ReadDir(filepath.Join(md.Filepath(), "tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("partial message left in tmp")
+	}
+}
+
+func TestRcptQuota(t *testing.T) {
+	srv, _, addr := testServer(t, 0)
+	srv.Quota = func(recip string, size int64) error {
+		switch {
+		case strings.HasPrefix(recip, "full@"):
+			return mailstore.ErrMailboxFull
+		case size > 100:
+			return mailstore.ErrOverQuota
+		}
+		return nil
+	}
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO tester")
+	c.ReadResponse(250)
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<full@example.i2p>")
+	_, _, err := c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 452 || !strings.HasPrefix(e.Msg, "4.2.2") {
+		t.Errorf("expected 452 for full mailbox, got %v", err)
+	}
+	c.PrintfLine("RCPT TO:<bob@example.i2p>")
+	expectReply(t, c, 250, "2.1.5")
+	c.PrintfLine("RSET")
+	expectReply(t, c, 250, "")
+	// declared size is checked against the quota
+	c.PrintfLine("MAIL FROM:<alice@example.i2p> SIZE=1000")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<bob@example.i2p>")
+	_, _, err = c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 || !strings.HasPrefix(e.Msg, "5.2.2") {
+		t.Errorf("expected 552 for message over quota, got %v", err)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	srv, _, addr := testServer(t, 0)
+	seen := make(map[string]bool)
+	srv.Greylist = func(host, from, recip string) (bool, error) {
+		triple := host + " " + from + " " + recip
+		pass := seen[triple]
+		seen[triple] = true
+		return pass, nil
+	}
+	c := testDial(t, addr)
+	c.PrintfLine("HELO tester")
+	c.ReadResponse(250)
+	c.PrintfLine("MAIL FROM:<alice@example.i2p>")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<bob@example.i2p>")
+	_, _, err := c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 451 || !strings.HasPrefix(e.Msg, "4.7.1") {
+		t.Errorf("expected 451 for unseen triple, got %v", err)
+	}
+	c.PrintfLine("RCPT TO:<bob@example.i2p>")
+	expectReply(t, c, 250, "2.1.5")
+	if !seen["127.0.0.1 alice@example.i2p bob@example.i2p"] {
+		t.Errorf("greylist not keyed on the remote host: %v", seen)
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	srv, _, addr := testServer(t, 0)
+	got := make(chan *mailstore.DSN, 1)
+	srv.Handler = func(remote net.Addr, from string, to []string, dsn *mailstore.DSN, fpath string) {
+		if from != "" {
+			t.Errorf("expected the null sender, got %q", from)
+		}
+		got <- dsn
+	}
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO tester")
+	_, msg, _ := c.ReadResponse(250)
+	if !strings.Contains(msg, "\nDSN\n") {
+		t.Errorf("DSN not advertised: %q", msg)
+	}
+	c.PrintfLine("MAIL FROM:<> RET=BAD")
+	expectReply(t, c, 501, "5.5.4")
+	c.PrintfLine("MAIL FROM:<> RET=hdrs ENVID=QQ+2B1")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<bob@example.i2p> NOTIFY=NEVER,SUCCESS")
+	expectReply(t, c, 501, "5.5.4")
+	c.PrintfLine("RCPT TO:<bob@example.i2p> NOTIFY=success,FAILURE ORCPT=rfc822;bob+2Bx@example.i2p")
+	expectReply(t, c, 250, "2.1.5")
+	c.PrintfLine("RCPT TO:<carol@example.i2p>")
+	expectReply(t, c, 250, "2.1.5")
+	c.PrintfLine("DATA")
+	expectReply(t, c, 354, "")
+	c.PrintfLine("Subject: test\r\n\r\nhi\r\n.")
+	expectReply(t, c, 250, "2.0.0")
+	dsn := <-got
+	if dsn == nil || dsn.Ret != "HDRS" || dsn.EnvID != "QQ+1" {
+		t.Fatalf("bad envelope parameters %+v", dsn)
+	}
+	if dsn.Notify["bob@example.i2p"] != "SUCCESS,FAILURE" || dsn.ORcpt["bob@example.i2p"] != "rfc822;bob+x@example.i2p" {
+		t.Errorf("bad recipiant parameters %+v", dsn)
+	}
+	if _, ok := dsn.Notify["carol@example.i2p"]; ok {
+		t.Errorf("NOTIFY recorded for carol who gave none")
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	for in, out := range map[string]string{"abc": "abc", "a+2Bb+3Dc": "a+b=c", "a+20b": "a b"} {
+		if got, err := decodeXtext(in); err != nil || got != out {
+			t.Errorf("decodeXtext(%q) = %q, %v want %q", in, got, err, out)
+		}
+	}
+	for _, in := range []string{"a+2", "a+2b", "a=b", "a+0A"} {
+		if _, err := decodeXtext(in); err == nil {
+			t.Errorf("decodeXtext(%q) did not fail", in)
+		}
+	}
+}
+
+// non ascii addresses need SMTPUTF8
+func TestSMTPUTF8(t *testing.T) {
+	_, _, addr := testServer(t, 0)
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO tester")
+	c.ReadResponse(250)
+	c.PrintfLine("MAIL FROM:<ålice@example.i2p>")
+	_, _, err := c.ReadResponse(250)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 553 {
+		t.Errorf("expected 553, got %v", err)
+	}
+	c.PrintfLine("MAIL FROM:<ålice@example.i2p> SMTPUTF8")
+	expectReply(t, c, 250, "2.1.0")
+	c.PrintfLine("RCPT TO:<bøb@example.i2p>")
+	expectReply(t, c, 250, "2.1.5")
+}
+
+func testClient(t *testing.T, addr string) *Client {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := NewClient(nc, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cl.Close()
+	})
+	if err = cl.Hello("tester"); err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+func TestClientSendMail(t *testing.T) {
+	_, md, addr := testServer(t, 1024)
+	cl := testClient(t, addr)
+	if cl.MaxSize() != 1024 {
+		t.Errorf("bad max size %d", cl.MaxSize())
+	}
+	body := "Subject: hi\r\n\r\nhello\r\n"
+	err := cl.SendMail("alice@example.i2p", []string{"bob@example.i2p", "bad@example.i2p"}, int64(len(body)), strings.NewReader(body))
+	var te *textproto.Error
+	if !errors.As(err, &te) || te.Code != 550 {
+		t.Errorf("expected rejected recipiant, got %v", err)
+	}
+	if n := countNew(t, md); n != 1 {
+		t.Errorf("expected message for accepted recipiant, got %d", n)
+	}
+	// all recipiants rejected
+	err = cl.SendMail("alice@example.i2p", []string{"bad@example.i2p"}, int64(len(body)), strings.NewReader(body))
+	if !errors.As(err, &te) || te.Code != 550 {
+		t.Errorf("expected rejected recipiant, got %v", err)
+	}
+	// too big for server
+	err = cl.SendMail("alice@example.i2p", []string{"bob@example.i2p"}, 2048, strings.NewReader(body))
+	if !errors.As(err, &te) || te.Code != 552 {
+		t.Errorf("expected size rejection, got %v", err)
+	}
+	// connection still usable
+	if err = cl.SendMail("ålice@example.i2p", []string{"bob@example.i2p"}, -1, strings.NewReader(body)); err != nil {
+		t.Errorf("send failed: %v", err)
+	}
+	if n := countNew(t, md); n != 2 {
+		t.Errorf("expected 2 messages, got %d", n)
+	}
+	// message read errors don't end the message
+	f, _ := os.Open(filepath.Join(t.TempDir()))
+	f.Close()
+	err = cl.SendMail("alice@example.i2p", []string{"bob@example.i2p"}, -1, bufio.NewReader(f))
+	if err == nil {
+		t.Errorf("send of unreadable message worked")
+	}
+	if n := countNew(t, md); n != 2 {
+		t.Errorf("partial message was delivered")
+	}
+}
+
+// accepts 1 user with password "hunter2"
+type testAuth struct{}
+
+func (testAuth) Plain(user, passwd string) bool {
+	return user == "alice" && passwd == "hunter2"
+}
+
+func (testAuth) Scram(user string) *sasl.ScramCred {
+	return nil
+}
+
+func (testAuth) PermitSend(from, user string) bool {
+	return from == user+"@localhost"
+}
+
+func TestAuth(t *testing.T) {
+	srv, _, addr := testServer(t, 1024)
+	srv.Auth = testAuth{}
+	b64 := base64.StdEncoding.EncodeToString
+
+	c := testDial(t, addr)
+	c.PrintfLine("EHLO client")
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "AUTH PLAIN LOGIN SCRAM-SHA-256") {
+		t.Errorf("mechanisms not advertised over loopback: %q", msg)
+	}
+	c.PrintfLine("AUTH CRAM-MD5")
+	expectReply(t, c, 504, "5.5.4")
+	// PLAIN with the credentials sent after an empty challenge
+	c.PrintfLine("AUTH PLAIN")
+	expectReply(t, c, 334, "")
+	c.PrintfLine(b64([]byte("\x00alice\x00wrong")))
+	expectReply(t, c, 535, "5.7.8")
+	c.PrintfLine("AUTH PLAIN")
+	expectReply(t, c, 334, "")
+	c.PrintfLine("*")
+	expectReply(t, c, 501, "")
+	c.PrintfLine("AUTH PLAIN")
+	expectReply(t, c, 334, "")
+	c.PrintfLine(b64([]byte("\x00alice\x00hunter2")))
+	expectReply(t, c, 235, "2.7.0")
+	c.PrintfLine("AUTH PLAIN")
+	expectReply(t, c, 503, "")
+
+	c = testDial(t, addr)
+	c.PrintfLine("EHLO client")
+	c.ReadResponse(250)
+	c.PrintfLine("AUTH LOGIN %s", b64([]byte("alice")))
+	expectReply(t, c, 334, b64([]byte("Password:")))
+	c.PrintfLine(b64([]byte("hunter2")))
+	expectReply(t, c, 235, "2.7.0")
+}
+
+func TestSubmission(t *testing.T) {
+	srv, _, _ := testServer(t, 1024)
+	srv.Auth = testAuth{}
+	dir := t.TempDir()
+	cert := &starttls.Cert{
+		Hosts:    []string{"localhost"},
+		Org:      "test",
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		KeyType:  starttls.KeyECDSA,
+	}
+	if err := cert.Load(); err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = cert.Config()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeSubmission(starttls.NewListener(l, func() *tls.Config {
+		return srv.TLS
+	}))
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	nc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(nc)
+	defer c.Close()
+	expectReply(t, c, 220, "localhost")
+	c.PrintfLine("EHLO client")
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg, "STARTTLS") {
+		t.Errorf("STARTTLS offered over implicit tls: %q", msg)
+	}
+	c.PrintfLine("STARTTLS")
+	expectReply(t, c, 503, "5.5.1")
+	c.PrintfLine("MAIL FROM:<alice@localhost>")
+	expectReply(t, c, 530, "5.7.0")
+	c.PrintfLine("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00alice\x00hunter2")))
+	expectReply(t, c, 235, "2.7.0")
+	c.PrintfLine("MAIL FROM:<alice@localhost>")
+	expectReply(t, c, 250, "2.1.0")
+}
@@ -0,0 +1,76 @@
+package starttls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// local certificate authority that issues the certificates of our listeners
+// clients trust its certificate once instead of pinning each listener's
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// load a local ca from pem files, generating it if they don't exist
+func LoadCA(certfile, keyfile, org, keytype string) (ca *CA, err error) {
+	if missing(certfile) || missing(keyfile) {
+		var key crypto.Signer
+		key, err = GenerateKey(keytype)
+		if err != nil {
+			return
+		}
+		var tmpl *x509.Certificate
+		tmpl, err = newTemplate(org+" local CA", org, caLifetime)
+		if err != nil {
+			return
+		}
+		tmpl.IsCA = true
+		tmpl.MaxPathLenZero = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		var der []byte
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		if err == nil {
+			err = writeKeyPair(certfile, keyfile, der, key)
+		}
+		if err != nil {
+			return
+		}
+		log.Infof("generated %s local ca %s", keytype, certfile)
+	}
+	cert, err := loadKeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", certfile, err.Error())
+	}
+	if !cert.Leaf.IsCA {
+		return nil, errors.New(certfile + " is not a ca certificate")
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(keyfile + " can't sign certificates")
+	}
+	ca = &CA{
+		Cert: cert.Leaf,
+		Key:  key,
+	}
+	return
+}
+
+// sign a certificate for a public key, returns the der encoded certificate
+func (ca *CA) issue(tmpl *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	// a certificate can't outlive its issuer
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Key)
+}
+
+// return true if a certificate was issued by this ca
+func (ca *CA) Issued(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, ca.Cert.RawSubject) && cert.CheckSignatureFrom(ca.Cert) == nil
+}
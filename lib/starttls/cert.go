@@ -0,0 +1,260 @@
+package starttls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// key types of generated certificates
+const (
+	KeyECDSA   = "ecdsa"
+	KeyEd25519 = "ed25519"
+	KeyRSA     = "rsa"
+)
+
+// bits of generated rsa keys
+const rsaBits = 3072
+
+// how long generated certificates are valid for
+const (
+	selfSignedLifetime = 10 * 365 * 24 * time.Hour
+	issuedLifetime     = 365 * 24 * time.Hour
+	caLifetime         = 20 * 365 * 24 * time.Hour
+)
+
+// certificates issued by a local ca are renewed when they expire sooner than this
+const renewBefore = 30 * 24 * time.Hour
+
+// how often certificate files are checked for changes
+var CheckInterval = 10 * time.Second
+
+var ErrBadKeyType = errors.New("tls key type must be ecdsa, ed25519 or rsa")
+
+// generate a private key of a key type
+func GenerateKey(keytype string) (key crypto.Signer, err error) {
+	switch keytype {
+	case KeyECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case KeyRSA:
+		key, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	default:
+		err = ErrBadKeyType
+	}
+	return
+}
+
+// make a certificate template with a random serial number
+func newTemplate(cn, org string, lifetime time.Duration) (tmpl *x509.Certificate, err error) {
+	var serial *big.Int
+	serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err == nil {
+		now := time.Now()
+		tmpl = &x509.Certificate{
+			SerialNumber: serial,
+			Subject: pkix.Name{
+				CommonName:   cn,
+				Organization: []string{org},
+			},
+			// allow for clocks that are a bit behind
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(lifetime),
+			BasicConstraintsValid: true,
+		}
+	}
+	return
+}
+
+// write a certificate and its private key to pem files, the key is only readable by us
+func writeKeyPair(certfile, keyfile string, der []byte, key crypto.Signer) (err error) {
+	var kb []byte
+	kb, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600)
+	if err == nil {
+		err = os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	}
+	return
+}
+
+// load a certificate and key pair and parse its leaf certificate
+func loadKeyPair(certfile, keyfile string) (cert tls.Certificate, err error) {
+	cert, err = tls.LoadX509KeyPair(certfile, keyfile)
+	if err == nil && cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return
+}
+
+// return true if a file does not exist
+func missing(fname string) bool {
+	_, err := os.Stat(fname)
+	return os.IsNotExist(err)
+}
+
+// modification time of a file, zero if it can't be read
+func modTime(fname string) (t time.Time) {
+	if info, err := os.Stat(fname); err == nil {
+		t = info.ModTime()
+	}
+	return
+}
+
+// a certificate and private key kept in pem files
+// the files are generated if they don't exist and reloaded when they change
+type Cert struct {
+	// names and ip addresses a generated certificate is for, the first is its common name
+	Hosts []string
+	// organization of a generated certificate
+	Org string
+	// pem files the certificate chain and private key are in
+	CertFile string
+	KeyFile  string
+	// key type of a generated certificate, one of the Key values
+	KeyType string
+	// issues generated certificates and renews them before they expire, nil to make self signed ones
+	CA *CA
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// generate a new certificate for a private key, a new key is made if it is nil
+func (c *Cert) generate(key crypto.Signer) (err error) {
+	if len(c.Hosts) == 0 {
+		return errors.New("no hostname to generate a tls certificate for")
+	}
+	if key == nil {
+		key, err = GenerateKey(c.KeyType)
+		if err != nil {
+			return
+		}
+	}
+	lifetime := selfSignedLifetime
+	if c.CA != nil {
+		lifetime = issuedLifetime
+	}
+	var tmpl *x509.Certificate
+	tmpl, err = newTemplate(c.Hosts[0], c.Org, lifetime)
+	if err != nil {
+		return
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range c.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	var der []byte
+	if c.CA == nil {
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	} else {
+		der, err = c.CA.issue(tmpl, key.Public())
+	}
+	if err == nil {
+		err = writeKeyPair(c.CertFile, c.KeyFile, der, key)
+	}
+	if err == nil {
+		log.Infof("generated %s tls certificate %s", c.KeyType, c.CertFile)
+	}
+	return
+}
+
+// return true if we should replace a certificate our ca issued because it expires soon
+func (c *Cert) needsRenewal(leaf *x509.Certificate) bool {
+	return c.CA != nil && c.CA.Issued(leaf) && time.Until(leaf.NotAfter) < renewBefore
+}
+
+// load the certificate, generating it if its files don't exist
+func (c *Cert) Load() (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.load()
+}
+
+func (c *Cert) load() (err error) {
+	if missing(c.CertFile) || missing(c.KeyFile) {
+		err = c.generate(nil)
+		if err != nil {
+			return
+		}
+	}
+	var cert tls.Certificate
+	cert, err = loadKeyPair(c.CertFile, c.KeyFile)
+	if err == nil && c.needsRenewal(cert.Leaf) {
+		log.Infof("renewing tls certificate %s that expires %s", c.CertFile, cert.Leaf.NotAfter)
+		// keep the key so clients that pinned it keep working
+		key, _ := cert.PrivateKey.(crypto.Signer)
+		err = c.generate(key)
+		if err == nil {
+			cert, err = loadKeyPair(c.CertFile, c.KeyFile)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.CertFile, err.Error())
+	}
+	c.cert = &cert
+	c.certMod = modTime(c.CertFile)
+	c.keyMod = modTime(c.KeyFile)
+	c.checked = time.Now()
+	return
+}
+
+// get the certificate, reloading it first if its files changed or it needs renewal
+// if reloading fails the certificate we have is kept
+func (c *Cert) Certificate() (cert *tls.Certificate, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.cert == nil {
+		err = c.load()
+	} else if time.Since(c.checked) >= CheckInterval {
+		c.checked = time.Now()
+		if !modTime(c.CertFile).Equal(c.certMod) || !modTime(c.KeyFile).Equal(c.keyMod) || c.needsRenewal(c.cert.Leaf) {
+			if e := c.load(); e == nil {
+				log.Infof("reloaded tls certificate %s", c.CertFile)
+			} else {
+				log.Errorf("failed to reload tls certificate: %s", e.Error())
+			}
+		}
+	}
+	cert = c.cert
+	return
+}
+
+// get a tls config serving this certificate
+func (c *Cert) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.Certificate()
+		},
+	}
+}
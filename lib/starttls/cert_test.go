@@ -0,0 +1,178 @@
+package starttls
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testCert(dir, name, keytype string, ca *CA) *Cert {
+	return &Cert{
+		Hosts:    []string{"mail.example.i2p", "127.0.0.1"},
+		Org:      "test",
+		CertFile: filepath.Join(dir, name+"-cert.pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+		KeyType:  keytype,
+		CA:       ca,
+	}
+}
+
+func TestCertKeyTypes(t *testing.T) {
+	dir := t.TempDir()
+	for _, keytype := range []string{KeyECDSA, KeyEd25519, KeyRSA} {
+		c := testCert(dir, keytype, keytype, nil)
+		if err := c.Load(); err != nil {
+			t.Fatalf("%s: %s", keytype, err)
+		}
+		cert, _ := c.Certificate()
+		leaf := cert.Leaf
+		if leaf.PublicKeyAlgorithm.String() != map[string]string{KeyECDSA: "ECDSA", KeyEd25519: "Ed25519", KeyRSA: "RSA"}[keytype] {
+			t.Errorf("%s: generated a %s key", keytype, leaf.PublicKeyAlgorithm)
+		}
+		if err := leaf.VerifyHostname("mail.example.i2p"); err != nil {
+			t.Errorf("%s: %s", keytype, err)
+		}
+		if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+			t.Errorf("%s: %s", keytype, err)
+		}
+		if info, err := os.Stat(c.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: private key is not private: %v %v", keytype, info.Mode(), err)
+		}
+	}
+	if _, err := GenerateKey("dsa"); err != ErrBadKeyType {
+		t.Errorf("expected ErrBadKeyType, got %v", err)
+	}
+}
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadCA(filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "ca-key.pem"), "test", KeyECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// loading it again uses the same ca
+	again, err := LoadCA(filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "ca-key.pem"), "test", KeyECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(again.Cert) != Fingerprint(ca.Cert) {
+		t.Fatal("ca regenerated when loaded again")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, name := range []string{"smtp", "pop3"} {
+		c := testCert(dir, name, KeyEd25519, ca)
+		if err = c.Load(); err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := c.Certificate()
+		if !ca.Issued(cert.Leaf) {
+			t.Errorf("%s: not issued by the local ca", name)
+		}
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "mail.example.i2p", Roots: roots})
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestCertRenewal(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadCA(filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "ca-key.pem"), "test", KeyECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testCert(dir, "renew", KeyECDSA, ca)
+	if err = c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := c.Certificate()
+	// replace it with one that expires soon
+	tmpl, err := newTemplate(c.Hosts[0], c.Org, renewBefore/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.DNSNames = []string{c.Hosts[0]}
+	der, err := ca.issue(tmpl, cert.Leaf.PublicKey)
+	if err == nil {
+		err = writeKeyPair(c.CertFile, c.KeyFile, der, cert.PrivateKey.(crypto.Signer))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := c.Certificate()
+	if time.Until(renewed.Leaf.NotAfter) < renewBefore {
+		t.Fatalf("certificate not renewed, expires %s", renewed.Leaf.NotAfter)
+	}
+	if PublicKeyPin(renewed.Leaf) != PublicKeyPin(cert.Leaf) {
+		t.Error("renewal changed the key")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	old := CheckInterval
+	CheckInterval = 0
+	defer func() {
+		CheckInterval = old
+	}()
+	dir := t.TempDir()
+	c := testCert(dir, "reload", KeyECDSA, nil)
+	cfg := c.Config()
+	first, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replace the files with another certificate
+	other := testCert(t.TempDir(), "other", KeyECDSA, nil)
+	if err = other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range [][2]string{{other.CertFile, c.CertFile}, {other.KeyFile, c.KeyFile}} {
+		data, _ := os.ReadFile(f[0])
+		if err = os.WriteFile(f[1], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(f[1], later, later)
+	}
+	second, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(second.Leaf) == Fingerprint(first.Leaf) {
+		t.Error("certificate not reloaded after its files changed")
+	}
+	// a broken file keeps the certificate we have
+	os.WriteFile(c.CertFile, []byte("garbage"), 0644)
+	later := time.Now().Add(2 * time.Minute)
+	os.Chtimes(c.CertFile, later, later)
+	third, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || third != second {
+		t.Errorf("lost certificate on bad reload: %v", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	c := testCert(t.TempDir(), "fp", KeyECDSA, nil)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ReadCertFile(c.CertFile)
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("read %d certs: %v", len(certs), err)
+	}
+	if !regexp.MustCompile(`^([0-9A-F]{2}:){31}[0-9A-F]{2}$`).MatchString(Fingerprint(certs[0])) {
+		t.Errorf("bad fingerprint %s", Fingerprint(certs[0]))
+	}
+	if len(PublicKeyPin(certs[0])) != 44 {
+		t.Errorf("bad public key pin %s", PublicKeyPin(certs[0]))
+	}
+}
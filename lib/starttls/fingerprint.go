@@ -0,0 +1,53 @@
+package starttls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// get the sha256 fingerprint of a certificate as colon separated hex
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for idx, b := range sum {
+		hex[idx] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// get the base64 sha256 hash of a certificate's public key
+// pinning this keeps working when the local ca renews the certificate, renewals keep the key
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// read all certificates in a pem file
+func ReadCertFile(fname string) (certs []*x509.Certificate, err error) {
+	var data []byte
+	data, err = os.ReadFile(fname)
+	for err == nil {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if err == nil && len(certs) == 0 {
+		err = errors.New("no certificates in " + fname)
+	}
+	return
+}
@@ -2,20 +2,403 @@ package admin
 
 import (
 	"github.com/majestrate/bdsmail/lib/db"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/model"
+	"github.com/majestrate/bdsmail/lib/web/session"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// a mail queue shown in the panel
+type Queue struct {
+	// name to show
+	Name string
+	// where the queued mail is
+	Store mailstore.Store
+}
+
 type Admin struct {
 	d db.DB
+	// the only user allowed to log in
+	user string
+	// directory new users' maildirs go in
+	mailroot string
+	// queues we can inspect
+	queues []Queue
+	// logged in admins
+	sessions *session.Store
+	// quota of users who don't have their own
+	Quota model.Quota
+	// ends the webmail sessions of a user, nil does nothing
+	Revoke func(user string)
+}
+
+// max size of a form
+const maxFormSize = 64 * 1024
+
+// users the server needs that can't be deleted, the admin can't be either
+var builtinUsers = []string{"postmaster", "abuse"}
+
+// 1 user in the user list
+type userEntry struct {
+	Name     string
+	Disabled bool
+	HasLogin bool
+	// has a login cred from an older version that can't be used
+	NeedsReset bool
+	Usage      usage
+	// the user's own quota settings, 0 for the default and -1 for unlimited
+	QuotaBytes    int64
+	QuotaMessages int64
+}
+
+// data given to templates
+type page struct {
+	Session *session.Session
+	Error   string
+	Notice  string
+	Users   []userEntry
+	Queue   string
+	Queues  []Queue
+	Entries []queueEntry
+}
+
+// valid names for new users
+var reUserName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+func (a *Admin) render(w http.ResponseWriter, name string, p *page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	err := templates.ExecuteTemplate(w, name, p)
+	if err != nil {
+		log.Errorf("admin: failed to render %s: %s", name, err.Error())
+	}
+}
+
+// show an error page
+func (a *Admin) fail(w http.ResponseWriter, s *session.Session, code int, msg string) {
+	w.WriteHeader(code)
+	a.render(w, "header", &page{
+		Session: s,
+		Error:   msg,
+	})
 }
 
 // handle admin request
 func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	// limit the body before anything parses the form
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if action == "login" {
+		a.serveLogin(w, r)
+		return
+	}
+	s, ok := a.sessions.Get(r)
+	if !ok {
+		a.render(w, "login", &page{})
+		return
+	}
+	if r.Method == http.MethodPost {
+		if !s.CheckCSRF(r.FormValue("csrf")) {
+			a.fail(w, s, http.StatusForbidden, "bad form token")
+			return
+		}
+	} else if action != "" && action != "queue" {
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+		return
+	}
+	switch action {
+	case "":
+		a.serveUsers(w, s, "")
+	case "logout":
+		a.sessions.Destroy(w, r)
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	case "create":
+		a.serveCreate(w, r, s)
+	case "disable":
+		a.serveSetDisabled(w, r, s, true)
+	case "enable":
+		a.serveSetDisabled(w, r, s, false)
+	case "delete":
+		a.serveDelete(w, r, s)
+	case "password":
+		a.servePassword(w, r, s)
+	case "quota":
+		a.serveQuota(w, r, s)
+	case "queue":
+		a.serveQueue(w, r, s)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Admin) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+		return
+	}
+	user := r.FormValue("user")
+	good := false
+	if user == a.user {
+		var err error
+		good, err = a.d.CheckUserLogin(user, r.FormValue("password"))
+		if err != nil {
+			log.Errorf("admin: login check failed: %s", err.Error())
+		}
+	}
+	if !good {
+		log.Warnf("admin: failed login for %q from %s", user, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		a.render(w, "login", &page{
+			Error: "bad login",
+		})
+		return
+	}
+	a.sessions.Create(w, user)
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// show the user list with a notice
+func (a *Admin) serveUsers(w http.ResponseWriter, s *session.Session, notice string) {
+	p := &page{
+		Session: s,
+		Notice:  notice,
+		Queues:  a.queues,
+	}
+	err := a.d.VisitAllUsers(func(u *model.User) error {
+		us, err := u.Usage()
+		if err != nil {
+			log.Warnf("admin: failed to get usage of %s: %s", u.Name, err.Error())
+		}
+		p.Users = append(p.Users, userEntry{
+			Name:          u.Name,
+			Disabled:      u.Disabled,
+			HasLogin:      u.Login != "",
+			NeedsReset:    u.NeedsPasswordReset(),
+			Usage:         usage{Usage: us, Quota: u.Quota(a.Quota)},
+			QuotaBytes:    u.QuotaBytes,
+			QuotaMessages: u.QuotaMessages,
+		})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("admin: failed to list users: %s", err.Error())
+		p.Error = "failed to list users"
+	}
+	sort.Slice(p.Users, func(i, j int) bool {
+		return p.Users[i].Name < p.Users[j].Name
+	})
+	a.render(w, "users", p)
+}
+
+// check if a user exists
+func (a *Admin) hasUser(name string) (has bool) {
+	a.d.VisitUser(name, func(u *model.User) error {
+		has = u != nil
+		return nil
+	})
+	return
+}
 
+func (a *Admin) serveCreate(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	passwd := r.FormValue("password")
+	if !reUserName.MatchString(name) {
+		a.fail(w, s, http.StatusBadRequest, "invalid user name")
+		return
+	}
+	if passwd == "" {
+		a.fail(w, s, http.StatusBadRequest, "password required")
+		return
+	}
+	if a.hasUser(name) {
+		a.fail(w, s, http.StatusConflict, "user already exists")
+		return
+	}
+	err := a.d.CreateUser(func(u *model.User) error {
+		u.Name = name
+		u.SetPassword(passwd)
+		u.MailDirPath = filepath.Join(a.mailroot, name)
+		return nil
+	}, func(u *model.User) error {
+		return u.Ensure()
+	})
+	if err != nil {
+		log.Errorf("admin: failed to create user %s: %s", name, err.Error())
+		a.fail(w, s, http.StatusInternalServerError, "failed to create user")
+		return
+	}
+	log.Infof("admin: created user %s", name)
+	a.serveUsers(w, s, "created user "+name)
+}
+
+func (a *Admin) serveSetDisabled(w http.ResponseWriter, r *http.Request, s *session.Session, disabled bool) {
+	name := r.FormValue("name")
+	if name == a.user {
+		a.fail(w, s, http.StatusBadRequest, "cannot disable the admin user")
+		return
+	}
+	err := a.d.UpdateUser(name, func(u *model.User) *model.User {
+		u.Disabled = disabled
+		return u
+	})
+	if err != nil {
+		log.Errorf("admin: failed to update user %s: %s", name, err.Error())
+		a.fail(w, s, http.StatusInternalServerError, "failed to update user")
+		return
+	}
+	if disabled {
+		a.revoke(name)
+		log.Infof("admin: disabled user %s", name)
+		a.serveUsers(w, s, "disabled user "+name)
+	} else {
+		log.Infof("admin: enabled user %s", name)
+		a.serveUsers(w, s, "enabled user "+name)
+	}
+}
+
+// return true if a user is built in and can't be deleted
+func (a *Admin) builtin(name string) bool {
+	if name == a.user {
+		return true
+	}
+	for _, b := range builtinUsers {
+		if name == b {
+			return true
+		}
+	}
+	return false
+}
+
+// end the webmail sessions of a user
+func (a *Admin) revoke(name string) {
+	if a.Revoke != nil {
+		a.Revoke(name)
+	}
+}
+
+func (a *Admin) serveDelete(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	name := r.FormValue("name")
+	if a.builtin(name) {
+		a.fail(w, s, http.StatusBadRequest, "cannot delete built in user "+name)
+		return
+	}
+	var mdpath string
+	a.d.VisitUser(name, func(u *model.User) error {
+		mdpath = u.MailDirPath
+		return nil
+	})
+	err := a.d.DeleteUser(name)
+	if err != nil {
+		log.Errorf("admin: failed to delete user %s: %s", name, err.Error())
+		a.fail(w, s, http.StatusInternalServerError, "failed to delete user")
+		return
+	}
+	a.revoke(name)
+	log.Infof("admin: deleted user %s", name)
+	if r.FormValue("purge") != "" && mdpath != "" {
+		err = os.RemoveAll(mdpath)
+		if err != nil {
+			log.Errorf("admin: failed to remove maildir of %s: %s", name, err.Error())
+			a.fail(w, s, http.StatusInternalServerError, "user deleted but maildir was not removed")
+			return
+		}
+		log.Infof("admin: removed maildir %s", mdpath)
+	}
+	a.serveUsers(w, s, "deleted user "+name)
+}
+
+func (a *Admin) servePassword(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	name := r.FormValue("name")
+	passwd := r.FormValue("password")
+	if passwd == "" {
+		a.fail(w, s, http.StatusBadRequest, "password required")
+		return
+	}
+	if !a.hasUser(name) {
+		a.fail(w, s, http.StatusNotFound, "no such user")
+		return
+	}
+	err := a.d.UpdateUser(name, func(u *model.User) *model.User {
+		u.SetPassword(passwd)
+		return u
+	})
+	if err != nil {
+		log.Errorf("admin: failed to reset password of %s: %s", name, err.Error())
+		a.fail(w, s, http.StatusInternalServerError, "failed to reset password")
+		return
+	}
+	a.revoke(name)
+	log.Infof("admin: reset password of %s", name)
+	a.serveUsers(w, s, "reset password of "+name)
+}
+
+func (a *Admin) serveQuota(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	name := r.FormValue("name")
+	qbytes, err := strconv.ParseInt(r.FormValue("bytes"), 10, 64)
+	var qmsgs int64
+	if err == nil {
+		qmsgs, err = strconv.ParseInt(r.FormValue("messages"), 10, 64)
+	}
+	if err != nil || qbytes < -1 || qmsgs < -1 {
+		a.fail(w, s, http.StatusBadRequest, "invalid quota")
+		return
+	}
+	if !a.hasUser(name) {
+		a.fail(w, s, http.StatusNotFound, "no such user")
+		return
+	}
+	err = a.d.UpdateUser(name, func(u *model.User) *model.User {
+		u.QuotaBytes = qbytes
+		u.QuotaMessages = qmsgs
+		return u
+	})
+	if err != nil {
+		log.Errorf("admin: failed to set quota of %s: %s", name, err.Error())
+		a.fail(w, s, http.StatusInternalServerError, "failed to set quota")
+		return
+	}
+	log.Infof("admin: set quota of %s to %d bytes %d messages", name, qbytes, qmsgs)
+	a.serveUsers(w, s, "set quota of "+name)
+}
+
+func (a *Admin) serveQueue(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	name := r.FormValue("name")
+	for _, q := range a.queues {
+		if q.Name == name {
+			entries, err := listQueue(q.Store)
+			p := &page{
+				Session: s,
+				Queue:   q.Name,
+				Queues:  a.queues,
+				Entries: entries,
+			}
+			if err != nil {
+				log.Errorf("admin: failed to list queue %s: %s", name, err.Error())
+				p.Error = "failed to list queue"
+			}
+			a.render(w, "queue", p)
+			return
+		}
+	}
+	http.NotFound(w, r)
 }
 
-func New(dao db.DB) *Admin {
+// create admin panel
+// only user may log in, new users get maildirs in mailroot
+func New(dao db.DB, user, mailroot string, queues ...Queue) *Admin {
 	return &Admin{
-		d: dao,
+		d:        dao,
+		user:     user,
+		mailroot: mailroot,
+		queues:   queues,
+		sessions: session.NewStore("bdsmail-admin", "/admin"),
 	}
 }
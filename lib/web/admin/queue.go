@@ -0,0 +1,110 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/model"
+	"mime"
+	"net/textproto"
+	"os"
+	"sort"
+	"time"
+)
+
+// storage a user's mail takes up and their quota
+type usage struct {
+	model.Usage
+	Quota model.Quota
+}
+
+// human readable size
+func (u usage) Size() string {
+	return formatSize(u.Bytes)
+}
+
+// human readable storage quota or empty if unlimited
+func (u usage) QuotaSize() string {
+	if u.Quota.Bytes <= 0 {
+		return ""
+	}
+	return formatSize(u.Quota.Bytes)
+}
+
+// format a byte count
+func formatSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	idx := 0
+	for f >= 1024 && idx < len(units)-1 {
+		f /= 1024
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, units[idx])
+}
+
+// 1 message sitting in a queue
+type queueEntry struct {
+	Filename string
+	New      bool
+	From     string
+	To       string
+	Subject  string
+	Size     string
+	Queued   time.Time
+}
+
+// read what a queued message is
+func readEntry(msg mailstore.Message, isNew bool) (e queueEntry) {
+	e.Filename = msg.Filename()
+	e.New = isNew
+	f, err := os.Open(msg.Filepath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err == nil {
+		e.Size = formatSize(st.Size())
+		e.Queued = st.ModTime()
+	}
+	hdr, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	dec := new(mime.WordDecoder)
+	for _, h := range []struct {
+		name string
+		val  *string
+	}{{"From", &e.From}, {"To", &e.To}, {"Subject", &e.Subject}} {
+		v := hdr.Get(h.name)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		*h.val = v
+	}
+	return
+}
+
+// list everything in a queue, oldest first
+func listQueue(st mailstore.Store) (entries []queueEntry, err error) {
+	var msgs []mailstore.Message
+	msgs, err = st.ListNew()
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		entries = append(entries, readEntry(msg, true))
+	}
+	msgs, err = st.List()
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		entries = append(entries, readEntry(msg, false))
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Queued.Before(entries[j].Queued)
+	})
+	return
+}
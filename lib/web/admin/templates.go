@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"html/template"
+)
+
+var templates = template.Must(template.New("admin").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Brain Dead Simple Mail Admin</title>
+  </head>
+  <body>
+    {{if .Session}}
+    <form method="post" action="/admin/logout">
+      {{.Session.User}}
+      <a href="/admin/">users</a>
+      {{range .Queues}}<a href="/admin/queue?name={{.Name}}">{{.Name}} queue</a> {{end}}
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <input type="submit" value="logout">
+    </form>
+    <hr>
+    {{end}}
+    {{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+    {{if .Notice}}<p>{{.Notice}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}
+  </body>
+</html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+    <form method="post" action="/admin/login">
+      <p><label>user <input type="text" name="user"></label></p>
+      <p><label>password <input type="password" name="password"></label></p>
+      <p><input type="submit" value="login"></p>
+    </form>
+{{template "footer" .}}{{end}}
+
+{{define "users"}}{{template "header" .}}
+    <table>
+      <tr><th>user</th><th>status</th><th>messages</th><th>size</th><th>quota</th><th>password</th><th></th></tr>
+      {{range .Users}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td>{{if .Disabled}}disabled{{else if not .HasLogin}}no login{{else if .NeedsReset}}needs password reset{{else}}active{{end}}</td>
+        <td>{{.Usage.Messages}}{{if gt .Usage.Quota.Messages 0}} / {{.Usage.Quota.Messages}}{{end}}</td>
+        <td>{{.Usage.Size}}{{with .Usage.QuotaSize}} / {{.}}{{end}}</td>
+        <td>
+          <form method="post" action="/admin/quota">
+            <input type="hidden" name="csrf" value="{{$.Session.CSRF}}">
+            <input type="hidden" name="name" value="{{.Name}}">
+            <label>bytes <input type="number" name="bytes" min="-1" value="{{.QuotaBytes}}"></label>
+            <label>messages <input type="number" name="messages" min="-1" value="{{.QuotaMessages}}"></label>
+            <input type="submit" value="set">
+          </form>
+        </td>
+        <td>
+          <form method="post" action="/admin/password">
+            <input type="hidden" name="csrf" value="{{$.Session.CSRF}}">
+            <input type="hidden" name="name" value="{{.Name}}">
+            <input type="password" name="password">
+            <input type="submit" value="reset">
+          </form>
+        </td>
+        <td>
+          <form method="post" action="/admin/{{if .Disabled}}enable{{else}}disable{{end}}">
+            <input type="hidden" name="csrf" value="{{$.Session.CSRF}}">
+            <input type="hidden" name="name" value="{{.Name}}">
+            <input type="submit" value="{{if .Disabled}}enable{{else}}disable{{end}}">
+          </form>
+          <form method="post" action="/admin/delete">
+            <input type="hidden" name="csrf" value="{{$.Session.CSRF}}">
+            <input type="hidden" name="name" value="{{.Name}}">
+            <label><input type="checkbox" name="purge" value="1"> remove maildir</label>
+            <input type="submit" value="delete">
+          </form>
+        </td>
+      </tr>
+      {{else}}
+      <tr><td colspan="7">no users</td></tr>
+      {{end}}
+    </table>
+    <p>quotas of 0 use the server default, -1 is unlimited</p>
+    <hr>
+    <form method="post" action="/admin/create">
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <label>user <input type="text" name="name"></label>
+      <label>password <input type="password" name="password"></label>
+      <input type="submit" value="create">
+    </form>
+{{template "footer" .}}{{end}}
+
+{{define "queue"}}{{template "header" .}}
+    <p>{{.Queue}} queue: {{len .Entries}} messages</p>
+    <table>
+      <tr><th>file</th><th>state</th><th>from</th><th>to</th><th>subject</th><th>size</th><th>queued</th></tr>
+      {{range .Entries}}
+      <tr>
+        <td>{{.Filename}}</td>
+        <td>{{if .New}}new{{else}}cur{{end}}</td>
+        <td>{{.From}}</td>
+        <td>{{.To}}</td>
+        <td>{{.Subject}}</td>
+        <td>{{.Size}}</td>
+        <td>{{.Queued.Format "2006-01-02 15:04:05"}}</td>
+      </tr>
+      {{else}}
+      <tr><td colspan="7">queue is empty</td></tr>
+      {{end}}
+    </table>
+{{template "footer" .}}{{end}}
+`))
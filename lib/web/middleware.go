@@ -2,19 +2,49 @@ package web
 
 import (
 	"github.com/majestrate/bdsmail/lib/db"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/model"
 	"github.com/majestrate/bdsmail/lib/web/admin"
 	"github.com/majestrate/bdsmail/lib/web/webmail"
 	"net/http"
 )
 
+// web ui configuration
+type Config struct {
+	// directory of static files
+	AssetsDir string
+	// database access
+	DB db.DB
+	// queue webmail sends mail through
+	Outbound mailstore.SendQueue
+	// domain of our users' mail addresses
+	Domain string
+	// the user allowed into the admin panel
+	AdminUser string
+	// directory new users' maildirs go in
+	MailRoot string
+	// queues the admin panel can inspect
+	Queues []admin.Queue
+	// quota of users who don't have their own
+	Quota model.Quota
+	// learns a user's message as spam or ham, nil for no training
+	Train func(user string, msg mailstore.Message, spam bool)
+}
+
 // create middleware for web ui
-func NewMiddleware(assetsdir string, dao db.DB) http.Handler {
+func NewMiddleware(conf Config) http.Handler {
 	r := newRouter()
 	// admin actions
-	r.Handle("/admin", admin.New(dao))
+	adm := admin.New(conf.DB, conf.AdminUser, conf.MailRoot, conf.Queues...)
+	adm.Quota = conf.Quota
+	r.Handle("/admin", adm)
 	// mail actions
-	r.Handle("/mail", webmail.New(dao))
+	wm := webmail.New(conf.DB, conf.Outbound, conf.Domain)
+	wm.Train = conf.Train
+	r.Handle("/mail", wm)
+	// admin changes to a user log them out of webmail
+	adm.Revoke = wm.Revoke
 	// file server
-	r.HandleDefault(http.FileServer(http.Dir(assetsdir)))
+	r.HandleDefault(http.FileServer(http.Dir(conf.AssetsDir)))
 	return r
 }
@@ -21,12 +21,11 @@ func (m *httpMux) HandleDefault(handler http.Handler) {
 
 func (m *httpMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	route := m.defaultHandler
-	path := r.URL.String()
-	prefix := strings.Split(path, "/")
+	prefix := strings.Split(r.URL.Path, "/")
 	if len(prefix) > 1 {
-		r, ok := m.routes[prefix[1]]
+		h, ok := m.routes["/"+prefix[1]]
 		if ok {
-			route = r
+			route = h
 		}
 	}
 	route.ServeHTTP(w, r)
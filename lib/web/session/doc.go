@@ -0,0 +1,2 @@
+// cookie based login sessions for the web ui
+package session
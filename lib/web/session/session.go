@@ -0,0 +1,136 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// default lifetime of a session
+const DefaultLifetime = time.Hour * 12
+
+// 1 logged in user
+type Session struct {
+	// name of logged in user
+	User string
+	// token forms must include to prove they came from us
+	CSRF string
+	// when this session expires
+	Expires time.Time
+}
+
+// check a csrf token from a form against this session
+func (s *Session) CheckCSRF(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(s.CSRF), []byte(token)) == 1
+}
+
+// in memory session store
+type Store struct {
+	// name of cookie holding the session id
+	cookie string
+	// path the cookie is valid for
+	path string
+	// how long sessions last
+	lifetime time.Duration
+	// sessions by id
+	sessions map[string]*Session
+	access   sync.Mutex
+}
+
+// create a new session store using a cookie name and path
+func NewStore(cookie, path string) *Store {
+	return &Store{
+		cookie:   cookie,
+		path:     path,
+		lifetime: DefaultLifetime,
+		sessions: make(map[string]*Session),
+	}
+}
+
+func randToken() string {
+	b := make([]byte, 32)
+	io.ReadFull(rand.Reader, b)
+	return hex.EncodeToString(b)
+}
+
+// create a session for a user and set the session cookie
+func (st *Store) Create(w http.ResponseWriter, user string) (s *Session) {
+	id := randToken()
+	s = &Session{
+		User:    user,
+		CSRF:    randToken(),
+		Expires: time.Now().Add(st.lifetime),
+	}
+	st.access.Lock()
+	st.expire()
+	st.sessions[id] = s
+	st.access.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     st.cookie,
+		Value:    id,
+		Path:     st.path,
+		Expires:  s.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return
+}
+
+// get the session of a request
+func (st *Store) Get(r *http.Request) (s *Session, ok bool) {
+	c, err := r.Cookie(st.cookie)
+	if err != nil {
+		return
+	}
+	st.access.Lock()
+	s, ok = st.sessions[c.Value]
+	if ok && time.Now().After(s.Expires) {
+		delete(st.sessions, c.Value)
+		s, ok = nil, false
+	}
+	st.access.Unlock()
+	return
+}
+
+// end the session of a request and clear the session cookie
+func (st *Store) Destroy(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(st.cookie)
+	if err == nil {
+		st.access.Lock()
+		delete(st.sessions, c.Value)
+		st.access.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     st.cookie,
+		Value:    "",
+		Path:     st.path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// end all sessions of a user
+func (st *Store) DestroyUser(user string) {
+	st.access.Lock()
+	for id, s := range st.sessions {
+		if s.User == user {
+			delete(st.sessions, id)
+		}
+	}
+	st.access.Unlock()
+}
+
+// remove expired sessions, must hold lock
+func (st *Store) expire() {
+	now := time.Now()
+	for id, s := range st.sessions {
+		if now.After(s.Expires) {
+			delete(st.sessions, id)
+		}
+	}
+}
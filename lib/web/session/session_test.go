@@ -0,0 +1,33 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// make a request carrying the cookie a response set
+func withCookie(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/mail/", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestDestroyUser(t *testing.T) {
+	st := NewStore("test", "/mail")
+	alice, again, bob := httptest.NewRecorder(), httptest.NewRecorder(), httptest.NewRecorder()
+	st.Create(alice, "alice")
+	st.Create(again, "alice")
+	st.Create(bob, "bob")
+	st.DestroyUser("alice")
+	for _, rec := range []*httptest.ResponseRecorder{alice, again} {
+		if _, ok := st.Get(withCookie(rec)); ok {
+			t.Error("session of alice still valid")
+		}
+	}
+	if s, ok := st.Get(withCookie(bob)); !ok || s.User != "bob" {
+		t.Error("session of bob ended too")
+	}
+}
@@ -0,0 +1,151 @@
+package webmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/util"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// a file attached to a composed message
+type upload struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// a message composed in the web ui
+type composed struct {
+	From string
+	To   []string
+	Cc   []string
+	// blind recipiants, only in the envelope
+	Bcc        []string
+	Subject    string
+	Body       string
+	InReplyTo  string
+	Attachment []upload
+}
+
+// parse a comma separated address list typed by a user
+func parseAddrList(s string) (addrs []string, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return
+	}
+	var list []*mail.Address
+	list, err = mail.ParseAddressList(s)
+	if err == nil {
+		for _, a := range list {
+			addrs = append(addrs, a.Address)
+		}
+	}
+	return
+}
+
+// all envelope recipiants
+func (c *composed) Recipients() (to []string) {
+	to = append(to, c.To...)
+	to = append(to, c.Cc...)
+	to = append(to, c.Bcc...)
+	return
+}
+
+// write a header line, folding is not needed because values are encoded
+func writeHeader(w io.Writer, name, value string) {
+	fmt.Fprintf(w, "%s: %s\r\n", name, value)
+}
+
+// write quoted printable text with crlf line endings
+func writeText(w io.Writer, text string) (err error) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\n", "\r\n", -1)
+	qp := quotedprintable.NewWriter(w)
+	_, err = io.WriteString(qp, text)
+	if err == nil {
+		err = qp.Close()
+	}
+	return
+}
+
+// write base64 data in 76 column lines
+func writeBase64(w io.Writer, data []byte) (err error) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 && err == nil {
+		_, err = io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	if err == nil {
+		_, err = io.WriteString(w, enc+"\r\n")
+	}
+	return
+}
+
+// build the rfc 5322 message
+func (c *composed) build(domain string) (msg []byte, err error) {
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", c.From)
+	if len(c.To) > 0 {
+		writeHeader(&buf, "To", strings.Join(c.To, ", "))
+	}
+	if len(c.Cc) > 0 {
+		writeHeader(&buf, "Cc", strings.Join(c.Cc, ", "))
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", c.Subject))
+	writeHeader(&buf, "Date", time.Now().UTC().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", fmt.Sprintf("<%s@%s>", strings.ToLower(util.RandStr(24)), domain))
+	if c.InReplyTo != "" {
+		writeHeader(&buf, "In-Reply-To", c.InReplyTo)
+		writeHeader(&buf, "References", c.InReplyTo)
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+	if len(c.Attachment) == 0 {
+		writeHeader(&buf, "Content-Type", "text/plain; charset=utf-8")
+		writeHeader(&buf, "Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		err = writeText(&buf, c.Body)
+		msg = buf.Bytes()
+		return
+	}
+	mw := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	text := make(textproto.MIMEHeader)
+	text.Set("Content-Type", "text/plain; charset=utf-8")
+	text.Set("Content-Transfer-Encoding", "quoted-printable")
+	var w io.Writer
+	w, err = mw.CreatePart(text)
+	if err == nil {
+		err = writeText(w, c.Body)
+	}
+	for _, up := range c.Attachment {
+		if err != nil {
+			break
+		}
+		h := make(textproto.MIMEHeader)
+		ct := up.ContentType
+		if _, _, e := mime.ParseMediaType(ct); e != nil || ct == "" {
+			ct = "application/octet-stream"
+		}
+		h.Set("Content-Type", ct)
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": up.Filename}))
+		w, err = mw.CreatePart(h)
+		if err == nil {
+			err = writeBase64(w, up.Data)
+		}
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	msg = buf.Bytes()
+	return
+}
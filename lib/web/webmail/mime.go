@@ -0,0 +1,242 @@
+package webmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// max size of a message we render
+const maxMessageSize = 32 * 1024 * 1024
+
+// an attached file in a message
+type attachment struct {
+	// index of the part in the message
+	Index int
+	// suggested filename
+	Filename string
+	// media type
+	ContentType string
+	// decoded size
+	Size int
+}
+
+// a message made safe for display
+type rendered struct {
+	From    string
+	To      string
+	Cc      string
+	Subject string
+	Date    string
+	// decoded plain text body
+	Text string
+	// attachments of the message
+	Attachments []attachment
+	// raw message id header
+	MessageID string
+}
+
+// 1 decoded leaf part of a message
+type leafPart struct {
+	header   textproto.MIMEHeader
+	media    string
+	params   map[string]string
+	filename string
+	attached bool
+	body     []byte
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: charsetReader,
+}
+
+// decode an rfc 2047 encoded header
+func decodeHeader(h string) string {
+	d, err := wordDecoder.DecodeHeader(h)
+	if err != nil {
+		d = h
+	}
+	return strings.ToValidUTF8(d, "�")
+}
+
+// decode a part body given its transfer encoding
+func decodeBody(r io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return ioutil.ReadAll(io.LimitReader(r, maxMessageSize))
+}
+
+// walk all parts of a mime entity and collect its leaf parts
+func walkParts(hdr textproto.MIMEHeader, body io.Reader, leafs []*leafPart, depth int) ([]*leafPart, error) {
+	media, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		media = "text/plain"
+		params = map[string]string{}
+	}
+	if strings.HasPrefix(media, "multipart/") && depth < 16 {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return leafs, err
+			}
+			leafs, err = walkParts(p.Header, p, leafs, depth+1)
+			if err != nil {
+				return leafs, err
+			}
+		}
+		return leafs, nil
+	}
+	leaf := &leafPart{
+		header: hdr,
+		media:  media,
+		params: params,
+	}
+	disp, dparams, err := mime.ParseMediaType(hdr.Get("Content-Disposition"))
+	if err == nil {
+		leaf.attached = disp == "attachment"
+		leaf.filename = dparams["filename"]
+	}
+	if leaf.filename == "" {
+		leaf.filename = params["name"]
+	}
+	leaf.filename = decodeHeader(leaf.filename)
+	if leaf.filename != "" {
+		leaf.attached = true
+	}
+	if !strings.HasPrefix(media, "text/") {
+		leaf.attached = true
+	}
+	leaf.body, err = decodeBody(body, hdr.Get("Content-Transfer-Encoding"))
+	leafs = append(leafs, leaf)
+	return leafs, err
+}
+
+// parse a message file into its leaf parts
+func parseMessage(fname string) (hdr textproto.MIMEHeader, leafs []*leafPart, err error) {
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.LimitReader(f, maxMessageSize))
+	hdr, err = textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return
+	}
+	leafs, err = walkParts(hdr, r, nil, 0)
+	return
+}
+
+// render a message file for display
+func renderMessage(fname string) (msg *rendered, err error) {
+	var hdr textproto.MIMEHeader
+	var leafs []*leafPart
+	hdr, leafs, err = parseMessage(fname)
+	if err != nil && len(leafs) == 0 {
+		return
+	}
+	err = nil
+	msg = &rendered{
+		From:      decodeHeader(hdr.Get("From")),
+		To:        decodeHeader(hdr.Get("To")),
+		Cc:        decodeHeader(hdr.Get("Cc")),
+		Subject:   decodeHeader(hdr.Get("Subject")),
+		Date:      hdr.Get("Date"),
+		MessageID: hdr.Get("Message-Id"),
+	}
+	var plain, htm *leafPart
+	for idx, leaf := range leafs {
+		if leaf.attached {
+			msg.Attachments = append(msg.Attachments, attachment{
+				Index:       idx,
+				Filename:    leaf.filename,
+				ContentType: leaf.media,
+				Size:        len(leaf.body),
+			})
+			continue
+		}
+		if leaf.media == "text/plain" && plain == nil {
+			plain = leaf
+		} else if leaf.media == "text/html" && htm == nil {
+			htm = leaf
+		}
+	}
+	if plain != nil {
+		msg.Text = toUTF8(plain.body, plain.params["charset"])
+	} else if htm != nil {
+		msg.Text = stripHTML(toUTF8(htm.body, htm.params["charset"]))
+	}
+	msg.Text = strings.Replace(msg.Text, "\r\n", "\n", -1)
+	return
+}
+
+// get the decoded attachment with an index
+func getAttachment(fname string, idx int) (leaf *leafPart, err error) {
+	var leafs []*leafPart
+	_, leafs, err = parseMessage(fname)
+	if idx >= 0 && idx < len(leafs) {
+		leaf = leafs[idx]
+		err = nil
+	} else if err == nil {
+		err = os.ErrNotExist
+	}
+	return
+}
+
+// charset reader for rfc 2047 words
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(toUTF8(b, charset)), nil
+}
+
+// convert text in a charset to utf-8, unknown charsets are assumed to be utf-8
+func toUTF8(b []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "us-ascii":
+		var buf bytes.Buffer
+		for _, c := range b {
+			buf.WriteRune(rune(c))
+		}
+		return buf.String()
+	}
+	return strings.ToValidUTF8(string(b), "�")
+}
+
+var (
+	reHTMLDrop   = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)\s*>`)
+	reHTMLBreak  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/h[1-6]|/li)[^>]*>`)
+	reHTMLTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+	reBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// turn html into plain text, the result is escaped when rendered so no markup survives
+func stripHTML(s string) string {
+	s = reHTMLDrop.ReplaceAllString(s, "")
+	s = reHTMLBreak.ReplaceAllString(s, "\n")
+	s = reHTMLTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.Replace(s, "\r", "", -1)
+	return strings.TrimSpace(reBlankLines.ReplaceAllString(s, "\n\n"))
+}
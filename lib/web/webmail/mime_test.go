@@ -0,0 +1,56 @@
+package webmail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestComposeAndRender(t *testing.T) {
+	c := &composed{
+		From:    "me@a.b32.i2p",
+		To:      []string{"you@b.b32.i2p"},
+		Subject: "héllo",
+		Body:    "line one\nline two",
+		Attachment: []upload{
+			{Filename: "evil.html", ContentType: "text/html", Data: []byte("<script>alert(1)</script>")},
+		},
+	}
+	data, err := c.build("a.b32.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "webmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+	msg, err := renderMessage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "héllo" || msg.To != "you@b.b32.i2p" {
+		t.Fatalf("bad headers: %+v", msg)
+	}
+	if msg.Text != "line one\nline two" {
+		t.Fatalf("bad text: %q", msg.Text)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "evil.html" {
+		t.Fatalf("bad attachments: %+v", msg.Attachments)
+	}
+	leaf, err := getAttachment(f.Name(), msg.Attachments[0].Index)
+	if err != nil || !bytes.Equal(leaf.body, []byte("<script>alert(1)</script>")) {
+		t.Fatalf("bad attachment data: %v", err)
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	s := stripHTML(`<html><head><title>x</title></head><body><script>alert(1)</script><p>hi &amp; bye</p><img src=x onerror=alert(1)></body></html>`)
+	if strings.Contains(s, "alert") || strings.Contains(s, "<") || s != "hi & bye" {
+		t.Fatalf("bad stripped html: %q", s)
+	}
+}
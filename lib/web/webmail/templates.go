@@ -0,0 +1,111 @@
+package webmail
+
+import (
+	"html/template"
+)
+
+var templates = template.Must(template.New("webmail").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Brain Dead Simple Mail</title>
+  </head>
+  <body>
+    {{if .Session}}
+    <form method="post" action="/mail/logout">
+      {{.Session.User}}
+      <a href="/mail/">inbox</a>
+      {{range .Folders}}<a href="/mail/?folder={{.}}">{{.}}</a>
+      {{end}}
+      <a href="/mail/compose">compose</a>
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <input type="submit" value="logout">
+    </form>
+    <hr>
+    {{end}}
+    {{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+{{end}}
+
+{{define "footer"}}
+  </body>
+</html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+    <form method="post" action="/mail/login">
+      <p><label>user <input type="text" name="user"></label></p>
+      <p><label>password <input type="password" name="password"></label></p>
+      <p><input type="submit" value="login"></p>
+    </form>
+{{template "footer" .}}{{end}}
+
+{{define "inbox"}}{{template "header" .}}
+    {{if .Folder}}<p>{{.Folder}}</p>{{end}}
+    <table>
+      <tr><th></th><th>from</th><th>subject</th><th>date</th></tr>
+      {{range .Messages}}
+      <tr>
+        <td>{{if not .Seen}}*{{end}}</td>
+        <td>{{.From}}</td>
+        <td><a href="/mail/read?id={{.ID}}{{with $.Folder}}&amp;folder={{.}}{{end}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+        <td>{{.Date}}</td>
+      </tr>
+      {{else}}
+      <tr><td colspan="4">no messages</td></tr>
+      {{end}}
+    </table>
+{{template "footer" .}}{{end}}
+
+{{define "read"}}{{template "header" .}}
+    {{with .Message}}
+    <p>from: {{.From}}</p>
+    <p>to: {{.To}}</p>
+    {{if .Cc}}<p>cc: {{.Cc}}</p>{{end}}
+    <p>date: {{.Date}}</p>
+    <p>subject: {{.Subject}}</p>
+    <hr>
+    <pre>{{.Text}}</pre>
+    {{if .Attachments}}
+    <hr>
+    <ul>
+      {{range .Attachments}}
+      <li><a href="/mail/attachment?id={{$.ID}}&amp;part={{.Index}}{{with $.Folder}}&amp;folder={{.}}{{end}}">{{if .Filename}}{{.Filename}}{{else}}part {{.Index}}{{end}}</a> ({{.ContentType}}, {{.Size}} bytes)</li>
+      {{end}}
+    </ul>
+    {{end}}
+    {{end}}
+    <hr>
+    <a href="/mail/compose?reply={{.ID}}{{with .Folder}}&amp;folder={{.}}{{end}}">reply</a>
+    <form method="post" action="/mail/delete">
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <input type="hidden" name="id" value="{{.ID}}">
+      <input type="hidden" name="folder" value="{{.Folder}}">
+      <input type="submit" value="delete">
+    </form>
+    <form method="post" action="/mail/junk">
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <input type="hidden" name="id" value="{{.ID}}">
+      <input type="hidden" name="folder" value="{{.Folder}}">
+      <input type="submit" value="{{if eq .Folder "Junk"}}not junk{{else}}junk{{end}}">
+    </form>
+{{template "footer" .}}{{end}}
+
+{{define "compose"}}{{template "header" .}}
+    <form method="post" action="/mail/send" enctype="multipart/form-data">
+      <input type="hidden" name="csrf" value="{{.Session.CSRF}}">
+      <input type="hidden" name="in_reply_to" value="{{.Compose.InReplyTo}}">
+      <p><label>to <input type="text" name="to" size="80" value="{{.Compose.To}}"></label></p>
+      <p><label>cc <input type="text" name="cc" size="80" value="{{.Compose.Cc}}"></label></p>
+      <p><label>bcc <input type="text" name="bcc" size="80" value="{{.Compose.Bcc}}"></label></p>
+      <p><label>subject <input type="text" name="subject" size="80" value="{{.Compose.Subject}}"></label></p>
+      <p><textarea name="body" rows="25" cols="80">{{.Compose.Body}}</textarea></p>
+      <p><label>attach <input type="file" name="attachment" multiple></label></p>
+      <p><input type="submit" value="send"></p>
+    </form>
+{{template "footer" .}}{{end}}
+
+{{define "sent"}}{{template "header" .}}
+    <p>your message was queued for delivery</p>
+{{template "footer" .}}{{end}}
+`))
@@ -1,20 +1,508 @@
 package webmail
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/majestrate/bdsmail/lib/db"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/mailstore"
+	"github.com/majestrate/bdsmail/lib/web/session"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// max size of a compose form including attachments
+const maxComposeSize = 32 * 1024 * 1024
+
+// max size of any other form
+const maxFormSize = 64 * 1024
+
 type WebMail struct {
 	d db.DB
+	// queue composed mail is sent through
+	outbound mailstore.SendQueue
+	// domain of our users' mail addresses
+	domain string
+	// logged in users
+	sessions *session.Store
+	// learns a user's message as spam or ham, nil for no training
+	Train func(user string, msg mailstore.Message, spam bool)
+}
+
+// 1 entry in the message list
+type listEntry struct {
+	ID      string
+	From    string
+	Subject string
+	Date    string
+	Seen    bool
+	t       time.Time
+}
+
+// values of the compose form
+type composeForm struct {
+	To        string
+	Cc        string
+	Bcc       string
+	Subject   string
+	Body      string
+	InReplyTo string
+}
+
+// data given to templates
+type page struct {
+	Session  *session.Session
+	Error    string
+	Messages []listEntry
+	Message  *rendered
+	ID       string
+	Compose  composeForm
+	// folder being looked at, empty for the inbox
+	Folder string
+	// folders of the logged in user
+	Folders []string
+}
+
+func (m *WebMail) render(w http.ResponseWriter, name string, p *page) {
+	if p.Session != nil {
+		p.Folders = m.folders(p.Session.User)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	err := templates.ExecuteTemplate(w, name, p)
+	if err != nil {
+		log.Errorf("webmail: failed to render %s: %s", name, err.Error())
+	}
+}
+
+// show an error page
+func (m *WebMail) fail(w http.ResponseWriter, s *session.Session, code int, msg string) {
+	w.WriteHeader(code)
+	m.render(w, "header", &page{
+		Session: s,
+		Error:   msg,
+	})
 }
 
 func (m *WebMail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mail"), "/")
+	// limit the body before anything parses the form
+	if action == "send" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxComposeSize)
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	}
+	if action == "login" {
+		m.serveLogin(w, r)
+		return
+	}
+	s, ok := m.sessions.Get(r)
+	if !ok {
+		m.render(w, "login", &page{})
+		return
+	}
+	if r.Method == http.MethodPost {
+		if !s.CheckCSRF(r.FormValue("csrf")) {
+			m.fail(w, s, http.StatusForbidden, "bad form token")
+			return
+		}
+	}
+	inbox, err := m.getMailDir(s.User)
+	md := inbox
+	folder := r.FormValue("folder")
+	if err == nil && folder == mailstore.JunkFolder {
+		md, err = inbox.EnsureFolder(folder)
+	} else if err == nil && folder != "" {
+		if !inbox.HasFolder(folder) {
+			m.fail(w, s, http.StatusNotFound, "no such folder")
+			return
+		}
+		md, err = inbox.Folder(folder)
+	}
+	if err != nil {
+		log.Errorf("webmail: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "cannot open mailbox")
+		return
+	}
+	switch action {
+	case "":
+		m.serveList(w, r, s, md)
+	case "logout":
+		if r.Method != http.MethodPost {
+			m.fail(w, s, http.StatusMethodNotAllowed, "bad method")
+			return
+		}
+		m.sessions.Destroy(w, r)
+		http.Redirect(w, r, "/mail/", http.StatusSeeOther)
+	case "read":
+		m.serveRead(w, r, s, md)
+	case "attachment":
+		m.serveAttachment(w, r, s, md)
+	case "delete":
+		m.serveDelete(w, r, s, md)
+	case "junk":
+		m.serveJunk(w, r, s, inbox, md, folder)
+	case "compose":
+		m.serveCompose(w, r, s, md)
+	case "send":
+		m.serveSend(w, r, s)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *WebMail) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/mail/", http.StatusSeeOther)
+		return
+	}
+	user := r.FormValue("user")
+	good, err := m.d.CheckUserLogin(user, r.FormValue("password"))
+	if err != nil {
+		log.Errorf("webmail: login check failed: %s", err.Error())
+	}
+	if !good {
+		w.WriteHeader(http.StatusForbidden)
+		m.render(w, "login", &page{
+			Error: "bad login",
+		})
+		return
+	}
+	m.sessions.Create(w, user)
+	http.Redirect(w, r, "/mail/", http.StatusSeeOther)
+}
+
+// end all webmail sessions of a user
+func (m *WebMail) Revoke(user string) {
+	m.sessions.DestroyUser(user)
+}
+
+// get the folders of a user's maildir, the junk folder is always there
+func (m *WebMail) folders(user string) (names []string) {
+	md, err := m.getMailDir(user)
+	if err == nil {
+		names, err = md.Folders()
+	}
+	if err != nil {
+		log.Errorf("webmail: failed to list folders: %s", err.Error())
+	}
+	for _, name := range names {
+		if name == mailstore.JunkFolder {
+			return
+		}
+	}
+	return append([]string{mailstore.JunkFolder}, names...)
+}
+
+// get a user's maildir
+func (m *WebMail) getMailDir(user string) (md maildir.MailDir, err error) {
+	st, has := m.d.FindStoreFor(user)
+	if !has {
+		err = errors.New("no such local user")
+		return
+	}
+	var ok bool
+	md, ok = st.(maildir.MailDir)
+	if !ok {
+		err = errors.New("mail store is not a maildir")
+	}
+	return
+}
+
+func (m *WebMail) serveList(w http.ResponseWriter, r *http.Request, s *session.Session, md maildir.MailDir) {
+	// move new mail into cur
+	news, err := md.ListNew()
+	if err == nil {
+		for _, msg := range news {
+			_, err = md.Process(msg)
+			if err != nil {
+				log.Errorf("webmail: error processing maildir: %s", err.Error())
+			}
+		}
+	}
+	infos, err := md.ListInfo()
+	if err != nil {
+		log.Errorf("webmail: failed to list maildir: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "cannot list mailbox")
+		return
+	}
+	p := &page{
+		Session: s,
+		Folder:  r.FormValue("folder"),
+	}
+	for _, info := range infos {
+		p.Messages = append(p.Messages, listEntry{
+			ID:      info.Name,
+			From:    decodeHeader(info.Envelope.From),
+			Subject: decodeHeader(info.Envelope.Subject),
+			Date:    info.Envelope.Date,
+			Seen:    strings.ContainsRune(info.Flags, maildir.Seen.Rune()),
+			t:       info.Date,
+		})
+	}
+	// newest first
+	sort.Slice(p.Messages, func(i, j int) bool {
+		return p.Messages[i].t.After(p.Messages[j].t)
+	})
+	m.render(w, "inbox", p)
+}
+
+func (m *WebMail) serveRead(w http.ResponseWriter, r *http.Request, s *session.Session, md maildir.MailDir) {
+	id := r.FormValue("id")
+	msg, err := md.Find(id)
+	if err != nil {
+		m.fail(w, s, http.StatusNotFound, "no such message")
+		return
+	}
+	rendered, err := renderMessage(msg.Filepath())
+	if err != nil {
+		log.Errorf("webmail: failed to render message: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "cannot read message")
+		return
+	}
+	if !msg.HasFlag(maildir.Seen) {
+		_, err = md.AddFlags(msg, maildir.Seen)
+		if err != nil {
+			log.Errorf("webmail: failed to mark message seen: %s", err.Error())
+		}
+	}
+	m.render(w, "read", &page{
+		Session: s,
+		Message: rendered,
+		ID:      id,
+		Folder:  r.FormValue("folder"),
+	})
+}
+
+func (m *WebMail) serveAttachment(w http.ResponseWriter, r *http.Request, s *session.Session, md maildir.MailDir) {
+	msg, err := md.Find(r.FormValue("id"))
+	if err != nil {
+		m.fail(w, s, http.StatusNotFound, "no such message")
+		return
+	}
+	idx, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil {
+		m.fail(w, s, http.StatusBadRequest, "bad part")
+		return
+	}
+	leaf, err := getAttachment(msg.Filepath(), idx)
+	if err != nil {
+		m.fail(w, s, http.StatusNotFound, "no such part")
+		return
+	}
+	fname := leaf.filename
+	if fname == "" {
+		fname = fmt.Sprintf("part%d", idx)
+	}
+	// always download, never render attachments inline
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sanitizeFilename(fname)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(leaf.body)))
+	w.Write(leaf.body)
+}
+
+// make a filename safe to put into a header
+func sanitizeFilename(fname string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '"' || r == '\\' || r == '/' || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, fname)
+}
+
+func (m *WebMail) serveDelete(w http.ResponseWriter, r *http.Request, s *session.Session, md maildir.MailDir) {
+	if r.Method != http.MethodPost {
+		m.fail(w, s, http.StatusMethodNotAllowed, "bad method")
+		return
+	}
+	msg, err := md.Find(r.FormValue("id"))
+	if err == nil {
+		err = msg.Remove()
+	}
+	if err != nil {
+		m.fail(w, s, http.StatusNotFound, "no such message")
+		return
+	}
+	http.Redirect(w, r, folderURL(r.FormValue("folder")), http.StatusSeeOther)
+}
+
+// get the url of a folder's message list
+func folderURL(folder string) string {
+	if folder == "" {
+		return "/mail/"
+	}
+	return "/mail/?folder=" + url.QueryEscape(folder)
+}
 
+// move a message from a folder to the junk folder or from the junk folder to the inbox and learn it as spam or ham
+func (m *WebMail) serveJunk(w http.ResponseWriter, r *http.Request, s *session.Session, inbox, md maildir.MailDir, folder string) {
+	if r.Method != http.MethodPost {
+		m.fail(w, s, http.StatusMethodNotAllowed, "bad method")
+		return
+	}
+	junk, err := inbox.EnsureFolder(mailstore.JunkFolder)
+	if err != nil {
+		log.Errorf("webmail: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "cannot open junk folder")
+		return
+	}
+	from, to, spam := md, junk, true
+	if folder == mailstore.JunkFolder {
+		from, to, spam = junk, inbox, false
+	}
+	msg, err := from.Find(r.FormValue("id"))
+	if err != nil {
+		m.fail(w, s, http.StatusNotFound, "no such message")
+		return
+	}
+	moved, err := from.Move(msg, to)
+	if err != nil {
+		log.Errorf("webmail: failed to move message: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "cannot move message")
+		return
+	}
+	if m.Train != nil {
+		m.Train(s.User, moved, spam)
+	}
+	http.Redirect(w, r, folderURL(folder), http.StatusSeeOther)
+}
+
+func (m *WebMail) serveCompose(w http.ResponseWriter, r *http.Request, s *session.Session, md maildir.MailDir) {
+	p := &page{
+		Session: s,
+	}
+	if reply := r.FormValue("reply"); reply != "" {
+		msg, err := md.Find(reply)
+		if err == nil {
+			var orig *rendered
+			orig, err = renderMessage(msg.Filepath())
+			if err == nil {
+				p.Compose.To = orig.From
+				p.Compose.Subject = orig.Subject
+				if !strings.HasPrefix(strings.ToLower(p.Compose.Subject), "re:") {
+					p.Compose.Subject = "Re: " + p.Compose.Subject
+				}
+				p.Compose.InReplyTo = orig.MessageID
+				p.Compose.Body = "\n\n> " + strings.Replace(orig.Text, "\n", "\n> ", -1)
+			}
+		}
+	}
+	m.render(w, "compose", p)
+}
+
+func (m *WebMail) serveSend(w http.ResponseWriter, r *http.Request, s *session.Session) {
+	if r.Method != http.MethodPost {
+		m.fail(w, s, http.StatusMethodNotAllowed, "bad method")
+		return
+	}
+	err := r.ParseMultipartForm(maxComposeSize)
+	if err != nil && err != http.ErrNotMultipart {
+		m.fail(w, s, http.StatusBadRequest, "bad form")
+		return
+	}
+	form := composeForm{
+		To:        r.FormValue("to"),
+		Cc:        r.FormValue("cc"),
+		Bcc:       r.FormValue("bcc"),
+		Subject:   r.FormValue("subject"),
+		Body:      r.FormValue("body"),
+		InReplyTo: r.FormValue("in_reply_to"),
+	}
+	c := &composed{
+		From:      fmt.Sprintf("%s@%s", s.User, m.domain),
+		Subject:   form.Subject,
+		Body:      form.Body,
+		InReplyTo: strings.Map(stripCRLF, form.InReplyTo),
+	}
+	c.To, err = parseAddrList(form.To)
+	if err == nil {
+		c.Cc, err = parseAddrList(form.Cc)
+	}
+	if err == nil {
+		c.Bcc, err = parseAddrList(form.Bcc)
+	}
+	if err == nil && len(c.To)+len(c.Cc)+len(c.Bcc) == 0 {
+		err = errors.New("no recipiants")
+	}
+	if err == nil && r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["attachment"] {
+			f, e := fh.Open()
+			if e != nil {
+				err = e
+				break
+			}
+			data, e := ioutil.ReadAll(f)
+			f.Close()
+			if e != nil {
+				err = e
+				break
+			}
+			c.Attachment = append(c.Attachment, upload{
+				Filename:    fh.Filename,
+				ContentType: fh.Header.Get("Content-Type"),
+				Data:        data,
+			})
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		m.render(w, "compose", &page{
+			Session: s,
+			Error:   err.Error(),
+			Compose: form,
+		})
+		return
+	}
+	err = m.send(c)
+	if err != nil {
+		log.Errorf("webmail: failed to queue mail: %s", err.Error())
+		m.fail(w, s, http.StatusInternalServerError, "failed to send mail")
+		return
+	}
+	log.Infof("webmail: %s queued mail to %s", s.User, strings.Join(c.Recipients(), ", "))
+	m.render(w, "sent", &page{
+		Session: s,
+	})
+}
+
+func stripCRLF(r rune) rune {
+	if r == '\r' || r == '\n' {
+		return -1
+	}
+	return r
+}
+
+// put a composed message into the outbound queue
+func (m *WebMail) send(c *composed) (err error) {
+	if m.outbound == nil {
+		err = errors.New("no outbound mail queue")
+		return
+	}
+	var data []byte
+	data, err = c.build(m.domain)
+	if err != nil {
+		return
+	}
+	_, err = m.outbound.Enqueue(c.From, c.Recipients(), bytes.NewReader(data))
+	return
 }
 
-func New(dao db.DB) *WebMail {
+// create webmail handler that sends mail through an outbound queue as users at a domain
+func New(dao db.DB, outbound mailstore.SendQueue, domain string) *WebMail {
 	return &WebMail{
-		d: dao,
+		d:        dao,
+		outbound: outbound,
+		domain:   domain,
+		sessions: session.NewStore("bdsmail-webmail", "/mail"),
 	}
 }